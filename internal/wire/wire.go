@@ -56,14 +56,21 @@ func InitializeChatServer(name string) (*common.Server, error) {
 		chat.NewUserClientConn,
 		chat.NewForwarderClientConn,
 
+		chat.NewMessageCipher,
+
 		chat.NewUserRepoImpl,
 		wire.Bind(new(chat.UserRepo), new(*chat.UserRepoImpl)),
+		chat.NewMessageStore,
 		chat.NewMessageRepoImpl,
 		wire.Bind(new(chat.MessageRepo), new(*chat.MessageRepoImpl)),
 		chat.NewChannelRepoImpl,
 		wire.Bind(new(chat.ChannelRepo), new(*chat.ChannelRepoImpl)),
 		chat.NewForwardRepoImpl,
 		wire.Bind(new(chat.ForwardRepo), new(*chat.ForwardRepoImpl)),
+		chat.NewArchiveRepoImpl,
+		wire.Bind(new(chat.ArchiveRepo), new(*chat.ArchiveRepoImpl)),
+		chat.NewAttachmentRepoImpl,
+		wire.Bind(new(chat.AttachmentRepo), new(*chat.AttachmentRepoImpl)),
 
 		chat.NewUserRepoCacheImpl,
 		wire.Bind(new(chat.UserRepoCache), new(*chat.UserRepoCacheImpl)),
@@ -86,6 +93,8 @@ func InitializeChatServer(name string) (*common.Server, error) {
 		wire.Bind(new(chat.ForwardService), new(*chat.ForwardServiceImpl)),
 
 		chat.NewMelodyChatConn,
+		chat.NewMessageRateLimiter,
+		chat.NewMessageModerator,
 
 		chat.NewGinServer,
 
@@ -192,6 +201,20 @@ func InitializeUploaderServer(name string) (*common.Server, error) {
 		uploader.NewGinServer,
 
 		uploader.NewChannelUploadRateLimiter,
+		uploader.NewPresignRateLimiter,
+		uploader.NewChannelStorageQuota,
+		uploader.NewUploadDedupIndex,
+		uploader.NewUploadIdempotencyStore,
+		uploader.NewMultipartUploadStore,
+		uploader.NewUserUploadLimiter,
+		uploader.NewUserUploadQuota,
+		uploader.NewAudioTranscoder,
+		uploader.NewUploadScanner,
+		uploader.NewUserClientConn,
+		uploader.NewUserRepoImpl,
+		wire.Bind(new(uploader.UserRepo), new(*uploader.UserRepoImpl)),
+		uploader.NewUserServiceImpl,
+		wire.Bind(new(uploader.UserService), new(*uploader.UserServiceImpl)),
 
 		uploader.NewHttpServer,
 		wire.Bind(new(common.HttpServer), new(*uploader.HttpServer)),
@@ -57,7 +57,7 @@ func InitializeChatServer(name string) (*common.Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	messageSubscriber, err := chat.NewMessageSubscriber(name, router, configConfig, subscriber, melodyChatConn)
+	messageCipher, err := chat.NewMessageCipher(configConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -65,7 +65,7 @@ func InitializeChatServer(name string) (*common.Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	redisCacheImpl := infra.NewRedisCacheImpl(universalClient)
+	redisCacheImpl := infra.NewRedisCacheImpl(universalClient, configConfig)
 	session, err := infra.NewCassandraSession(configConfig)
 	if err != nil {
 		return nil, err
@@ -75,35 +75,53 @@ func InitializeChatServer(name string) (*common.Server, error) {
 		return nil, err
 	}
 	userRepoImpl := chat.NewUserRepoImpl(session, userClientConn)
-	userRepoCacheImpl := chat.NewUserRepoCacheImpl(redisCacheImpl, userRepoImpl)
-	userServiceImpl := chat.NewUserServiceImpl(userRepoCacheImpl)
+	userRepoCacheImpl := chat.NewUserRepoCacheImpl(configConfig, redisCacheImpl, userRepoImpl)
+	userServiceImpl := chat.NewUserServiceImpl(configConfig, userRepoCacheImpl)
 	publisher, err := infra.NewKafkaPublisher(configConfig)
 	if err != nil {
 		return nil, err
 	}
-	messageRepoImpl := chat.NewMessageRepoImpl(configConfig, session, publisher)
-	messageRepoCacheImpl := chat.NewMessageRepoCacheImpl(messageRepoImpl)
+	messageStore, err := chat.NewMessageStore(configConfig, session, messageCipher)
+	if err != nil {
+		return nil, err
+	}
+	messageRepoImpl := chat.NewMessageRepoImpl(configConfig, publisher, messageCipher, messageStore)
+	messageRepoCacheImpl := chat.NewMessageRepoCacheImpl(configConfig, redisCacheImpl, messageRepoImpl, messageCipher)
+	messageSubscriber, err := chat.NewMessageSubscriber(name, router, configConfig, subscriber, melodyChatConn, messageCipher, messageRepoCacheImpl)
+	if err != nil {
+		return nil, err
+	}
 	idGenerator, err := common.NewSonyFlake()
 	if err != nil {
 		return nil, err
 	}
-	messageServiceImpl := chat.NewMessageServiceImpl(messageRepoCacheImpl, userRepoCacheImpl, idGenerator)
+	attachmentRepoImpl := chat.NewAttachmentRepoImpl(configConfig)
 	channelRepoImpl := chat.NewChannelRepoImpl(session)
 	channelRepoCacheImpl := chat.NewChannelRepoCacheImpl(redisCacheImpl, channelRepoImpl)
-	channelServiceImpl := chat.NewChannelServiceImpl(channelRepoCacheImpl, userRepoCacheImpl, idGenerator)
+	messageServiceImpl := chat.NewMessageServiceImpl(messageRepoCacheImpl, userRepoCacheImpl, channelRepoCacheImpl, attachmentRepoImpl, idGenerator)
+	archiveRepoImpl := chat.NewArchiveRepoImpl(configConfig, messageCipher)
+	channelServiceImpl := chat.NewChannelServiceImpl(channelRepoCacheImpl, userRepoCacheImpl, messageRepoCacheImpl, archiveRepoImpl, attachmentRepoImpl, idGenerator)
 	forwarderClientConn, err := chat.NewForwarderClientConn(configConfig)
 	if err != nil {
 		return nil, err
 	}
 	forwardRepoImpl := chat.NewForwardRepoImpl(forwarderClientConn)
 	forwardServiceImpl := chat.NewForwardServiceImpl(forwardRepoImpl)
-	httpServer := chat.NewHttpServer(name, httpLog, configConfig, engine, melodyChatConn, messageSubscriber, userServiceImpl, messageServiceImpl, channelServiceImpl, forwardServiceImpl)
+	messageRateLimiter := chat.NewMessageRateLimiter(universalClient, configConfig)
+	messageModerator, err := chat.NewMessageModerator(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	httpServer, err := chat.NewHttpServer(name, httpLog, configConfig, engine, melodyChatConn, messageSubscriber, userServiceImpl, messageServiceImpl, channelServiceImpl, forwardServiceImpl, messageRateLimiter, messageModerator)
+	if err != nil {
+		return nil, err
+	}
 	grpcLog, err := common.NewGrpcLog(configConfig)
 	if err != nil {
 		return nil, err
 	}
-	grpcServer := chat.NewGrpcServer(name, grpcLog, configConfig, userServiceImpl, channelServiceImpl)
-	chatRouter := chat.NewRouter(httpServer, grpcServer)
+	grpcServer := chat.NewGrpcServer(name, grpcLog, configConfig, userServiceImpl, messageServiceImpl, channelServiceImpl)
+	chatRouter := chat.NewRouter(configConfig, httpServer, grpcServer)
 	infraCloser := chat.NewInfraCloser()
 	observabilityInjector := common.NewObservabilityInjector(configConfig)
 	server := common.NewServer(name, chatRouter, infraCloser, observabilityInjector)
@@ -123,7 +141,7 @@ func InitializeForwarderServer(name string) (*common.Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	redisCacheImpl := infra.NewRedisCacheImpl(universalClient)
+	redisCacheImpl := infra.NewRedisCacheImpl(universalClient, configConfig)
 	publisher, err := infra.NewKafkaPublisher(configConfig)
 	if err != nil {
 		return nil, err
@@ -160,7 +178,7 @@ func InitializeMatchServer(name string) (*common.Server, error) {
 		return nil, err
 	}
 	engine := match.NewGinServer(name, httpLog, configConfig)
-	melodyMatchConn := match.NewMelodyMatchConn()
+	melodyMatchConn := match.NewMelodyMatchConn(configConfig)
 	router, err := infra.NewBrokerRouter(name)
 	if err != nil {
 		return nil, err
@@ -187,14 +205,14 @@ func InitializeMatchServer(name string) (*common.Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	redisCacheImpl := infra.NewRedisCacheImpl(universalClient)
+	redisCacheImpl := infra.NewRedisCacheImpl(universalClient, configConfig)
 	publisher, err := infra.NewKafkaPublisher(configConfig)
 	if err != nil {
 		return nil, err
 	}
 	matchingRepoImpl := match.NewMatchingRepoImpl(redisCacheImpl, publisher)
 	channelRepoImpl := match.NewChannelRepoImpl(chatClientConn)
-	matchingServiceImpl := match.NewMatchingServiceImpl(matchingRepoImpl, channelRepoImpl)
+	matchingServiceImpl := match.NewMatchingServiceImpl(configConfig, matchingRepoImpl, channelRepoImpl)
 	httpServer := match.NewHttpServer(name, httpLog, configConfig, engine, melodyMatchConn, matchSubscriber, userServiceImpl, matchingServiceImpl)
 	matchRouter := match.NewRouter(httpServer)
 	infraCloser := match.NewInfraCloser()
@@ -218,8 +236,29 @@ func InitializeUploaderServer(name string) (*common.Server, error) {
 		return nil, err
 	}
 	channelUploadRateLimiter := uploader.NewChannelUploadRateLimiter(universalClient, configConfig)
-	httpServer := uploader.NewHttpServer(name, httpLog, configConfig, engine, channelUploadRateLimiter)
-	router := uploader.NewRouter(httpServer)
+	presignRateLimiter := uploader.NewPresignRateLimiter(universalClient, configConfig)
+	channelStorageQuota := uploader.NewChannelStorageQuota(universalClient, configConfig)
+	uploadDedupIndex := uploader.NewUploadDedupIndex(universalClient, configConfig)
+	uploadIdempotencyStore := uploader.NewUploadIdempotencyStore(universalClient, configConfig)
+	multipartUploadStore := uploader.NewMultipartUploadStore(universalClient, configConfig)
+	userUploadLimiter := uploader.NewUserUploadLimiter(universalClient, configConfig)
+	userUploadQuota := uploader.NewUserUploadQuota(universalClient, configConfig)
+	userClientConn, err := uploader.NewUserClientConn(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	userRepoImpl := uploader.NewUserRepoImpl(userClientConn)
+	userServiceImpl := uploader.NewUserServiceImpl(userRepoImpl)
+	audioTranscoder := uploader.NewAudioTranscoder(configConfig)
+	uploadScanner, err := uploader.NewUploadScanner(configConfig)
+	if err != nil {
+		return nil, err
+	}
+	httpServer, err := uploader.NewHttpServer(name, httpLog, configConfig, engine, channelUploadRateLimiter, presignRateLimiter, channelStorageQuota, uploadDedupIndex, uploadIdempotencyStore, multipartUploadStore, userUploadLimiter, userUploadQuota, userServiceImpl, audioTranscoder, uploadScanner, universalClient)
+	if err != nil {
+		return nil, err
+	}
+	router := uploader.NewRouter(configConfig, httpServer)
 	infraCloser := uploader.NewInfraCloser()
 	observabilityInjector := common.NewObservabilityInjector(configConfig)
 	server := common.NewServer(name, router, infraCloser, observabilityInjector)
@@ -240,7 +279,7 @@ func InitializeUserServer(name string) (*common.Server, error) {
 	if err != nil {
 		return nil, err
 	}
-	redisCacheImpl := infra.NewRedisCacheImpl(universalClient)
+	redisCacheImpl := infra.NewRedisCacheImpl(universalClient, configConfig)
 	userRepoImpl := user.NewUserRepoImpl(redisCacheImpl)
 	idGenerator, err := common.NewSonyFlake()
 	if err != nil {
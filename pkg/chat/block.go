@@ -0,0 +1,105 @@
+package chat
+
+import (
+	"strconv"
+	"sync"
+
+	"gopkg.in/olahol/melody.v1"
+)
+
+// blockList is the block state of the user of a session: the users it blocked, whose
+// events the session does not receive, and the users who blocked it, whose presence is
+// hidden from the session if hidePresence is set. It is loaded on connect and kept in sync
+// by block events, so that delivery does not hit redis
+type blockList struct {
+	mu           sync.RWMutex
+	userID       uint64
+	blocked      map[uint64]bool
+	blockedBy    map[uint64]bool
+	hidePresence bool
+}
+
+func newBlockList(userID uint64, blocked []BlockedUser, blockerIDs []uint64, hidePresence bool) *blockList {
+	l := &blockList{
+		userID:       userID,
+		blocked:      make(map[uint64]bool, len(blocked)),
+		blockedBy:    make(map[uint64]bool, len(blockerIDs)),
+		hidePresence: hidePresence,
+	}
+	for _, user := range blocked {
+		l.blocked[user.UserID] = true
+	}
+	for _, blockerID := range blockerIDs {
+		l.blockedBy[blockerID] = true
+	}
+	return l
+}
+
+// Hides reports whether the message must not be delivered to the session
+func (l *blockList) Hides(msg *Message) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.blocked[msg.UserID] {
+		return true
+	}
+	return l.hidePresence && l.blockedBy[msg.UserID] && revealsPresence(msg)
+}
+
+// VisibleUsers drops the users whose presence is hidden from the user of the list
+func (l *blockList) VisibleUsers(userIDs []uint64) []uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	visible := make([]uint64, 0, len(userIDs))
+	for _, userID := range userIDs {
+		if l.blocked[userID] || (l.hidePresence && l.blockedBy[userID]) {
+			continue
+		}
+		visible = append(visible, userID)
+	}
+	return visible
+}
+
+// Apply updates the list with a block or unblock event concerning the user
+func (l *blockList) Apply(msg *Message) {
+	targetID, err := strconv.ParseUint(msg.Payload, 10, 64)
+	if err != nil {
+		return
+	}
+	blocked := msg.Event == EventBlock
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch l.userID {
+	case msg.UserID:
+		setBlocked(l.blocked, targetID, blocked)
+	case targetID:
+		setBlocked(l.blockedBy, msg.UserID, blocked)
+	}
+}
+
+func setBlocked(users map[uint64]bool, userID uint64, blocked bool) {
+	if blocked {
+		users[userID] = true
+	} else {
+		delete(users, userID)
+	}
+}
+
+// isBlockEvent reports whether the message syncs block lists
+func isBlockEvent(event int) bool {
+	return event == EventBlock || event == EventUnblock
+}
+
+// hiddenFrom reports whether the message must not be delivered to the session, because it
+// is a direct message between other users, because the block list hides it, or because
+// the client is too old for its event
+func hiddenFrom(sess *melody.Session, msg *Message) bool {
+	if !supportsEvent(sess, msg.Event) {
+		return true
+	}
+	// the uid query param is only trusted for direct messages when the token is bound to it
+	if msg.Event == EventDirect && !msg.VisibleTo(sessionTokenUserID(sess)) {
+		return true
+	}
+	blocks, ok := sess.Get(sessBlocksKey)
+	return ok && blocks.(*blockList).Hides(msg)
+}
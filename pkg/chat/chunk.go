@@ -0,0 +1,146 @@
+package chat
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxChunkIDLen bounds the msg_id of chunks, which is chosen by the client
+const maxChunkIDLen = 64
+
+// defaultChunkTimeout is used when the configured timeout is not positive, which would
+// drop every set as soon as its first chunk arrives
+const defaultChunkTimeout = 30 * time.Second
+
+// chunkAssembler reassembles text messages sent in chunks over a connection. Chunks may
+// arrive in any order; a set that is not complete within the timeout is dropped, and the
+// chunks buffered across all sets of the connection are capped at maxBytes
+type chunkAssembler struct {
+	mu         sync.Mutex
+	maxChunks  int
+	maxBytes   int
+	maxPayload int
+	timeout    time.Duration
+	buffered   int
+	sets       map[string]*chunkSet
+	isClosed   bool
+}
+
+type chunkSet struct {
+	// first is the chunk at index 0, which carries the options of the message
+	first    *MessagePresenter
+	chunks   []string
+	received int
+	size     int
+	timer    *time.Timer
+}
+
+func newChunkAssembler(maxChunks, maxBytes, maxPayload int, timeout time.Duration) *chunkAssembler {
+	return &chunkAssembler{
+		maxChunks:  maxChunks,
+		maxBytes:   maxBytes,
+		maxPayload: maxPayload,
+		timeout:    timeout,
+		sets:       make(map[string]*chunkSet),
+	}
+}
+
+// Add buffers a chunk and returns the reassembled text message once all chunks of its set
+// arrived, or nil while some are missing. The message takes its client message id, reply
+// and ttl from the chunk at index 0. expired is called with the client message id of a set
+// that times out
+func (a *chunkAssembler) Add(chunk *MessagePresenter, expired func(clientMsgID string)) (*MessagePresenter, error) {
+	if chunk.ChunkID == "" || len(chunk.ChunkID) > maxChunkIDLen || chunk.ChunkData == "" ||
+		chunk.ChunkTotal <= 0 || chunk.ChunkTotal > a.maxChunks ||
+		chunk.ChunkIndex < 0 || chunk.ChunkIndex >= chunk.ChunkTotal {
+		return nil, ErrInvalidChunk
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.isClosed {
+		return nil, nil
+	}
+	set, ok := a.sets[chunk.ChunkID]
+	if !ok {
+		set = &chunkSet{chunks: make([]string, chunk.ChunkTotal)}
+		a.sets[chunk.ChunkID] = set
+		set.timer = time.AfterFunc(a.timeout, func() {
+			if a.expire(chunk.ChunkID, set) {
+				expired(set.clientMsgID())
+			}
+		})
+	}
+	if chunk.ChunkTotal != len(set.chunks) {
+		a.drop(chunk.ChunkID, set)
+		return nil, ErrInvalidChunk
+	}
+	// a chunk sent again is ignored
+	if set.chunks[chunk.ChunkIndex] != "" {
+		return nil, nil
+	}
+	if a.maxPayload > 0 && set.size+len(chunk.ChunkData) > a.maxPayload {
+		a.drop(chunk.ChunkID, set)
+		return nil, ErrMessageTooLarge
+	}
+	if a.buffered+len(chunk.ChunkData) > a.maxBytes {
+		a.drop(chunk.ChunkID, set)
+		return nil, ErrChunkBufferFull
+	}
+	set.chunks[chunk.ChunkIndex] = chunk.ChunkData
+	set.received++
+	set.size += len(chunk.ChunkData)
+	a.buffered += len(chunk.ChunkData)
+	if chunk.ChunkIndex == 0 {
+		set.first = chunk
+	}
+	if set.received < len(set.chunks) {
+		return nil, nil
+	}
+	a.drop(chunk.ChunkID, set)
+	return &MessagePresenter{
+		Event:       EventText,
+		UserID:      set.first.UserID,
+		Payload:     strings.Join(set.chunks, ""),
+		Time:        set.first.Time,
+		Guaranteed:  set.first.Guaranteed,
+		ClientMsgID: set.first.ClientMsgID,
+		ReplyTo:     set.first.ReplyTo,
+		TTLSeconds:  set.first.TTLSeconds,
+		ContentType: set.first.ContentType,
+	}, nil
+}
+
+// expire drops the set if it is still incomplete, and reports whether it was
+func (a *chunkAssembler) expire(chunkID string, set *chunkSet) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sets[chunkID] != set {
+		return false
+	}
+	a.drop(chunkID, set)
+	return !a.isClosed
+}
+
+func (a *chunkAssembler) drop(chunkID string, set *chunkSet) {
+	set.timer.Stop()
+	a.buffered -= set.size
+	delete(a.sets, chunkID)
+}
+
+// Close drops the incomplete sets of a closed connection
+func (a *chunkAssembler) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for chunkID, set := range a.sets {
+		a.drop(chunkID, set)
+	}
+	a.isClosed = true
+}
+
+func (s *chunkSet) clientMsgID() string {
+	if s.first == nil {
+		return ""
+	}
+	return s.first.ClientMsgID
+}
@@ -0,0 +1,139 @@
+package chat
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	b64 "encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// encryptedPayloadPrefix marks encrypted payloads, so that payloads stored before
+// encryption was enabled can still be read
+const encryptedPayloadPrefix = "enc:v1:"
+
+var payloadDecryptFailuresTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "chat",
+	Name:      "payload_decrypt_failures_total",
+	Help:      "Total number of stored message payloads that could not be decrypted.",
+})
+
+// MessageCipher encrypts message payloads before they are stored or published and
+// decrypts them when they are read back
+type MessageCipher interface {
+	Encrypt(channelID uint64, payload string) (string, error)
+	Decrypt(channelID uint64, payload string) (string, error)
+}
+
+// NewMessageCipher returns an AES-GCM cipher if a master key is configured. Without
+// EncryptAtRest the cipher only decrypts, so that encryption can be turned off without
+// losing access to payloads encrypted so far
+func NewMessageCipher(config *config.Config) (MessageCipher, error) {
+	encryptConfig := config.Chat.Message
+	if encryptConfig.EncryptionKey == "" {
+		if encryptConfig.EncryptAtRest {
+			return nil, ErrInvalidMasterKey
+		}
+		return NoopCipher{}, nil
+	}
+	masterKey, err := b64.StdEncoding.DecodeString(encryptConfig.EncryptionKey)
+	if err != nil || len(masterKey) != 32 {
+		return nil, ErrInvalidMasterKey
+	}
+	return &AESGCMCipher{
+		masterKey: masterKey,
+		encrypt:   encryptConfig.EncryptAtRest,
+	}, nil
+}
+
+// NoopCipher stores payloads in plaintext
+type NoopCipher struct{}
+
+func (NoopCipher) Encrypt(channelID uint64, payload string) (string, error) {
+	return payload, nil
+}
+func (NoopCipher) Decrypt(channelID uint64, payload string) (string, error) {
+	return payload, nil
+}
+
+// AESGCMCipher encrypts payloads with AES-256-GCM under a per-channel key, derived from
+// the master key and the channel id with HMAC-SHA256. The channel id is also bound as
+// additional data, so a payload copied to another channel fails to decrypt
+type AESGCMCipher struct {
+	masterKey []byte
+	encrypt   bool
+}
+
+func (c *AESGCMCipher) Encrypt(channelID uint64, payload string) (string, error) {
+	if !c.encrypt || payload == "" {
+		return payload, nil
+	}
+	aead, err := c.channelAEAD(channelID)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(payload)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(payload), channelAdditionalData(channelID))
+	return encryptedPayloadPrefix + b64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+func (c *AESGCMCipher) Decrypt(channelID uint64, payload string) (string, error) {
+	encoded, encrypted := strings.CutPrefix(payload, encryptedPayloadPrefix)
+	if !encrypted {
+		return payload, nil
+	}
+	sealed, err := b64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrDecryptPayload
+	}
+	aead, err := c.channelAEAD(channelID)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", ErrDecryptPayload
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], channelAdditionalData(channelID))
+	if err != nil {
+		return "", ErrDecryptPayload
+	}
+	return string(plaintext), nil
+}
+
+func (c *AESGCMCipher) channelAEAD(channelID uint64) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, c.masterKey)
+	mac.Write([]byte(common.Join("rc:msgkey:", strconv.FormatUint(channelID, 10))))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func channelAdditionalData(channelID uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, channelID)
+}
+
+// decryptMessage decrypts the payload of a message in place. A payload that cannot be
+// decrypted is blanked rather than failing the whole read, so that one corrupted row does
+// not hide the rest of the history
+func decryptMessage(c MessageCipher, msg *Message) {
+	payload, err := c.Decrypt(msg.ChannelID, msg.Payload)
+	if err != nil {
+		payloadDecryptFailuresTotal.Inc()
+		payload = ""
+	}
+	msg.Payload = payload
+}
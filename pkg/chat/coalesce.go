@@ -0,0 +1,104 @@
+package chat
+
+import (
+	"bytes"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/olahol/melody.v1"
+)
+
+// CapabilityBatch is the capability a client passes in the caps query param of /chat
+// to receive coalesced frames
+const CapabilityBatch = "batch"
+
+var batchSize = promauto.NewHistogram(prometheus.HistogramOpts{
+	Namespace: "chat",
+	Name:      "ws_batch_size",
+	Help:      "Number of messages coalesced into a single websocket frame.",
+	Buckets:   []float64{1, 2, 4, 8, 16, 32, 64, 128},
+})
+
+// frameBatcher coalesces messages destined for the same connection into a single frame.
+// The first message of a batch starts a timer of the configured window; everything that
+// arrives before it fires (or until the batch is full) is sent as one JSON array of
+// message presenters. A larger window means fewer frames in busy channels at the cost
+// of up to one window of extra delivery latency for every message.
+type frameBatcher struct {
+	mu       sync.Mutex
+	flushMu  sync.Mutex
+	sess     *melody.Session
+	window   time.Duration
+	maxSize  int
+	pending  [][]byte
+	timer    *time.Timer
+	isClosed bool
+}
+
+func newFrameBatcher(window time.Duration, maxSize int) *frameBatcher {
+	return &frameBatcher{
+		window:  window,
+		maxSize: maxSize,
+	}
+}
+
+// Add queues a frame for the session that owns the batcher
+func (b *frameBatcher) Add(sess *melody.Session, frame []byte) {
+	b.mu.Lock()
+	if b.isClosed {
+		b.mu.Unlock()
+		return
+	}
+	b.sess = sess
+	b.pending = append(b.pending, frame)
+	if len(b.pending) >= b.maxSize {
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+		b.mu.Unlock()
+		b.flush()
+		return
+	}
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+	b.mu.Unlock()
+}
+
+func (b *frameBatcher) flush() {
+	// serialize flushes so that batches are written in order
+	b.flushMu.Lock()
+	defer b.flushMu.Unlock()
+	b.mu.Lock()
+	frames := b.pending
+	sess := b.sess
+	b.pending = nil
+	b.timer = nil
+	b.mu.Unlock()
+	if len(frames) == 0 {
+		return
+	}
+	batchSize.Observe(float64(len(frames)))
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	buf.Write(bytes.Join(frames, []byte{','}))
+	buf.WriteByte(']')
+	if err := writeShaped(sess, buf.Bytes()); err != nil && !isShapingDrop(err) {
+		slog.Error(err.Error())
+	}
+}
+
+// Close drops pending frames and stops batching
+func (b *frameBatcher) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.isClosed = true
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
@@ -0,0 +1,57 @@
+package chat
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var compressedConnsTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "chat",
+	Name:      "ws_compressed_connections_total",
+	Help:      "Total number of websocket connections that negotiated permessage-deflate.",
+})
+
+var deflateExtension = []byte("\r\nSec-WebSocket-Extensions: permessage-deflate")
+
+// deflateRecorder counts upgrades whose handshake accepts permessage-deflate. The upgrader
+// writes the handshake straight to the hijacked connection and melody does not expose the
+// websocket connection, so the handshake is the only place the negotiation shows
+type deflateRecorder struct {
+	http.ResponseWriter
+}
+
+func (w deflateRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("error hijack: response does not implement http.Hijacker")
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &handshakeConn{Conn: conn}, brw, nil
+}
+
+// handshakeConn inspects the first write to the connection, which is the handshake
+type handshakeConn struct {
+	net.Conn
+	handshaken bool
+}
+
+func (c *handshakeConn) Write(p []byte) (int, error) {
+	if c.handshaken {
+		return c.Conn.Write(p)
+	}
+	c.handshaken = true
+	n, err := c.Conn.Write(p)
+	if err == nil && bytes.Contains(p, deflateExtension) {
+		compressedConnsTotal.Inc()
+	}
+	return n, err
+}
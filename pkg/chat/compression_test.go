@@ -0,0 +1,89 @@
+package chat
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/olahol/melody.v1"
+)
+
+func dialTestServer(t testing.TB, handler http.HandlerFunc, compress bool) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	dialer := websocket.Dialer{EnableCompression: compress}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestDeflateRecorderCountsNegotiatedConnections(t *testing.T) {
+	m := melody.New()
+	m.Upgrader.EnableCompression = true
+	m.HandleConnect(func(sess *melody.Session) {
+		sess.Write([]byte("connected"))
+	})
+	handler := func(w http.ResponseWriter, req *http.Request) {
+		m.HandleRequest(deflateRecorder{w}, req)
+	}
+	for _, tt := range []struct {
+		compress bool
+		want     float64
+	}{
+		{false, 0},
+		{true, 1},
+	} {
+		before := testutil.ToFloat64(compressedConnsTotal)
+		conn := dialTestServer(t, handler, tt.compress)
+		// frames still flow through the wrapped connection
+		if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "connected" {
+			t.Fatalf("read: got %q, %v", msg, err)
+		}
+		if got := testutil.ToFloat64(compressedConnsTotal) - before; got != tt.want {
+			t.Errorf("client compression %v: counted %v connections, want %v", tt.compress, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkCompression measures writing a typical message frame with and without
+// permessage-deflate
+func BenchmarkCompression(b *testing.B) {
+	frame := []byte(`{"message_id":"1712345678901234567","event":1,"user_id":"1712345678901234000","payload":"hey, are we still meeting at the usual place later today?","seen":false,"time":1712345678901}`)
+	for _, compress := range []bool{false, true} {
+		name := "plain"
+		if compress {
+			name = "deflate"
+		}
+		b.Run(name, func(b *testing.B) {
+			upgrader := websocket.Upgrader{EnableCompression: compress}
+			handler := func(w http.ResponseWriter, req *http.Request) {
+				conn, err := upgrader.Upgrade(w, req, nil)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				for {
+					if _, _, err := conn.NextReader(); err != nil {
+						return
+					}
+				}
+			}
+			conn := dialTestServer(b, handler, compress)
+			b.SetBytes(int64(len(frame)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := conn.WriteMessage(websocket.TextMessage, frame); err != nil {
+					b.Fatalf("write: %v", err)
+				}
+			}
+		})
+	}
+}
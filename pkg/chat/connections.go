@@ -0,0 +1,57 @@
+package chat
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/olahol/melody.v1"
+)
+
+// connection is a websocket connection to a channel on this instance
+type connection struct {
+	ChannelID   uint64
+	UserID      uint64
+	ReadOnly    bool
+	ConnectedAt time.Time
+	Metadata    map[string]string
+}
+
+// connRegistry keeps the websocket connections of the instance for the debug endpoint,
+// since melody does not expose its sessions
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[*melody.Session]connection
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns: make(map[*melody.Session]connection),
+	}
+}
+
+func (reg *connRegistry) Add(sess *melody.Session, conn connection) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.conns[sess] = conn
+}
+
+func (reg *connRegistry) Remove(sess *melody.Session) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	delete(reg.conns, sess)
+}
+
+// List returns the connections, oldest first
+func (reg *connRegistry) List() []connection {
+	reg.mu.Lock()
+	conns := make([]connection, 0, len(reg.conns))
+	for _, conn := range reg.conns {
+		conns = append(conns, conn)
+	}
+	reg.mu.Unlock()
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].ConnectedAt.Before(conns[j].ConnectedAt)
+	})
+	return conns
+}
@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"encoding/json"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// ContentType tells clients how to render a message, independent of the event it is
+// carried by
+type ContentType string
+
+const (
+	ContentTypeText ContentType = "text"
+	// ContentTypeEmoji is a text message made only of emojis, which clients may render larger
+	ContentTypeEmoji   ContentType = "emoji"
+	ContentTypeImage   ContentType = "image"
+	ContentTypeFile    ContentType = "file"
+	ContentTypeSticker ContentType = "sticker"
+	// ContentTypeSystem is a notice generated by the server, such as a user joining or the
+	// channel being archived. Clients cannot send system messages, so they never count
+	// against the rate limits of users
+	ContentTypeSystem ContentType = "system"
+)
+
+// ContentType classifies the content of a message from its event and payload. Events that
+// carry no content, such as seen or typing events, have no content type
+func (m *Message) ContentType() ContentType {
+	switch m.Event {
+	case EventText, EventDirect:
+		if isEmojiOnly(m.Payload) {
+			return ContentTypeEmoji
+		}
+		return ContentTypeText
+	case EventSticker:
+		return ContentTypeSticker
+	case EventFile:
+		return fileContentType(mime.TypeByExtension(path.Ext(fileURLPath(m.Payload))))
+	case EventAttachment:
+		var attachment Attachment
+		if err := json.Unmarshal([]byte(m.Payload), &attachment); err != nil {
+			return ContentTypeFile
+		}
+		return fileContentType(attachment.ContentType)
+	case EventAction:
+		if action := Action(m.Payload); action == IsTypingMessage || action == EndTypingMessage {
+			return ""
+		}
+		return ContentTypeSystem
+	}
+	return ""
+}
+
+// Accepts reports whether a message of this content type may be declared as declared by
+// its sender. Emojis are text and images are files, so the broader type is accepted too
+func (t ContentType) Accepts(declared ContentType) bool {
+	return declared == t ||
+		(t == ContentTypeEmoji && declared == ContentTypeText) ||
+		(t == ContentTypeImage && declared == ContentTypeFile)
+}
+
+func fileContentType(mimeType string) ContentType {
+	if strings.HasPrefix(mimeType, "image/") {
+		return ContentTypeImage
+	}
+	return ContentTypeFile
+}
+
+// fileURLPath returns the path of the url of a file message, without its query
+func fileURLPath(payload string) string {
+	u, err := url.Parse(payload)
+	if err != nil {
+		return payload
+	}
+	return u.Path
+}
+
+// isEmojiOnly reports whether the text consists of at least one emoji and otherwise only
+// of emoji modifiers, joiners and spaces
+func isEmojiOnly(text string) bool {
+	hasEmoji := false
+	for _, r := range text {
+		switch {
+		case isEmojiRune(r):
+			hasEmoji = true
+		case isEmojiModifier(r), unicode.IsSpace(r):
+		default:
+			return false
+		}
+	}
+	return hasEmoji
+}
+
+func isEmojiRune(r rune) bool {
+	return (r >= 0x1F000 && r <= 0x1FAFF) || // pictographs, emoticons, flags and symbols
+		(r >= 0x2600 && r <= 0x27BF) || // miscellaneous symbols and dingbats
+		(r >= 0x2B00 && r <= 0x2BFF) || // arrows and shapes such as ⭐
+		(r >= 0x2300 && r <= 0x23FF) // technical symbols such as ⌚
+}
+
+func isEmojiModifier(r rune) bool {
+	return r == 0x200D || // zero width joiner
+		r == 0xFE0F || r == 0xFE0E || // variation selectors
+		r == 0x20E3 || // combining keycap
+		(r >= 0xE0020 && r <= 0xE007F) // tags of subdivision flags
+}
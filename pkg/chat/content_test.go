@@ -0,0 +1,88 @@
+package chat
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+)
+
+func TestIsEmojiOnly(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"😀", true},
+		{"😀 🎉", true},
+		{"👍🏽", true},
+		{"👨‍👩‍👧", true},
+		{"❤️", true},
+		{"⭐", true},
+		{"1️⃣", false},
+		{"🏴󠁧󠁢󠁳󠁣󠁴󠁿", true},
+		{"", false},
+		{"   ", false},
+		{"‍️", false},
+		{"hi 😀", false},
+		{"😀!", false},
+		{"→", false},
+	}
+	for _, tt := range tests {
+		if got := isEmojiOnly(tt.text); got != tt.want {
+			t.Errorf("isEmojiOnly(%q) = %v, want %v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestContentTypeAccepts(t *testing.T) {
+	tests := []struct {
+		actual   ContentType
+		declared ContentType
+		want     bool
+	}{
+		{ContentTypeText, ContentTypeText, true},
+		{ContentTypeEmoji, ContentTypeEmoji, true},
+		{ContentTypeEmoji, ContentTypeText, true},
+		{ContentTypeText, ContentTypeEmoji, false},
+		{ContentTypeImage, ContentTypeImage, true},
+		{ContentTypeImage, ContentTypeFile, true},
+		{ContentTypeFile, ContentTypeImage, false},
+		{ContentTypeSticker, ContentTypeImage, false},
+		{ContentTypeText, ContentTypeSystem, false},
+	}
+	for _, tt := range tests {
+		if got := tt.actual.Accepts(tt.declared); got != tt.want {
+			t.Errorf("%s.Accepts(%s) = %v, want %v", tt.actual, tt.declared, got, tt.want)
+		}
+	}
+}
+
+func TestToMessageAttachmentContentType(t *testing.T) {
+	common.JwtSecret = "test"
+	common.JwtExpirationSecond = 60
+	accessToken, err := common.NewJWT(1)
+	if err != nil {
+		t.Fatalf("new jwt: %v", err)
+	}
+	tests := []struct {
+		contentType string
+		declared    ContentType
+		wantErr     error
+	}{
+		{"image/png", ContentTypeImage, nil},
+		{"image/png", ContentTypeFile, nil},
+		{"application/pdf", ContentTypeFile, nil},
+		{"application/pdf", ContentTypeImage, ErrContentTypeMismatch},
+	}
+	for _, tt := range tests {
+		msgPresenter := &MessagePresenter{
+			Event:       EventAttachment,
+			UserID:      "2",
+			ContentType: string(tt.declared),
+			Attachment:  &AttachmentPresenter{Key: "1/a", ContentType: tt.contentType, Filename: "a"},
+		}
+		if _, err := msgPresenter.ToMessage(accessToken); !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s declared as %s: got error %v, want %v", tt.contentType, tt.declared, err, tt.wantErr)
+		}
+	}
+}
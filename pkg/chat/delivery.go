@@ -0,0 +1,67 @@
+package chat
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/olahol/melody.v1"
+)
+
+var deliveryFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "chat",
+	Name:      "delivery_failures_total",
+	Help:      "Total number of broadcast messages that could not be written to a websocket session, by reason.",
+}, []string{"reason"})
+
+var errFrameDropped = errors.New("error frame dropped by melody")
+
+// deliveryTracker detects broadcast frames that melody drops. melody does not fail the
+// write of a frame to a slow or closing session but reports it to its error handler,
+// which runs synchronously within the write and marks the tracker of the session.
+// Frames delayed by send shaping or coalescing are only tracked up to their queueing.
+// Tracked writes are serialized so that concurrent broadcasts do not clear each other's
+// failures; a failure of an untracked write at the same time is counted against the
+// tracked one, which at worst delivers the message again
+type deliveryTracker struct {
+	mu       sync.Mutex
+	failures atomic.Uint64
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{}
+}
+
+// MarkFailed records that a write to the session failed
+func (t *deliveryTracker) MarkFailed() {
+	t.failures.Add(1)
+}
+
+// Write writes a broadcast frame to the session, returning an error if it is dropped
+func (t *deliveryTracker) Write(sess *melody.Session, frame []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	failures := t.failures.Load()
+	if err := writeShaped(sess, frame); err != nil {
+		return err
+	}
+	if t.failures.Load() != failures {
+		return errFrameDropped
+	}
+	return nil
+}
+
+func deliveryFailureReason(sess *melody.Session, err error) string {
+	switch {
+	case errors.Is(err, errShaperQueueFull):
+		return "shaper_queue_full"
+	case errors.Is(err, errSlowConsumerEvicted):
+		return "evicted"
+	case sess.IsClosed():
+		return "closed"
+	default:
+		return "buffer_full"
+	}
+}
@@ -10,8 +10,74 @@ const (
 	EventAction
 	EventSeen
 	EventFile
+	EventNack
+	EventSticker
+	EventSnapshot
+	EventResumeToken
+	EventDeliveryAck
+	EventEdit
+	EventDeleteMessage
+	EventTyping
+	EventStopTyping
+	EventReaction
+	EventPin
+	EventUnpin
+	EventAck
+	EventReauth
+	EventRateLimited
+	EventAttachment
+	EventChannelExpired
+	EventBulkDelete
+	EventPresence
+	EventModerated
+	// EventBlock and EventUnblock sync the block lists of connected sessions; they are
+	// never written to clients
+	EventBlock
+	EventUnblock
+	// EventDirect is a text message that is only delivered to its sender and its recipient
+	EventDirect
+	// EventChunk is a part of a text message too long for a single frame
+	EventChunk
 )
 
+// SupportedClientEvents are the events clients may send to the server
+var SupportedClientEvents = []int{EventText, EventAction, EventSeen, EventFile, EventSticker, EventDeliveryAck, EventEdit, EventDeleteMessage, EventTyping, EventStopTyping, EventReaction, EventReauth, EventAttachment, EventDirect, EventChunk}
+
+// changesChannel reports whether a client event adds to or modifies the history of the
+// channel, which soft-archived channels do not accept
+func changesChannel(event int) bool {
+	switch event {
+	case EventText, EventFile, EventSticker, EventAttachment, EventDirect, EventEdit, EventDeleteMessage, EventReaction:
+		return true
+	}
+	return false
+}
+
+// isContentEvent reports whether the event carries content sent by a user
+func isContentEvent(event int) bool {
+	return event == EventText || event == EventFile || event == EventSticker || event == EventAttachment
+}
+
+// isEphemeralEvent reports whether messages of the event are only broadcast and never stored
+func isEphemeralEvent(event int) bool {
+	return event == EventTyping || event == EventStopTyping || event == EventPresence
+}
+
+// revealsPresence reports whether the message tells that its user is online, offline or typing
+func revealsPresence(msg *Message) bool {
+	if isEphemeralEvent(msg.Event) {
+		return true
+	}
+	if msg.Event != EventAction {
+		return false
+	}
+	switch Action(msg.Payload) {
+	case WaitingMessage, JoinedMessage, OfflineMessage, IsTypingMessage, EndTypingMessage:
+		return true
+	}
+	return false
+}
+
 type Action string
 
 var (
@@ -21,8 +87,52 @@ var (
 	EndTypingMessage Action = "endtyping"
 	OfflineMessage   Action = "offline"
 	LeavedMessage    Action = "leaved"
+
+	StickerPackUpdatedMessage Action = "stickerpackupdated"
+	ArchivedMessage           Action = "archived"
+	UnarchivedMessage         Action = "unarchived"
+
+	// ChannelJoinedMessage and ChannelLeftMessage record membership changes in the channel
+	// history, unlike joined and leaved, which are only broadcast as users connect and leave
+	ChannelJoinedMessage Action = "channeljoined"
+	ChannelLeftMessage   Action = "channelleft"
+)
+
+// Role is the role of a user in a channel. The channel creator is an admin unless demoted,
+// and everyone else is a member unless promoted
+type Role string
+
+var (
+	RoleAdmin  Role = "admin"
+	RoleMember Role = "member"
 )
 
+type ReactionAction string
+
+var (
+	ReactionAdd    ReactionAction = "add"
+	ReactionRemove ReactionAction = "remove"
+)
+
+// Attachment describes an uploaded file referred to by an attachment message. Attachment
+// messages carry it json-encoded as their payload
+type Attachment struct {
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Filename    string `json:"filename"`
+}
+
+// UserChannel is a channel a user belongs to
+type UserChannel struct {
+	ChannelID uint64
+	// LastMessageTime is the time of the latest message in unix milliseconds, or 0 if unknown
+	LastMessageTime int64
+}
+
+// DefaultStickers is the sticker set of channels without a custom sticker pack
+var DefaultStickers = []string{"👍", "❤️", "😂", "😮", "😢", "🎉", "🙏", "🔥"}
+
 type Message struct {
 	MessageID uint64 `json:"message_id"`
 	Event     int    `json:"event"`
@@ -31,6 +141,51 @@ type Message struct {
 	Payload   string `json:"payload"`
 	Seen      bool   `json:"seen"`
 	Time      int64  `json:"time"`
+	// Guaranteed messages are retained in the outbox of offline recipients until acked
+	Guaranteed bool `json:"guaranteed"`
+	// EditedTime is the time of the last edit in unix milliseconds, or 0 if never edited
+	EditedTime int64 `json:"edited_time"`
+	// Deleted messages are kept as tombstones without their payload
+	Deleted bool `json:"deleted"`
+	// Reactions maps emojis to the users who reacted with them
+	Reactions map[string][]uint64 `json:"reactions,omitempty"`
+	// Emoji and ReactionAction describe the change carried by a reaction event
+	Emoji          string         `json:"emoji,omitempty"`
+	ReactionAction ReactionAction `json:"reaction_action,omitempty"`
+	// ReplyTo is the root of the thread a reply belongs to, or 0 for other messages
+	ReplyTo uint64 `json:"reply_to,omitempty"`
+	// ReplyCount is the number of replies to a thread root; it is only loaded for listings
+	ReplyCount int64 `json:"reply_count,omitempty"`
+	// DeletedIDs are the messages deleted by a bulk delete event
+	DeletedIDs []uint64 `json:"deleted_ids,omitempty"`
+	// Status is the presence carried by a presence event
+	Status PresenceState `json:"status,omitempty"`
+	// Seq is the position of a stored message in its channel; it is 0 for events that are
+	// not stored
+	Seq uint64 `json:"seq,omitempty"`
+	// ExpiresAt is when a disappearing message is deleted in unix milliseconds, or 0 if
+	// the message never expires
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// RecipientID is the only member who can see a direct message besides its sender
+	RecipientID uint64 `json:"recipient_id,omitempty"`
+}
+
+// BulkDeleteStatus is the outcome of deleting one message of a bulk delete
+type BulkDeleteStatus string
+
+var (
+	BulkDeleteDeleted  BulkDeleteStatus = "deleted"
+	BulkDeleteNotFound BulkDeleteStatus = "not_found"
+	BulkDeleteFailed   BulkDeleteStatus = "failed"
+)
+
+// BulkDeleteResult is the outcome of deleting one message of a bulk delete. Messages that
+// were already deleted are reported as deleted, so that retrying a bulk delete is harmless
+type BulkDeleteResult struct {
+	MessageID uint64
+	Status    BulkDeleteStatus
+	// Err is the cause of a failed deletion
+	Err error
 }
 
 type Channel struct {
@@ -38,23 +193,248 @@ type Channel struct {
 	AccessToken string
 }
 
+// ChannelMetadata is what is known about a channel from its creation. CreatedAt is in
+// unix milliseconds, and 0 for channels created before metadata was recorded
+type ChannelMetadata struct {
+	Name      string
+	CreatedAt int64
+	// CreatorID is 0 if no creator was given at creation
+	CreatorID uint64
+}
+
+// ChannelInfo describes a channel for rendering its header
+type ChannelInfo struct {
+	ChannelID   uint64
+	Name        string
+	CreatedAt   int64
+	CreatorID   uint64
+	MemberCount int
+	OnlineCount int
+}
+
+// ChannelDeletion is the scope of a channel deletion
+type ChannelDeletion struct {
+	MessageCount    int64
+	AttachmentCount int
+	MemberCount     int
+}
+
 type User struct {
 	ID   uint64
 	Name string
 }
 
+// Snapshot is the metadata, presence and typing state of a channel at connect time
+type Snapshot struct {
+	ChannelID     uint64
+	UserIDs       []uint64
+	OnlineUserIDs []uint64
+	TypingUserIDs []uint64
+	Channel       *ChannelInfo
+}
+
+// ScheduledMessage is a text message waiting to be broadcast at SendAt (unix milliseconds)
+type ScheduledMessage struct {
+	ID        uint64
+	ChannelID uint64
+	UserID    uint64
+	Payload   string
+	SendAt    int64
+}
+
+// ChannelArchive is what an archived channel is serialized to in cold storage
+type ChannelArchive struct {
+	ChannelID  uint64
+	ArchivedAt int64
+	Messages   []*Message
+}
+
+type PresenceState string
+
+// ChannelUser is a user in a channel
+type ChannelUser struct {
+	ChannelID uint64
+	UserID    uint64
+}
+
+// BlockedUser is a user blocked by another user
+type BlockedUser struct {
+	UserID uint64
+	// BlockedAt is when the user was blocked in unix milliseconds
+	BlockedAt int64
+}
+
+// ChannelMessage identifies a message in a channel
+type ChannelMessage struct {
+	ChannelID uint64
+	MessageID uint64
+}
+
+const (
+	PresenceOnline  PresenceState = "online"
+	PresenceAway    PresenceState = "away"
+	PresenceOffline PresenceState = "offline"
+)
+
+type Sticker struct {
+	Name      string
+	ObjectKey string
+}
+
 func (m *Message) Encode() []byte {
 	result, _ := json.Marshal(m)
 	return result
 }
 
+// Expired reports whether a disappearing message outlived its ttl at now, in unix milliseconds
+func (m *Message) Expired(now int64) bool {
+	return m.ExpiresAt > 0 && m.ExpiresAt <= now
+}
+
+// VisibleTo reports whether the user may see the message; direct messages are only
+// visible to their sender and their recipient
+func (m *Message) VisibleTo(userID uint64) bool {
+	return m.Event != EventDirect || m.UserID == userID || m.RecipientID == userID
+}
+
 func (m *Message) ToPresenter() *MessagePresenter {
 	return &MessagePresenter{
-		MessageID: strconv.FormatUint(m.MessageID, 10),
-		Event:     m.Event,
-		UserID:    strconv.FormatUint(m.UserID, 10),
-		Payload:   m.Payload,
-		Seen:      m.Seen,
-		Time:      m.Time,
+		MessageID:   strconv.FormatUint(m.MessageID, 10),
+		Event:       m.Event,
+		UserID:      strconv.FormatUint(m.UserID, 10),
+		Payload:     m.Payload,
+		Seen:        m.Seen,
+		Time:        m.Time,
+		Guaranteed:  m.Guaranteed,
+		Edited:      m.EditedTime > 0,
+		EditedTime:  m.EditedTime,
+		Deleted:     m.Deleted,
+		Reactions:   toReactionsPresenter(m.Reactions, 0),
+		Emoji:       m.Emoji,
+		Action:      string(m.ReactionAction),
+		Attachment:  toAttachmentPresenter(m),
+		ReplyTo:     formatReplyTo(m.ReplyTo),
+		ReplyCount:  m.ReplyCount,
+		DeletedIDs:  formatMessageIDs(m.DeletedIDs),
+		Status:      string(m.Status),
+		Seq:         m.Seq,
+		ExpiresAt:   m.ExpiresAt,
+		RecipientID: formatRecipientID(m.RecipientID),
+		ContentType: string(m.ContentType()),
+	}
+}
+
+func formatRecipientID(recipientID uint64) string {
+	if recipientID == 0 {
+		return ""
+	}
+	return strconv.FormatUint(recipientID, 10)
+}
+
+func formatMessageIDs(messageIDs []uint64) []string {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	ids := make([]string, len(messageIDs))
+	for i, messageID := range messageIDs {
+		ids[i] = strconv.FormatUint(messageID, 10)
+	}
+	return ids
+}
+
+func formatReplyTo(replyTo uint64) string {
+	if replyTo == 0 {
+		return ""
+	}
+	return strconv.FormatUint(replyTo, 10)
+}
+
+// toAttachmentPresenter decodes the attachment of an attachment message, or returns nil
+// for other messages and deleted attachment messages
+func toAttachmentPresenter(m *Message) *AttachmentPresenter {
+	if m.Event != EventAttachment || m.Deleted || m.Payload == "" {
+		return nil
+	}
+	var attachment Attachment
+	if err := json.Unmarshal([]byte(m.Payload), &attachment); err != nil {
+		return nil
+	}
+	return &AttachmentPresenter{
+		Key:         attachment.Key,
+		ContentType: attachment.ContentType,
+		Size:        attachment.Size,
+		Filename:    attachment.Filename,
+	}
+}
+
+// decodeReactions decodes reactions stored as a json object of emojis to user id strings
+func decodeReactions(data string) (map[string][]uint64, error) {
+	if data == "" {
+		return nil, nil
+	}
+	var userIDStrs map[string][]string
+	if err := json.Unmarshal([]byte(data), &userIDStrs); err != nil {
+		return nil, err
+	}
+	reactions := make(map[string][]uint64, len(userIDStrs))
+	for emoji, strs := range userIDStrs {
+		for _, str := range strs {
+			userID, err := strconv.ParseUint(str, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			reactions[emoji] = append(reactions[emoji], userID)
+		}
+	}
+	return reactions, nil
+}
+
+func (m *ScheduledMessage) Encode() []byte {
+	result, _ := json.Marshal(m)
+	return result
+}
+
+func (m *ScheduledMessage) ToPresenter() *ScheduledMessagePresenter {
+	return &ScheduledMessagePresenter{
+		ID:      strconv.FormatUint(m.ID, 10),
+		Payload: m.Payload,
+		SendAt:  m.SendAt,
+	}
+}
+
+func (s *Snapshot) ToPresenter() *SnapshotPresenter {
+	presenter := &SnapshotPresenter{
+		ChannelID:     strconv.FormatUint(s.ChannelID, 10),
+		UserIDs:       formatIDs(s.UserIDs),
+		OnlineUserIDs: formatIDs(s.OnlineUserIDs),
+		TypingUserIDs: formatIDs(s.TypingUserIDs),
+	}
+	if s.Channel != nil {
+		presenter.Channel = s.Channel.ToPresenter()
+	}
+	return presenter
+}
+
+func (d *ChannelDeletion) ToPresenter(dryRun bool) *ChannelDeletionPresenter {
+	return &ChannelDeletionPresenter{
+		DryRun:          dryRun,
+		MessageCount:    d.MessageCount,
+		AttachmentCount: d.AttachmentCount,
+		MemberCount:     d.MemberCount,
+	}
+}
+
+func (i *ChannelInfo) ToPresenter() *ChannelInfoPresenter {
+	presenter := &ChannelInfoPresenter{
+		ChannelID:   strconv.FormatUint(i.ChannelID, 10),
+		Name:        i.Name,
+		CreatedAt:   i.CreatedAt,
+		MemberCount: i.MemberCount,
+		OnlineCount: i.OnlineCount,
+	}
+	// the creator is only known once a user joined the channel
+	if i.CreatorID != 0 {
+		presenter.CreatorID = strconv.FormatUint(i.CreatorID, 10)
 	}
+	return presenter
 }
@@ -1,9 +1,144 @@
 package chat
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+)
 
 var (
-	ErrUserNotFound           = errors.New("error user not found")
-	ErrChannelOrUserNotFound  = errors.New("error channel or user not found")
-	ErrExceedMessageNumLimits = errors.New("error exceed max number of messages")
+	ErrUserNotFound            = errors.New("error user not found")
+	ErrChannelOrUserNotFound   = errors.New("error channel or user not found")
+	ErrExceedMessageNumLimits  = errors.New("error exceed max number of messages")
+	ErrMessageRateLimited      = errors.New("error message rate limited")
+	ErrConnectionCooldown      = errors.New("error connection is cooling down due to message flooding")
+	ErrInvalidPayloadEncoding  = errors.New("error payload is not valid utf-8")
+	ErrInvalidPayloadCharacter = errors.New("error payload contains null bytes or control characters")
+	ErrMessageTooLarge         = errors.New("error message too large")
+	ErrStickerPackTooLarge     = errors.New("error exceed max number of stickers")
+	ErrInvalidSticker          = errors.New("error invalid sticker")
+	ErrStickerNotAllowed       = errors.New("error sticker not allowed in channel")
+	ErrInvalidResumeToken      = errors.New("error invalid resume token")
+	ErrResumeTokenExpired      = errors.New("error resume token expired")
+	ErrResumeGapTooLarge       = errors.New("error too many missed messages to resume")
+	ErrReplayOverflow          = errors.New("error too many messages arrived during replay; reconnect to resume")
+	ErrOriginNotAllowed        = errors.New("error websocket origin not allowed")
+	ErrContentTypeMismatch     = errors.New("error message content does not match its content type")
+	ErrSystemMessage           = errors.New("error system messages can only be sent by the server")
+	ErrInvalidReplyTo          = errors.New("error invalid reply_to message id")
+	ErrReplyNotFound           = errors.New("error replied message not found")
+	ErrInvalidRefreshToken     = errors.New("error invalid refresh token")
+	ErrRefreshTokenExpired     = errors.New("error refresh token expired")
+	ErrRefreshTokenRevoked     = errors.New("error refresh token revoked")
+	ErrSessionUserMismatch     = errors.New("error logged in user is not the given user")
+	ErrReauthMismatch          = errors.New("error access token belongs to another channel or user")
+	ErrNoRecipientOnline       = errors.New("error no other user online in channel")
+	ErrInvalidSendTime         = errors.New("error send time is in the past or beyond the max schedule horizon")
+	ErrScheduledMsgNotFound    = errors.New("error scheduled message not found")
+	ErrUnsupportedEvent        = errors.New("error unsupported event")
+	ErrUnsupportedSubprotocol  = errors.New("error unsupported websocket subprotocol")
+	ErrPresenceBatchTooLarge   = errors.New("error exceed max number of users per presence query")
+	ErrChannelArchived         = errors.New("error channel is archived; restore it first")
+	ErrChannelReadOnly         = errors.New("error channel is archived and read-only; unarchive it first")
+	ErrChannelExpired          = errors.New("error channel expired")
+	ErrInvalidChannelTTL       = errors.New("error channel ttl is negative or beyond the max ttl")
+	ErrInvalidChannelName      = errors.New("error channel name is too long")
+	ErrMessageNotFound         = errors.New("error message not found or deleted")
+	ErrNotMessageOwner         = errors.New("error message is not sent by the user")
+	ErrDeleteNotAllowed        = errors.New("error only the sender or a channel admin can delete a message")
+	ErrMessageNotEditable      = errors.New("error only text messages can be edited")
+	ErrEditWindowExpired       = errors.New("error message is too old to be edited")
+	ErrReactionNotAllowed      = errors.New("error emoji is not an allowed reaction")
+	ErrInvalidReactionAction   = errors.New("error reaction action must be add or remove")
+	ErrPinNotAllowed           = errors.New("error only channel admins can pin messages")
+	ErrExceedPinLimit          = errors.New("error exceed max number of pinned messages")
+	ErrPinDirectMessage        = errors.New("error direct messages cannot be pinned")
+	ErrStoreMessage            = errors.New("error message could not be stored")
+	ErrInvalidRole             = errors.New("error role must be admin or member")
+	ErrRoleChangeNotAllowed    = errors.New("error only channel admins can change roles")
+	ErrLastAdmin               = errors.New("error channel must keep at least one admin")
+	ErrUserTokenRequired       = errors.New("error admin actions require an access token bound to the user")
+	ErrChannelDeleteNotAllowed = errors.New("error only channel admins can delete the channel")
+	ErrBulkDeleteNotAllowed    = errors.New("error only channel admins can bulk delete messages")
+	ErrBulkDeleteTooLarge      = errors.New("error exceed max number of messages per bulk delete")
+	ErrExportNotAllowed        = errors.New("error only channel admins can export messages")
+	ErrMessageTTLNotAllowed    = errors.New("error only channel admins can set the message ttl")
+	ErrInvalidMessageTTL       = errors.New("error message ttl is negative or beyond the max ttl")
+	ErrMessageModerated        = errors.New("error message rejected by moderation")
+	ErrModerationUnavailable   = errors.New("error message could not be moderated")
+	ErrReadOnlySession         = errors.New("error connection is read-only and cannot send events")
+	ErrBlockSelf               = errors.New("error users cannot block themselves")
+	ErrInvalidPageLimit        = errors.New("error limit is out of range")
+	ErrInvalidMasterKey        = errors.New("error message encryption key must be 32 bytes encoded in base64")
+	ErrUnknownMessageStore     = errors.New("error unknown message store; expected cassandra or memory")
+	ErrDecryptPayload          = errors.New("error decrypt message payload")
+	ErrInvalidAttachment       = errors.New("error attachment must have a key and a filename of at most 255 bytes")
+	ErrAttachmentNotFound      = errors.New("error attachment not found")
+	ErrAttachmentNotInChannel  = errors.New("error attachment does not belong to the channel")
+	ErrInvalidDirectRecipient  = errors.New("error direct message must have a recipient_id other than the sender")
+	ErrRecipientNotMember      = errors.New("error recipient of direct message is not a member of the channel")
+	ErrSlowConsumer            = errors.New("error connection cannot keep up with messages; reconnect to catch up")
+	ErrInvalidChunk            = errors.New("error chunk must have a msg_id, non-empty data and an index below a total within the max number of chunks")
+	ErrChunkBufferFull         = errors.New("error too many chunked messages in progress on the connection")
+	ErrChunksIncomplete        = errors.New("error chunked message not completed in time")
 )
+
+var errorCodes = map[error]common.ErrorCode{
+	ErrUserNotFound:            common.CodeUserNotFound,
+	ErrChannelOrUserNotFound:   common.CodeChannelNotFound,
+	ErrExceedMessageNumLimits:  common.CodeLimitExceeded,
+	ErrMessageRateLimited:      common.CodeRateLimited,
+	ErrConnectionCooldown:      common.CodeRateLimited,
+	ErrMessageTooLarge:         common.CodePayloadTooLarge,
+	ErrStickerPackTooLarge:     common.CodeLimitExceeded,
+	ErrStickerNotAllowed:       common.CodeForbidden,
+	ErrResumeTokenExpired:      common.CodeTokenExpired,
+	ErrResumeGapTooLarge:       common.CodeLimitExceeded,
+	ErrInvalidReplyTo:          common.CodeInvalidParam,
+	ErrReplyNotFound:           common.CodeMessageNotFound,
+	ErrInvalidRefreshToken:     common.CodeUnauthorized,
+	ErrRefreshTokenExpired:     common.CodeTokenExpired,
+	ErrRefreshTokenRevoked:     common.CodeUnauthorized,
+	ErrSessionUserMismatch:     common.CodeUnauthorized,
+	ErrReauthMismatch:          common.CodeUnauthorized,
+	ErrScheduledMsgNotFound:    common.CodeMessageNotFound,
+	ErrPresenceBatchTooLarge:   common.CodeLimitExceeded,
+	ErrChannelArchived:         common.CodeChannelArchived,
+	ErrChannelReadOnly:         common.CodeChannelArchived,
+	ErrUnsupportedSubprotocol:  common.CodeInvalidParam,
+	ErrInvalidChannelTTL:       common.CodeInvalidParam,
+	ErrMessageNotFound:         common.CodeMessageNotFound,
+	ErrNotMessageOwner:         common.CodeForbidden,
+	ErrDeleteNotAllowed:        common.CodeForbidden,
+	ErrEditWindowExpired:       common.CodeForbidden,
+	ErrReactionNotAllowed:      common.CodeForbidden,
+	ErrPinNotAllowed:           common.CodeForbidden,
+	ErrExceedPinLimit:          common.CodeLimitExceeded,
+	ErrPinDirectMessage:        common.CodeInvalidParam,
+	ErrInvalidPageLimit:        common.CodeInvalidParam,
+	ErrStoreMessage:            common.CodeServerError,
+	ErrRoleChangeNotAllowed:    common.CodeForbidden,
+	ErrLastAdmin:               common.CodeConflict,
+	ErrUserTokenRequired:       common.CodeUnauthorized,
+	ErrChannelDeleteNotAllowed: common.CodeForbidden,
+	ErrBulkDeleteNotAllowed:    common.CodeForbidden,
+	ErrBulkDeleteTooLarge:      common.CodeLimitExceeded,
+	ErrExportNotAllowed:        common.CodeForbidden,
+	ErrMessageTTLNotAllowed:    common.CodeForbidden,
+	ErrInvalidMessageTTL:       common.CodeInvalidParam,
+	ErrMessageModerated:        common.CodeForbidden,
+	ErrModerationUnavailable:   common.CodeUnavailable,
+	ErrReadOnlySession:         common.CodeForbidden,
+	ErrBlockSelf:               common.CodeInvalidParam,
+	ErrInvalidAttachment:       common.CodeInvalidParam,
+	ErrAttachmentNotFound:      common.CodeFileNotFound,
+	ErrAttachmentNotInChannel:  common.CodeForbidden,
+	ErrInvalidDirectRecipient:  common.CodeInvalidParam,
+	ErrRecipientNotMember:      common.CodeUserNotFound,
+	ErrInvalidChunk:            common.CodeInvalidParam,
+	ErrOriginNotAllowed:        common.CodeForbidden,
+	ErrContentTypeMismatch:     common.CodeInvalidParam,
+	ErrSystemMessage:           common.CodeForbidden,
+	ErrChunkBufferFull:         common.CodeLimitExceeded,
+	ErrChunksIncomplete:        common.CodeUnprocessable,
+}
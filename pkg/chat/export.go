@@ -0,0 +1,114 @@
+package chat
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+)
+
+const (
+	exportFormatJSON = "json"
+	exportFormatCSV  = "csv"
+)
+
+var exportCSVHeader = []string{"message_id", "user_id", "time", "payload", "seen"}
+
+// messageExporter streams exported messages page by page, so that a channel history is
+// never held in memory as a whole
+type messageExporter interface {
+	ContentType() string
+	Write(msgs []*Message) error
+	// Close completes the document, which is valid even if nothing was written
+	Close() error
+}
+
+func newMessageExporter(format string, w io.Writer) (messageExporter, bool) {
+	switch format {
+	case "", exportFormatJSON:
+		return &jsonMessageExporter{w: w}, true
+	case exportFormatCSV:
+		return &csvMessageExporter{w: csv.NewWriter(w)}, true
+	}
+	return nil, false
+}
+
+// jsonMessageExporter writes messages as elements of a single json array
+type jsonMessageExporter struct {
+	w       io.Writer
+	written bool
+}
+
+func (e *jsonMessageExporter) ContentType() string {
+	return "application/json"
+}
+func (e *jsonMessageExporter) Write(msgs []*Message) error {
+	for _, msg := range msgs {
+		data, err := json.Marshal(toExportMessagePresenter(msg))
+		if err != nil {
+			return err
+		}
+		sep := ",\n"
+		if !e.written {
+			sep = "[\n"
+			e.written = true
+		}
+		if _, err := io.WriteString(e.w, sep); err != nil {
+			return err
+		}
+		if _, err := e.w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (e *jsonMessageExporter) Close() error {
+	end := "\n]\n"
+	if !e.written {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(e.w, end)
+	return err
+}
+
+// csvMessageExporter writes messages as csv rows after a header row
+type csvMessageExporter struct {
+	w       *csv.Writer
+	written bool
+}
+
+func (e *csvMessageExporter) ContentType() string {
+	return "text/csv; charset=utf-8"
+}
+func (e *csvMessageExporter) writeHeader() error {
+	if e.written {
+		return nil
+	}
+	e.written = true
+	return e.w.Write(exportCSVHeader)
+}
+func (e *csvMessageExporter) Write(msgs []*Message) error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if err := e.w.Write([]string{
+			strconv.FormatUint(msg.MessageID, 10),
+			strconv.FormatUint(msg.UserID, 10),
+			strconv.FormatInt(msg.Time, 10),
+			msg.Payload,
+			strconv.FormatBool(msg.Seen),
+		}); err != nil {
+			return err
+		}
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+func (e *csvMessageExporter) Close() error {
+	if err := e.writeHeader(); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
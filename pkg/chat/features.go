@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/olahol/melody.v1"
+)
+
+// eventGate withholds events from clients older than the version that introduced them.
+// The client version is read from the connection metadata captured on connect
+type eventGate struct {
+	versionKey  string
+	minVersions map[int][]int
+}
+
+// newEventGate parses comma-separated event:version pairs
+func newEventGate(versionKey, eventMinVersions string) (*eventGate, error) {
+	gate := &eventGate{
+		versionKey:  versionKey,
+		minVersions: make(map[int][]int),
+	}
+	for _, pair := range splitNonEmpty(eventMinVersions) {
+		event, version, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("error parse event gate %q: want event:version", pair)
+		}
+		eventNum, err := strconv.Atoi(strings.TrimSpace(event))
+		if err != nil {
+			return nil, fmt.Errorf("error parse event gate %q: %w", pair, err)
+		}
+		minVersion, ok := parseVersion(version)
+		if !ok {
+			return nil, fmt.Errorf("error parse event gate %q: invalid version", pair)
+		}
+		gate.minVersions[eventNum] = minVersion
+	}
+	return gate, nil
+}
+
+// Unsupported returns the gated events a client with the metadata must not receive, or nil
+// if it receives every event. Clients without a valid version are below every gate
+func (g *eventGate) Unsupported(metadata map[string]string) map[int]struct{} {
+	if len(g.minVersions) == 0 {
+		return nil
+	}
+	version, ok := parseVersion(metadata[g.versionKey])
+	var unsupported map[int]struct{}
+	for event, minVersion := range g.minVersions {
+		if ok && compareVersions(version, minVersion) >= 0 {
+			continue
+		}
+		if unsupported == nil {
+			unsupported = make(map[int]struct{})
+		}
+		unsupported[event] = struct{}{}
+	}
+	return unsupported
+}
+
+// supportsEvent reports whether the client of the session may receive the event
+func supportsEvent(sess *melody.Session, event int) bool {
+	unsupported, ok := sess.Get(sessGatedKey)
+	if !ok {
+		return true
+	}
+	_, gated := unsupported.(map[int]struct{})[event]
+	return !gated
+}
+
+// parseVersion parses a dotted numeric version such as 2.1.0, ignoring a leading v
+func parseVersion(s string) ([]int, bool) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "v")
+	if s == "" {
+		return nil, false
+	}
+	parts := strings.Split(s, ".")
+	version := make([]int, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, false
+		}
+		version = append(version, n)
+	}
+	return version, true
+}
+
+// compareVersions compares two versions part by part, treating missing parts as 0
+func compareVersions(a, b []int) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
@@ -4,6 +4,7 @@ import (
 	"log/slog"
 	"net"
 	"os"
+	"time"
 
 	"google.golang.org/grpc"
 
@@ -18,15 +19,23 @@ type GrpcServer struct {
 	logger   common.GrpcLog
 	s        *grpc.Server
 	userSvc  UserService
+	msgSvc   MessageService
 	chanSvc  ChannelService
+
+	maxChannelTTL     time.Duration
+	joinLeaveMessages bool
 }
 
-func NewGrpcServer(name string, logger common.GrpcLog, config *config.Config, userSvc UserService, chanSvc ChannelService) *GrpcServer {
+func NewGrpcServer(name string, logger common.GrpcLog, config *config.Config, userSvc UserService, msgSvc MessageService, chanSvc ChannelService) *GrpcServer {
 	srv := &GrpcServer{
 		grpcPort: config.Chat.Grpc.Server.Port,
 		logger:   logger,
 		userSvc:  userSvc,
+		msgSvc:   msgSvc,
 		chanSvc:  chanSvc,
+
+		maxChannelTTL:     time.Duration(config.Chat.Ephemeral.MaxTTLSecond) * time.Second,
+		joinLeaveMessages: config.Chat.SystemMessages.JoinLeave,
 	}
 	srv.s = transport.InitializeGrpcServer(name, srv.logger)
 	return srv
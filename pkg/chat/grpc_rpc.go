@@ -2,14 +2,25 @@ package chat
 
 import (
 	"context"
+	"time"
+	"unicode/utf8"
 
 	chatpb "github.com/minghsu0107/go-random-chat/proto/chat"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+const maxChannelNameLen = 64
+
 func (srv *GrpcServer) CreateChannel(ctx context.Context, req *chatpb.CreateChannelRequest) (*chatpb.CreateChannelResponse, error) {
-	channel, err := srv.chanSvc.CreateChannel(ctx)
+	ttl := time.Duration(req.TtlSeconds) * time.Second
+	if ttl < 0 || (srv.maxChannelTTL > 0 && ttl > srv.maxChannelTTL) {
+		return nil, status.Error(codes.InvalidArgument, ErrInvalidChannelTTL.Error())
+	}
+	if utf8.RuneCountInString(req.Name) > maxChannelNameLen {
+		return nil, status.Error(codes.InvalidArgument, ErrInvalidChannelName.Error())
+	}
+	channel, err := srv.chanSvc.CreateChannel(ctx, req.Name, ttl, req.CreatorId)
 	if err != nil {
 		srv.logger.Error(err.Error())
 		return nil, status.Error(codes.Internal, err.Error())
@@ -21,9 +32,24 @@ func (srv *GrpcServer) CreateChannel(ctx context.Context, req *chatpb.CreateChan
 }
 
 func (srv *GrpcServer) AddUserToChannel(ctx context.Context, req *chatpb.AddUserRequest) (*chatpb.AddUserResponse, error) {
+	// adding a member again must not record another join
+	joined := srv.joinLeaveMessages
+	if joined {
+		exist, err := srv.userSvc.IsChannelUserExist(ctx, req.ChannelId, req.UserId)
+		if err != nil {
+			srv.logger.Error(err.Error())
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		joined = !exist
+	}
 	if err := srv.userSvc.AddUserToChannel(ctx, req.ChannelId, req.UserId); err != nil {
 		srv.logger.Error(err.Error())
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if joined {
+		if _, err := srv.msgSvc.BroadcastSystemMessage(ctx, req.ChannelId, req.UserId, ChannelJoinedMessage); err != nil {
+			srv.logger.Error(err.Error())
+		}
+	}
 	return &chatpb.AddUserResponse{}, nil
 }
@@ -0,0 +1,31 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+
+	"gopkg.in/olahol/melody.v1"
+)
+
+// newGuestID returns a random id for a guest watching a channel. Guests are not users of
+// the channel; the id only tells their websocket sessions apart
+func newGuestID() (uint64, error) {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		// ids stay positive as int64 like sonyflake ids, and 0 is reserved for the
+		// channel token
+		if id := binary.BigEndian.Uint64(b[:]) >> 1; id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// isReadOnlySession reports whether the session was opened with a guest token, which
+// receives broadcasts but cannot send events
+func isReadOnlySession(sess *melody.Session) bool {
+	_, ok := sess.Get(sessReadOnlyKey)
+	return ok
+}
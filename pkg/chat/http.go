@@ -2,13 +2,21 @@ package chat
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/minghsu0107/go-random-chat/pkg/common"
 	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
 	metrics "github.com/slok/go-http-metrics/metrics/prometheus"
 	prommiddleware "github.com/slok/go-http-metrics/middleware"
 	ginmiddleware "github.com/slok/go-http-metrics/middleware/gin"
@@ -20,21 +28,115 @@ import (
 )
 
 var (
-	sessCidKey = "sesscid"
+	sessCidKey      = "sesscid"
+	sessMetadataKey = "sessmetadata"
+	sessGatedKey    = "sessgated"
+	sessTokenUidKey = "sesstokenuid"
+	sessBatcherKey  = "sessbatcher"
+	sessShaperKey   = "sessshaper"
+	sessResumeKey   = "sessresume"
+	sessTypingKey   = "sesstyping"
+	sessPongKey     = "sesspong"
+	sessClosedKey   = "sessclosed"
+	sessAuthKey     = "sessauth"
+	sessLimitedKey  = "sesslimited"
+	sessDeliveryKey = "sessdelivery"
+	sessExpiredKey  = "sessexpired"
+	sessReadOnlyKey = "sessreadonly"
+	sessTrafficKey  = "sesstraffic"
+	sessBlocksKey   = "sessblocks"
+	sessEvictKey    = "sessevict"
+	sessChunksKey   = "sesschunks"
+	sessReplayKey   = "sessreplay"
 
 	MelodyChat MelodyChatConn
+
+	idleDisconnectsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "ws_idle_disconnects_total",
+		Help:      "Total number of websocket connections dropped for not answering pings in time.",
+	})
+	pingIntervalSeconds = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "chat",
+		Name:      "ws_ping_interval_seconds",
+		Help:      "Configured interval between server pings on a websocket connection.",
+	})
+	floodDisconnectsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "flood_disconnects_total",
+		Help:      "Total number of websocket connections closed due to sustained message flooding.",
+	})
+	unknownEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "unknown_events_total",
+		Help:      "Total number of websocket messages with an event type the server does not know.",
+	}, []string{"event"})
+	trimmedMessagesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "retention_trimmed_messages_total",
+		Help:      "Total number of messages trimmed by the retention policy.",
+	})
+	// a histogram rather than a gauge labeled by channel id, which would have unbounded cardinality
+	trimmedMessagesPerChannel = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "chat",
+		Name:      "retention_trimmed_messages_per_channel",
+		Help:      "Number of messages trimmed from a channel in a single retention run.",
+		Buckets:   []float64{0, 1, 10, 100, 1000, 10000},
+	})
+	archivedChannelsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "archived_channels_total",
+		Help:      "Total number of inactive channels archived to cold storage.",
+	})
+	reapedChannelsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "reaped_channels_total",
+		Help:      "Total number of channels nobody is connected to archived or deleted after being inactive.",
+	}, []string{"action"})
+	expiredChannelsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "expired_channels_total",
+		Help:      "Total number of ephemeral channels purged after their ttl elapsed.",
+	})
+	expiredMessagesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "expired_messages_total",
+		Help:      "Total number of disappearing messages deleted after their ttl elapsed.",
+	})
+	scheduledBacklog = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "chat",
+		Name:      "scheduled_messages_backlog",
+		Help:      "Number of scheduled messages waiting to be delivered.",
+	})
 )
 
 type MelodyChatConn struct {
 	*melody.Melody
 }
 
+type MessageRateLimiter struct {
+	*common.RateLimiter
+}
+
+func NewMessageRateLimiter(rc redis.UniversalClient, config *config.Config) MessageRateLimiter {
+	return MessageRateLimiter{
+		common.NewRateLimiter(
+			rc,
+			config.Redis.KeyPrefix,
+			config.Chat.RateLimit.Message.Rps,
+			config.Chat.RateLimit.Message.Burst,
+			time.Duration(config.Redis.ExpirationHour)*time.Hour,
+		),
+	}
+}
+
 type HttpServer struct {
 	name          string
 	logger        common.HttpLog
 	svr           *gin.Engine
 	mc            MelodyChatConn
 	httpPort      string
+	tlsConfig     config.TLSConfig
 	httpServer    *http.Server
 	msgSubscriber *MessageSubscriber
 	userSvc       UserService
@@ -42,11 +144,121 @@ type HttpServer struct {
 	chanSvc       ChannelService
 	forwardSvc    ForwardService
 	serveSwag     bool
+	serveDebug    bool
+	debugToken    string
+
+	controlCharPolicy   string
+	maxPayloadBytes     int
+	soloPolicy          string
+	unknownEventPolicy  string
+	maxPresenceBatch    int
+	maxStickerPackSize  int
+	metadataHeaders     []string
+	metadataParams      []string
+	eventGate           *eventGate
+	conns               *connRegistry
+	coalesceEnabled     bool
+	coalesceWindow      time.Duration
+	coalesceMaxBatch    int
+	compressionEnabled  bool
+	shapingRate         int
+	shapingQueueSize    int
+	slowConsumerPolicy  string
+	chunkMaxChunks      int
+	chunkMaxBufferBytes int
+	chunkTimeout        time.Duration
+	outboxEnabled       bool
+	pendingEnabled      bool
+	resumeEnabled       bool
+	resumeIdleWindow    time.Duration
+	stopResumeRenewer   chan struct{}
+	resumeMaxReplay     int
+	replayMaxHeld       int
+	msgRateLimiter      MessageRateLimiter
+	moderator           MessageModerator
+	moderationFailOpen  bool
+	floodMaxViolations  int64
+	floodWindow         time.Duration
+	floodCooldown       time.Duration
+	scheduleHorizon     time.Duration
+	editMaxAge          time.Duration
+	searchMaxResults    int
+	searchMaxScanned    int
+	typingThrottle      time.Duration
+	typingStopTimeout   time.Duration
+	allowedReactions    []string
+	maxPinned           int64
+	maxBulkDelete       int
+	adminOnlyDeletion   bool
+	hideBlockedPresence bool
+	defaultPageSize     int
+	refreshTokenTTL     time.Duration
+	guestTokenTTL       time.Duration
+	maxPageSize         int
+	schedulePoll        time.Duration
+	stopScheduler       chan struct{}
+	retention           time.Duration
+	maxPerChannel       int64
+	trimInterval        time.Duration
+	stopTrimmer         chan struct{}
+	archiveEnabled      bool
+	joinLeaveMessages   bool
+	archiveInactive     time.Duration
+	archiveInterval     time.Duration
+	stopArchiver        chan struct{}
+	emptyInactive       time.Duration
+	emptyInterval       time.Duration
+	emptyAction         string
+	stopReaper          chan struct{}
+	expirySweep         time.Duration
+	stopExpirySweeper   chan struct{}
+	maxMessageTTL       time.Duration
+	messageSweep        time.Duration
+	stopMessageSweeper  chan struct{}
+	presenceDebounced   bool
+	stopOfflineSweeper  chan struct{}
+	traffic             *channelTraffic
+	workers             common.Workers
+	inFlight            *common.InFlightRequests
+	allowedOrigins      common.OriginAllowlist
 }
 
+// defaultPongWait is the pong timeout used when the configured one is not positive
+const defaultPongWait = 60 * time.Second
+
 func NewMelodyChatConn(config *config.Config) MelodyChatConn {
 	m := melody.New()
 	m.Config.MaxMessageSize = config.Chat.Message.MaxSizeByte
+	if bufferSize := config.Chat.Websocket.SlowConsumer.BufferSize; bufferSize > 0 {
+		m.Config.MessageBufferSize = bufferSize
+	}
+	// frames carrying a payload above the cap have to be read in full so that the message
+	// can be rejected instead of the connection being closed. Payloads grow at most six
+	// times when escaped as json strings
+	if maxPayloadBytes := config.Chat.Message.MaxPayloadBytes; maxPayloadBytes > 0 {
+		frameSize := 6*int64(maxPayloadBytes) + config.Chat.Message.MaxSizeByte
+		if frameSize > m.Config.MaxMessageSize {
+			m.Config.MaxMessageSize = frameSize
+		}
+	}
+	// melody pings every PingPeriod and drops a connection whose read deadline, extended
+	// by each pong, passes PongWait
+	m.Config.PongWait = time.Duration(config.Chat.Websocket.Heartbeat.PongTimeoutSecond) * time.Second
+	// a read deadline in the past would drop every connection as soon as it is read from
+	if m.Config.PongWait <= 0 {
+		slog.Warn("chat.websocket.heartbeat.pongTimeoutSecond must be positive, using the default", slog.Duration("pongTimeout", defaultPongWait))
+		m.Config.PongWait = defaultPongWait
+	}
+	m.Config.PingPeriod = time.Duration(config.Chat.Websocket.Heartbeat.PingIntervalSecond) * time.Second
+	if m.Config.PingPeriod <= 0 || m.Config.PingPeriod >= m.Config.PongWait {
+		m.Config.PingPeriod = (m.Config.PongWait * 9) / 10
+	}
+	pingIntervalSeconds.Set(m.Config.PingPeriod.Seconds())
+	// the upgrader accepts permessage-deflate if the client offers it; frames stay text
+	// frames carrying the same json, compressed on the wire at the fastest flate level,
+	// since melody does not expose the connection to set another one
+	m.Upgrader.EnableCompression = config.Chat.Websocket.Compression.Enabled
+	m.Upgrader.Subprotocols = supportedSubprotocols
 	MelodyChat = MelodyChatConn{
 		m,
 	}
@@ -56,7 +268,7 @@ func NewMelodyChatConn(config *config.Config) MelodyChatConn {
 func NewGinServer(name string, logger common.HttpLog, config *config.Config) *gin.Engine {
 	svr := gin.New()
 	svr.Use(gin.Recovery())
-	svr.Use(common.CorsMiddleware())
+	svr.Use(common.CorsMiddleware(config.Chat.Http.Server.Cors))
 	svr.Use(common.LoggingMiddleware(logger))
 	svr.Use(common.MaxAllowed(config.Chat.Http.Server.MaxConn))
 
@@ -69,8 +281,79 @@ func NewGinServer(name string, logger common.HttpLog, config *config.Config) *gi
 	return svr
 }
 
-func NewHttpServer(name string, logger common.HttpLog, config *config.Config, svr *gin.Engine, mc MelodyChatConn, msgSubscriber *MessageSubscriber, userSvc UserService, msgSvc MessageService, chanSvc ChannelService, forwardSvc ForwardService) *HttpServer {
+func NewHttpServer(name string, logger common.HttpLog, config *config.Config, svr *gin.Engine, mc MelodyChatConn, msgSubscriber *MessageSubscriber, userSvc UserService, msgSvc MessageService, chanSvc ChannelService, forwardSvc ForwardService, msgRateLimiter MessageRateLimiter, moderator MessageModerator) (*HttpServer, error) {
 	initJWT(config)
+	inFlight := common.NewInFlightRequests()
+	svr.Use(inFlight.Middleware())
+	allowedOrigins := common.NewOriginAllowlist(config.Chat.Websocket.AllowedOrigins)
+	if allowedOrigins.AllowAll() {
+		logger.Warn("websocket connections are accepted from any origin; set chat.websocket.allowedOrigins to prevent cross-site websocket hijacking")
+	}
+	schedulePoll := time.Duration(config.Chat.Scheduled.PollIntervalMilliSecond) * time.Millisecond
+	if schedulePoll <= 0 {
+		logger.Warn("chat.scheduled.pollIntervalMilliSecond must be positive, using the default", slog.Duration("pollInterval", defaultSchedulePoll))
+		schedulePoll = defaultSchedulePoll
+	}
+	chunkTimeout := time.Duration(config.Chat.Websocket.Chunking.TimeoutSecond) * time.Second
+	if chunkTimeout <= 0 {
+		logger.Warn("chat.websocket.chunking.timeoutSecond must be positive, using the default", slog.Duration("timeout", defaultChunkTimeout))
+		chunkTimeout = defaultChunkTimeout
+	}
+	searchMaxResults := config.Chat.Search.MaxResults
+	if searchMaxResults <= 0 {
+		logger.Warn("chat.search.maxResults must be positive, using the default", slog.Int("maxResults", defaultSearchMaxResults))
+		searchMaxResults = defaultSearchMaxResults
+	}
+	searchMaxScanned := config.Chat.Search.MaxScannedMessages
+	if searchMaxScanned <= 0 {
+		logger.Warn("chat.search.maxScannedMessages must be positive, using the default", slog.Int("maxScannedMessages", defaultSearchMaxScanned))
+		searchMaxScanned = defaultSearchMaxScanned
+	}
+	replayMaxHeld := config.Chat.Resume.MaxHeldLiveMessages
+	if replayMaxHeld <= 0 {
+		logger.Warn("chat.resume.maxHeldLiveMessages must be positive, using the default", slog.Int("maxHeldLiveMessages", defaultReplayMaxHeld))
+		replayMaxHeld = defaultReplayMaxHeld
+	}
+	if config.Chat.Archive.Enabled && config.Chat.Archive.ScanIntervalSecond <= 0 {
+		logger.Warn("inactive channels are not archived: chat.archive.scanIntervalSecond must be positive")
+	}
+	if config.Chat.Ephemeral.SweepIntervalSecond <= 0 {
+		logger.Warn("ephemeral channels are not purged: chat.ephemeral.sweepIntervalSecond must be positive")
+	}
+	if config.Chat.MessageExpiry.SweepIntervalSecond <= 0 {
+		logger.Warn("disappearing messages are not deleted: chat.messageExpiry.sweepIntervalSecond must be positive")
+	}
+	if (config.Chat.Message.RetentionDays > 0 || config.Chat.Message.MaxPerChannel > 0) && config.Chat.Message.TrimIntervalSecond <= 0 {
+		logger.Warn("messages are not trimmed: chat.message.trimIntervalSecond must be positive")
+	}
+	emptyInactive := time.Duration(config.Chat.EmptyChannels.InactiveSecond) * time.Second
+	emptyAction := config.Chat.EmptyChannels.Action
+	if emptyInactive > 0 {
+		switch {
+		case emptyAction != emptyChannelArchive && emptyAction != emptyChannelDelete:
+			logger.Warn("empty channels are kept: chat.emptyChannels.action must be archive or delete", slog.String("action", emptyAction))
+			emptyInactive = 0
+		case emptyAction == emptyChannelArchive && !config.Chat.Archive.Enabled:
+			logger.Warn("empty channels are kept: archiving them requires chat.archive.enabled")
+			emptyInactive = 0
+		case config.Chat.EmptyChannels.ScanIntervalSecond <= 0:
+			logger.Warn("empty channels are kept: chat.emptyChannels.scanIntervalSecond must be positive")
+			emptyInactive = 0
+		}
+	}
+	gate, err := newEventGate(config.Chat.Websocket.Metadata.VersionKey, config.Chat.Websocket.Metadata.EventMinVersions)
+	if err != nil {
+		return nil, err
+	}
+	if config.Chat.Http.Server.Debug && config.Chat.Http.Server.DebugToken == "" {
+		return nil, errors.New("chat.http.server.debug requires chat.http.server.debugToken")
+	}
+	// an unknown policy would let control characters through silently
+	switch config.Chat.Message.ControlCharPolicy {
+	case ControlCharPolicyAllow, ControlCharPolicyStrip, ControlCharPolicyReject:
+	default:
+		return nil, fmt.Errorf("unknown chat.message.controlCharPolicy %q: must be allow, strip or reject", config.Chat.Message.ControlCharPolicy)
+	}
 
 	return &HttpServer{
 		name:          name,
@@ -78,18 +361,96 @@ func NewHttpServer(name string, logger common.HttpLog, config *config.Config, sv
 		svr:           svr,
 		mc:            mc,
 		httpPort:      config.Chat.Http.Server.Port,
+		tlsConfig:     config.Chat.Http.Server.TLS,
 		msgSubscriber: msgSubscriber,
 		userSvc:       userSvc,
 		msgSvc:        msgSvc,
 		chanSvc:       chanSvc,
 		forwardSvc:    forwardSvc,
 		serveSwag:     config.Chat.Http.Server.Swag,
-	}
+		serveDebug:    config.Chat.Http.Server.Debug,
+		debugToken:    config.Chat.Http.Server.DebugToken,
+
+		controlCharPolicy:   config.Chat.Message.ControlCharPolicy,
+		maxPayloadBytes:     config.Chat.Message.MaxPayloadBytes,
+		soloPolicy:          config.Chat.Message.SoloPolicy,
+		unknownEventPolicy:  config.Chat.Websocket.UnknownEventPolicy,
+		maxPresenceBatch:    config.Chat.Presence.MaxBatchSize,
+		maxStickerPackSize:  config.Chat.Sticker.MaxPackSize,
+		metadataHeaders:     splitNonEmpty(config.Chat.Websocket.Metadata.Headers),
+		metadataParams:      splitNonEmpty(config.Chat.Websocket.Metadata.QueryParams),
+		eventGate:           gate,
+		conns:               newConnRegistry(),
+		coalesceEnabled:     config.Chat.Websocket.Coalesce.Enabled,
+		coalesceWindow:      time.Duration(config.Chat.Websocket.Coalesce.WindowMilliSecond) * time.Millisecond,
+		coalesceMaxBatch:    config.Chat.Websocket.Coalesce.MaxBatchSize,
+		compressionEnabled:  config.Chat.Websocket.Compression.Enabled,
+		shapingRate:         config.Chat.Websocket.Shaping.MaxMessagesPerSecond,
+		shapingQueueSize:    config.Chat.Websocket.Shaping.QueueSize,
+		slowConsumerPolicy:  config.Chat.Websocket.SlowConsumer.Policy,
+		chunkMaxChunks:      config.Chat.Websocket.Chunking.MaxChunks,
+		chunkMaxBufferBytes: config.Chat.Websocket.Chunking.MaxBufferBytes,
+		chunkTimeout:        chunkTimeout,
+		outboxEnabled:       config.Chat.Outbox.Enabled,
+		pendingEnabled:      config.Chat.PendingDelivery.Enabled,
+		resumeEnabled:       config.Chat.Resume.Enabled,
+		resumeIdleWindow:    time.Duration(config.Chat.Resume.IdleWindowSecond) * time.Second,
+		stopResumeRenewer:   make(chan struct{}),
+		resumeMaxReplay:     config.Chat.Resume.MaxReplayMessages,
+		replayMaxHeld:       replayMaxHeld,
+		msgRateLimiter:      msgRateLimiter,
+		moderator:           moderator,
+		moderationFailOpen:  config.Chat.Moderation.FailOpen,
+		floodMaxViolations:  config.Chat.RateLimit.Flood.MaxViolations,
+		floodWindow:         time.Duration(config.Chat.RateLimit.Flood.WindowSecond) * time.Second,
+		floodCooldown:       time.Duration(config.Chat.RateLimit.Flood.CooldownSecond) * time.Second,
+		scheduleHorizon:     time.Duration(config.Chat.Scheduled.MaxHorizonSecond) * time.Second,
+		editMaxAge:          time.Duration(config.Chat.Message.MaxEditAgeSecond) * time.Second,
+		searchMaxResults:    searchMaxResults,
+		searchMaxScanned:    searchMaxScanned,
+		typingThrottle:      time.Duration(config.Chat.Typing.ThrottleMilliSecond) * time.Millisecond,
+		typingStopTimeout:   time.Duration(config.Chat.Typing.StopTimeoutSecond) * time.Second,
+		allowedReactions:    splitNonEmpty(config.Chat.Reaction.AllowedEmojis),
+		maxPinned:           config.Chat.Pin.MaxPinned,
+		maxBulkDelete:       config.Chat.Message.MaxBulkDelete,
+		adminOnlyDeletion:   config.Chat.Role.AdminOnlyChannelDeletion,
+		hideBlockedPresence: config.Chat.Block.HidePresence,
+		defaultPageSize:     min(config.Chat.Message.PaginationNum, config.Chat.Message.MaxPageSize),
+		maxPageSize:         config.Chat.Message.MaxPageSize,
+		refreshTokenTTL:     time.Duration(config.Chat.JWT.RefreshExpirationSecond) * time.Second,
+		guestTokenTTL:       time.Duration(config.Chat.JWT.GuestExpirationSecond) * time.Second,
+		schedulePoll:        schedulePoll,
+		stopScheduler:       make(chan struct{}),
+		retention:           time.Duration(config.Chat.Message.RetentionDays) * 24 * time.Hour,
+		maxPerChannel:       config.Chat.Message.MaxPerChannel,
+		trimInterval:        time.Duration(config.Chat.Message.TrimIntervalSecond) * time.Second,
+		stopTrimmer:         make(chan struct{}),
+		archiveEnabled:      config.Chat.Archive.Enabled,
+		joinLeaveMessages:   config.Chat.SystemMessages.JoinLeave,
+		archiveInactive:     time.Duration(config.Chat.Archive.InactiveSecond) * time.Second,
+		archiveInterval:     time.Duration(config.Chat.Archive.ScanIntervalSecond) * time.Second,
+		stopArchiver:        make(chan struct{}),
+		emptyInactive:       emptyInactive,
+		emptyInterval:       time.Duration(config.Chat.EmptyChannels.ScanIntervalSecond) * time.Second,
+		emptyAction:         emptyAction,
+		stopReaper:          make(chan struct{}),
+		expirySweep:         time.Duration(config.Chat.Ephemeral.SweepIntervalSecond) * time.Second,
+		stopExpirySweeper:   make(chan struct{}),
+		maxMessageTTL:       time.Duration(config.Chat.MessageExpiry.MaxTTLSecond) * time.Second,
+		messageSweep:        time.Duration(config.Chat.MessageExpiry.SweepIntervalSecond) * time.Second,
+		stopMessageSweeper:  make(chan struct{}),
+		presenceDebounced:   config.Chat.Presence.DebounceSecond > 0,
+		traffic:             newChannelTraffic(config.Chat.Websocket.Metrics.MaxChannelLabels),
+		stopOfflineSweeper:  make(chan struct{}),
+		inFlight:            inFlight,
+		allowedOrigins:      allowedOrigins,
+	}, nil
 }
 
 func initJWT(config *config.Config) {
 	common.JwtSecret = config.Chat.JWT.Secret
 	common.JwtExpirationSecond = config.Chat.JWT.ExpirationSecond
+	common.JwtLeewaySecond = config.Chat.JWT.LeewaySecond
 }
 
 // @title           Chat Service Swagger API
@@ -107,6 +468,14 @@ func (r *HttpServer) RegisterRoutes() {
 	{
 		chatGroup.GET("", r.StartChat)
 
+		tokenGroup := chatGroup.Group("/token")
+		{
+			tokenGroup.POST("", common.JWTAuth(), r.IssueToken)
+			tokenGroup.POST("/refresh", r.RefreshToken)
+			tokenGroup.POST("/revoke", r.RevokeToken)
+			tokenGroup.POST("/guest", common.JWTAuth(), r.IssueGuestToken)
+		}
+
 		forwardAuthGroup := chatGroup.Group("/forwardauth")
 		forwardAuthGroup.Use(common.JWTAuth())
 		{
@@ -118,18 +487,55 @@ func (r *HttpServer) RegisterRoutes() {
 		{
 			usersGroup.GET("", r.GetChannelUsers)
 			usersGroup.GET("/online", r.GetOnlineUsers)
+			usersGroup.GET("/receipts", r.GetReadReceipts)
+			usersGroup.POST("/presence", r.GetPresence)
+			usersGroup.PUT("/receipts", r.SetReadReceipts)
+		}
+		userGroup := chatGroup.Group("/user")
+		userGroup.Use(common.JWTAuth())
+		{
+			userGroup.GET("/channels", r.ListUserChannels)
+			userGroup.GET("/blocks", r.ListBlockedUsers)
+			userGroup.POST("/block", r.BlockUser)
+			userGroup.DELETE("/block", r.UnblockUser)
 		}
 		channelGroup := chatGroup.Group("/channel")
 		channelGroup.Use(common.JWTAuth())
 		{
-			channelGroup.GET("/messages", r.ListMessages)
+			channelGroup.GET("", r.GetChannel)
+			channelGroup.GET("/info", r.GetChannelInfo)
+			channelGroup.GET("/unread", r.RequireActiveChannel(), r.GetUnreadCount)
+			channelGroup.GET("/messages", r.RequireActiveChannel(), r.ListMessages)
+			channelGroup.GET("/messages/search", r.RequireActiveChannel(), r.SearchMessages)
+			channelGroup.GET("/messages/export", r.RequireActiveChannel(), r.ExportMessages)
+			channelGroup.GET("/messages/thread", r.RequireActiveChannel(), r.ListThread)
+			channelGroup.GET("/messages/receipts", r.GetMessageReceipts)
+			channelGroup.POST("/messages/bulk-delete", r.RequireActiveChannel(), r.RequireWritableChannel(), r.BulkDeleteMessages)
 			channelGroup.DELETE("", r.DeleteChannel)
+			channelGroup.GET("/stickers", r.GetStickerPack)
+			channelGroup.PUT("/stickers", r.RequireActiveChannel(), r.RequireWritableChannel(), r.SetStickerPack)
+			channelGroup.PUT("/message-ttl", r.RequireActiveChannel(), r.RequireWritableChannel(), r.SetChannelMessageTTL)
+			channelGroup.POST("/messages/scheduled", r.RequireActiveChannel(), r.RequireWritableChannel(), r.ScheduleMessage)
+			channelGroup.POST("/restore", r.RestoreChannel)
+			channelGroup.POST("/unarchive", r.UnarchiveChannel)
+			channelGroup.POST("/trim", r.RequireActiveChannel(), r.RequireWritableChannel(), r.TrimChannel)
+			channelGroup.DELETE("/messages/scheduled/:id", r.CancelScheduledMessage)
+			channelGroup.POST("/pin", r.RequireActiveChannel(), r.RequireWritableChannel(), r.PinMessage)
+			channelGroup.DELETE("/pin", r.RequireWritableChannel(), r.UnpinMessage)
+			channelGroup.POST("/role", r.SetUserRole)
+			channelGroup.GET("/pins", r.RequireActiveChannel(), r.ListPinnedMessages)
 		}
 	}
 	r.mc.HandleMessage(r.HandleChatOnMessage)
 	r.mc.HandleConnect(r.HandleChatOnConnect)
 	r.mc.HandleClose(r.HandleChatOnClose)
+	r.mc.HandleDisconnect(r.HandleChatOnDisconnect)
+	r.mc.HandlePong(r.HandleChatOnPong)
+	r.mc.HandleError(r.HandleChatOnError)
 
+	if r.serveDebug {
+		chatGroup.GET("/debug/connections", r.DebugAuth(), r.ListConnections)
+	}
 	if r.serveSwag {
 		chatGroup.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler, ginSwagger.InstanceName(doc.SwaggerInfochat.InfoInstanceName)))
 	}
@@ -142,8 +548,8 @@ func (r *HttpServer) Run() {
 			Addr:    addr,
 			Handler: common.NewOtelHttpHandler(r.svr, r.name+"_http"),
 		}
-		r.logger.Info("http server listening", slog.String("addr", addr))
-		err := r.httpServer.ListenAndServe()
+		r.logger.Info("http server listening", slog.String("addr", addr), slog.Bool("tls", r.tlsConfig.Enabled))
+		err := common.ListenAndServe(r.httpServer, r.tlsConfig)
 		if err != nil && err != http.ErrServerClosed {
 			r.logger.Error(err.Error())
 			os.Exit(1)
@@ -156,26 +562,346 @@ func (r *HttpServer) Run() {
 			os.Exit(1)
 		}
 	}()
+	r.workers.Go(r.deliverScheduledMessages)
+	r.workers.Go(r.backfillUserChannels)
+	if (r.retention > 0 || r.maxPerChannel > 0) && r.trimInterval > 0 {
+		r.workers.Go(r.trimActiveChannels)
+	}
+	if r.archiveEnabled && r.archiveInterval > 0 {
+		r.workers.Go(r.archiveInactiveChannels)
+	}
+	if r.emptyInactive > 0 {
+		r.workers.Go(r.reapEmptyChannels)
+	}
+	if r.resumeEnabled && r.resumeIdleWindow > 0 {
+		r.workers.Go(r.renewResumeTokens)
+	}
+	if r.expirySweep > 0 {
+		r.workers.Go(r.sweepExpiredChannels)
+	}
+	if r.messageSweep > 0 {
+		r.workers.Go(r.sweepExpiredMessages)
+	}
+	if r.presenceDebounced {
+		r.workers.Go(r.sweepOfflineUsers)
+	}
 }
-func (r *HttpServer) GracefulStop(ctx context.Context) error {
-	err := MelodyChat.Close()
-	if err != nil {
-		return err
+
+// trimActiveChannels periodically applies the message retention policy to active channels
+func (r *HttpServer) trimActiveChannels() {
+	ticker := time.NewTicker(r.trimInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			trimmed, err := r.chanSvc.TrimActiveChannels(context.Background(), r.retentionCutoff(), r.maxPerChannel, r.trimInterval)
+			if err != nil {
+				r.logger.Error(err.Error())
+			}
+			total := 0
+			for _, n := range trimmed {
+				trimmedMessagesPerChannel.Observe(float64(n))
+				total += n
+			}
+			if total > 0 {
+				trimmedMessagesTotal.Add(float64(total))
+				r.logger.Info("trimmed messages", slog.Int("count", total), slog.Int("channels", len(trimmed)))
+			}
+		case <-r.stopTrimmer:
+			return
+		}
 	}
-	err = r.httpServer.Shutdown(ctx)
-	if err != nil {
-		return err
+}
+
+// retentionCutoff returns the time before which messages are trimmed, or the zero time
+// if messages are kept regardless of their age
+func (r *HttpServer) retentionCutoff() time.Time {
+	if r.retention <= 0 {
+		return time.Time{}
 	}
-	err = r.msgSubscriber.GracefulStop()
+	return time.Now().Add(-r.retention)
+}
+
+// archiveInactiveChannels periodically archives channels that have been inactive for
+// longer than the configured threshold
+func (r *HttpServer) archiveInactiveChannels() {
+	ticker := time.NewTicker(r.archiveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := r.chanSvc.ArchiveInactiveChannels(context.Background(), time.Now().Add(-r.archiveInactive))
+			if err != nil {
+				r.logger.Error(err.Error())
+			}
+			if n > 0 {
+				archivedChannelsTotal.Add(float64(n))
+				r.logger.Info("archived inactive channels", slog.Int("count", n))
+			}
+		case <-r.stopArchiver:
+			return
+		}
+	}
+}
+
+// renewResumeTokens hands connections a renewed resume token every half idle window, so
+// that the token of a quiet connection is still valid when the connection drops
+func (r *HttpServer) renewResumeTokens() {
+	interval := r.resumeIdleWindow / 2
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = r.mc.BroadcastFilter(nil, func(sess *melody.Session) bool {
+				state, ok := sess.Get(sessResumeKey)
+				if !ok || !state.(*resumeState).Renew(interval) {
+					return false
+				}
+				frame, err := state.(*resumeState).RenewedTokenFrame(r.resumeIdleWindow)
+				if err != nil {
+					r.sessionLogger(sess).Error(err.Error())
+					return false
+				}
+				observeTraffic(sess, directionOut, frame)
+				if batcher, ok := sess.Get(sessBatcherKey); ok {
+					batcher.(*frameBatcher).Add(sess, frame)
+				} else if err := writeShaped(sess, frame); err != nil && !isShapingDrop(err) {
+					r.sessionLogger(sess).Error(err.Error())
+				}
+				return false
+			})
+		case <-r.stopResumeRenewer:
+			return
+		}
+	}
+}
+
+const (
+	emptyChannelArchive = "archive"
+	emptyChannelDelete  = "delete"
+)
+
+// reapEmptyChannels periodically archives or deletes the channels nobody is connected to
+// that have been inactive for longer than the configured threshold
+func (r *HttpServer) reapEmptyChannels() {
+	ticker := time.NewTicker(r.emptyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := r.chanSvc.ReapEmptyChannels(context.Background(), time.Now().Add(-r.emptyInactive), r.emptyAction == emptyChannelDelete)
+			if err != nil {
+				r.logger.Error(err.Error())
+			}
+			if n > 0 {
+				reapedChannelsTotal.WithLabelValues(r.emptyAction).Add(float64(n))
+				r.logger.Info("reaped empty channels", slog.Int("count", n), slog.String("action", r.emptyAction))
+			}
+		case <-r.stopReaper:
+			return
+		}
+	}
+}
+
+// sweepExpiredChannels periodically tears down ephemeral channels whose ttl elapsed
+func (r *HttpServer) sweepExpiredChannels() {
+	ticker := time.NewTicker(r.expirySweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := r.chanSvc.ExpireDueChannels(context.Background(), time.Now())
+			if err != nil {
+				r.logger.Error(err.Error())
+			}
+			if n > 0 {
+				expiredChannelsTotal.Add(float64(n))
+				r.logger.Info("purged expired channels", slog.Int("count", n))
+			}
+		case <-r.stopExpirySweeper:
+			return
+		}
+	}
+}
+
+// sweepExpiredMessages periodically deletes disappearing messages whose ttl elapsed
+func (r *HttpServer) sweepExpiredMessages() {
+	ticker := time.NewTicker(r.messageSweep)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := r.msgSvc.ExpireDueMessages(context.Background(), time.Now())
+			if err != nil {
+				r.logger.Error(err.Error())
+			}
+			if n > 0 {
+				expiredMessagesTotal.Add(float64(n))
+			}
+		case <-r.stopMessageSweeper:
+			return
+		}
+	}
+}
+
+// offlineSweepInterval bounds how late held back offline presences are sent
+const offlineSweepInterval = time.Second
+
+// sweepOfflineUsers periodically sends the offline presences held back for users that did
+// not reconnect within the debounce period
+func (r *HttpServer) sweepOfflineUsers() {
+	ticker := time.NewTicker(offlineSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			users, err := r.userSvc.PopDueOfflineUsers(context.Background(), time.Now())
+			if err != nil {
+				r.logger.Error(err.Error())
+			}
+			for _, user := range users {
+				if err := r.broadcastOffline(context.Background(), user.ChannelID, user.UserID); err != nil {
+					r.logger.Error(err.Error())
+				}
+			}
+		case <-r.stopOfflineSweeper:
+			return
+		}
+	}
+}
+
+// RequireActiveChannel rejects requests to archived channels
+func (r *HttpServer) RequireActiveChannel() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !r.archiveEnabled {
+			c.Next()
+			return
+		}
+		channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+		if !ok {
+			response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+			c.Abort()
+			return
+		}
+		archived, err := r.chanSvc.IsChannelArchived(c.Request.Context(), channelID)
+		if err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			c.Abort()
+			return
+		}
+		if archived {
+			response(c, http.StatusConflict, ErrChannelArchived)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// DebugAuth requires the configured debug token as a bearer token, since debug endpoints
+// expose the connections of every user
+func (r *HttpServer) DebugAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(r.debugToken)) != 1 {
+			response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireWritableChannel rejects requests modifying soft-archived channels, which are
+// read-only until unarchived
+func (r *HttpServer) RequireWritableChannel() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+		if !ok {
+			response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+			c.Abort()
+			return
+		}
+		softArchived, err := r.chanSvc.IsChannelSoftArchived(c.Request.Context(), channelID)
+		if err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			c.Abort()
+			return
+		}
+		if softArchived {
+			response(c, http.StatusConflict, ErrChannelReadOnly)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// defaultSearchMaxResults and defaultSearchMaxScanned bound message searches when the
+// configured bounds are not positive
+const (
+	defaultSearchMaxResults = 50
+	defaultSearchMaxScanned = 5000
+)
+
+// defaultSchedulePoll is the poll interval of scheduled messages used when the configured one is not positive
+const defaultSchedulePoll = time.Second
+
+// deliverScheduledMessages periodically broadcasts due scheduled messages. Every replica
+// runs the loop; due messages are dequeued atomically so each is delivered only once
+func (r *HttpServer) deliverScheduledMessages() {
+	ticker := time.NewTicker(r.schedulePoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx := context.Background()
+			if _, err := r.msgSvc.DeliverDueScheduledMessages(ctx, r.moderateScheduledMessage); err != nil {
+				r.logger.Error(err.Error())
+			}
+			backlog, err := r.msgSvc.CountScheduledMessages(ctx)
+			if err != nil {
+				r.logger.Error(err.Error())
+				continue
+			}
+			scheduledBacklog.Set(float64(backlog))
+		case <-r.stopScheduler:
+			return
+		}
+	}
+}
+
+// backfillUserChannels indexes the memberships of channels joined before the channels of
+// users were indexed
+func (r *HttpServer) backfillUserChannels() {
+	backfilled, err := r.userSvc.BackfillUserChannels(context.Background())
 	if err != nil {
-		return err
+		r.logger.Error(err.Error())
+	}
+	if backfilled > 0 {
+		r.logger.Info("user channels backfilled", slog.Int("memberships", backfilled))
 	}
-	return nil
+}
+func (r *HttpServer) GracefulStop(ctx context.Context) error {
+	close(r.stopScheduler)
+	close(r.stopArchiver)
+	close(r.stopReaper)
+	close(r.stopResumeRenewer)
+	close(r.stopTrimmer)
+	close(r.stopExpirySweeper)
+	close(r.stopMessageSweeper)
+	close(r.stopOfflineSweeper)
+	// websocket connections are hijacked, so Shutdown does not wait for them and sessions
+	// are closed beforehand. Later steps run even if an earlier one fails
+	err := MelodyChat.Close()
+	err = errors.Join(err, common.Shutdown(ctx, r.httpServer, r.inFlight, r.logger.Logger))
+	err = errors.Join(err, r.msgSubscriber.GracefulStop())
+	return errors.Join(err, r.workers.Wait(ctx))
 }
 
 func response(c *gin.Context, httpCode int, err error) {
-	message := err.Error()
-	c.JSON(httpCode, common.ErrResponse{
-		Message: message,
-	})
+	c.JSON(httpCode, common.NewRequestErrResponse(c.Request.Context(), err, httpCode, errorCodes))
 }
@@ -3,10 +3,17 @@ package chat
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
 	"github.com/minghsu0107/go-random-chat/pkg/common"
 	"gopkg.in/olahol/melody.v1"
 )
@@ -15,47 +22,276 @@ import (
 // @Description Websocket initialization endpoint for starting a chat
 // @Tags chat
 // @Produce json
-// @Param uid query int true "user id"
-// @Param access_token query string true "access token of the channel"
+// @Param uid query int true "user id, or the guest id of a guest token"
+// @Param access_token query string true "access token of the channel; with a guest token the connection only receives broadcasts"
+// @Param snapshot query bool false "send a snapshot event with channel metadata, channel users, online users and typing users right after connecting"
+// @Param caps query string false "comma-separated client capabilities; batch receives coalesced frames as json arrays"
+// @Param resume query string false "resume token of a previous connection; the messages missed since then are replayed before any live message, without duplicates"
+// @Param Sec-WebSocket-Protocol header string false "requested versions of the event schema, e.g. randomchat.v1; randomchat.v1 is used if none is requested"
 // @Failure 400 {object} common.ErrResponse
 // @Failure 401 {object} common.ErrResponse
+// @Failure 403 {object} common.ErrResponse
 // @Failure 404 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 429 {object} common.ErrResponse
 // @Failure 500 {object} common.ErrResponse
 // @Router /chat [get]
 func (r *HttpServer) StartChat(c *gin.Context) {
+	// browsers send cookies and tokens of other sites along with websocket upgrades, which
+	// are not subject to CORS
+	if !r.allowedOrigins.Allowed(c.GetHeader("Origin")) {
+		response(c, http.StatusForbidden, ErrOriginNotAllowed)
+		return
+	}
+	if _, ok := negotiateSubprotocol(c.Request); !ok {
+		response(c, http.StatusBadRequest, ErrUnsupportedSubprotocol)
+		return
+	}
 	uid := c.Query("uid")
 	userID, err := strconv.ParseUint(uid, 10, 64)
 	if err != nil {
 		response(c, http.StatusBadRequest, common.ErrInvalidParam)
 		return
 	}
-	_, err = r.userSvc.GetUser(c.Request.Context(), userID)
+	accessToken := c.Query("access_token")
+	authResult, err := common.Auth(&common.AuthPayload{
+		AccessToken: accessToken,
+	})
+	if err != nil {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	if authResult.Expired {
+		r.logger.ErrorContext(c.Request.Context(), common.ErrTokenExpired.Error())
+		response(c, http.StatusUnauthorized, common.ErrTokenExpired)
+		return
+	}
+	channelID := authResult.ChannelID
+	if authResult.UserID != 0 && authResult.UserID != userID {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	// guests are bound to their channel by the token alone and are not users of it
+	readOnly := authResult.ReadOnly()
+	if !readOnly && !r.checkChatUser(c, channelID, userID) {
+		return
+	}
+	if r.archiveEnabled {
+		archived, err := r.chanSvc.IsChannelArchived(c.Request.Context(), channelID)
+		if err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return
+		}
+		if archived {
+			response(c, http.StatusConflict, ErrChannelArchived)
+			return
+		}
+	}
+
+	metadata := r.captureMetadata(c)
+	keys := map[string]interface{}{
+		sessTokenUidKey: authResult.UserID,
+		sessMetadataKey: metadata,
+		sessTypingKey:   newTypingTimer(),
+		sessAuthKey:     newSessionAuth(accessToken),
+		sessLimitedKey:  new(atomic.Bool),
+	}
+	if readOnly {
+		keys[sessReadOnlyKey] = true
+	}
+	// events newer than the client are withheld, which must be decided before the session
+	// receives broadcasts
+	if unsupported := r.eventGate.Unsupported(metadata); unsupported != nil {
+		keys[sessGatedKey] = unsupported
+	}
+	if r.pendingEnabled && !readOnly {
+		keys[sessDeliveryKey] = newDeliveryTracker()
+	}
+	if r.coalesceEnabled && hasCapability(c.Query("caps"), CapabilityBatch) {
+		keys[sessBatcherKey] = newFrameBatcher(r.coalesceWindow, r.coalesceMaxBatch)
+	}
+	if r.resumeEnabled && !readOnly {
+		state := newResumeState(channelID, userID)
+		if resumeToken := c.Query("resume"); resumeToken != "" {
+			state.Resume(resumeToken)
+		}
+		keys[sessResumeKey] = state
+	}
+	if r.shapingRate > 0 {
+		keys[sessShaperKey] = newSendShaper(r.shapingRate, r.shapingQueueSize)
+	}
+	if r.slowConsumerPolicy == SlowConsumerPolicyEvict {
+		keys[sessEvictKey] = newSlowConsumer()
+	}
+	if (r.resumeEnabled || r.outboxEnabled || r.pendingEnabled) && !readOnly {
+		keys[sessReplayKey] = newReplayGate(r.replayMaxHeld)
+	}
+	if !readOnly {
+		keys[sessChunksKey] = newChunkAssembler(r.chunkMaxChunks, r.chunkMaxBufferBytes, r.maxPayloadBytes, r.chunkTimeout)
+	}
+	var w http.ResponseWriter = c.Writer
+	if r.compressionEnabled {
+		w = deflateRecorder{c.Writer}
+	}
+	if err := r.mc.HandleRequestWithKeys(w, c.Request, keys); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "upgrade websocket error: "+err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+}
+
+// checkChatUser checks that the user exists, belongs to the channel and is not cooling down
+// after flooding, writing the error response otherwise. The cooldown is checked last, so that
+// it is not revealed for users the token does not authorize
+func (r *HttpServer) checkChatUser(c *gin.Context, channelID, userID uint64) bool {
+	_, err := r.userSvc.GetUser(c.Request.Context(), userID)
 	if err != nil {
 		if errors.Is(err, ErrUserNotFound) {
 			response(c, http.StatusNotFound, ErrUserNotFound)
-			return
+			return false
 		}
-		r.logger.Error(err.Error())
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
 		response(c, http.StatusInternalServerError, common.ErrServer)
+		return false
+	}
+	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, userID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return false
+	}
+	if !exist {
+		response(c, http.StatusNotFound, ErrChannelOrUserNotFound)
+		return false
+	}
+	cooling, err := r.userSvc.IsInConnectionCooldown(c.Request.Context(), userID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return false
+	}
+	if cooling {
+		response(c, http.StatusTooManyRequests, ErrConnectionCooldown)
+		return false
+	}
+	return true
+}
+
+// @Summary Issue tokens
+// @Description Issue an access token bound to the user together with a refresh token that can renew it. The user has to be logged in to the user service as uid, since the channel token alone does not prove who the caller is
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param uid query string true "user id"
+// @Success 200 {object} TokenPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/token [post]
+func (r *HttpServer) IssueToken(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	sid, err := common.GetCookie(c, common.SessionIdCookieName)
+	if err != nil {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	sessionUserID, err := r.userSvc.GetUserIDBySession(c.Request.Context(), sid)
+	if err != nil {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	userID, ok := r.channelUserID(c)
+	if !ok {
+		return
+	}
+	if userID != sessionUserID {
+		response(c, http.StatusUnauthorized, ErrSessionUserMismatch)
 		return
 	}
+	r.issueTokens(c, channelID, userID)
+}
 
-	accessToken := c.Query("access_token")
-	authResult, err := common.Auth(&common.AuthPayload{
+// @Summary Issue guest token
+// @Description Issue a short-lived read-only access token of the channel for a guest. The guest connects to the chat websocket with the returned guest id as uid and receives broadcasts, but cannot send events or call other endpoints
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param uid query string true "id of the user inviting the guest"
+// @Success 200 {object} GuestTokenPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/token/guest [post]
+func (r *HttpServer) IssueGuestToken(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	if _, ok := r.channelUserID(c); !ok {
+		return
+	}
+	guestID, err := newGuestID()
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	accessToken, err := common.NewGuestJWT(channelID, guestID, r.guestTokenTTL)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, &GuestTokenPresenter{
 		AccessToken: accessToken,
+		GuestID:     strconv.FormatUint(guestID, 10),
+		ExpiresAt:   time.Now().Add(r.guestTokenTTL).UnixMilli(),
 	})
+}
+
+// @Summary Refresh tokens
+// @Description Exchange a refresh token for a new access token and refresh token. A refresh token can only be exchanged once
+// @Tags chat
+// @Accept json
+// @Produce json
+// @Param request body RefreshTokenRequest true "refresh token"
+// @Success 200 {object} TokenPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/token/refresh [post]
+func (r *HttpServer) RefreshToken(c *gin.Context) {
+	var req RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	claims, err := parseRefreshToken(req.RefreshToken)
 	if err != nil {
-		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		response(c, http.StatusUnauthorized, err)
 		return
 	}
-	if authResult.Expired {
-		r.logger.Error(common.ErrTokenExpired.Error())
-		response(c, http.StatusUnauthorized, common.ErrTokenExpired)
+	// spend the token before issuing new ones so that a replayed token is rejected
+	revoked, err := r.userSvc.RevokeRefreshToken(c.Request.Context(), claims)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
 	}
-	channelID := authResult.ChannelID
-	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, userID)
+	if !revoked {
+		response(c, http.StatusUnauthorized, ErrRefreshTokenRevoked)
+		return
+	}
+	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), claims.ChannelID, claims.UserID)
 	if err != nil {
-		r.logger.Error(err.Error())
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
 		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
@@ -63,12 +299,59 @@ func (r *HttpServer) StartChat(c *gin.Context) {
 		response(c, http.StatusNotFound, ErrChannelOrUserNotFound)
 		return
 	}
+	r.issueTokens(c, claims.ChannelID, claims.UserID)
+}
+
+// @Summary Revoke refresh token
+// @Description Revoke a refresh token, for example on logout, so that it can no longer be exchanged. Access tokens it already renewed stay valid until they expire
+// @Tags chat
+// @Accept json
+// @Produce json
+// @Param request body RefreshTokenRequest true "refresh token"
+// @Success 204 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/token/revoke [post]
+func (r *HttpServer) RevokeToken(c *gin.Context) {
+	var req RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	claims, err := parseRefreshToken(req.RefreshToken)
+	if err != nil {
+		response(c, http.StatusUnauthorized, err)
+		return
+	}
+	if _, err := r.userSvc.RevokeRefreshToken(c.Request.Context(), claims); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusNoContent, common.SuccessMessage{
+		Message: "ok",
+	})
+}
 
-	if err := r.mc.HandleRequest(c.Writer, c.Request); err != nil {
-		r.logger.Error("upgrade websocket error: " + err.Error())
+func (r *HttpServer) issueTokens(c *gin.Context, channelID, userID uint64) {
+	accessToken, err := common.NewUserJWT(channelID, userID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
 		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
+	refreshToken, err := newRefreshToken(channelID, userID, r.refreshTokenTTL)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, &TokenPresenter{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresAt:    time.Now().Add(time.Duration(common.JwtExpirationSecond) * time.Second).UnixMilli(),
+	})
 }
 
 // @Summary Forward auth
@@ -92,7 +375,7 @@ func (r *HttpServer) ForwardAuth(c *gin.Context) {
 }
 
 // @Summary Get channel users
-// @Description Get all users of a channel
+// @Description Get all users of a channel with their roles
 // @Tags chat
 // @Produce json
 // @param Authorization header string true "channel authorization"
@@ -109,243 +392,2614 @@ func (r *HttpServer) GetChannelUsers(c *gin.Context) {
 	}
 	userIDs, err := r.userSvc.GetChannelUserIDs(c.Request.Context(), channelID)
 	if err != nil {
-		r.logger.Error(err.Error())
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	roles, err := r.userSvc.GetChannelRoles(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
 		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
 	userIDsPresenter := []string{}
+	rolesPresenter := make(map[string]Role, len(userIDs))
 	for _, userID := range userIDs {
-		userIDsPresenter = append(userIDsPresenter, strconv.FormatUint(userID, 10))
+		userIDStr := strconv.FormatUint(userID, 10)
+		userIDsPresenter = append(userIDsPresenter, userIDStr)
+		rolesPresenter[userIDStr] = roles[userID]
 	}
 	c.JSON(http.StatusOK, &UserIDsPresenter{
 		UserIDs: userIDsPresenter,
+		Roles:   rolesPresenter,
 	})
 }
 
-// @Summary Get online users
-// @Description Get all online users of a channel
+// @Summary List user channels
+// @Description List the channels of the user the access token is issued to, the most recently active first
 // @Tags chat
 // @Produce json
-// @param Authorization header string true "channel authorization"
-// @Success 200 {object} UserIDsPresenter
+// @param Authorization header string true "user authorization"
+// @Success 200 {object} UserChannelsPresenter
 // @Failure 401 {object} common.ErrResponse
-// @Failure 404 {object} common.ErrResponse
 // @Failure 500 {object} common.ErrResponse
-// @Router /chat/users/online [get]
-func (r *HttpServer) GetOnlineUsers(c *gin.Context) {
-	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+// @Router /chat/user/channels [get]
+func (r *HttpServer) ListUserChannels(c *gin.Context) {
+	userID, ok := c.Request.Context().Value(common.UserKey).(uint64)
 	if !ok {
 		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
 		return
 	}
-	userIDs, err := r.userSvc.GetOnlineUserIDs(c.Request.Context(), channelID)
+	channels, err := r.chanSvc.ListUserChannels(c.Request.Context(), userID)
 	if err != nil {
-		r.logger.Error(err.Error())
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
 		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
-	userIDsPresenter := []string{}
-	for _, userID := range userIDs {
-		userIDsPresenter = append(userIDsPresenter, strconv.FormatUint(userID, 10))
+	channelsPresenter := make([]UserChannelPresenter, len(channels))
+	for i, channel := range channels {
+		channelsPresenter[i] = UserChannelPresenter{
+			ChannelID:       strconv.FormatUint(channel.ChannelID, 10),
+			LastMessageTime: channel.LastMessageTime,
+		}
 	}
-	c.JSON(http.StatusOK, &UserIDsPresenter{
-		UserIDs: userIDsPresenter,
+	c.JSON(http.StatusOK, &UserChannelsPresenter{
+		Channels: channelsPresenter,
 	})
 }
 
-// @Summary List channel messages
-// @Description List messages of a channel
+// @Summary List blocked users
+// @Description List the users blocked by the user the access token is issued to, the most recently blocked first
 // @Tags chat
 // @Produce json
-// @param Authorization header string true "channel authorization"
-// @Param ps query string false "page state"
-// @Success 200 {object} MessagesPresenter
+// @param Authorization header string true "user authorization"
+// @Success 200 {object} BlockedUsersPresenter
 // @Failure 401 {object} common.ErrResponse
-// @Failure 404 {object} common.ErrResponse
 // @Failure 500 {object} common.ErrResponse
-// @Router /chat/channel/messages [get]
-func (r *HttpServer) ListMessages(c *gin.Context) {
-	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+// @Router /chat/user/blocks [get]
+func (r *HttpServer) ListBlockedUsers(c *gin.Context) {
+	userID, ok := c.Request.Context().Value(common.UserKey).(uint64)
 	if !ok {
 		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
 		return
 	}
-	pageState := c.Query("ps")
-	msgs, nextPageState, err := r.msgSvc.ListMessages(c.Request.Context(), channelID, pageState)
+	blocked, err := r.userSvc.GetBlockedUsers(c.Request.Context(), userID)
 	if err != nil {
-		r.logger.Error(err.Error())
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
 		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
-	msgsPresenter := []MessagePresenter{}
-	for _, msg := range msgs {
-		msgsPresenter = append(msgsPresenter, *msg.ToPresenter())
+	blockedPresenter := make([]BlockedUserPresenter, len(blocked))
+	for i, user := range blocked {
+		blockedPresenter[i] = BlockedUserPresenter{
+			UserID:    strconv.FormatUint(user.UserID, 10),
+			BlockedAt: user.BlockedAt,
+		}
 	}
-	c.JSON(http.StatusOK, &MessagesPresenter{
-		NextPageState: nextPageState,
-		Messages:      msgsPresenter,
+	c.JSON(http.StatusOK, &BlockedUsersPresenter{
+		BlockedUsers: blockedPresenter,
 	})
 }
 
-// @Summary Delete channel
-// @Description Delete a channel
+// @Summary Block user
+// @Description Block a user in every channel. The user's messages and other events are no longer delivered to the blocker, including on reconnects
 // @Tags chat
+// @Accept json
 // @Produce json
-// @param Authorization header string true "channel authorization"
-// @Param delby query string true "id of the user that performs the deletion"
-// @Success 204 {object} common.SuccessMessage
+// @param Authorization header string true "user authorization"
+// @Param block body BlockRequest true "user to block"
+// @Success 200 {object} common.SuccessMessage
 // @Failure 400 {object} common.ErrResponse
 // @Failure 401 {object} common.ErrResponse
 // @Failure 404 {object} common.ErrResponse
 // @Failure 500 {object} common.ErrResponse
-// @Router /chat/channel [delete]
-func (r *HttpServer) DeleteChannel(c *gin.Context) {
-	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+// @Router /chat/user/block [post]
+func (r *HttpServer) BlockUser(c *gin.Context) {
+	userID, ok := c.Request.Context().Value(common.UserKey).(uint64)
 	if !ok {
 		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
 		return
 	}
-	uid := c.Query("delby")
-	userID, err := strconv.ParseUint(uid, 10, 64)
-	if err != nil {
+	var req BlockRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
 		response(c, http.StatusBadRequest, common.ErrInvalidParam)
 		return
 	}
-
-	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, userID)
+	targetID, err := strconv.ParseUint(req.UserID, 10, 64)
 	if err != nil {
-		r.logger.Error(err.Error())
-		response(c, http.StatusInternalServerError, common.ErrServer)
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
 		return
 	}
-	if !exist {
-		response(c, http.StatusBadRequest, ErrChannelOrUserNotFound)
+	if err := r.userSvc.BlockUser(c.Request.Context(), userID, targetID); err != nil {
+		switch {
+		case errors.Is(err, ErrBlockSelf):
+			response(c, http.StatusBadRequest, err)
+		case errors.Is(err, ErrUserNotFound):
+			response(c, http.StatusNotFound, ErrUserNotFound)
+		default:
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+		}
 		return
 	}
+	if err := r.msgSvc.BroadcastBlockMessage(c.Request.Context(), userID, targetID, true); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+	}
+	c.JSON(http.StatusOK, common.OkMsg)
+}
 
-	err = r.msgSvc.BroadcastActionMessage(c.Request.Context(), channelID, userID, LeavedMessage)
-	if err != nil {
-		r.logger.Error(err.Error())
-		response(c, http.StatusInternalServerError, common.ErrServer)
+// @Summary Unblock user
+// @Description Remove a user from the block list
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "user authorization"
+// @Param user_id query string true "id of the user to unblock"
+// @Success 200 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/user/block [delete]
+func (r *HttpServer) UnblockUser(c *gin.Context) {
+	userID, ok := c.Request.Context().Value(common.UserKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
 		return
 	}
-	err = r.chanSvc.DeleteChannel(c.Request.Context(), channelID)
+	targetID, err := strconv.ParseUint(c.Query("user_id"), 10, 64)
 	if err != nil {
-		r.logger.Error(err.Error())
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if err := r.userSvc.UnblockUser(c.Request.Context(), userID, targetID); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
 		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
-	c.JSON(http.StatusNoContent, common.SuccessMessage{
-		Message: "ok",
-	})
+	if err := r.msgSvc.BroadcastBlockMessage(c.Request.Context(), userID, targetID, false); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+	}
+	c.JSON(http.StatusOK, common.OkMsg)
 }
 
-func (r *HttpServer) HandleChatOnConnect(sess *melody.Session) {
-	userID, err := strconv.ParseUint(sess.Request.URL.Query().Get("uid"), 10, 64)
-	if err != nil {
-		r.logger.Error(err.Error())
+// @Summary Set user role
+// @Description Promote a user of the channel to admin or demote them to member. Only channel admins can change roles, and the last admin cannot be demoted. The admin is authenticated by a channel token bound to them
+// @Tags chat
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param role body RoleRequest true "user and role"
+// @Success 200 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 403 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/role [post]
+func (r *HttpServer) SetUserRole(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
 		return
 	}
-	accessToken := sess.Request.URL.Query().Get("access_token")
-	authResult, err := common.Auth(&common.AuthPayload{
-		AccessToken: accessToken,
-	})
-	if err != nil {
-		r.logger.Error(err.Error())
+	actorID, ok := r.adminUserID(c)
+	if !ok {
+		return
 	}
-	if authResult.Expired {
-		r.logger.Error(common.ErrTokenExpired.Error())
+	var req RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	targetID, err := strconv.ParseUint(req.UserID, 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if err := r.userSvc.SetUserRole(c.Request.Context(), channelID, actorID, targetID, req.Role); err != nil {
+		switch {
+		case errors.Is(err, ErrInvalidRole), errors.Is(err, ErrChannelOrUserNotFound):
+			response(c, http.StatusBadRequest, err)
+		case errors.Is(err, ErrRoleChangeNotAllowed):
+			response(c, http.StatusForbidden, err)
+		case errors.Is(err, ErrLastAdmin):
+			response(c, http.StatusConflict, err)
+		default:
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, common.OkMsg)
+}
+
+// @Summary Get online users
+// @Description Get all online users of a channel, except users blocked by the caller. With chat.block.hidePresence, users who blocked the caller are left out too, and the channel token must be bound to the caller
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Success 200 {object} UserIDsPresenter
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/users/online [get]
+func (r *HttpServer) GetOnlineUsers(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	viewerID := tokenUserID(c)
+	// presence hidden from blocked users must not be readable with an unbound token
+	if r.hideBlockedPresence && viewerID == 0 {
+		response(c, http.StatusUnauthorized, ErrUserTokenRequired)
+		return
+	}
+	userIDs, err := r.userSvc.GetOnlineUserIDs(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if viewerID != 0 {
+		blocks, err := r.getBlockList(c.Request.Context(), viewerID)
+		if err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return
+		}
+		userIDs = blocks.VisibleUsers(userIDs)
+	}
+	userIDsPresenter := []string{}
+	for _, userID := range userIDs {
+		userIDsPresenter = append(userIDsPresenter, strconv.FormatUint(userID, 10))
+	}
+	c.JSON(http.StatusOK, &UserIDsPresenter{
+		UserIDs: userIDsPresenter,
+	})
+}
+
+// @Summary Get presence of users
+// @Description Get the global presence (online, away or offline) of many users at once; unknown users are reported offline
+// @Tags chat
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param users body PresenceRequest true "user ids"
+// @Success 200 {object} PresencePresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/users/presence [post]
+func (r *HttpServer) GetPresence(c *gin.Context) {
+	if _, ok := c.Request.Context().Value(common.ChannelKey).(uint64); !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	var req PresenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if len(req.UserIDs) > r.maxPresenceBatch {
+		response(c, http.StatusBadRequest, ErrPresenceBatchTooLarge)
+		return
+	}
+	userIDs := make([]uint64, len(req.UserIDs))
+	for i, id := range req.UserIDs {
+		userID, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return
+		}
+		userIDs[i] = userID
+	}
+	presence, err := r.userSvc.GetPresence(c.Request.Context(), userIDs)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	presencePresenter := make(map[string]PresenceState, len(presence))
+	for userID, state := range presence {
+		presencePresenter[strconv.FormatUint(userID, 10)] = state
+	}
+	c.JSON(http.StatusOK, &PresencePresenter{
+		Presence: presencePresenter,
+	})
+}
+
+// @Summary Restore channel
+// @Description Restore an archived channel by rehydrating its messages from cold storage; restoring an active channel does nothing
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Success 200 {object} common.SuccessMessage
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/restore [post]
+func (r *HttpServer) RestoreChannel(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	if err := r.chanSvc.RestoreChannel(c.Request.Context(), channelID); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, common.OkMsg)
+}
+
+// @Summary Trim channel messages
+// @Description Apply the message retention policy to the channel right away instead of waiting for the periodic run; pinned messages are kept
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Success 200 {object} TrimPresenter
+// @Failure 401 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/trim [post]
+func (r *HttpServer) TrimChannel(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	n, err := r.chanSvc.TrimChannelMessages(c.Request.Context(), channelID, r.retentionCutoff(), r.maxPerChannel)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	trimmedMessagesPerChannel.Observe(float64(n))
+	trimmedMessagesTotal.Add(float64(n))
+	c.JSON(http.StatusOK, &TrimPresenter{
+		Trimmed: n,
+	})
+}
+
+// @Summary Get read receipts preference
+// @Description Get whether the user shares read receipts
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param uid query string true "user id"
+// @Success 200 {object} ReadReceiptsPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/users/receipts [get]
+func (r *HttpServer) GetReadReceipts(c *gin.Context) {
+	userID, ok := r.channelUserID(c)
+	if !ok {
+		return
+	}
+	enabled, err := r.userSvc.IsReadReceiptsEnabled(c.Request.Context(), userID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, &ReadReceiptsPresenter{
+		Enabled: &enabled,
+	})
+}
+
+// @Summary Set read receipts preference
+// @Description Set whether the user shares read receipts. When disabled, messages the user sees are not marked seen for others and no seen event is broadcast, while the user still receives read receipts from others
+// @Tags chat
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param uid query string true "user id"
+// @Param preference body ReadReceiptsPresenter true "read receipts preference"
+// @Success 200 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/users/receipts [put]
+func (r *HttpServer) SetReadReceipts(c *gin.Context) {
+	userID, ok := r.channelUserID(c)
+	if !ok {
+		return
+	}
+	var pref ReadReceiptsPresenter
+	if err := c.ShouldBindJSON(&pref); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if err := r.userSvc.SetReadReceiptsEnabled(c.Request.Context(), userID, *pref.Enabled); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, common.OkMsg)
+}
+
+// tokenUserID returns the user the channel token was issued to, or 0 for a token that is
+// only bound to the channel. Unlike the uid query param, it cannot be picked by the caller
+func tokenUserID(c *gin.Context) uint64 {
+	userID, _ := c.Request.Context().Value(common.UserKey).(uint64)
+	return userID
+}
+
+// sessionTokenUserID returns the user the token of a websocket session was issued to, or 0
+func sessionTokenUserID(sess *melody.Session) uint64 {
+	userID, ok := sess.Get(sessTokenUidKey)
+	if !ok {
+		return 0
+	}
+	return userID.(uint64)
+}
+
+// adminUserID returns the user the channel token is bound to as the actor of an admin-only
+// endpoint, writing the error response for channel tokens that are not bound to a user.
+// The uid query param is picked by the caller and cannot prove that the caller is an admin
+func (r *HttpServer) adminUserID(c *gin.Context) (uint64, bool) {
+	userID := tokenUserID(c)
+	if userID == 0 {
+		response(c, http.StatusUnauthorized, ErrUserTokenRequired)
+		return 0, false
+	}
+	return userID, true
+}
+
+// channelUserID returns the uid query param after checking that the user belongs to the
+// authorized channel, writing an error response otherwise
+func (r *HttpServer) channelUserID(c *gin.Context) (uint64, bool) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return 0, false
+	}
+	userID, err := strconv.ParseUint(c.Query("uid"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return 0, false
+	}
+	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, userID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return 0, false
+	}
+	if !exist {
+		response(c, http.StatusBadRequest, ErrChannelOrUserNotFound)
+		return 0, false
+	}
+	return userID, true
+}
+
+// @Summary List channel messages
+// @Description List messages of a channel with their reactions in descending sequence order. If uid is given, seen and reacted are derived relative to the user: a message of the user is seen once another user sharing read receipts has seen it, and a message of another user is seen once the user has seen it. Disappearing messages whose ttl elapsed are left out, and direct messages are only listed to their sender and recipient when the channel token is bound to them
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param uid query string false "user id"
+// @Param ps query string false "page state returned as next_ps by the previous page"
+// @Param limit query int false "max number of messages in the page"
+// @Success 200 {object} MessagesPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/messages [get]
+func (r *HttpServer) ListMessages(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	var viewerID uint64
+	if c.Query("uid") != "" {
+		var ok bool
+		if viewerID, ok = r.channelUserID(c); !ok {
+			return
+		}
+	}
+	limit, ok := r.pageLimit(c)
+	if !ok {
+		return
+	}
+	pageState := c.Query("ps")
+	// direct messages are only listed to the user the token is bound to
+	msgs, nextPageState, err := r.msgSvc.ListMessages(c.Request.Context(), channelID, tokenUserID(c), pageState, limit)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if viewerID != 0 {
+		receipts, err := r.userSvc.GetReadReceipts(c.Request.Context(), channelID, viewerID)
+		if err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return
+		}
+		for _, msg := range msgs {
+			msg.Seen = isSeenBy(msg, viewerID, receipts)
+		}
+	}
+	if err := r.msgSvc.LoadReactions(c.Request.Context(), channelID, msgs); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if err := r.msgSvc.LoadReplyCounts(c.Request.Context(), channelID, msgs); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	msgsPresenter := []MessagePresenter{}
+	for _, msg := range msgs {
+		msgPresenter := msg.ToPresenter()
+		msgPresenter.Reactions = toReactionsPresenter(msg.Reactions, viewerID)
+		msgsPresenter = append(msgsPresenter, *msgPresenter)
+	}
+	c.JSON(http.StatusOK, &MessagesPresenter{
+		NextPageState: nextPageState,
+		Messages:      msgsPresenter,
+	})
+}
+
+// @Summary List thread
+// @Description List a thread root with its replies, oldest first. Pass the id of the last reply as after to get the next page. Direct messages are only listed to their sender and recipient when the channel token is bound to them
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param root query string true "message id of the thread root"
+// @Param after query string false "list the replies after this reply id"
+// @Param limit query int false "max number of replies in the page"
+// @Success 200 {object} ThreadPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/messages/thread [get]
+func (r *HttpServer) ListThread(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	rootID, err := strconv.ParseUint(c.Query("root"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	var after uint64
+	if c.Query("after") != "" {
+		if after, err = strconv.ParseUint(c.Query("after"), 10, 64); err != nil {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return
+		}
+	}
+	limit, ok := r.pageLimit(c)
+	if !ok {
+		return
+	}
+	root, replies, err := r.msgSvc.ListThread(c.Request.Context(), channelID, tokenUserID(c), rootID, after, limit)
+	if errors.Is(err, ErrMessageNotFound) {
+		response(c, http.StatusNotFound, ErrMessageNotFound)
+		return
+	} else if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	msgs := append([]*Message{root}, replies...)
+	if err := r.msgSvc.LoadReactions(c.Request.Context(), channelID, msgs); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if err := r.msgSvc.LoadReplyCounts(c.Request.Context(), channelID, msgs[:1]); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	repliesPresenter := []MessagePresenter{}
+	for _, reply := range replies {
+		repliesPresenter = append(repliesPresenter, *reply.ToPresenter())
+	}
+	c.JSON(http.StatusOK, &ThreadPresenter{
+		Root:    *root.ToPresenter(),
+		Replies: repliesPresenter,
+	})
+}
+
+// pageLimit parses the optional limit query param, falling back to the default page size.
+// It responds with 400 and returns false when the limit is out of range
+func (r *HttpServer) pageLimit(c *gin.Context) (int, bool) {
+	v := c.Query("limit")
+	if v == "" {
+		return r.defaultPageSize, true
+	}
+	limit, err := strconv.Atoi(v)
+	if err != nil || limit < 1 || limit > r.maxPageSize {
+		response(c, http.StatusBadRequest, ErrInvalidPageLimit)
+		return 0, false
+	}
+	return limit, true
+}
+
+// isSeenBy reports whether a message is seen from the point of view of the viewer.
+// Message ids are snowflakes, so a read cursor covers every earlier message
+func isSeenBy(msg *Message, viewerID uint64, receipts map[uint64]uint64) bool {
+	if msg.UserID != viewerID {
+		return receipts[viewerID] >= msg.MessageID
+	}
+	for userID, lastSeenID := range receipts {
+		if userID != viewerID && lastSeenID >= msg.MessageID {
+			return true
+		}
+	}
+	return false
+}
+
+// @Summary Get channel info
+// @Description Get what a client needs to render the header of a channel: its name, when and by whom it was created, and how many users it has and how many of them are online. The creator is the user the channel was created for, or else the first user that joined it
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Success 200 {object} ChannelInfoPresenter
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/info [get]
+func (r *HttpServer) GetChannelInfo(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	info, err := r.chanSvc.GetChannelInfo(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, info.ToPresenter())
+}
+
+// @Summary Get channel
+// @Description Get the metadata of a channel, including the number of messages it holds and, for ephemeral channels, when it expires
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Success 200 {object} ChannelPresenter
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel [get]
+func (r *HttpServer) GetChannel(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	count, err := r.msgSvc.CountMessages(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	archived, err := r.chanSvc.IsChannelArchived(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	expiresAt, err := r.chanSvc.GetChannelExpiry(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	softArchived, err := r.chanSvc.IsChannelSoftArchived(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	messageTTL, err := r.msgSvc.GetChannelMessageTTL(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	channelPresenter := &ChannelPresenter{
+		ChannelID:         strconv.FormatUint(channelID, 10),
+		MessageCount:      count,
+		Archived:          archived,
+		SoftArchived:      softArchived,
+		MessageTTLSeconds: int64(messageTTL / time.Second),
+	}
+	if !expiresAt.IsZero() {
+		channelPresenter.ExpiresAt = expiresAt.UnixMilli()
+	}
+	c.JSON(http.StatusOK, channelPresenter)
+}
+
+// @Summary Get unread message count
+// @Description Count the messages of other users after the given message. Without since, counting starts after the read cursor of the user. If since has been trimmed or deleted, counting starts from the earliest retained message
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param uid query string true "user id"
+// @Param since query string false "message id"
+// @Success 200 {object} UnreadPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/unread [get]
+func (r *HttpServer) GetUnreadCount(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	userID, ok := r.channelUserID(c)
+	if !ok {
+		return
+	}
+	var since uint64
+	if v := c.Query("since"); v != "" {
+		var err error
+		if since, err = strconv.ParseUint(v, 10, 64); err != nil {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return
+		}
+	} else {
+		receipts, err := r.userSvc.GetReadReceipts(c.Request.Context(), channelID, userID)
+		if err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return
+		}
+		since = receipts[userID]
+	}
+	unread, err := r.msgSvc.CountUnreadMessages(c.Request.Context(), channelID, userID, since)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, &UnreadPresenter{
+		Since:  strconv.FormatUint(since, 10),
+		Unread: unread,
+	})
+}
+
+// @Summary Get message read receipts
+// @Description Get the id of the last message seen by each user of the channel who shares read receipts. The user's own read cursor is always included
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param uid query string false "user id"
+// @Success 200 {object} MessageReceiptsPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/messages/receipts [get]
+func (r *HttpServer) GetMessageReceipts(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	var viewerID uint64
+	if c.Query("uid") != "" {
+		if viewerID, ok = r.channelUserID(c); !ok {
+			return
+		}
+	}
+	receipts, err := r.userSvc.GetReadReceipts(c.Request.Context(), channelID, viewerID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	receiptsPresenter := make(map[string]string, len(receipts))
+	for userID, messageID := range receipts {
+		receiptsPresenter[strconv.FormatUint(userID, 10)] = strconv.FormatUint(messageID, 10)
+	}
+	c.JSON(http.StatusOK, &MessageReceiptsPresenter{
+		Receipts: receiptsPresenter,
+	})
+}
+
+// @Summary Search channel messages
+// @Description Search text messages of a channel by case-insensitive substring, newest first. At most the configured number of results is returned, and only the configured number of most recent messages of the channel is scanned
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param q query string true "text to search for"
+// @Param from query int false "earliest message time in unix milliseconds"
+// @Param to query int false "latest message time in unix milliseconds"
+// @Success 200 {object} MessagesPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/messages/search [get]
+func (r *HttpServer) SearchMessages(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	var req SearchMessagesRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if req.From < 0 || req.To < 0 || (req.To > 0 && req.From > req.To) {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	msgs, err := r.msgSvc.SearchMessages(c.Request.Context(), channelID, req.Query, req.From, req.To, r.searchMaxResults, r.searchMaxScanned)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	msgsPresenter := []MessagePresenter{}
+	for _, msg := range msgs {
+		msgsPresenter = append(msgsPresenter, *msg.ToPresenter())
+	}
+	c.JSON(http.StatusOK, &MessagesPresenter{
+		Messages: msgsPresenter,
+	})
+}
+
+// @Summary Export channel messages
+// @Description Download the message history of a channel as a json array or a csv file, newest first. Deleted messages are left out, and so are direct messages unless the admin sent or received them. Only channel admins can export, authenticated by a channel token bound to them. The export is streamed, so a failure after it has started truncates the file
+// @Tags chat
+// @Produce json
+// @Produce text/csv
+// @param Authorization header string true "channel authorization"
+// @Param format query string false "json or csv, json by default"
+// @Param from query int false "earliest message time in unix milliseconds"
+// @Param to query int false "latest message time in unix milliseconds"
+// @Success 200 {array} ExportMessagePresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 403 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/messages/export [get]
+func (r *HttpServer) ExportMessages(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	userID, ok := r.adminUserID(c)
+	if !ok {
+		return
+	}
+	var req ExportMessagesRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if req.From < 0 || req.To < 0 || (req.To > 0 && req.From > req.To) {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	exporter, ok := newMessageExporter(req.Format, c.Writer)
+	if !ok {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if req.Format == "" {
+		req.Format = exportFormatJSON
+	}
+	// the response is committed once the first page is written, after which errors can
+	// only cut the stream short
+	started := false
+	start := func() {
+		c.Header("Content-Type", exporter.ContentType())
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="channel-%d-messages.%s"`, channelID, req.Format))
+		c.Status(http.StatusOK)
+		started = true
+	}
+	err := r.msgSvc.ExportMessages(c.Request.Context(), channelID, userID, req.From, req.To, func(msgs []*Message) error {
+		if !started {
+			start()
+		}
+		if err := exporter.Write(msgs); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+	if err != nil {
+		if started {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			c.Abort()
+			return
+		}
+		if errors.Is(err, ErrExportNotAllowed) {
+			response(c, http.StatusForbidden, err)
+			return
+		}
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !started {
+		start()
+	}
+	if err := exporter.Close(); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+	}
+}
+
+// @Summary Delete channel
+// @Description Delete a channel along with its members, messages and uploaded files, and return what was removed; when admin-only channel deletion is enabled, only channel admins can delete it. With dry_run, nothing is deleted and the response reports what would be removed. With soft, the channel is archived instead: it becomes read-only and hidden from channel lists, but its message history can still be read
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param delby query string true "id of the user that performs the deletion"
+// @Param soft query bool false "soft-archive the channel instead of deleting it"
+// @Param dry_run query bool false "report what would be deleted without deleting; cannot be combined with soft"
+// @Success 200 {object} ChannelDeletionPresenter
+// @Success 204 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 403 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel [delete]
+func (r *HttpServer) DeleteChannel(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	soft := false
+	if s := c.Query("soft"); s != "" {
+		var err error
+		if soft, err = strconv.ParseBool(s); err != nil {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return
+		}
+	}
+	dryRun := false
+	if s := c.Query("dry_run"); s != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(s); err != nil || (dryRun && soft) {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return
+		}
+	}
+	userID, ok := r.authorizeChannelDeletion(c, channelID, c.Query("delby"))
+	if !ok {
+		return
+	}
+
+	if dryRun {
+		deletion, err := r.chanSvc.PreviewChannelDeletion(c.Request.Context(), channelID)
+		if err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return
+		}
+		c.JSON(http.StatusOK, deletion.ToPresenter(true))
+		return
+	}
+
+	if soft {
+		// the history outlives a soft deletion, so it records who left
+		if r.joinLeaveMessages {
+			if _, err := r.msgSvc.BroadcastSystemMessage(c.Request.Context(), channelID, userID, ChannelLeftMessage); err != nil {
+				r.logger.ErrorContext(c.Request.Context(), err.Error())
+			}
+		}
+		if err := r.chanSvc.SoftArchiveChannel(c.Request.Context(), channelID); err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return
+		}
+		// the others keep the channel until it is deleted, but not the user who left it
+		if err := r.userSvc.RemoveUserChannel(c.Request.Context(), channelID, userID); err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+		}
+		if err := r.msgSvc.BroadcastActionMessage(c.Request.Context(), channelID, userID, ArchivedMessage); err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+		}
+		c.JSON(http.StatusNoContent, common.SuccessMessage{
+			Message: "ok",
+		})
+		return
+	}
+	err := r.msgSvc.BroadcastActionMessage(c.Request.Context(), channelID, userID, LeavedMessage)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	deletion, err := r.chanSvc.DeleteChannel(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, deletion.ToPresenter(false))
+}
+
+// @Summary Unarchive channel
+// @Description Make a soft-archived channel writable and listed again; when admin-only channel deletion is enabled, only channel admins can unarchive it
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param uid query string true "user id"
+// @Success 200 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 403 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/unarchive [post]
+func (r *HttpServer) UnarchiveChannel(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	userID, ok := r.authorizeChannelDeletion(c, channelID, c.Query("uid"))
+	if !ok {
+		return
+	}
+	if err := r.chanSvc.UnarchiveChannel(c.Request.Context(), channelID); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if err := r.msgSvc.BroadcastActionMessage(c.Request.Context(), channelID, userID, UnarchivedMessage); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+	}
+	c.JSON(http.StatusOK, common.OkMsg)
+}
+
+// authorizeChannelDeletion checks that the user given by uid can delete or archive the
+// channel, writing the error response otherwise. When deletion is admin-only, the user
+// also has to be the one the channel token is bound to
+func (r *HttpServer) authorizeChannelDeletion(c *gin.Context, channelID uint64, uid string) (uint64, bool) {
+	userID, err := strconv.ParseUint(uid, 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return 0, false
+	}
+	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, userID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return 0, false
+	}
+	if !exist {
+		response(c, http.StatusBadRequest, ErrChannelOrUserNotFound)
+		return 0, false
+	}
+	if r.adminOnlyDeletion {
+		if userID != tokenUserID(c) {
+			response(c, http.StatusUnauthorized, ErrUserTokenRequired)
+			return 0, false
+		}
+		role, err := r.userSvc.GetUserRole(c.Request.Context(), channelID, userID)
+		if err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return 0, false
+		}
+		if role != RoleAdmin {
+			response(c, http.StatusForbidden, ErrChannelDeleteNotAllowed)
+			return 0, false
+		}
+	}
+	return userID, true
+}
+
+// @Summary Get sticker pack
+// @Description Get the sticker pack of a channel; channels without a custom pack get the default stickers
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Success 200 {object} StickerPackPresenter
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/stickers [get]
+func (r *HttpServer) GetStickerPack(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	stickers, isDefault, err := r.chanSvc.GetStickerPack(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	stickersPresenter := []StickerPresenter{}
+	for _, sticker := range stickers {
+		stickersPresenter = append(stickersPresenter, StickerPresenter{
+			Name:      sticker.Name,
+			ObjectKey: sticker.ObjectKey,
+		})
+	}
+	c.JSON(http.StatusOK, &StickerPackPresenter{
+		Stickers: stickersPresenter,
+		Default:  isDefault,
+	})
+}
+
+const maxStickerNameLen = 32
+
+// @Summary Set sticker pack
+// @Description Replace the sticker pack of a channel with stickers referencing uploaded images; an empty pack restores the default stickers
+// @Tags chat
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param uid query string true "id of the user that updates the pack"
+// @Param pack body StickerPackPresenter true "sticker pack"
+// @Success 200 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/stickers [put]
+func (r *HttpServer) SetStickerPack(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	userID, err := strconv.ParseUint(c.Query("uid"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	var pack StickerPackPresenter
+	if err := c.ShouldBindJSON(&pack); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if len(pack.Stickers) > r.maxStickerPackSize {
+		response(c, http.StatusBadRequest, ErrStickerPackTooLarge)
+		return
+	}
+	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, userID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !exist {
+		response(c, http.StatusBadRequest, ErrChannelOrUserNotFound)
+		return
+	}
+
+	// stickers must reference images uploaded to this channel
+	objectKeyPrefix := strconv.FormatUint(channelID, 10) + "/"
+	names := make(map[string]struct{})
+	var stickers []Sticker
+	for _, sticker := range pack.Stickers {
+		_, duplicated := names[sticker.Name]
+		if sticker.Name == "" || utf8.RuneCountInString(sticker.Name) > maxStickerNameLen || duplicated ||
+			!strings.HasPrefix(sticker.ObjectKey, objectKeyPrefix) || len(sticker.ObjectKey) == len(objectKeyPrefix) {
+			response(c, http.StatusBadRequest, ErrInvalidSticker)
+			return
+		}
+		if _, err := sanitizeTextPayload(sticker.Name, ControlCharPolicyReject); err != nil {
+			response(c, http.StatusBadRequest, ErrInvalidSticker)
+			return
+		}
+		names[sticker.Name] = struct{}{}
+		stickers = append(stickers, Sticker{
+			Name:      sticker.Name,
+			ObjectKey: sticker.ObjectKey,
+		})
+	}
+	if err := r.chanSvc.SetStickerPack(c.Request.Context(), channelID, stickers); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if err := r.msgSvc.BroadcastActionMessage(c.Request.Context(), channelID, userID, StickerPackUpdatedMessage); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, common.OkMsg)
+}
+
+// @Summary Schedule message
+// @Description Schedule a text message to be broadcast to the channel at a future time. The message is moderated when it is scheduled and again when it is delivered
+// @Tags chat
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param uid query string true "id of the sender"
+// @Param message body ScheduledMessagePresenter true "scheduled message"
+// @Success 201 {object} ScheduledMessagePresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 403 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Failure 503 {object} common.ErrResponse
+// @Router /chat/channel/messages/scheduled [post]
+func (r *HttpServer) ScheduleMessage(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	userID, err := strconv.ParseUint(c.Query("uid"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	var scheduled ScheduledMessagePresenter
+	if err := c.ShouldBindJSON(&scheduled); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	now := time.Now()
+	sendAt := time.UnixMilli(scheduled.SendAt)
+	if !sendAt.After(now) || sendAt.Sub(now) > r.scheduleHorizon {
+		response(c, http.StatusBadRequest, ErrInvalidSendTime)
+		return
+	}
+	payload, err := sanitizeTextPayload(scheduled.Payload, r.controlCharPolicy)
+	if err != nil {
+		response(c, http.StatusBadRequest, err)
+		return
+	}
+	exist, err := r.userSvc.IsChannelUserExist(c.Request.Context(), channelID, userID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !exist {
+		response(c, http.StatusBadRequest, ErrChannelOrUserNotFound)
+		return
+	}
+	allowed, _, err := r.moderator.Moderate(c.Request.Context(), payload)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		if !r.moderationFailOpen {
+			response(c, http.StatusServiceUnavailable, ErrModerationUnavailable)
+			return
+		}
+	} else if !allowed {
+		moderatedMessagesTotal.Inc()
+		response(c, http.StatusForbidden, ErrMessageModerated)
+		return
+	}
+	msg, err := r.msgSvc.ScheduleTextMessage(c.Request.Context(), channelID, userID, payload, sendAt)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusCreated, msg.ToPresenter())
+}
+
+// @Summary Cancel scheduled message
+// @Description Cancel a scheduled message of the user before it is delivered
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param id path string true "scheduled message id"
+// @Param uid query string true "id of the sender"
+// @Success 200 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/messages/scheduled/{id} [delete]
+func (r *HttpServer) CancelScheduledMessage(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	userID, err := strconv.ParseUint(c.Query("uid"), 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if err := r.msgSvc.CancelScheduledMessage(c.Request.Context(), channelID, userID, id); err != nil {
+		if errors.Is(err, ErrScheduledMsgNotFound) {
+			response(c, http.StatusNotFound, err)
+			return
+		}
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, common.OkMsg)
+}
+
+// @Summary Set message ttl
+// @Description Set the default ttl of messages sent to the channel without a ttl_seconds of their own; messages are deleted and replaced with tombstones once it elapses. Only channel admins can set it, and 0 turns it off. The admin is authenticated by a channel token bound to them
+// @Tags chat
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param ttl body MessageTTLRequest true "message ttl"
+// @Success 200 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 403 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/message-ttl [put]
+func (r *HttpServer) SetChannelMessageTTL(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	userID, ok := r.adminUserID(c)
+	if !ok {
+		return
+	}
+	var req MessageTTLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	ttl := time.Duration(req.TTLSeconds) * time.Second
+	if r.maxMessageTTL > 0 && ttl > r.maxMessageTTL {
+		response(c, http.StatusBadRequest, ErrInvalidMessageTTL)
+		return
+	}
+	if err := r.msgSvc.SetChannelMessageTTL(c.Request.Context(), channelID, userID, ttl); err != nil {
+		if errors.Is(err, ErrMessageTTLNotAllowed) {
+			response(c, http.StatusForbidden, err)
+			return
+		}
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, common.OkMsg)
+}
+
+// @Summary Bulk delete messages
+// @Description Replace messages of the channel with tombstones and broadcast their ids in a single bulk delete event. Only channel admins can bulk delete. Every message gets a status of deleted, not_found or failed; messages that were already deleted are reported as deleted. The admin is authenticated by a channel token bound to them
+// @Tags chat
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param messages body BulkDeleteRequest true "ids of the messages to delete"
+// @Success 200 {object} BulkDeletePresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 403 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/messages/bulk-delete [post]
+func (r *HttpServer) BulkDeleteMessages(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	userID, ok := r.adminUserID(c)
+	if !ok {
+		return
+	}
+	var req BulkDeleteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if r.maxBulkDelete > 0 && len(req.MessageIDs) > r.maxBulkDelete {
+		response(c, http.StatusBadRequest, ErrBulkDeleteTooLarge)
+		return
+	}
+	messageIDs := make([]uint64, len(req.MessageIDs))
+	for i, id := range req.MessageIDs {
+		messageID, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			response(c, http.StatusBadRequest, common.ErrInvalidParam)
+			return
+		}
+		messageIDs[i] = messageID
+	}
+	results, err := r.msgSvc.BulkDeleteMessages(c.Request.Context(), channelID, userID, messageIDs)
+	if err != nil {
+		if errors.Is(err, ErrBulkDeleteNotAllowed) {
+			response(c, http.StatusForbidden, err)
+			return
+		}
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	resultsPresenter := make([]BulkDeleteResultPresenter, len(results))
+	for i, result := range results {
+		if result.Err != nil {
+			r.logger.ErrorContext(c.Request.Context(), result.Err.Error())
+		}
+		resultsPresenter[i] = BulkDeleteResultPresenter{
+			MessageID: strconv.FormatUint(result.MessageID, 10),
+			Status:    string(result.Status),
+		}
+	}
+	c.JSON(http.StatusOK, &BulkDeletePresenter{
+		Results: resultsPresenter,
+	})
+}
+
+// @Summary Pin message
+// @Description Pin a message of the channel and broadcast the pin to connected users. Only channel admins can pin messages, authenticated by a channel token bound to them
+// @Tags chat
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param pin body PinRequest true "message to pin"
+// @Success 200 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 403 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/pin [post]
+func (r *HttpServer) PinMessage(c *gin.Context) {
+	channelID, userID, messageID, ok := r.bindPinRequest(c)
+	if !ok {
+		return
+	}
+	if err := r.msgSvc.PinMessage(c.Request.Context(), channelID, userID, messageID, r.maxPinned); err != nil {
+		switch {
+		case errors.Is(err, ErrExceedPinLimit), errors.Is(err, ErrPinDirectMessage):
+			response(c, http.StatusBadRequest, err)
+		case errors.Is(err, ErrPinNotAllowed):
+			response(c, http.StatusForbidden, err)
+		case errors.Is(err, ErrMessageNotFound):
+			response(c, http.StatusNotFound, err)
+		default:
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, common.OkMsg)
+}
+
+// @Summary Unpin message
+// @Description Unpin a message of the channel and broadcast the unpin to connected users. Only channel admins can unpin messages, authenticated by a channel token bound to them
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param message_id query string true "message id"
+// @Success 200 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 403 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/pin [delete]
+func (r *HttpServer) UnpinMessage(c *gin.Context) {
+	channelID, userID, messageID, ok := r.bindPinRequest(c)
+	if !ok {
+		return
+	}
+	if err := r.msgSvc.UnpinMessage(c.Request.Context(), channelID, userID, messageID); err != nil {
+		if errors.Is(err, ErrPinNotAllowed) {
+			response(c, http.StatusForbidden, err)
+			return
+		}
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, common.OkMsg)
+}
+
+// bindPinRequest returns the channel, the user and the message of a pin request,
+// writing an error response if any of them is invalid
+func (r *HttpServer) bindPinRequest(c *gin.Context) (uint64, uint64, uint64, bool) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return 0, 0, 0, false
+	}
+	userID, ok := r.adminUserID(c)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	var req PinRequest
+	if err := c.ShouldBind(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return 0, 0, 0, false
+	}
+	messageID, err := strconv.ParseUint(req.MessageID, 10, 64)
+	if err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return 0, 0, 0, false
+	}
+	return channelID, userID, messageID, true
+}
+
+// @Summary List pinned messages
+// @Description List the pinned messages of a channel, most recently pinned first
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Success 200 {array} MessagePresenter
+// @Failure 401 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /chat/channel/pins [get]
+func (r *HttpServer) ListPinnedMessages(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	msgs, err := r.msgSvc.ListPinnedMessages(c.Request.Context(), channelID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	msgsPresenter := []MessagePresenter{}
+	for _, msg := range msgs {
+		msgsPresenter = append(msgsPresenter, *msg.ToPresenter())
+	}
+	c.JSON(http.StatusOK, msgsPresenter)
+}
+
+// @Summary List websocket connections
+// @Description List the websocket connections of this instance with their connection metadata, oldest first. Only served when chat.http.server.debug is enabled, to requests bearing chat.http.server.debugToken
+// @Tags chat
+// @Produce json
+// @param Authorization header string true "Bearer <debug token>"
+// @Success 200 {object} ConnectionsPresenter
+// @Failure 401 {object} common.ErrResponse
+// @Router /chat/debug/connections [get]
+func (r *HttpServer) ListConnections(c *gin.Context) {
+	conns := r.conns.List()
+	connsPresenter := make([]ConnectionPresenter, 0, len(conns))
+	for _, conn := range conns {
+		connsPresenter = append(connsPresenter, ConnectionPresenter{
+			ChannelID:   strconv.FormatUint(conn.ChannelID, 10),
+			UserID:      strconv.FormatUint(conn.UserID, 10),
+			ReadOnly:    conn.ReadOnly,
+			ConnectedAt: conn.ConnectedAt.UnixMilli(),
+			Metadata:    conn.Metadata,
+		})
+	}
+	c.JSON(http.StatusOK, &ConnectionsPresenter{
+		Connections: connsPresenter,
+	})
+}
+
+const maxMetadataValueLen = 128
+
+// captureMetadata collects the allow-listed headers and query params of the upgrade request
+func (r *HttpServer) captureMetadata(c *gin.Context) map[string]string {
+	metadata := make(map[string]string)
+	for _, header := range r.metadataHeaders {
+		if v := c.GetHeader(header); v != "" {
+			metadata[header] = truncate(v, maxMetadataValueLen)
+		}
+	}
+	for _, param := range r.metadataParams {
+		if v := c.Query(param); v != "" {
+			metadata[param] = truncate(v, maxMetadataValueLen)
+		}
+	}
+	return metadata
+}
+
+// sessionMetadata returns the connection metadata captured at connect time
+func sessionMetadata(sess *melody.Session) map[string]string {
+	metadata, exist := sess.Get(sessMetadataKey)
+	if !exist {
+		return nil
+	}
+	return metadata.(map[string]string)
+}
+
+// sessionLogger returns a logger annotated with the connection metadata
+func (r *HttpServer) sessionLogger(sess *melody.Session) *slog.Logger {
+	// the session keeps the upgrade request, so its logs carry the id of that request
+	logger := r.logger.With(slog.String("request_id", common.RequestID(sess.Request.Context())))
+	metadata := sessionMetadata(sess)
+	if len(metadata) == 0 {
+		return logger
+	}
+	attrs := make([]any, 0, len(metadata))
+	for k, v := range metadata {
+		attrs = append(attrs, slog.String(k, v))
+	}
+	return logger.With(slog.Group("metadata", attrs...))
+}
+
+func (r *HttpServer) HandleChatOnConnect(sess *melody.Session) {
+	// live messages are held until everything replayed below is sent
+	defer releaseReplay(sess)
+	sess.Set(sessPongKey, time.Now())
+	logger := r.sessionLogger(sess)
+	userID, err := strconv.ParseUint(sess.Request.URL.Query().Get("uid"), 10, 64)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	accessToken := sess.Request.URL.Query().Get("access_token")
+	authResult, err := common.Auth(&common.AuthPayload{
+		AccessToken: accessToken,
+	})
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if authResult.Expired {
+		logger.Error(common.ErrTokenExpired.Error())
+		return
 	}
 	channelID := authResult.ChannelID
-	err = r.initializeChatSession(sess, channelID, userID)
+	r.conns.Add(sess, connection{
+		ChannelID:   channelID,
+		UserID:      userID,
+		ReadOnly:    isReadOnlySession(sess),
+		ConnectedAt: time.Now(),
+		Metadata:    sessionMetadata(sess),
+	})
+	if auth, ok := sess.Get(sessAuthKey); ok {
+		auth.(*sessionAuth).Renew(accessToken, r.authDeadline(authResult.ExpiresAt), func() { r.expireSession(sess) })
+	}
+	if isReadOnlySession(sess) {
+		r.watchChannel(sess, channelID, userID)
+		return
+	}
+	// the block list must be in place before the session starts receiving broadcasts
+	if err := r.loadBlockList(sess, userID); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	online, err := r.initializeChatSession(sess, channelID, userID)
 	if err != nil {
-		r.logger.Error(err.Error())
+		logger.Error(err.Error())
+		return
+	}
+	logger.Info("websocket connected", slog.Uint64("channel_id", channelID), slog.Uint64("user_id", userID))
+	if online {
+		if err := r.msgSvc.BroadcastPresenceMessage(context.Background(), channelID, userID, PresenceOnline); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	if err := r.userSvc.TouchPresence(context.Background(), userID); err != nil {
+		logger.Error(err.Error())
+	}
+	if err := r.msgSvc.BroadcastConnectMessage(context.Background(), channelID, userID); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if state, ok := sess.Get(sessResumeKey); ok {
+		if err := r.replayMissed(sess, state.(*resumeState)); err != nil {
+			logger.Error(err.Error())
+		}
+		if err := r.sendResumeToken(sess, state.(*resumeState)); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	if sess.Request.URL.Query().Get("snapshot") == "true" {
+		if err := r.sendSnapshot(sess, channelID); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	if r.outboxEnabled {
+		if err := r.redeliverOutbox(sess, channelID, userID); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	if r.pendingEnabled {
+		if err := r.redeliverPending(sess, channelID, userID); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+	if err := r.sendTombstones(sess, channelID, userID); err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// replayMissed sends the messages the client missed since the resume token it reconnected
+// with. A rejected token, or one too far behind, is nacked so that the client falls back
+// to fetching the history
+func (r *HttpServer) replayMissed(sess *melody.Session, state *resumeState) error {
+	if state.resumeErr != nil {
+		r.nack(sess, state.resumeErr)
+		return nil
+	}
+	if state.resumeFrom == 0 {
+		return nil
+	}
+	msgs, err := r.msgSvc.ListMissedMessages(context.Background(), state.channelID, state.resumeFrom, r.resumeMaxReplay)
+	if errors.Is(err, ErrResumeGapTooLarge) {
+		r.nack(sess, err)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if !hiddenFrom(sess, msg) {
+			if err := sess.Write(msg.ToPresenter().Encode()); err != nil {
+				return err
+			}
+			markReplayed(sess, msg.MessageID)
+		}
+		state.Advance(msg.MessageID)
+	}
+	return nil
+}
+
+// sendResumeToken sends the initial resume token, positioned at the latest message of the channel
+func (r *HttpServer) sendResumeToken(sess *melody.Session, state *resumeState) error {
+	latestMessageID, err := r.msgSvc.GetLatestMessageID(context.Background(), state.channelID)
+	if err != nil {
+		return err
+	}
+	state.Advance(latestMessageID)
+	frame, err := state.TokenFrame(r.resumeIdleWindow)
+	if err != nil {
+		return err
+	}
+	return sess.Write(frame)
+}
+
+// redeliverOutbox sends guaranteed messages the user has not acked yet. Messages stay in the
+// outbox until the client replies with a delivery ack event carrying the message id
+func (r *HttpServer) redeliverOutbox(sess *melody.Session, channelID, userID uint64) error {
+	msgs, err := r.msgSvc.GetOutboxMessages(context.Background(), channelID, userID)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if hiddenFrom(sess, msg) {
+			continue
+		}
+		if err := sess.Write(msg.ToPresenter().Encode()); err != nil {
+			return err
+		}
+		markReplayed(sess, msg.MessageID)
+	}
+	return nil
+}
+
+// redeliverPending sends the messages that could not be written to a previous connection of
+// the user. They are delivered again on every connect until acked with a delivery ack event
+func (r *HttpServer) redeliverPending(sess *melody.Session, channelID, userID uint64) error {
+	msgs, err := r.msgSvc.GetPendingMessages(context.Background(), channelID, userID)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		if hiddenFrom(sess, msg) {
+			continue
+		}
+		if err := sess.Write(msg.ToPresenter().Encode()); err != nil {
+			return err
+		}
+		markReplayed(sess, msg.MessageID)
+	}
+	return nil
+}
+
+// sendTombstones sends the tombstones of the disappearing messages that expired while the
+// user was offline, so that the client deletes its local copies of them
+func (r *HttpServer) sendTombstones(sess *melody.Session, channelID, userID uint64) error {
+	tombstones, err := r.msgSvc.GetTombstones(context.Background(), channelID, userID)
+	if err != nil {
+		return err
+	}
+	// a tombstone is only dropped once written, so that the next connect gets it otherwise
+	for _, tombstone := range tombstones {
+		if err := sess.Write(tombstone.ToPresenter().Encode()); err != nil {
+			return err
+		}
+		if err := r.msgSvc.RemoveTombstone(context.Background(), channelID, userID, tombstone.MessageID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendSnapshot sends the current state of the channel to a newly connected session.
+// The payload of the snapshot event is a SnapshotPresenter encoded in json
+func (r *HttpServer) sendSnapshot(sess *melody.Session, channelID uint64) error {
+	snapshot, err := r.userSvc.GetSnapshot(context.Background(), channelID)
+	if err != nil {
+		return err
+	}
+	if snapshot.Channel, err = r.chanSvc.GetChannelInfo(context.Background(), channelID); err != nil {
+		return err
+	}
+	if blocks, ok := sess.Get(sessBlocksKey); ok {
+		snapshot.OnlineUserIDs = blocks.(*blockList).VisibleUsers(snapshot.OnlineUserIDs)
+		snapshot.TypingUserIDs = blocks.(*blockList).VisibleUsers(snapshot.TypingUserIDs)
+	}
+	msgPresenter := &MessagePresenter{
+		Event:   EventSnapshot,
+		Payload: string(snapshot.ToPresenter().Encode()),
+		Time:    time.Now().UnixMilli(),
+	}
+	return sess.Write(msgPresenter.Encode())
+}
+
+// loadBlockList attaches the block list of the user to the session
+func (r *HttpServer) loadBlockList(sess *melody.Session, userID uint64) error {
+	blocks, err := r.getBlockList(context.Background(), userID)
+	if err != nil {
+		return err
+	}
+	sess.Set(sessBlocksKey, blocks)
+	return nil
+}
+
+func (r *HttpServer) getBlockList(ctx context.Context, userID uint64) (*blockList, error) {
+	blocked, err := r.userSvc.GetBlockedUsers(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	var blockerIDs []uint64
+	if r.hideBlockedPresence {
+		if blockerIDs, err = r.userSvc.GetBlockerIDs(ctx, userID); err != nil {
+			return nil, err
+		}
+	}
+	return newBlockList(userID, blocked, blockerIDs, r.hideBlockedPresence), nil
+}
+
+// watchChannel registers a guest session in its channel. Guests only receive broadcasts,
+// so they are neither counted online nor announced to the channel
+func (r *HttpServer) watchChannel(sess *melody.Session, channelID, guestID uint64) {
+	logger := r.sessionLogger(sess)
+	sess.Set(sessCidKey, channelID)
+	sess.Set(sessTrafficKey, r.traffic.Open(channelID))
+	if err := r.forwardSvc.RegisterChannelSession(context.Background(), channelID, guestID, r.msgSubscriber.subscriberID); err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	logger.Info("guest websocket connected", slog.Uint64("channel_id", channelID), slog.Uint64("guest_id", guestID))
+	if sess.Request.URL.Query().Get("snapshot") == "true" {
+		if err := r.sendSnapshot(sess, channelID); err != nil {
+			logger.Error(err.Error())
+		}
+	}
+}
+
+// initializeChatSession registers the session in its channel and reports whether its user
+// came online with it
+func (r *HttpServer) initializeChatSession(sess *melody.Session, channelID, userID uint64) (bool, error) {
+	ctx := context.Background()
+	online, err := r.userSvc.AddOnlineUser(ctx, channelID, userID)
+	if err != nil {
+		return false, err
+	}
+	// the session is counted online, so it must be uncounted on close from here on
+	sess.Set(sessCidKey, channelID)
+	sess.Set(sessTrafficKey, r.traffic.Open(channelID))
+	if err := r.forwardSvc.RegisterChannelSession(ctx, channelID, userID, r.msgSubscriber.subscriberID); err != nil {
+		return false, err
+	}
+	return online, nil
+}
+
+// maxAttachmentFilenameBytes bounds the filename of attachments, the only attachment
+// field stored as sent by the client
+const maxAttachmentFilenameBytes = 255
+
+func (r *HttpServer) HandleChatOnMessage(sess *melody.Session, data []byte) {
+	logger := r.sessionLogger(sess)
+	observeTraffic(sess, directionIn, data)
+	// json decoding silently replaces invalid utf-8 with the replacement character,
+	// so the raw frame has to be validated beforehand
+	if !utf8.Valid(data) {
+		r.nack(sess, ErrInvalidPayloadEncoding)
+		return
+	}
+	msgPresenter, err := DecodeToMessagePresenter(data)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if msgPresenter.Event == EventReauth {
+		r.reauth(sess, msgPresenter.AccessToken)
+		return
+	}
+	if isReadOnlySession(sess) {
+		r.nackMessage(sess, msgPresenter.ClientMsgID, ErrReadOnlySession)
+		return
+	}
+	sessUserID, err := strconv.ParseUint(sess.Request.URL.Query().Get("uid"), 10, 64)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	chunked := msgPresenter.Event == EventChunk
+	if chunked {
+		// every chunk counts against the rate limit, rather than the reassembled message
+		// only, so that a set that is never completed cannot be sent for free
+		if !r.allowMessage(sess, sessUserID, msgPresenter.ClientMsgID) {
+			return
+		}
+		if msgPresenter = r.assembleChunk(sess, msgPresenter); msgPresenter == nil {
+			return
+		}
+	}
+	msg, err := msgPresenter.ToMessage(sessionAccessToken(sess))
+	if errors.Is(err, ErrInvalidReplyTo) || errors.Is(err, ErrInvalidDirectRecipient) || errors.Is(err, ErrContentTypeMismatch) {
+		r.nackMessage(sess, msgPresenter.ClientMsgID, err)
+		return
+	} else if err != nil {
+		logger.Error(err.Error())
 		return
 	}
-	if err := r.msgSvc.BroadcastConnectMessage(context.Background(), channelID, userID); err != nil {
-		r.logger.Error(err.Error())
+	// joined, left and other notices are only generated by the server
+	if msg.ContentType() == ContentTypeSystem {
+		r.nackMessage(sess, msgPresenter.ClientMsgID, ErrSystemMessage)
 		return
 	}
-}
-
-func (r *HttpServer) initializeChatSession(sess *melody.Session, channelID, userID uint64) error {
-	ctx := context.Background()
-	if err := r.userSvc.AddOnlineUser(ctx, channelID, userID); err != nil {
-		return err
+	if r.maxPayloadBytes > 0 && len(msg.Payload) > r.maxPayloadBytes {
+		r.nackMessage(sess, msgPresenter.ClientMsgID, ErrMessageTooLarge)
+		return
 	}
-	if err := r.forwardSvc.RegisterChannelSession(ctx, channelID, userID, r.msgSubscriber.subscriberID); err != nil {
-		return err
+	if !chunked && !r.allowMessage(sess, sessUserID, msgPresenter.ClientMsgID) {
+		return
 	}
-	sess.Set(sessCidKey, channelID)
-	return nil
-}
-
-func (r *HttpServer) HandleChatOnMessage(sess *melody.Session, data []byte) {
-	msgPresenter, err := DecodeToMessagePresenter(data)
-	if err != nil {
-		r.logger.Error(err.Error())
+	if !r.allowSoloMessage(sess, msg) {
 		return
 	}
-	msg, err := msgPresenter.ToMessage(sess.Request.URL.Query().Get("access_token"))
-	if err != nil {
-		r.logger.Error(err.Error())
+	if msgPresenter.TTLSeconds < 0 || (r.maxMessageTTL > 0 && time.Duration(msgPresenter.TTLSeconds)*time.Second > r.maxMessageTTL) {
+		r.nackMessage(sess, msgPresenter.ClientMsgID, ErrInvalidMessageTTL)
 		return
 	}
+	ttl := time.Duration(msgPresenter.TTLSeconds) * time.Second
+	if changesChannel(msg.Event) {
+		softArchived, err := r.chanSvc.IsChannelSoftArchived(context.Background(), msg.ChannelID)
+		if err != nil {
+			logger.Error(err.Error())
+			r.nackMessage(sess, msgPresenter.ClientMsgID, ErrStoreMessage)
+			return
+		}
+		if softArchived {
+			r.nackMessage(sess, msgPresenter.ClientMsgID, ErrChannelReadOnly)
+			return
+		}
+	}
+	if err := r.userSvc.TouchPresence(context.Background(), sessUserID); err != nil {
+		logger.Error(err.Error())
+	}
 	switch msg.Event {
 	case EventText:
-		if err := r.msgSvc.BroadcastTextMessage(context.Background(), msg.ChannelID, msg.UserID, msg.Payload); err != nil {
-			r.logger.Error(err.Error())
+		payload, err := sanitizeTextPayload(msg.Payload, r.controlCharPolicy)
+		if err != nil {
+			r.nackMessage(sess, msgPresenter.ClientMsgID, err)
+			return
+		}
+		if !r.moderateMessage(sess, msgPresenter.ClientMsgID, payload) {
+			return
 		}
+		stored, err := r.msgSvc.BroadcastTextMessage(context.Background(), msg.ChannelID, msg.UserID, msg.ReplyTo, payload, msg.Guaranteed && r.outboxEnabled, ttl)
+		r.ackMessage(sess, msgPresenter.ClientMsgID, stored, err)
 	case EventAction:
-		if err := r.msgSvc.BroadcastActionMessage(context.Background(), msg.ChannelID, msg.UserID, Action(msg.Payload)); err != nil {
-			r.logger.Error(err.Error())
+		action := Action(msg.Payload)
+		if action == IsTypingMessage || action == EndTypingMessage {
+			if err := r.userSvc.SetTypingUser(context.Background(), msg.ChannelID, msg.UserID, action == IsTypingMessage); err != nil {
+				logger.Error(err.Error())
+			}
+		}
+		if err := r.msgSvc.BroadcastActionMessage(context.Background(), msg.ChannelID, msg.UserID, action); err != nil {
+			logger.Error(err.Error())
 		}
 	case EventSeen:
 		messageID, err := strconv.ParseUint(msg.Payload, 10, 64)
 		if err != nil {
-			r.logger.Error(err.Error())
+			logger.Error(err.Error())
 			return
 		}
 		if err := r.msgSvc.MarkMessageSeen(context.Background(), msg.ChannelID, msg.UserID, messageID); err != nil {
-			r.logger.Error(err.Error())
+			logger.Error(err.Error())
 		}
 	case EventFile:
-		if err := r.msgSvc.BroadcastFileMessage(context.Background(), msg.ChannelID, msg.UserID, msg.Payload); err != nil {
-			r.logger.Error(err.Error())
+		if !r.moderateMessage(sess, msgPresenter.ClientMsgID, msg.Payload) {
+			return
+		}
+		stored, err := r.msgSvc.BroadcastFileMessage(context.Background(), msg.ChannelID, msg.UserID, msg.ReplyTo, msg.Payload, msg.Guaranteed && r.outboxEnabled, ttl)
+		r.ackMessage(sess, msgPresenter.ClientMsgID, stored, err)
+	case EventAttachment:
+		attachment := msgPresenter.Attachment
+		if attachment == nil || attachment.Key == "" || attachment.Filename == "" || len(attachment.Filename) > maxAttachmentFilenameBytes {
+			r.nackMessage(sess, msgPresenter.ClientMsgID, ErrInvalidAttachment)
+			return
+		}
+		if !r.moderateMessage(sess, msgPresenter.ClientMsgID, attachment.Filename) {
+			return
+		}
+		stored, err := r.msgSvc.BroadcastAttachmentMessage(context.Background(), msg.ChannelID, msg.UserID, msg.ReplyTo, &Attachment{
+			Key:         attachment.Key,
+			ContentType: attachment.ContentType,
+			Size:        attachment.Size,
+			Filename:    attachment.Filename,
+		}, msg.Guaranteed && r.outboxEnabled, ttl)
+		if errors.Is(err, ErrAttachmentNotFound) || errors.Is(err, ErrAttachmentNotInChannel) {
+			r.nackMessage(sess, msgPresenter.ClientMsgID, err)
+			return
+		}
+		r.ackMessage(sess, msgPresenter.ClientMsgID, stored, err)
+	case EventDeliveryAck:
+		messageID, err := strconv.ParseUint(msg.Payload, 10, 64)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		if err := r.msgSvc.AckOutboxMessage(context.Background(), msg.ChannelID, sessUserID, messageID); err != nil {
+			logger.Error(err.Error())
+		}
+	case EventEdit:
+		messageID, err := strconv.ParseUint(msgPresenter.MessageID, 10, 64)
+		if err != nil {
+			r.nack(sess, ErrMessageNotFound)
+			return
+		}
+		payload, err := sanitizeTextPayload(msg.Payload, r.controlCharPolicy)
+		if err != nil {
+			r.nack(sess, err)
+			return
+		}
+		if !r.moderateMessage(sess, msgPresenter.ClientMsgID, payload) {
+			return
+		}
+		if err := r.msgSvc.EditTextMessage(context.Background(), msg.ChannelID, sessUserID, messageID, payload, r.editMaxAge); err != nil {
+			switch {
+			case errors.Is(err, ErrMessageNotFound), errors.Is(err, ErrNotMessageOwner),
+				errors.Is(err, ErrMessageNotEditable), errors.Is(err, ErrEditWindowExpired):
+				r.nack(sess, err)
+			default:
+				logger.Error(err.Error())
+			}
+		}
+	case EventDeleteMessage:
+		messageID, err := strconv.ParseUint(msgPresenter.MessageID, 10, 64)
+		if err != nil {
+			r.nack(sess, ErrMessageNotFound)
+			return
 		}
+		// only a uid verified by a user-bound token may delete the messages of others as admin
+		verified := sessionTokenUserID(sess) == sessUserID
+		if err := r.msgSvc.DeleteMessage(context.Background(), msg.ChannelID, sessUserID, messageID, verified); err != nil {
+			switch {
+			case errors.Is(err, ErrMessageNotFound), errors.Is(err, ErrDeleteNotAllowed):
+				r.nack(sess, err)
+			default:
+				logger.Error(err.Error())
+			}
+		}
+	case EventTyping:
+		r.handleTyping(sess, msg.ChannelID, sessUserID)
+	case EventStopTyping:
+		r.handleStopTyping(sess, msg.ChannelID, sessUserID)
+	case EventReaction:
+		messageID, err := strconv.ParseUint(msgPresenter.MessageID, 10, 64)
+		if err != nil {
+			r.nack(sess, ErrMessageNotFound)
+			return
+		}
+		if !r.isReactionAllowed(msgPresenter.Emoji) {
+			r.nack(sess, ErrReactionNotAllowed)
+			return
+		}
+		action := ReactionAction(msgPresenter.Action)
+		if action != ReactionAdd && action != ReactionRemove {
+			r.nack(sess, ErrInvalidReactionAction)
+			return
+		}
+		if err := r.msgSvc.ReactToMessage(context.Background(), msg.ChannelID, sessUserID, messageID, msgPresenter.Emoji, action); err != nil {
+			if errors.Is(err, ErrMessageNotFound) {
+				r.nack(sess, err)
+				return
+			}
+			logger.Error(err.Error())
+		}
+	case EventSticker:
+		allowed, err := r.chanSvc.IsStickerAllowed(context.Background(), msg.ChannelID, msg.Payload)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
+		if !allowed {
+			r.nackMessage(sess, msgPresenter.ClientMsgID, ErrStickerNotAllowed)
+			return
+		}
+		stored, err := r.msgSvc.BroadcastStickerMessage(context.Background(), msg.ChannelID, msg.UserID, msg.ReplyTo, msg.Payload, ttl)
+		r.ackMessage(sess, msgPresenter.ClientMsgID, stored, err)
+	case EventDirect:
+		payload, err := sanitizeTextPayload(msg.Payload, r.controlCharPolicy)
+		if err != nil {
+			r.nackMessage(sess, msgPresenter.ClientMsgID, err)
+			return
+		}
+		if !r.moderateMessage(sess, msgPresenter.ClientMsgID, payload) {
+			return
+		}
+		stored, err := r.msgSvc.BroadcastDirectMessage(context.Background(), msg.ChannelID, msg.UserID, msg.RecipientID, payload, ttl)
+		if errors.Is(err, ErrRecipientNotMember) {
+			r.nackMessage(sess, msgPresenter.ClientMsgID, err)
+			return
+		}
+		r.ackMessage(sess, msgPresenter.ClientMsgID, stored, err)
 	default:
-		r.logger.Error("invailid event type: " + strconv.Itoa(msg.Event))
+		r.handleUnknownEvent(sess, msg.Event)
 	}
 }
 
-func (r *HttpServer) HandleChatOnClose(sess *melody.Session, i int, s string) error {
-	userID, err := strconv.ParseUint(sess.Request.URL.Query().Get("uid"), 10, 64)
+// assembleChunk buffers a chunk of a text message, and returns the message once it is
+// complete or nil otherwise
+func (r *HttpServer) assembleChunk(sess *melody.Session, chunk *MessagePresenter) *MessagePresenter {
+	assembler, ok := sess.Get(sessChunksKey)
+	if !ok {
+		return nil
+	}
+	msgPresenter, err := assembler.(*chunkAssembler).Add(chunk, func(clientMsgID string) {
+		r.nackMessage(sess, clientMsgID, ErrChunksIncomplete)
+	})
+	if err != nil {
+		r.nackMessage(sess, chunk.ClientMsgID, err)
+		return nil
+	}
+	return msgPresenter
+}
+
+// handleTyping broadcasts that the user is typing at most once per throttle interval,
+// and broadcasts that the user stopped typing once no typing event arrives for the stop timeout
+func (r *HttpServer) handleTyping(sess *melody.Session, channelID, userID uint64) {
+	logger := r.sessionLogger(sess)
+	if timer, ok := sess.Get(sessTypingKey); ok {
+		timer.(*typingTimer).Touch(r.typingStopTimeout, func() {
+			if err := r.userSvc.SetTypingUser(context.Background(), channelID, userID, false); err != nil {
+				logger.Error(err.Error())
+			}
+			if err := r.msgSvc.BroadcastTypingMessage(context.Background(), channelID, userID, false); err != nil {
+				logger.Error(err.Error())
+			}
+		})
+	}
+	allowed, err := r.userSvc.AllowTypingBroadcast(context.Background(), channelID, userID, r.typingThrottle)
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	if !allowed {
+		return
+	}
+	if err := r.userSvc.SetTypingUser(context.Background(), channelID, userID, true); err != nil {
+		logger.Error(err.Error())
+	}
+	if err := r.msgSvc.BroadcastTypingMessage(context.Background(), channelID, userID, true); err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+// handleStopTyping ends the typing state of a user who stopped typing before the timeout,
+// e.g. by clearing the input. It is not throttled, and ignored if the user is not typing
+func (r *HttpServer) handleStopTyping(sess *melody.Session, channelID, userID uint64) {
+	timer, ok := sess.Get(sessTypingKey)
+	if !ok || !timer.(*typingTimer).Stop() {
+		return
+	}
+	logger := r.sessionLogger(sess)
+	if err := r.userSvc.SetTypingUser(context.Background(), channelID, userID, false); err != nil {
+		logger.Error(err.Error())
+	}
+	if err := r.msgSvc.BroadcastTypingMessage(context.Background(), channelID, userID, false); err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func (r *HttpServer) isReactionAllowed(emoji string) bool {
+	for _, allowed := range r.allowedReactions {
+		if emoji == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// maxUnknownEventLabel bounds the cardinality of the unknown events metric;
+// larger event types are counted as "other"
+const maxUnknownEventLabel = 63
+
+func (r *HttpServer) handleUnknownEvent(sess *melody.Session, event int) {
+	label := "other"
+	if event >= 0 && event <= maxUnknownEventLabel {
+		label = strconv.Itoa(event)
+	}
+	unknownEventsTotal.WithLabelValues(label).Inc()
+
+	if r.unknownEventPolicy == UnknownEventPolicyNack {
+		supported := make([]string, len(SupportedClientEvents))
+		for i, e := range SupportedClientEvents {
+			supported[i] = strconv.Itoa(e)
+		}
+		r.nack(sess, fmt.Errorf("%w %d; supported events: %s", ErrUnsupportedEvent, event, strings.Join(supported, ",")))
+		return
+	}
+	r.sessionLogger(sess).Warn("unknown event type", slog.Int("event", event))
+}
+
+// allowSoloMessage applies the solo policy to content messages sent while no other
+// user in the channel is online, e.g. after the partner has left a random chat
+func (r *HttpServer) allowSoloMessage(sess *melody.Session, msg *Message) bool {
+	if r.soloPolicy != SoloPolicyDrop && r.soloPolicy != SoloPolicyReject {
+		return true
+	}
+	if !isContentEvent(msg.Event) {
+		return true
+	}
+	alone, err := r.userSvc.IsAloneInChannel(context.Background(), msg.ChannelID, msg.UserID)
 	if err != nil {
 		r.logger.Error(err.Error())
-		return err
+		return true
 	}
-	accessToken := sess.Request.URL.Query().Get("access_token")
+	if !alone {
+		return true
+	}
+	if r.soloPolicy == SoloPolicyReject {
+		r.nack(sess, ErrNoRecipientOnline)
+	}
+	return false
+}
+
+// allowMessage applies per-user message rate limiting. Users who keep exceeding the
+// limit are disconnected and cannot reconnect until the cooldown elapses
+func (r *HttpServer) allowMessage(sess *melody.Session, userID uint64, clientMsgID string) bool {
+	ctx := context.Background()
+	allowed, err := r.msgRateLimiter.Allow(ctx, common.Join("chatmsg:", strconv.FormatUint(userID, 10)))
+	if err != nil {
+		r.logger.Error(err.Error())
+		return true
+	}
+	if allowed {
+		if limited, ok := sess.Get(sessLimitedKey); ok {
+			limited.(*atomic.Bool).Store(false)
+		}
+		return true
+	}
+	r.nackMessage(sess, clientMsgID, ErrMessageRateLimited)
+	r.notifyRateLimited(sess)
+
+	violations, err := r.userSvc.AddFloodViolation(ctx, userID, r.floodWindow)
+	if err != nil {
+		r.logger.Error(err.Error())
+		return false
+	}
+	if violations < r.floodMaxViolations {
+		return false
+	}
+	if err := r.userSvc.SetConnectionCooldown(ctx, userID, r.floodCooldown); err != nil {
+		r.logger.Error(err.Error())
+	}
+	floodDisconnectsTotal.Inc()
+	r.logger.Info("disconnect flooding user", slog.Uint64("user_id", userID), slog.Int64("violations", violations))
+	if err := sess.CloseWithMsg(melody.FormatCloseMessage(websocket.ClosePolicyViolation, "flood")); err != nil {
+		r.logger.Error(err.Error())
+	}
+	return false
+}
+
+// notifyRateLimited sends a rate limited event when a session starts being rate limited.
+// Further rejected messages are only nacked until a message gets through again, so that
+// a flooding client is not sent two frames for every message it floods
+func (r *HttpServer) notifyRateLimited(sess *melody.Session) {
+	if limited, ok := sess.Get(sessLimitedKey); ok && !limited.(*atomic.Bool).CompareAndSwap(false, true) {
+		return
+	}
+	msgPresenter := &MessagePresenter{
+		Event:      EventRateLimited,
+		Reason:     ErrMessageRateLimited.Error(),
+		ReasonCode: common.CodeRateLimited,
+		Time:       time.Now().UnixMilli(),
+	}
+	if err := sess.Write(msgPresenter.Encode()); err != nil {
+		r.logger.Error(err.Error())
+	}
+}
+
+// moderateMessage checks a payload with the moderator before it is stored, telling the
+// sender with a moderated event if it is rejected. If the moderator fails, the payload
+// is nacked unless moderation is configured to fail open
+func (r *HttpServer) moderateMessage(sess *melody.Session, clientMsgID, payload string) bool {
+	allowed, reason, err := r.moderator.Moderate(context.Background(), payload)
+	if err != nil {
+		r.sessionLogger(sess).Error(err.Error())
+		if r.moderationFailOpen {
+			return true
+		}
+		r.nackMessage(sess, clientMsgID, ErrModerationUnavailable)
+		return false
+	}
+	if allowed {
+		return true
+	}
+	moderatedMessagesTotal.Inc()
+	if reason == "" {
+		reason = ErrMessageModerated.Error()
+	}
+	msgPresenter := &MessagePresenter{
+		Event:       EventModerated,
+		Reason:      reason,
+		ReasonCode:  common.ErrorCodeOf(ErrMessageModerated, http.StatusForbidden, errorCodes),
+		ClientMsgID: clientMsgID,
+		Time:        time.Now().UnixMilli(),
+	}
+	if err := sess.Write(msgPresenter.Encode()); err != nil {
+		r.logger.Error(err.Error())
+	}
+	return false
+}
+
+// moderateScheduledMessage moderates a scheduled message again at delivery, since it may
+// have been scheduled under other moderation rules. A failed check returns an error so that
+// the message is retried, unless moderation fails open
+func (r *HttpServer) moderateScheduledMessage(ctx context.Context, payload string) (bool, error) {
+	allowed, _, err := r.moderator.Moderate(ctx, payload)
+	if err != nil {
+		if r.moderationFailOpen {
+			r.logger.Error(err.Error())
+			return true, nil
+		}
+		return false, err
+	}
+	if !allowed {
+		moderatedMessagesTotal.Inc()
+	}
+	return allowed, nil
+}
+
+// sessionAccessToken returns the access token the connection is currently authenticated with
+func sessionAccessToken(sess *melody.Session) string {
+	if auth, ok := sess.Get(sessAuthKey); ok {
+		return auth.(*sessionAuth).AccessToken()
+	}
+	return sess.Request.URL.Query().Get("access_token")
+}
+
+// authDeadline returns the time after which a connection authenticated with a token that
+// expires at expiresAt is closed, tolerating the configured clock skew
+func (r *HttpServer) authDeadline(expiresAt time.Time) time.Time {
+	if expiresAt.IsZero() {
+		return expiresAt
+	}
+	return expiresAt.Add(time.Duration(common.JwtLeewaySecond) * time.Second)
+}
+
+// expireSession closes a connection whose access token expired without a reauth
+func (r *HttpServer) expireSession(sess *melody.Session) {
+	r.sessionLogger(sess).Info("close websocket with expired access token")
+	if err := sess.CloseWithMsg(melody.FormatCloseMessage(websocket.ClosePolicyViolation, common.ErrTokenExpired.Error())); err != nil {
+		r.logger.Error(err.Error())
+	}
+}
+
+// reauth renews the access token of a connection. The new token has to belong to the
+// channel of the connection and, if it is bound to a user, to the user of the connection.
+// The connection is closed if the token is rejected; otherwise a reauth event carrying
+// the new expiry in unix milliseconds is sent back
+func (r *HttpServer) reauth(sess *melody.Session, accessToken string) {
+	logger := r.sessionLogger(sess)
 	authResult, err := common.Auth(&common.AuthPayload{
 		AccessToken: accessToken,
 	})
+	if err == nil && authResult.Expired {
+		err = common.ErrTokenExpired
+	}
+	if err == nil {
+		channelID, _ := sess.Get(sessCidKey)
+		userID, _ := strconv.ParseUint(sess.Request.URL.Query().Get("uid"), 10, 64)
+		// a connection keeps the scope it was opened with
+		if authResult.ChannelID != channelID || (authResult.UserID != 0 && authResult.UserID != userID) ||
+			authResult.ReadOnly() != isReadOnlySession(sess) {
+			err = ErrReauthMismatch
+		}
+	}
+	if err != nil {
+		logger.Info("close websocket with failed reauth", slog.String("reason", err.Error()))
+		if err := sess.CloseWithMsg(melody.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error())); err != nil {
+			r.logger.Error(err.Error())
+		}
+		return
+	}
+	if auth, ok := sess.Get(sessAuthKey); ok {
+		auth.(*sessionAuth).Renew(accessToken, r.authDeadline(authResult.ExpiresAt), func() { r.expireSession(sess) })
+	}
+	var expiresAt int64
+	if !authResult.ExpiresAt.IsZero() {
+		expiresAt = authResult.ExpiresAt.UnixMilli()
+	}
+	msgPresenter := &MessagePresenter{
+		Event:   EventReauth,
+		Payload: strconv.FormatInt(expiresAt, 10),
+		Time:    time.Now().UnixMilli(),
+	}
+	if err := sess.Write(msgPresenter.Encode()); err != nil {
+		logger.Error(err.Error())
+	}
+}
+
+func (r *HttpServer) nack(sess *melody.Session, reason error) {
+	r.nackMessage(sess, "", reason)
+}
+
+// nackMessage rejects a message sent by the session, echoing its client message id
+func (r *HttpServer) nackMessage(sess *melody.Session, clientMsgID string, reason error) {
+	msgPresenter := &MessagePresenter{
+		Event:       EventNack,
+		Reason:      reason.Error(),
+		ReasonCode:  common.ErrorCodeOf(reason, http.StatusBadRequest, errorCodes),
+		ClientMsgID: clientMsgID,
+	}
+	if err := sess.Write(msgPresenter.Encode()); err != nil {
+		r.logger.Error(err.Error())
+	}
+}
+
+// ackMessage confirms to the sender that its message is stored, with the id and time the
+// server assigned to it, or nacks the message if storing it failed. Senders that did
+// not supply a client message id get no ack, but are still nacked on failure
+func (r *HttpServer) ackMessage(sess *melody.Session, clientMsgID string, msg *Message, err error) {
+	if errors.Is(err, ErrReplyNotFound) {
+		r.nackMessage(sess, clientMsgID, err)
+		return
+	}
 	if err != nil {
+		r.sessionLogger(sess).Error(err.Error())
+		r.nackMessage(sess, clientMsgID, ErrStoreMessage)
+		return
+	}
+	if clientMsgID == "" {
+		return
+	}
+	msgPresenter := &MessagePresenter{
+		MessageID:   strconv.FormatUint(msg.MessageID, 10),
+		Event:       EventAck,
+		UserID:      strconv.FormatUint(msg.UserID, 10),
+		Time:        msg.Time,
+		ClientMsgID: clientMsgID,
+	}
+	if err := sess.Write(msgPresenter.Encode()); err != nil {
 		r.logger.Error(err.Error())
+	}
+}
+
+// HandleChatOnError marks the session as failing writes, so that a dropped broadcast frame
+// is recorded as a pending delivery
+func (r *HttpServer) HandleChatOnError(sess *melody.Session, err error) {
+	if tracker, ok := sess.Get(sessDeliveryKey); ok {
+		tracker.(*deliveryTracker).MarkFailed()
+	}
+	if isSendBufferFull(err) && evictSlowConsumer(sess, r.mc.Config.PongWait) {
+		r.sessionLogger(sess).Warn("evicting slow consumer")
+	}
+}
+
+// HandleChatOnPong keeps connected users from turning offline while they are idle
+func (r *HttpServer) HandleChatOnPong(sess *melody.Session) {
+	sess.Set(sessPongKey, time.Now())
+	if isReadOnlySession(sess) {
+		return
+	}
+	userID, err := strconv.ParseUint(sess.Request.URL.Query().Get("uid"), 10, 64)
+	if err != nil {
+		return
+	}
+	if err := r.userSvc.KeepPresence(context.Background(), userID); err != nil {
+		r.sessionLogger(sess).Error(err.Error())
+	}
+}
+
+func (r *HttpServer) HandleChatOnDisconnect(sess *melody.Session) {
+	r.conns.Remove(sess)
+	if batcher, ok := sess.Get(sessBatcherKey); ok {
+		batcher.(*frameBatcher).Close()
+	}
+	if shaper, ok := sess.Get(sessShaperKey); ok {
+		shaper.(*sendShaper).Close()
+	}
+	if timer, ok := sess.Get(sessTypingKey); ok {
+		timer.(*typingTimer).Close()
+	}
+	if auth, ok := sess.Get(sessAuthKey); ok {
+		auth.(*sessionAuth).Close()
+	}
+	if assembler, ok := sess.Get(sessChunksKey); ok {
+		assembler.(*chunkAssembler).Close()
+	}
+	if conn, ok := sess.Get(sessTrafficKey); ok {
+		conn.(*channelConn).Close()
+	}
+	// connections that vanish without a close frame, e.g. dropped for missing pongs,
+	// never reach the close handler, so their users are taken offline here
+	if _, closed := sess.Get(sessClosedKey); closed {
+		return
+	}
+	if lastPong, ok := sess.Get(sessPongKey); ok && time.Since(lastPong.(time.Time)) >= r.mc.Config.PongWait {
+		idleDisconnectsTotal.Inc()
+		r.sessionLogger(sess).Info("websocket dropped for missing pongs")
+	}
+	r.leaveChannel(sess)
+}
+
+func (r *HttpServer) HandleChatOnClose(sess *melody.Session, i int, s string) error {
+	sess.Set(sessClosedKey, true)
+	return r.leaveChannel(sess)
+}
+
+// leaveChannel takes the user of a closed connection offline in its channel
+func (r *HttpServer) leaveChannel(sess *melody.Session) error {
+	logger := r.sessionLogger(sess)
+	userID, err := strconv.ParseUint(sess.Request.URL.Query().Get("uid"), 10, 64)
+	if err != nil {
+		logger.Error(err.Error())
 		return err
 	}
-	if authResult.Expired {
-		r.logger.Error(common.ErrTokenExpired.Error())
-		return common.ErrTokenExpired
+	// the access token may have expired by now, so the channel is taken from the session
+	cid, ok := sess.Get(sessCidKey)
+	if !ok {
+		return nil
 	}
-	channelID := authResult.ChannelID
-	err = r.userSvc.DeleteOnlineUser(context.Background(), channelID, userID)
+	channelID := cid.(uint64)
+	// the channel of an expired session is purged, so there is no one left to notify,
+	// and guests were never announced in the first place
+	if _, expired := sess.Get(sessExpiredKey); expired || isReadOnlySession(sess) {
+		return r.forwardSvc.RemoveChannelSession(context.Background(), channelID, userID)
+	}
+	offline, err := r.userSvc.DeleteOnlineUser(context.Background(), channelID, userID)
 	if err != nil {
-		r.logger.Error(err.Error())
+		logger.Error(err.Error())
+		return err
+	}
+	err = r.userSvc.SetTypingUser(context.Background(), channelID, userID, false)
+	if err != nil {
+		logger.Error(err.Error())
 		return err
 	}
 	err = r.forwardSvc.RemoveChannelSession(context.Background(), channelID, userID)
 	if err != nil {
-		r.logger.Error(err.Error())
+		logger.Error(err.Error())
+		return err
+	}
+	// with a debounce period the user goes offline later, in the offline sweeper
+	if !offline {
+		return nil
+	}
+	if err := r.broadcastOffline(context.Background(), channelID, userID); err != nil {
+		logger.Error(err.Error())
 		return err
 	}
-	return r.msgSvc.BroadcastActionMessage(context.Background(), channelID, userID, OfflineMessage)
+	return nil
+}
+
+// broadcastOffline announces a user that has no connection left in the channel
+func (r *HttpServer) broadcastOffline(ctx context.Context, channelID, userID uint64) error {
+	return errors.Join(
+		r.msgSvc.BroadcastPresenceMessage(ctx, channelID, userID, PresenceOffline),
+		r.msgSvc.BroadcastActionMessage(ctx, channelID, userID, OfflineMessage),
+	)
 }
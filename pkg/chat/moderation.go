@@ -0,0 +1,153 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var moderatedMessagesTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "chat",
+	Name:      "moderated_messages_total",
+	Help:      "Total number of messages rejected by content moderation.",
+})
+
+// MessageModerator decides whether a message payload may be stored and broadcast. A
+// rejected payload comes with the reason shown to its sender
+type MessageModerator interface {
+	Moderate(ctx context.Context, payload string) (allowed bool, reason string, err error)
+}
+
+// NewMessageModerator returns the moderators configured under Chat.Moderation. Blocked
+// keywords are checked before the webhook, so that the webhook is only called for
+// payloads the blocklist lets through
+func NewMessageModerator(config *config.Config) (MessageModerator, error) {
+	moderationConfig := config.Chat.Moderation
+	if !moderationConfig.Enabled {
+		return NoopModerator{}, nil
+	}
+	var moderators chainModerator
+	if keywords := splitNonEmpty(moderationConfig.BlockedKeywords); len(keywords) > 0 {
+		moderators = append(moderators, NewKeywordModerator(keywords))
+	}
+	if moderationConfig.Webhook.Url != "" {
+		// a zero timeout would let a hanging webhook stall every message
+		if moderationConfig.Webhook.TimeoutMilliSecond <= 0 {
+			return nil, fmt.Errorf("chat.moderation.webhook.timeoutMilliSecond %d must be positive", moderationConfig.Webhook.TimeoutMilliSecond)
+		}
+		moderators = append(moderators, NewWebhookModerator(
+			moderationConfig.Webhook.Url,
+			time.Duration(moderationConfig.Webhook.TimeoutMilliSecond)*time.Millisecond,
+		))
+	}
+	if len(moderators) == 0 {
+		return NoopModerator{}, nil
+	}
+	return moderators, nil
+}
+
+// NoopModerator allows every payload
+type NoopModerator struct{}
+
+func (NoopModerator) Moderate(ctx context.Context, payload string) (bool, string, error) {
+	return true, "", nil
+}
+
+// chainModerator allows a payload only if all of its moderators allow it
+type chainModerator []MessageModerator
+
+func (moderators chainModerator) Moderate(ctx context.Context, payload string) (bool, string, error) {
+	for _, moderator := range moderators {
+		allowed, reason, err := moderator.Moderate(ctx, payload)
+		if err != nil || !allowed {
+			return allowed, reason, err
+		}
+	}
+	return true, "", nil
+}
+
+// KeywordModerator rejects payloads containing any of its blocked keywords, ignoring case
+type KeywordModerator struct {
+	keywords []string
+}
+
+func NewKeywordModerator(keywords []string) *KeywordModerator {
+	lowered := make([]string, len(keywords))
+	for i, keyword := range keywords {
+		lowered[i] = strings.ToLower(keyword)
+	}
+	return &KeywordModerator{
+		keywords: lowered,
+	}
+}
+
+func (m *KeywordModerator) Moderate(ctx context.Context, payload string) (bool, string, error) {
+	payload = strings.ToLower(payload)
+	for _, keyword := range m.keywords {
+		if strings.Contains(payload, keyword) {
+			return false, "message contains a blocked keyword", nil
+		}
+	}
+	return true, "", nil
+}
+
+// WebhookModerator asks an external moderation service whether a payload is allowed. The
+// payload is posted as {"payload": ...} and the service answers with
+// {"allowed": bool, "reason": string}
+type WebhookModerator struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookModerator(url string, timeout time.Duration) *WebhookModerator {
+	return &WebhookModerator{
+		url: url,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+type webhookModerationRequest struct {
+	Payload string `json:"payload"`
+}
+
+type webhookModerationResponse struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+func (m *WebhookModerator) Moderate(ctx context.Context, payload string) (bool, string, error) {
+	body, err := json.Marshal(&webhookModerationRequest{
+		Payload: payload,
+	})
+	if err != nil {
+		return false, "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		return false, "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return false, "", fmt.Errorf("error call moderation webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("error call moderation webhook: unexpected status %d", resp.StatusCode)
+	}
+	var result webhookModerationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, "", fmt.Errorf("error decode moderation webhook response: %w", err)
+	}
+	return result.Allowed, result.Reason, nil
+}
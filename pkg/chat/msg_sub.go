@@ -2,8 +2,12 @@ package chat
 
 import (
 	"context"
+	"log/slog"
+	"strconv"
+	"time"
 
 	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/gorilla/websocket"
 	"github.com/minghsu0107/go-random-chat/pkg/config"
 	"gopkg.in/olahol/melody.v1"
 )
@@ -13,14 +17,24 @@ type MessageSubscriber struct {
 	router       *message.Router
 	sub          message.Subscriber
 	m            MelodyChatConn
+	cipher       MessageCipher
+	msgRepo      MessageRepoCache
+
+	resumeIdleWindow      time.Duration
+	resumeRefreshInterval time.Duration
 }
 
-func NewMessageSubscriber(name string, router *message.Router, config *config.Config, sub message.Subscriber, m MelodyChatConn) (*MessageSubscriber, error) {
+func NewMessageSubscriber(name string, router *message.Router, config *config.Config, sub message.Subscriber, m MelodyChatConn, cipher MessageCipher, msgRepo MessageRepoCache) (*MessageSubscriber, error) {
 	return &MessageSubscriber{
 		subscriberID: config.Chat.Subscriber.Id,
 		router:       router,
 		sub:          sub,
 		m:            m,
+		cipher:       cipher,
+		msgRepo:      msgRepo,
+
+		resumeIdleWindow:      time.Duration(config.Chat.Resume.IdleWindowSecond) * time.Second,
+		resumeRefreshInterval: time.Duration(config.Chat.Resume.RefreshIntervalSecond) * time.Second,
 	}, nil
 }
 
@@ -29,6 +43,7 @@ func (s *MessageSubscriber) HandleMessage(msg *message.Message) error {
 	if err != nil {
 		return err
 	}
+	decryptMessage(s.cipher, message)
 	return s.sendMessage(context.Background(), message)
 }
 
@@ -50,11 +65,143 @@ func (s *MessageSubscriber) GracefulStop() error {
 }
 
 func (s *MessageSubscriber) sendMessage(ctx context.Context, message *Message) error {
-	return s.m.BroadcastFilter(message.ToPresenter().Encode(), func(sess *melody.Session) bool {
+	frame := message.ToPresenter().Encode()
+	if message.Event == EventChannelExpired {
+		return s.closeChannel(message.ChannelID, frame)
+	}
+	if isBlockEvent(message.Event) {
+		return s.applyBlock(message)
+	}
+	return s.m.BroadcastFilter(frame, func(sess *melody.Session) bool {
 		channelID, exist := sess.Get(sessCidKey)
 		if !exist {
 			return false
 		}
-		return message.ChannelID == (channelID.(uint64))
+		if message.ChannelID != (channelID.(uint64)) {
+			return false
+		}
+		if hiddenFrom(sess, message) {
+			return false
+		}
+		// an evicted connection gets nothing more so that its close frame fits in its buffer;
+		// what it misses is replayed on reconnect
+		if isEvicted(sess) {
+			if _, tracked := sess.Get(sessDeliveryKey); tracked && isContentEvent(message.Event) {
+				go s.addPendingDelivery(sess, message, errSlowConsumerEvicted)
+			}
+			return false
+		}
+		ephemeral := isEphemeralEvent(message.Event)
+		// typing and presence are only shown to the other members of the channel
+		if ephemeral && sess.Request.URL.Query().Get("uid") == strconv.FormatUint(message.UserID, 10) {
+			return false
+		}
+		// messages arriving while the connection replays what it missed are sent after the replay
+		if gate, ok := sess.Get(sessReplayKey); ok && !ephemeral {
+			held, overflow := gate.(*replayGate).Hold(message.MessageID, func() {
+				if s.deliver(sess, message, frame, ephemeral) {
+					if err := sess.Write(frame); err != nil {
+						slog.Error(err.Error())
+					}
+				}
+			})
+			if overflow {
+				go func() {
+					if err := closeOverflowedReplay(sess); err != nil {
+						slog.Error(err.Error())
+					}
+				}()
+			}
+			if held {
+				return false
+			}
+		}
+		return s.deliver(sess, message, frame, ephemeral)
 	})
 }
+
+// deliver writes a message to a session, and reports whether the frame is left for the
+// broadcast to write as is
+func (s *MessageSubscriber) deliver(sess *melody.Session, message *Message, frame []byte, ephemeral bool) bool {
+	frames := [][]byte{frame}
+	// a refreshed resume token must follow the message it accounts for
+	if state, ok := sess.Get(sessResumeKey); ok && !ephemeral && state.(*resumeState).Deliver(message.MessageID, s.resumeRefreshInterval) {
+		tokenFrame, err := state.(*resumeState).TokenFrame(s.resumeIdleWindow)
+		if err != nil {
+			slog.Error(err.Error())
+		} else {
+			frames = append(frames, tokenFrame)
+		}
+	}
+	observeTraffic(sess, directionOut, frames...)
+	if batcher, ok := sess.Get(sessBatcherKey); ok {
+		for _, f := range frames {
+			batcher.(*frameBatcher).Add(sess, f)
+		}
+		return false
+	}
+	tracker, tracked := sess.Get(sessDeliveryKey)
+	tracked = tracked && isContentEvent(message.Event)
+	if _, shaped := sess.Get(sessShaperKey); !shaped && !tracked && len(frames) == 1 {
+		return true
+	}
+	for i, f := range frames {
+		if i == 0 && tracked {
+			if err := tracker.(*deliveryTracker).Write(sess, f); err != nil {
+				go s.addPendingDelivery(sess, message, err)
+			}
+			continue
+		}
+		if err := writeShaped(sess, f); err != nil && !isShapingDrop(err) {
+			slog.Error(err.Error())
+		}
+	}
+	return false
+}
+
+// closeChannel sends the expiry of a channel to its sessions and closes them. The frame
+// bypasses batching and shaping so that it is written before the close frame
+func (s *MessageSubscriber) closeChannel(channelID uint64, frame []byte) error {
+	return s.m.BroadcastFilter(frame, func(sess *melody.Session) bool {
+		cid, exist := sess.Get(sessCidKey)
+		if !exist || cid.(uint64) != channelID {
+			return false
+		}
+		sess.Set(sessExpiredKey, true)
+		if err := sess.Write(frame); err != nil {
+			slog.Error(err.Error())
+		}
+		if err := sess.CloseWithMsg(melody.FormatCloseMessage(websocket.CloseNormalClosure, ErrChannelExpired.Error())); err != nil {
+			slog.Error(err.Error())
+		}
+		return false
+	})
+}
+
+// applyBlock updates the block lists of the sessions in the channel of a block event. The
+// event itself is not written to any session
+func (s *MessageSubscriber) applyBlock(message *Message) error {
+	return s.m.BroadcastFilter(nil, func(sess *melody.Session) bool {
+		cid, exist := sess.Get(sessCidKey)
+		if !exist || cid.(uint64) != message.ChannelID {
+			return false
+		}
+		if blocks, ok := sess.Get(sessBlocksKey); ok {
+			blocks.(*blockList).Apply(message)
+		}
+		return false
+	})
+}
+
+// addPendingDelivery records a message that could not be written to a session, so that it
+// is delivered again when the user reconnects
+func (s *MessageSubscriber) addPendingDelivery(sess *melody.Session, message *Message, err error) {
+	deliveryFailuresTotal.WithLabelValues(deliveryFailureReason(sess, err)).Inc()
+	userID, err := strconv.ParseUint(sess.Request.URL.Query().Get("uid"), 10, 64)
+	if err != nil {
+		return
+	}
+	if err := s.msgRepo.AddPendingDelivery(context.Background(), message.ChannelID, userID, message.MessageID); err != nil {
+		slog.Error(err.Error())
+	}
+}
@@ -14,6 +14,73 @@ type MessagePresenter struct {
 	Payload   string `json:"payload"`
 	Seen      bool   `json:"seen"`
 	Time      int64  `json:"time"`
+	Reason    string `json:"reason,omitempty"`
+	// ReasonCode is the machine-readable code of a nack reason
+	ReasonCode common.ErrorCode `json:"reason_code,omitempty"`
+	// Guaranteed requests at-least-once delivery; recipients ack with a delivery ack event
+	Guaranteed bool  `json:"guaranteed,omitempty"`
+	Edited     bool  `json:"edited,omitempty"`
+	EditedTime int64 `json:"edited_time,omitempty"`
+	Deleted    bool  `json:"deleted,omitempty"`
+	// Reactions maps emojis to their reaction counts
+	Reactions map[string]ReactionPresenter `json:"reactions,omitempty"`
+	// Emoji and Action are set on reaction events; action is add or remove
+	Emoji  string `json:"emoji,omitempty"`
+	Action string `json:"action,omitempty"`
+	// ClientMsgID is generated by the sender of a message and echoed back in the ack or
+	// nack of the message, so that the sender can match them to its pending messages
+	ClientMsgID string `json:"client_msg_id,omitempty"`
+	// AccessToken is set on reauth events sent by clients to renew the connection token
+	AccessToken string `json:"access_token,omitempty"`
+	// Attachment is set on attachment events; clients get a download url for the key
+	// from the presign endpoint of the uploader
+	Attachment *AttachmentPresenter `json:"attachment,omitempty"`
+	// ReplyTo is the id of the message a content message replies to. Threads are one
+	// level deep, so a reply to a reply is broadcast with the root of the thread
+	ReplyTo string `json:"reply_to,omitempty"`
+	// ReplyCount is the number of replies to a thread root in listings
+	ReplyCount int64 `json:"reply_count,omitempty"`
+	// DeletedIDs are the ids of the messages deleted by a bulk delete event
+	DeletedIDs []string `json:"deleted_ids,omitempty"`
+	// Status is online or offline on presence events
+	Status string `json:"status,omitempty"`
+	// Seq increases strictly with every message stored in the channel, though numbers may
+	// be skipped; order messages by seq rather than time, which is only millisecond precise.
+	// A message may arrive more than once, e.g. when replayed after a resume, so clients
+	// should dedup messages by message_id
+	Seq uint64 `json:"seq,omitempty"`
+	// TTLSeconds makes a sent message disappear after this many seconds, overriding the
+	// default message ttl of the channel
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+	// ExpiresAt is when a disappearing message is deleted in unix milliseconds; a delete
+	// event carrying the message id is broadcast once it is
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+	// RecipientID is the user a direct message is sent to
+	RecipientID string `json:"recipient_id,omitempty"`
+	// ContentType is text, emoji, image, file, sticker or system, set by the server on
+	// messages with content. Senders may declare it, and the message is rejected if its
+	// content does not match
+	ContentType string `json:"content_type,omitempty"`
+	// ChunkID, ChunkIndex, ChunkTotal and ChunkData make up a chunk event, one of ChunkTotal
+	// parts of a text message identified by ChunkID. The text is the data of all chunks
+	// joined in index order, and is sent as one message once all chunks arrived
+	ChunkID    string `json:"msg_id,omitempty"`
+	ChunkIndex int    `json:"index,omitempty"`
+	ChunkTotal int    `json:"total,omitempty"`
+	ChunkData  string `json:"data,omitempty"`
+}
+
+type AttachmentPresenter struct {
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Filename    string `json:"filename"`
+}
+
+type ReactionPresenter struct {
+	Count int `json:"count"`
+	// Reacted tells whether the requesting user reacted with the emoji
+	Reacted bool `json:"reacted"`
 }
 
 type UserPresenter struct {
@@ -23,6 +90,218 @@ type UserPresenter struct {
 
 type UserIDsPresenter struct {
 	UserIDs []string `json:"user_ids"`
+	// Roles maps user ids to their roles in the channel
+	Roles map[string]Role `json:"roles,omitempty"`
+}
+
+type ScheduledMessagePresenter struct {
+	ID      string `json:"id"`
+	Payload string `json:"payload" binding:"required"`
+	// SendAt is the delivery time in unix milliseconds
+	SendAt int64 `json:"send_at" binding:"required"`
+}
+
+type ReadReceiptsPresenter struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+type TokenPresenter struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	// ExpiresAt is the expiry of the access token in unix milliseconds
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+// ChannelInfoPresenter describes a channel for rendering its header
+type ChannelInfoPresenter struct {
+	ChannelID string `json:"channel_id"`
+	Name      string `json:"name,omitempty"`
+	// CreatedAt is in unix milliseconds and omitted for channels created before it was recorded
+	CreatedAt   int64  `json:"created_at,omitempty"`
+	CreatorID   string `json:"creator_id,omitempty"`
+	MemberCount int    `json:"member_count"`
+	OnlineCount int    `json:"online_count"`
+}
+
+// ChannelDeletionPresenter is what a channel deletion removed, or would remove if DryRun
+type ChannelDeletionPresenter struct {
+	DryRun          bool  `json:"dry_run"`
+	MessageCount    int64 `json:"message_count"`
+	AttachmentCount int   `json:"attachment_count"`
+	MemberCount     int   `json:"member_count"`
+}
+
+// GuestTokenPresenter is a read-only access token for watching a channel. The guest
+// connects to the chat websocket with the guest id as uid
+type GuestTokenPresenter struct {
+	AccessToken string `json:"access_token"`
+	GuestID     string `json:"guest_id"`
+	// ExpiresAt is the expiry of the access token in unix milliseconds
+	ExpiresAt int64 `json:"expires_at"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type TrimPresenter struct {
+	Trimmed int `json:"trimmed"`
+}
+
+type RoleRequest struct {
+	UserID string `json:"user_id" binding:"required"`
+	Role   Role   `json:"role" binding:"required"`
+}
+
+type BlockRequest struct {
+	UserID string `json:"user_id" binding:"required"`
+}
+
+type BlockedUserPresenter struct {
+	UserID string `json:"user_id"`
+	// BlockedAt is when the user was blocked in unix milliseconds
+	BlockedAt int64 `json:"blocked_at"`
+}
+
+type BlockedUsersPresenter struct {
+	BlockedUsers []BlockedUserPresenter `json:"blocked_users"`
+}
+
+type PinRequest struct {
+	MessageID string `json:"message_id" form:"message_id" binding:"required"`
+}
+
+type BulkDeleteRequest struct {
+	MessageIDs []string `json:"message_ids" binding:"required,min=1"`
+}
+
+type BulkDeleteResultPresenter struct {
+	MessageID string `json:"message_id"`
+	// Status is deleted, not_found or failed
+	Status string `json:"status"`
+}
+
+type BulkDeletePresenter struct {
+	Results []BulkDeleteResultPresenter `json:"results"`
+}
+
+type UnreadPresenter struct {
+	// Since is the id of the message counting starts after
+	Since  string `json:"since"`
+	Unread int64  `json:"unread"`
+}
+
+type ChannelPresenter struct {
+	ChannelID    string `json:"channel_id"`
+	MessageCount int64  `json:"message_count"`
+	Archived     bool   `json:"archived"`
+	// SoftArchived reports whether the channel is read-only and hidden from channel lists
+	SoftArchived bool `json:"soft_archived"`
+	// MessageTTLSeconds is the ttl of messages sent without their own ttl, or 0 if they never expire
+	MessageTTLSeconds int64 `json:"message_ttl_seconds,omitempty"`
+	// ExpiresAt is the expiry of an ephemeral channel in unix milliseconds, or 0 if the channel never expires
+	ExpiresAt int64 `json:"expires_at,omitempty"`
+}
+
+type UserChannelPresenter struct {
+	ChannelID string `json:"channel_id"`
+	// LastMessageTime is the time of the latest message in unix milliseconds, or 0 if unknown
+	LastMessageTime int64 `json:"last_message_time"`
+}
+
+type UserChannelsPresenter struct {
+	Channels []UserChannelPresenter `json:"channels"`
+}
+
+type ConnectionPresenter struct {
+	ChannelID string `json:"channel_id"`
+	UserID    string `json:"user_id"`
+	ReadOnly  bool   `json:"read_only"`
+	// ConnectedAt is the connect time in unix milliseconds
+	ConnectedAt int64             `json:"connected_at"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+type ConnectionsPresenter struct {
+	Connections []ConnectionPresenter `json:"connections"`
+}
+
+type MessageReceiptsPresenter struct {
+	// Receipts maps user ids to the id of the last message they have seen
+	Receipts map[string]string `json:"receipts"`
+}
+
+type PresenceRequest struct {
+	UserIDs []string `json:"user_ids" binding:"required"`
+}
+
+type PresencePresenter struct {
+	// Presence maps user ids to online, away or offline
+	Presence map[string]PresenceState `json:"presence"`
+}
+
+type StickerPresenter struct {
+	Name      string `json:"name" binding:"required"`
+	ObjectKey string `json:"object_key"`
+}
+
+type StickerPackPresenter struct {
+	Stickers []StickerPresenter `json:"stickers" binding:"required"`
+	Default  bool               `json:"default"`
+}
+
+// SnapshotPresenter is carried as the payload of a snapshot event
+type SnapshotPresenter struct {
+	ChannelID     string   `json:"channel_id"`
+	UserIDs       []string `json:"user_ids"`
+	OnlineUserIDs []string `json:"online_user_ids"`
+	TypingUserIDs []string `json:"typing_user_ids"`
+	// Channel is the channel metadata, as returned by the channel info endpoint
+	Channel *ChannelInfoPresenter `json:"channel,omitempty"`
+}
+
+func (s *SnapshotPresenter) Encode() []byte {
+	result, _ := json.Marshal(s)
+	return result
+}
+
+type SearchMessagesRequest struct {
+	Query string `form:"q" binding:"required"`
+	// From and To bound the message time in unix milliseconds; 0 leaves the bound open
+	From int64 `form:"from"`
+	To   int64 `form:"to"`
+}
+
+type MessageTTLRequest struct {
+	// TTLSeconds is the default ttl of messages in the channel; 0 turns it off
+	TTLSeconds int64 `json:"ttl_seconds" binding:"min=0"`
+}
+
+type ExportMessagesRequest struct {
+	// Format is json or csv; json is used if empty
+	Format string `form:"format"`
+	// From and To bound the message time in unix milliseconds; 0 leaves the bound open
+	From int64 `form:"from"`
+	To   int64 `form:"to"`
+}
+
+// ExportMessagePresenter is a message as written to a json export
+type ExportMessagePresenter struct {
+	MessageID string `json:"message_id"`
+	UserID    string `json:"user_id"`
+	Time      int64  `json:"time"`
+	Payload   string `json:"payload"`
+	Seen      bool   `json:"seen"`
+}
+
+func toExportMessagePresenter(msg *Message) *ExportMessagePresenter {
+	return &ExportMessagePresenter{
+		MessageID: strconv.FormatUint(msg.MessageID, 10),
+		UserID:    strconv.FormatUint(msg.UserID, 10),
+		Time:      msg.Time,
+		Payload:   msg.Payload,
+		Seen:      msg.Seen,
+	}
 }
 
 type MessagesPresenter struct {
@@ -30,11 +309,47 @@ type MessagesPresenter struct {
 	Messages      []MessagePresenter `json:"messages"`
 }
 
+// ThreadPresenter is a thread root with a page of its replies, oldest first
+type ThreadPresenter struct {
+	Root    MessagePresenter   `json:"root"`
+	Replies []MessagePresenter `json:"replies"`
+}
+
+// toReactionsPresenter counts the reactions of a message; viewerID 0 stands for no viewer
+func toReactionsPresenter(reactions map[string][]uint64, viewerID uint64) map[string]ReactionPresenter {
+	if len(reactions) == 0 {
+		return nil
+	}
+	reactionsPresenter := make(map[string]ReactionPresenter, len(reactions))
+	for emoji, userIDs := range reactions {
+		reaction := ReactionPresenter{
+			Count: len(userIDs),
+		}
+		for _, userID := range userIDs {
+			if userID == viewerID {
+				reaction.Reacted = true
+				break
+			}
+		}
+		reactionsPresenter[emoji] = reaction
+	}
+	return reactionsPresenter
+}
+
 func (m *MessagePresenter) Encode() []byte {
 	result, _ := json.Marshal(m)
 	return result
 }
 
+// contentTypeOf classifies a message sent by a client. Clients send attachments in the
+// attachment field rather than in the payload, where stored attachment messages keep them
+func (m *MessagePresenter) contentTypeOf(msg *Message) ContentType {
+	if m.Event == EventAttachment && m.Attachment != nil {
+		return fileContentType(m.Attachment.ContentType)
+	}
+	return msg.ContentType()
+}
+
 func (m *MessagePresenter) ToMessage(accessToken string) (*Message, error) {
 	authResult, err := common.Auth(&common.AuthPayload{
 		AccessToken: accessToken,
@@ -50,11 +365,30 @@ func (m *MessagePresenter) ToMessage(accessToken string) (*Message, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Message{
-		Event:     m.Event,
-		ChannelID: channelID,
-		UserID:    userID,
-		Payload:   m.Payload,
-		Time:      m.Time,
-	}, nil
+	var replyTo uint64
+	if m.ReplyTo != "" {
+		if replyTo, err = strconv.ParseUint(m.ReplyTo, 10, 64); err != nil || replyTo == 0 {
+			return nil, ErrInvalidReplyTo
+		}
+	}
+	var recipientID uint64
+	if m.Event == EventDirect {
+		if recipientID, err = strconv.ParseUint(m.RecipientID, 10, 64); err != nil || recipientID == 0 || recipientID == userID {
+			return nil, ErrInvalidDirectRecipient
+		}
+	}
+	msg := &Message{
+		Event:       m.Event,
+		ChannelID:   channelID,
+		UserID:      userID,
+		Payload:     m.Payload,
+		Time:        m.Time,
+		Guaranteed:  m.Guaranteed,
+		ReplyTo:     replyTo,
+		RecipientID: recipientID,
+	}
+	if m.ContentType != "" && !m.contentTypeOf(msg).Accepts(ContentType(m.ContentType)) {
+		return nil, ErrContentTypeMismatch
+	}
+	return msg, nil
 }
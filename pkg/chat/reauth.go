@@ -0,0 +1,135 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+)
+
+// RefreshClaims are the claims of a refresh token.
+//
+// A refresh token is an HS256 JWT bound to a channel and a user that can be exchanged for
+// a new access token and refresh token pair until it expires. Tokens are signed with a key
+// derived from the channel JWT secret so that they can never be used as access tokens.
+// Every refresh token carries a random id that is denylisted once the token is exchanged
+// or revoked, so a refresh token can be spent only once. The user also has to still belong
+// to the channel for the exchange to succeed
+type RefreshClaims struct {
+	ChannelID uint64 `json:"cid"`
+	UserID    uint64 `json:"uid"`
+	jwt.RegisteredClaims
+}
+
+func refreshTokenSecret() []byte {
+	return []byte(common.Join(common.JwtSecret, ":refresh"))
+}
+
+func newRefreshToken(channelID, userID uint64, ttl time.Duration) (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	claims := &RefreshClaims{
+		ChannelID: channelID,
+		UserID:    userID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        hex.EncodeToString(id[:]),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(refreshTokenSecret())
+}
+
+// parseRefreshToken validates a refresh token and returns its claims
+func parseRefreshToken(refreshToken string) (*RefreshClaims, error) {
+	token, err := jwt.ParseWithClaims(refreshToken, &RefreshClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return refreshTokenSecret(), nil
+	})
+	if err != nil {
+		var v *jwt.ValidationError
+		if errors.As(err, &v) && v.Errors == jwt.ValidationErrorExpired {
+			return nil, ErrRefreshTokenExpired
+		}
+		return nil, ErrInvalidRefreshToken
+	}
+	claims, ok := token.Claims.(*RefreshClaims)
+	// tokens without an id predate revocation and cannot be denylisted
+	if !(ok && token.Valid) || claims.ID == "" {
+		return nil, ErrInvalidRefreshToken
+	}
+	return claims, nil
+}
+
+// sessionAuth holds the access token a connection is currently authenticated with. The
+// token is replaced whenever the client re-authenticates, and the connection is expired
+// once the token runs out without a re-authentication
+type sessionAuth struct {
+	mu          sync.Mutex
+	accessToken string
+	timer       *time.Timer
+	isClosed    bool
+}
+
+func newSessionAuth(accessToken string) *sessionAuth {
+	return &sessionAuth{
+		accessToken: accessToken,
+	}
+}
+
+// AccessToken returns the current access token of the connection
+func (a *sessionAuth) AccessToken() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.accessToken
+}
+
+// Renew replaces the access token and re-arms the expiry; onExpire runs if Renew is not
+// called again before deadline. A zero deadline never expires
+func (a *sessionAuth) Renew(accessToken string, deadline time.Time, onExpire func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.isClosed {
+		return
+	}
+	a.accessToken = accessToken
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	if deadline.IsZero() {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Until(deadline), func() {
+		a.mu.Lock()
+		// a renewal that raced with the timer firing has already replaced it
+		if a.isClosed || a.timer != timer {
+			a.mu.Unlock()
+			return
+		}
+		a.timer = nil
+		a.mu.Unlock()
+		onExpire()
+	})
+	a.timer = timer
+}
+
+// Close stops the expiry timer
+func (a *sessionAuth) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.isClosed = true
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+}
@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/olahol/melody.v1"
+)
+
+// replayGate orders the live messages of a connection after the messages replayed to it on
+// connect. A session starts receiving broadcasts before the missed, outbox and pending
+// messages are replayed, so the live messages arriving in the meantime are held and sent
+// once the replay is done, in the order they arrived and without the ones the replay sent.
+//
+// If more than maxHeld messages arrive during the replay, the connection is closed so that
+// the client resumes from where it is instead of receiving an out of order stream
+type replayGate struct {
+	mu         sync.Mutex
+	maxHeld    int
+	held       []heldMessage
+	replayed   map[uint64]struct{}
+	released   bool
+	overflowed bool
+}
+
+type heldMessage struct {
+	messageID uint64
+	deliver   func()
+}
+
+// defaultReplayMaxHeld is used when the configured chat.resume.maxHeldLiveMessages is not
+// positive, which would otherwise close every connection that replays
+const defaultReplayMaxHeld = 1000
+
+func newReplayGate(maxHeld int) *replayGate {
+	return &replayGate{
+		maxHeld:  maxHeld,
+		replayed: make(map[uint64]struct{}),
+	}
+}
+
+// Replayed records a message sent by the replay, so that the live copy of it is skipped
+func (g *replayGate) Replayed(messageID uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.released {
+		g.replayed[messageID] = struct{}{}
+	}
+}
+
+// Hold defers the delivery of a live message until the replay is released, and reports
+// whether it did. It reports true without keeping the message once the gate overflowed, in
+// which case overflow is true the first time only
+func (g *replayGate) Hold(messageID uint64, deliver func()) (held bool, overflow bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.released {
+		return false, false
+	}
+	if g.overflowed {
+		return true, false
+	}
+	if len(g.held) >= g.maxHeld {
+		g.overflowed = true
+		g.held = nil
+		return true, true
+	}
+	g.held = append(g.held, heldMessage{messageID, deliver})
+	return true, false
+}
+
+// Release delivers the held messages and lets later messages through. Messages arriving
+// meanwhile wait for the held ones, since they are delivered under the lock
+func (g *replayGate) Release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.released {
+		return
+	}
+	g.released = true
+	for _, msg := range g.held {
+		if _, ok := g.replayed[msg.messageID]; ok {
+			continue
+		}
+		msg.deliver()
+	}
+	g.held = nil
+	g.replayed = nil
+}
+
+// markReplayed records that a message was sent to the session by the replay
+func markReplayed(sess *melody.Session, messageID uint64) {
+	if gate, ok := sess.Get(sessReplayKey); ok && messageID != 0 {
+		gate.(*replayGate).Replayed(messageID)
+	}
+}
+
+// releaseReplay ends the replay of the session and sends the live messages held meanwhile
+func releaseReplay(sess *melody.Session) {
+	if gate, ok := sess.Get(sessReplayKey); ok {
+		gate.(*replayGate).Release()
+	}
+}
+
+// closeOverflowedReplay closes a connection whose live messages overflowed during replay
+func closeOverflowedReplay(sess *melody.Session) error {
+	return sess.CloseWithMsg(melody.FormatCloseMessage(websocket.CloseTryAgainLater, ErrReplayOverflow.Error()))
+}
@@ -2,11 +2,19 @@ package chat
 
 import (
 	"context"
-	b64 "encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/gocql/gocql"
 	"github.com/minghsu0107/go-random-chat/pkg/common"
 	"github.com/minghsu0107/go-random-chat/pkg/config"
@@ -24,19 +32,49 @@ var (
 type UserRepo interface {
 	AddUserToChannel(ctx context.Context, channelID uint64, userID uint64) error
 	GetUserByID(ctx context.Context, userID uint64) (*User, error)
+	GetUserIDBySession(ctx context.Context, sid string) (uint64, error)
 	GetChannelUserIDs(ctx context.Context, channelID uint64) ([]uint64, error)
+	GetChannelCreator(ctx context.Context, channelID uint64) (uint64, error)
+	ListChannelUsers(ctx context.Context, pageState []byte, pageSize int) ([]ChannelUser, []byte, error)
 }
 
 type MessageRepo interface {
 	InsertMessage(ctx context.Context, msg *Message) error
 	MarkMessageSeen(ctx context.Context, channelID, messageID uint64) error
+	GetMessage(ctx context.Context, channelID, messageID uint64) (*Message, error)
+	EditMessage(ctx context.Context, channelID, messageID uint64, payload string, editedTime int64) error
+	DeleteMessage(ctx context.Context, channelID, messageID uint64) error
 	PublishMessage(ctx context.Context, msg *Message) error
-	ListMessages(ctx context.Context, channelID uint64, pageStateBase64 string) ([]*Message, string, error)
+	ListMessages(ctx context.Context, channelID uint64, pageStateBase64 string, pageSize int) ([]*Message, string, error)
+	GetLatestMessageID(ctx context.Context, channelID uint64) (uint64, error)
+	GetLatestSeq(ctx context.Context, channelID uint64) (uint64, error)
+	CountMessages(ctx context.Context, channelID uint64) (int64, error)
+	CountMessagesAfter(ctx context.Context, channelID, messageID, excludedUserID uint64) (int64, error)
+	ListMessagesAfter(ctx context.Context, channelID, messageID uint64, limit int) ([]*Message, error)
+	ListReplyIDs(ctx context.Context, channelID, rootID, after uint64, limit int) ([]uint64, error)
+	CountReplies(ctx context.Context, channelID uint64, rootIDs []uint64) (map[uint64]int64, error)
+	RestoreMessages(ctx context.Context, msgs []*Message) error
+	DeleteMessages(ctx context.Context, channelID uint64) error
+	TrimMessages(ctx context.Context, channelID uint64, messageIDs []uint64) error
+}
+
+type ArchiveRepo interface {
+	PutArchive(ctx context.Context, channelID uint64, data []byte) error
+	GetArchive(ctx context.Context, channelID uint64) (bool, []byte, error)
+	DeleteArchive(ctx context.Context, channelID uint64) error
+}
+
+type AttachmentRepo interface {
+	StatAttachment(ctx context.Context, objectKey string) (*Attachment, error)
+	CountChannelAttachments(ctx context.Context, channelID uint64) (int, error)
+	DeleteChannelAttachments(ctx context.Context, channelID uint64) (int, error)
+	DeleteAttachment(ctx context.Context, objectKey string) (int64, error)
 }
 
 type ChannelRepo interface {
-	CreateChannel(ctx context.Context, channelID uint64) (*Channel, error)
+	CreateChannel(ctx context.Context, channelID uint64, name string, creatorID uint64) (*Channel, error)
 	DeleteChannel(ctx context.Context, channelID uint64) error
+	GetChannelMetadata(ctx context.Context, channelID uint64) (*ChannelMetadata, error)
 }
 
 type ForwardRepo interface {
@@ -45,8 +83,9 @@ type ForwardRepo interface {
 }
 
 type UserRepoImpl struct {
-	s       *gocql.Session
-	getUser endpoint.Endpoint
+	s                  *gocql.Session
+	getUser            endpoint.Endpoint
+	getUserIDBySession endpoint.Endpoint
 }
 
 func NewUserRepoImpl(s *gocql.Session, userConn *UserClientConn) *UserRepoImpl {
@@ -59,6 +98,13 @@ func NewUserRepoImpl(s *gocql.Session, userConn *UserClientConn) *UserRepoImpl {
 			"GetUser",
 			&userpb.GetUserResponse{},
 		),
+		getUserIDBySession: transport.NewGrpcEndpoint(
+			userConn.Conn,
+			"user",
+			"user.UserService",
+			"GetUserIdBySession",
+			&userpb.GetUserIdBySessionResponse{},
+		),
 	}
 }
 func (repo *UserRepoImpl) AddUserToChannel(ctx context.Context, channelID uint64, userID uint64) error {
@@ -66,8 +112,24 @@ func (repo *UserRepoImpl) AddUserToChannel(ctx context.Context, channelID uint64
 		channelID, userID).WithContext(ctx).Exec(); err != nil {
 		return err
 	}
+	// the first user added to a channel becomes its creator
+	if _, err := repo.s.Query("INSERT INTO channel_creators (channel_id, user_id) VALUES (?, ?) IF NOT EXISTS",
+		channelID, userID).WithContext(ctx).MapScanCAS(map[string]interface{}{}); err != nil {
+		return err
+	}
 	return nil
 }
+func (repo *UserRepoImpl) GetChannelCreator(ctx context.Context, channelID uint64) (uint64, error) {
+	var userID uint64
+	if err := repo.s.Query("SELECT user_id FROM channel_creators WHERE channel_id = ?", channelID).
+		WithContext(ctx).Idempotent(true).Scan(&userID); err != nil {
+		if err == gocql.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return userID, nil
+}
 func (repo *UserRepoImpl) GetUserByID(ctx context.Context, userID uint64) (*User, error) {
 	res, err := repo.getUser(ctx, &userpb.GetUserRequest{
 		UserId: userID,
@@ -84,6 +146,16 @@ func (repo *UserRepoImpl) GetUserByID(ctx context.Context, userID uint64) (*User
 		Name: pbUser.User.Name,
 	}, nil
 }
+func (repo *UserRepoImpl) GetUserIDBySession(ctx context.Context, sid string) (uint64, error) {
+	res, err := repo.getUserIDBySession(ctx, &userpb.GetUserIdBySessionRequest{
+		Sid: sid,
+	})
+	if err != nil {
+		return 0, err
+	}
+	pbUserID := res.(*userpb.GetUserIdBySessionResponse)
+	return pbUserID.UserId, nil
+}
 func (repo *UserRepoImpl) GetChannelUserIDs(ctx context.Context, channelID uint64) ([]uint64, error) {
 	iter := repo.s.Query("SELECT user_id FROM channels WHERE id = ?", channelID).WithContext(ctx).Idempotent(true).Iter()
 	var userIDs []uint64
@@ -97,86 +169,344 @@ func (repo *UserRepoImpl) GetChannelUserIDs(ctx context.Context, channelID uint6
 	return userIDs, nil
 }
 
+// ListChannelUsers pages through the users of all channels, leaving out the placeholder
+// row every channel is created with. An empty page state is returned after the last page
+func (repo *UserRepoImpl) ListChannelUsers(ctx context.Context, pageState []byte, pageSize int) ([]ChannelUser, []byte, error) {
+	iter := repo.s.Query("SELECT id, user_id FROM channels").WithContext(ctx).Idempotent(true).
+		PageSize(pageSize).PageState(pageState).Iter()
+	nextPageState := iter.PageState()
+	var (
+		channelUsers []ChannelUser
+		channelUser  ChannelUser
+	)
+	for iter.Scan(&channelUser.ChannelID, &channelUser.UserID) {
+		if channelUser.UserID != 0 {
+			channelUsers = append(channelUsers, channelUser)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, nil, err
+	}
+	return channelUsers, nextPageState, nil
+}
+
+// MessageRepoImpl stores and publishes message payloads encrypted by the cipher and
+// decrypts them when they are read back
 type MessageRepoImpl struct {
-	s           *gocql.Session
-	p           message.Publisher
-	maxMessages int64
-	pagination  int
+	p          message.Publisher
+	cipher     MessageCipher
+	store      MessageStore
+	pagination int
 }
 
-func NewMessageRepoImpl(config *config.Config, s *gocql.Session, p message.Publisher) *MessageRepoImpl {
-	return &MessageRepoImpl{s, p, config.Chat.Message.MaxNum, config.Chat.Message.PaginationNum}
+func NewMessageRepoImpl(config *config.Config, p message.Publisher, cipher MessageCipher, store MessageStore) *MessageRepoImpl {
+	return &MessageRepoImpl{p, cipher, store, config.Chat.Message.PaginationNum}
 }
 
 func (repo *MessageRepoImpl) InsertMessage(ctx context.Context, msg *Message) error {
-	var messageNum int64
-	err := repo.s.Query("SELECT msgnum FROM chanmsg_counters WHERE channel_id = ? LIMIT 1", msg.ChannelID).
-		WithContext(ctx).Idempotent(true).Scan(&messageNum)
-	if err != nil {
-		if err == gocql.ErrNotFound {
-			messageNum = 0
-		} else {
-			return err
-		}
-	}
-	if messageNum >= repo.maxMessages {
-		return ErrExceedMessageNumLimits
-	}
-	if err := repo.s.Query("INSERT INTO messages (id, event, channel_id, user_id, payload, seen, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		msg.MessageID,
-		msg.Event,
-		msg.ChannelID,
-		msg.UserID,
-		msg.Payload,
-		false,
-		msg.Time).WithContext(ctx).Exec(); err != nil {
-		return err
-	}
-	return repo.s.Query("UPDATE chanmsg_counters SET msgnum = msgnum + 1 WHERE channel_id = ?", msg.ChannelID).WithContext(ctx).Exec()
+	return repo.store.Save(ctx, msg)
 }
 func (repo *MessageRepoImpl) MarkMessageSeen(ctx context.Context, channelID, messageID uint64) error {
-	if err := repo.s.Query("UPDATE messages SET seen = ? WHERE channel_id = ? AND id = ?", true, channelID, messageID).
-		WithContext(ctx).Idempotent(true).Exec(); err != nil {
-		return err
-	}
-	return nil
+	return repo.store.MarkSeen(ctx, channelID, messageID)
+}
+func (repo *MessageRepoImpl) GetMessage(ctx context.Context, channelID, messageID uint64) (*Message, error) {
+	return repo.store.Get(ctx, channelID, messageID)
+}
+
+// EditMessage replaces the payload of an existing message; a message deleted in the meantime
+// is not brought back
+func (repo *MessageRepoImpl) EditMessage(ctx context.Context, channelID, messageID uint64, payload string, editedTime int64) error {
+	return repo.store.Edit(ctx, channelID, messageID, payload, editedTime)
+}
+
+// DeleteMessage turns a message into a tombstone
+func (repo *MessageRepoImpl) DeleteMessage(ctx context.Context, channelID, messageID uint64) error {
+	return repo.store.Delete(ctx, channelID, messageID)
 }
 func (repo *MessageRepoImpl) PublishMessage(ctx context.Context, msg *Message) error {
+	payload, err := repo.cipher.Encrypt(msg.ChannelID, msg.Payload)
+	if err != nil {
+		return err
+	}
+	encrypted := *msg
+	encrypted.Payload = payload
 	return repo.p.Publish(MessagePubTopic, message.NewMessage(
 		watermill.NewUUID(),
-		msg.Encode(),
+		encrypted.Encode(),
 	))
 }
-func (repo *MessageRepoImpl) ListMessages(ctx context.Context, channelID uint64, pageStateBase64 string) ([]*Message, string, error) {
-	var messages []*Message
-	pageState, err := b64.URLEncoding.DecodeString(pageStateBase64)
+
+// ListMessages returns a page of at most pageSize messages; a non-positive pageSize uses the configured pagination
+func (repo *MessageRepoImpl) ListMessages(ctx context.Context, channelID uint64, pageState string, pageSize int) ([]*Message, string, error) {
+	if pageSize <= 0 {
+		pageSize = repo.pagination
+	}
+	return repo.store.List(ctx, channelID, pageState, pageSize)
+}
+
+func (repo *MessageRepoImpl) GetLatestMessageID(ctx context.Context, channelID uint64) (uint64, error) {
+	return repo.store.LatestID(ctx, channelID)
+}
+
+// GetLatestSeq returns the highest sequence number stored in a channel, or 0 if it has none
+func (repo *MessageRepoImpl) GetLatestSeq(ctx context.Context, channelID uint64) (uint64, error) {
+	return repo.store.LatestSeq(ctx, channelID)
+}
+
+// CountMessages returns the number of messages stored in a channel as tracked by its counter
+func (repo *MessageRepoImpl) CountMessages(ctx context.Context, channelID uint64) (int64, error) {
+	return repo.store.Count(ctx, channelID)
+}
+
+// CountMessagesAfter counts the messages newer than messageID that are neither deleted nor
+// sent by excludedUserID, leaving out system messages and direct messages to other users
+func (repo *MessageRepoImpl) CountMessagesAfter(ctx context.Context, channelID, messageID, excludedUserID uint64) (int64, error) {
+	return repo.store.CountAfter(ctx, channelID, messageID, excludedUserID)
+}
+
+// ListMessagesAfter returns up to limit messages newer than messageID in sequence order
+func (repo *MessageRepoImpl) ListMessagesAfter(ctx context.Context, channelID, messageID uint64, limit int) ([]*Message, error) {
+	return repo.store.ListAfter(ctx, channelID, messageID, limit)
+}
+
+// RestoreMessages writes back archived messages as they were, without counting them
+// again towards the message limit of the channel
+func (repo *MessageRepoImpl) RestoreMessages(ctx context.Context, msgs []*Message) error {
+	return repo.store.Restore(ctx, msgs)
+}
+func (repo *MessageRepoImpl) DeleteMessages(ctx context.Context, channelID uint64) error {
+	return repo.store.DeleteChannel(ctx, channelID)
+}
+
+// ListReplyIDs returns up to limit replies to a thread root after the given reply, oldest first
+func (repo *MessageRepoImpl) ListReplyIDs(ctx context.Context, channelID, rootID, after uint64, limit int) ([]uint64, error) {
+	return repo.store.ListReplyIDs(ctx, channelID, rootID, after, limit)
+}
+
+// CountReplies counts the replies of each thread root; roots without replies are left out
+func (repo *MessageRepoImpl) CountReplies(ctx context.Context, channelID uint64, rootIDs []uint64) (map[uint64]int64, error) {
+	return repo.store.CountReplies(ctx, channelID, rootIDs)
+}
+
+// TrimMessages removes messages for good and gives their slots back to the message limit
+// of the channel
+func (repo *MessageRepoImpl) TrimMessages(ctx context.Context, channelID uint64, messageIDs []uint64) error {
+	return repo.store.Trim(ctx, channelID, messageIDs)
+}
+
+// ArchiveRepoImpl stores channel archives encrypted as a whole by the cipher
+type ArchiveRepoImpl struct {
+	s3Client *s3.Client
+	bucket   string
+	cipher   MessageCipher
+}
+
+func NewArchiveRepoImpl(config *config.Config, cipher MessageCipher) *ArchiveRepoImpl {
+	s3Config := config.Chat.Archive.S3
+	return &ArchiveRepoImpl{
+		s3Client: newS3Client(s3Config.Endpoint, s3Config.Region, s3Config.AccessKey, s3Config.SecretKey),
+		bucket:   s3Config.Bucket,
+		cipher:   cipher,
+	}
+}
+
+func newS3Client(endpoint, region, accessKey, secretKey string) *s3.Client {
+	creds := credentials.NewStaticCredentialsProvider(accessKey, secretKey, "")
+	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		return aws.Endpoint{
+			PartitionID:       "aws",
+			URL:               endpoint,
+			SigningRegion:     region,
+			HostnameImmutable: true,
+		}, nil
+	})
+	awsConfig := aws.Config{
+		Credentials:                 creds,
+		EndpointResolverWithOptions: customResolver,
+		Region:                      region,
+		RetryMaxAttempts:            3,
+	}
+	return s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.UsePathStyle = true
+	})
+}
+
+func (repo *ArchiveRepoImpl) PutArchive(ctx context.Context, channelID uint64, data []byte) error {
+	encrypted, err := repo.cipher.Encrypt(channelID, string(data))
+	if err != nil {
+		return err
+	}
+	_, err = repo.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(repo.bucket),
+		Key:    aws.String(archiveObjectKey(channelID)),
+		Body:   strings.NewReader(encrypted),
+	})
+	return err
+}
+func (repo *ArchiveRepoImpl) GetArchive(ctx context.Context, channelID uint64) (bool, []byte, error) {
+	out, err := repo.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(repo.bucket),
+		Key:    aws.String(archiveObjectKey(channelID)),
+	})
 	if err != nil {
-		return nil, "", err
-	}
-	iter := repo.s.Query(`SELECT id, event, channel_id, user_id, payload, seen, timestamp FROM messages WHERE channel_id = ?`, channelID).
-		WithContext(ctx).Idempotent(true).PageSize(repo.pagination).PageState(pageState).Iter()
-	nextPageStateBase64 := b64.URLEncoding.EncodeToString(iter.PageState())
-	scanner := iter.Scanner()
-
-	for scanner.Next() {
-		var message Message
-		if err = scanner.Scan(
-			&message.MessageID,
-			&message.Event,
-			&message.ChannelID,
-			&message.UserID,
-			&message.Payload,
-			&message.Seen,
-			&message.Time); err != nil {
-			return nil, "", err
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return false, nil, nil
+		}
+		return false, nil, err
+	}
+	defer out.Body.Close()
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return false, nil, err
+	}
+	decrypted, err := repo.cipher.Decrypt(channelID, string(data))
+	if err != nil {
+		return false, nil, err
+	}
+	return true, []byte(decrypted), nil
+}
+func (repo *ArchiveRepoImpl) DeleteArchive(ctx context.Context, channelID uint64) error {
+	_, err := repo.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(repo.bucket),
+		Key:    aws.String(archiveObjectKey(channelID)),
+	})
+	return err
+}
+
+func archiveObjectKey(channelID uint64) string {
+	return common.Join("archives/", strconv.FormatUint(channelID, 10), ".json")
+}
+
+// AttachmentRepoImpl looks up files in the upload buckets of the uploader
+type AttachmentRepoImpl struct {
+	s3Client *s3.Client
+	buckets  *common.BucketRouter
+}
+
+func NewAttachmentRepoImpl(config *config.Config) *AttachmentRepoImpl {
+	s3Config := config.Uploader.S3
+	return &AttachmentRepoImpl{
+		s3Client: newS3Client(s3Config.Endpoint, s3Config.Region, s3Config.AccessKey, s3Config.SecretKey),
+		buckets:  common.NewBucketRouter(s3Config.Bucket, s3Config.BucketRouting),
+	}
+}
+
+// StatAttachment returns the content type and size of an uploaded object
+func (repo *AttachmentRepoImpl) StatAttachment(ctx context.Context, objectKey string) (*Attachment, error) {
+	out, err := repo.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(repo.buckets.Bucket(objectKey)),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return nil, ErrAttachmentNotFound
+		}
+		return nil, err
+	}
+	return &Attachment{
+		Key:         objectKey,
+		ContentType: aws.ToString(out.ContentType),
+		Size:        out.ContentLength,
+	}, nil
+}
+
+// CountChannelAttachments returns the number of objects uploaded to a channel
+func (repo *AttachmentRepoImpl) CountChannelAttachments(ctx context.Context, channelID uint64) (int, error) {
+	count := 0
+	for _, bucket := range repo.buckets.Buckets() {
+		paginator := s3.NewListObjectsV2Paginator(repo.s3Client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(bucket),
+			Prefix: aws.String(common.Join(strconv.FormatUint(channelID, 10), "/")),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return count, err
+			}
+			count += len(page.Contents)
 		}
-		messages = append(messages, &message)
 	}
-	err = scanner.Err()
+	return count, nil
+}
+
+// thumbnailSuffix is appended by the uploader to the object key of an image to derive the
+// key of its thumbnail
+const thumbnailSuffix = "_thumb"
+
+// DeleteAttachment deletes an uploaded object along with its thumbnail, if any, and returns
+// the size of the object, which is 0 if it was already gone
+func (repo *AttachmentRepoImpl) DeleteAttachment(ctx context.Context, objectKey string) (int64, error) {
+	attachment, err := repo.StatAttachment(ctx, objectKey)
+	if errors.Is(err, ErrAttachmentNotFound) {
+		return 0, nil
+	}
 	if err != nil {
-		return nil, "", err
+		return 0, err
+	}
+	bucket := repo.buckets.Bucket(objectKey)
+	// deleting a missing thumbnail is a no-op
+	for _, key := range []string{objectKey, objectKey + thumbnailSuffix} {
+		if _, err := repo.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return attachment.Size, nil
+}
+
+// DeleteChannelAttachments deletes every object uploaded to a channel, i.e. every object
+// under the channel id prefix of each upload bucket, and returns the number of deleted objects
+func (repo *AttachmentRepoImpl) DeleteChannelAttachments(ctx context.Context, channelID uint64) (int, error) {
+	deleted := 0
+	for _, bucket := range repo.buckets.Buckets() {
+		n, err := repo.deleteChannelAttachments(ctx, bucket, channelID)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
 	}
-	return messages, nextPageStateBase64, nil
+	return deleted, nil
+}
+
+func (repo *AttachmentRepoImpl) deleteChannelAttachments(ctx context.Context, bucket string, channelID uint64) (int, error) {
+	paginator := s3.NewListObjectsV2Paginator(repo.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(common.Join(strconv.FormatUint(channelID, 10), "/")),
+	})
+	deleted := 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return deleted, err
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+		objects := make([]types.ObjectIdentifier, len(page.Contents))
+		for i, object := range page.Contents {
+			objects[i] = types.ObjectIdentifier{Key: object.Key}
+		}
+		// a page holds at most 1000 keys, which is also the limit of a batch delete
+		out, err := repo.s3Client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{
+				Objects: objects,
+				Quiet:   true,
+			},
+		})
+		if err != nil {
+			return deleted, err
+		}
+		if len(out.Errors) > 0 {
+			return deleted, fmt.Errorf("error delete object %s: %s", aws.ToString(out.Errors[0].Key), aws.ToString(out.Errors[0].Message))
+		}
+		deleted += len(objects)
+	}
+	return deleted, nil
 }
 
 type ChannelRepoImpl struct {
@@ -187,11 +517,22 @@ func NewChannelRepoImpl(s *gocql.Session) *ChannelRepoImpl {
 	return &ChannelRepoImpl{s}
 }
 
-func (repo *ChannelRepoImpl) CreateChannel(ctx context.Context, channelID uint64) (*Channel, error) {
+func (repo *ChannelRepoImpl) CreateChannel(ctx context.Context, channelID uint64, name string, creatorID uint64) (*Channel, error) {
 	if err := repo.s.Query("INSERT INTO channels (id, user_id) VALUES (?, ?)",
 		channelID, 0).WithContext(ctx).Exec(); err != nil {
 		return nil, err
 	}
+	if err := repo.s.Query("INSERT INTO channel_metadata (channel_id, name, created_at, creator_id) VALUES (?, ?, ?, ?)",
+		channelID, name, time.Now().UnixMilli(), creatorID).WithContext(ctx).Exec(); err != nil {
+		return nil, err
+	}
+	// a creator given at creation takes precedence over the first user added
+	if creatorID != 0 {
+		if err := repo.s.Query("INSERT INTO channel_creators (channel_id, user_id) VALUES (?, ?)",
+			channelID, creatorID).WithContext(ctx).Exec(); err != nil {
+			return nil, err
+		}
+	}
 	accessToken, err := common.NewJWT(channelID)
 	if err != nil {
 		return nil, fmt.Errorf("error create JWT: %w", err)
@@ -206,9 +547,31 @@ func (repo *ChannelRepoImpl) DeleteChannel(ctx context.Context, channelID uint64
 		WithContext(ctx).Exec(); err != nil {
 		return err
 	}
+	if err := repo.s.Query("DELETE FROM channel_creators WHERE channel_id = ?", channelID).
+		WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	if err := repo.s.Query("DELETE FROM channel_metadata WHERE channel_id = ?", channelID).
+		WithContext(ctx).Exec(); err != nil {
+		return err
+	}
 	return nil
 }
 
+// GetChannelMetadata returns the metadata recorded at creation, which is empty for
+// channels created before it was recorded
+func (repo *ChannelRepoImpl) GetChannelMetadata(ctx context.Context, channelID uint64) (*ChannelMetadata, error) {
+	var metadata ChannelMetadata
+	if err := repo.s.Query("SELECT name, created_at, creator_id FROM channel_metadata WHERE channel_id = ?", channelID).
+		WithContext(ctx).Idempotent(true).Scan(&metadata.Name, &metadata.CreatedAt, &metadata.CreatorID); err != nil {
+		if err == gocql.ErrNotFound {
+			return &ChannelMetadata{}, nil
+		}
+		return nil, err
+	}
+	return &metadata, nil
+}
+
 type ForwardRepoImpl struct {
 	registerChannelSession endpoint.Endpoint
 	removeChannelSession   endpoint.Endpoint
@@ -2,57 +2,261 @@ package chat
 
 import (
 	"context"
+	"encoding/json"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
 	"github.com/minghsu0107/go-random-chat/pkg/infra"
 )
 
 var (
-	channelUsersPrefix = "rc:chanusers"
-	onlineUsersPrefix  = "rc:onlineusers"
+	channelUsersPrefix    = "rc:chanusers"
+	userChannelsPrefix    = "rc:userchanset"
+	lastMessageTimeKey    = "rc:lastmsgtime"
+	onlineUsersPrefix     = "rc:onlineusers"
+	floodViolationsPrefix = "rc:floodviolations"
+	connCooldownPrefix    = "rc:conncooldown"
+	revokedTokensPrefix   = "rc:revokedtokens"
+	stickerPackPrefix     = "rc:stickerpack"
+	typingUsersPrefix     = "rc:typingusers"
+	typingThrottlePrefix  = "rc:typingthrottle"
+	outboxPrefix          = "rc:outbox"
+	pendingDeliveryPrefix = "rc:pendingdelivery"
+	scheduledMsgsKey      = "rc:scheduledmsgs"
+	scheduledMsgDataKey   = "rc:scheduledmsgdata"
+	readCursorPrefix      = "rc:readcursor"
+	hideReceiptsPrefix    = "rc:hidereceipts"
+	presencePrefix        = "rc:presence"
+	channelActivityKey    = "rc:channelactivity"
+	archivedPrefix        = "rc:archived"
+	softArchivedPrefix    = "rc:softarchived"
+	channelExpiryPrefix   = "rc:chanexpiry"
+	channelExpiriesKey    = "rc:chanexpiries"
+	pendingOfflineKey     = "rc:pendingoffline"
+	messageSeqPrefix      = "rc:msgseq"
+	messageTTLPrefix      = "rc:msgttl"
+	messageExpiriesKey    = "rc:msgexpiries"
+	tombstonesPrefix      = "rc:tombstones"
+	reactionsPrefix       = "rc:reactions"
+	pinsPrefix            = "rc:pins"
+	channelRolesPrefix    = "rc:chanroles"
+	blocksPrefix          = "rc:blocks"
+	blockedByPrefix       = "rc:blockedby"
+	retentionLockKey      = "rc:retentionlock"
+	// maintained by the uploader
+	channelStoragePrefix = "rc:channelstorage"
+	fileDigestPrefix     = "rc:filedigests"
+	// fileDigestKeyField prefixes the fields of the digest index that map an object key
+	// back to its digest
+	fileDigestKeyField = "key:"
+)
+
+var (
+	// legacyUserChannelsPrefix keyed the hashes that indexed the channels of users before
+	// the index became a set; they are removed by the backfill
+	legacyUserChannelsPrefix = "rc:userchans"
+	userChannelsBackfillKey  = "rc:userchansbackfill"
 )
 
 type UserRepoCache interface {
 	AddUserToChannel(ctx context.Context, channelID uint64, userID uint64) error
 	GetUserByID(ctx context.Context, userID uint64) (*User, error)
+	GetUserIDBySession(ctx context.Context, sid string) (uint64, error)
 	IsChannelUserExist(ctx context.Context, channelID, userID uint64) (bool, error)
 	GetChannelUserIDs(ctx context.Context, channelID uint64) ([]uint64, error)
-	AddOnlineUser(ctx context.Context, channelID uint64, userID uint64) error
-	DeleteOnlineUser(ctx context.Context, channelID, userID uint64) error
+	GetChannelCreator(ctx context.Context, channelID uint64) (uint64, error)
+	SetChannelRole(ctx context.Context, channelID, creatorID, userID uint64, role Role) (bool, error)
+	GetChannelRoles(ctx context.Context, channelID uint64) (map[uint64]Role, error)
+	AddOnlineUser(ctx context.Context, channelID uint64, userID uint64) (int64, error)
+	DeleteOnlineUser(ctx context.Context, channelID, userID uint64) (int64, error)
+	IsOnlineUser(ctx context.Context, channelID, userID uint64) (bool, error)
 	GetOnlineUserIDs(ctx context.Context, channelID uint64) ([]uint64, error)
+	SchedulePendingOffline(ctx context.Context, channelID, userID uint64, at time.Time) error
+	CancelPendingOffline(ctx context.Context, channelID, userID uint64) (bool, error)
+	PopDuePendingOffline(ctx context.Context, now time.Time) ([]ChannelUser, error)
+	AddFloodViolation(ctx context.Context, userID uint64, window time.Duration) (int64, error)
+	SetConnectionCooldown(ctx context.Context, userID uint64, cooldown time.Duration) error
+	IsInConnectionCooldown(ctx context.Context, userID uint64) (bool, error)
+	RevokeToken(ctx context.Context, tokenID string, ttl time.Duration) (bool, error)
+	GetUserChannelIDs(ctx context.Context, userID uint64) ([]uint64, error)
+	RemoveUserChannels(ctx context.Context, channelID uint64, userIDs []uint64) error
+	BackfillUserChannels(ctx context.Context, channelUsers []ChannelUser) error
+	ListChannelUsers(ctx context.Context, pageState []byte, pageSize int) ([]ChannelUser, []byte, error)
+	AcquireUserChannelsBackfill(ctx context.Context) (bool, error)
+	ReleaseUserChannelsBackfill(ctx context.Context) error
+	SetTypingUser(ctx context.Context, channelID, userID uint64, typing bool) error
+	GetTypingUserIDs(ctx context.Context, channelID uint64, since time.Time) ([]uint64, error)
+	AllowTypingBroadcast(ctx context.Context, channelID, userID uint64, interval time.Duration) (bool, error)
+	SetReadCursor(ctx context.Context, channelID, userID, messageID uint64) error
+	GetReadCursors(ctx context.Context, channelID uint64) (map[uint64]uint64, error)
+	SetReadReceiptsEnabled(ctx context.Context, userID uint64, enabled bool) error
+	IsReadReceiptsEnabled(ctx context.Context, userID uint64) (bool, error)
+	TouchPresence(ctx context.Context, userID uint64) error
+	KeepPresence(ctx context.Context, userID uint64) error
+	GetLastActiveTimes(ctx context.Context, userIDs []uint64) ([]int64, error)
+	SetBlocked(ctx context.Context, userID, targetID uint64, blocked bool) error
+	GetBlockedUsers(ctx context.Context, userID uint64) ([]BlockedUser, error)
+	GetBlockerIDs(ctx context.Context, userID uint64) ([]uint64, error)
 }
 
 type MessageRepoCache interface {
 	InsertMessage(ctx context.Context, msg *Message) error
 	MarkMessageSeen(ctx context.Context, channelID, messageID uint64) error
+	GetMessage(ctx context.Context, channelID, messageID uint64) (*Message, error)
+	EditMessage(ctx context.Context, channelID, messageID uint64, payload string, editedTime int64) error
+	DeleteMessage(ctx context.Context, channelID, messageID uint64) error
+	UpdateReaction(ctx context.Context, channelID, messageID, userID uint64, emoji string, add bool) (map[string][]uint64, error)
+	GetReactions(ctx context.Context, channelID uint64, messageIDs []uint64) ([]map[string][]uint64, error)
+	PinMessage(ctx context.Context, channelID, messageID uint64, maxPins int64) (bool, error)
+	UnpinMessage(ctx context.Context, channelID, messageID uint64) error
+	GetPinnedMessageIDs(ctx context.Context, channelID uint64) ([]uint64, error)
 	PublishMessage(ctx context.Context, msg *Message) error
-	ListMessages(ctx context.Context, channelID uint64, pageStateStr string) ([]*Message, string, error)
+	ListMessages(ctx context.Context, channelID uint64, pageStateStr string, pageSize int) ([]*Message, string, error)
+	GetLatestMessageID(ctx context.Context, channelID uint64) (uint64, error)
+	CountMessages(ctx context.Context, channelID uint64) (int64, error)
+	CountMessagesAfter(ctx context.Context, channelID, messageID, excludedUserID uint64) (int64, error)
+	ListMessagesAfter(ctx context.Context, channelID, messageID uint64, limit int) ([]*Message, error)
+	ListReplyIDs(ctx context.Context, channelID, rootID, after uint64, limit int) ([]uint64, error)
+	CountReplies(ctx context.Context, channelID uint64, rootIDs []uint64) (map[uint64]int64, error)
+	AddToOutbox(ctx context.Context, userID uint64, msg *Message) error
+	GetOutbox(ctx context.Context, channelID, userID uint64) ([]*Message, error)
+	RemoveFromOutbox(ctx context.Context, channelID, userID, messageID uint64) error
+	AddPendingDelivery(ctx context.Context, channelID, userID, messageID uint64) error
+	GetPendingDeliveries(ctx context.Context, channelID, userID uint64) ([]uint64, error)
+	RemovePendingDelivery(ctx context.Context, channelID, userID, messageID uint64) error
+	AddScheduledMessage(ctx context.Context, msg *ScheduledMessage) error
+	GetScheduledMessage(ctx context.Context, id uint64) (bool, *ScheduledMessage, error)
+	ClaimScheduledMessage(ctx context.Context, id uint64) (bool, error)
+	RemoveScheduledMessage(ctx context.Context, id uint64) error
+	PopDueScheduledMessageIDs(ctx context.Context, now time.Time) ([]uint64, error)
+	RequeueScheduledMessage(ctx context.Context, id uint64, sendAt time.Time) error
+	CountScheduledMessages(ctx context.Context) (int64, error)
+	RestoreMessages(ctx context.Context, msgs []*Message) error
+	DeleteMessages(ctx context.Context, channelID uint64) error
+	TrimMessages(ctx context.Context, channelID uint64, messageIDs []uint64) error
+	GetLastMessageTimes(ctx context.Context, channelIDs []uint64) (map[uint64]int64, error)
+	DeleteLastMessageTime(ctx context.Context, channelID uint64) error
+	SetChannelMessageTTL(ctx context.Context, channelID uint64, ttl time.Duration) error
+	GetChannelMessageTTL(ctx context.Context, channelID uint64) (time.Duration, error)
+	PopExpiredMessages(ctx context.Context, now time.Time) ([]ChannelMessage, error)
+	RetryMessageExpiry(ctx context.Context, channelID, messageID uint64) error
+	AddTombstone(ctx context.Context, userID uint64, tombstone *Message) error
+	GetTombstones(ctx context.Context, channelID, userID uint64) ([]*Message, error)
+	RemoveTombstone(ctx context.Context, channelID, userID, messageID uint64) error
+	ReleaseAttachment(ctx context.Context, channelID uint64, objectKey string, size int64) error
 }
 
 type ChannelRepoCache interface {
-	CreateChannel(ctx context.Context, channelID uint64) (*Channel, error)
+	CreateChannel(ctx context.Context, channelID uint64, name string, creatorID uint64) (*Channel, error)
 	DeleteChannel(ctx context.Context, channelID uint64) error
+	GetChannelMetadata(ctx context.Context, channelID uint64) (*ChannelMetadata, error)
+	SetStickerPack(ctx context.Context, channelID uint64, stickers []Sticker) error
+	GetStickerPack(ctx context.Context, channelID uint64) ([]Sticker, error)
+	IsStickerInPack(ctx context.Context, channelID uint64, name string) (bool, bool, error)
+	TouchChannelActivity(ctx context.Context, channelID uint64) error
+	GetInactiveChannelIDs(ctx context.Context, lastActiveBefore time.Time) ([]uint64, error)
+	TakeChannelActivity(ctx context.Context, channelID uint64) (bool, error)
+	GetActiveChannelIDs(ctx context.Context) ([]uint64, error)
+	AcquireRetentionRun(ctx context.Context, interval time.Duration) (bool, error)
+	SetChannelArchived(ctx context.Context, channelID uint64, archived bool) error
+	IsChannelArchived(ctx context.Context, channelID uint64) (bool, error)
+	SetChannelSoftArchived(ctx context.Context, channelID uint64, archived bool) error
+	IsChannelSoftArchived(ctx context.Context, channelID uint64) (bool, error)
+	FreeChannelCache(ctx context.Context, channelID uint64) error
+	SetChannelExpiry(ctx context.Context, channelID uint64, ttl time.Duration) error
+	GetChannelExpiry(ctx context.Context, channelID uint64) (time.Time, error)
+	PopExpiredChannelIDs(ctx context.Context, now time.Time) ([]uint64, error)
+	RetryChannelExpiry(ctx context.Context, channelID uint64) error
 }
 
 type UserRepoCacheImpl struct {
-	r        infra.RedisCache
-	userRepo UserRepo
+	r           infra.RedisCache
+	userRepo    UserRepo
+	presenceTTL time.Duration
 }
 
-func NewUserRepoCacheImpl(r infra.RedisCache, userRepo UserRepo) *UserRepoCacheImpl {
-	return &UserRepoCacheImpl{r, userRepo}
+func NewUserRepoCacheImpl(config *config.Config, r infra.RedisCache, userRepo UserRepo) *UserRepoCacheImpl {
+	return &UserRepoCacheImpl{
+		r:           r,
+		userRepo:    userRepo,
+		presenceTTL: time.Duration(config.Chat.Presence.OfflineSecond) * time.Second,
+	}
 }
 func (cache *UserRepoCacheImpl) AddUserToChannel(ctx context.Context, channelID uint64, userID uint64) error {
 	if err := cache.userRepo.AddUserToChannel(ctx, channelID, userID); err != nil {
 		return nil
 	}
 	key := constructKey(channelUsersPrefix, channelID)
-	return cache.r.HSet(ctx, key, strconv.FormatUint(userID, 10), 1)
+	if err := cache.r.HSet(ctx, key, strconv.FormatUint(userID, 10), 1); err != nil {
+		return err
+	}
+	return cache.r.SAdd(ctx, constructKey(userChannelsPrefix, userID), strconv.FormatUint(channelID, 10))
+}
+
+// GetUserChannelIDs returns the channels a user has joined, from the inverse index of
+// channel users kept on join, leave and channel deletion
+func (cache *UserRepoCacheImpl) GetUserChannelIDs(ctx context.Context, userID uint64) ([]uint64, error) {
+	members, err := cache.r.SMembers(ctx, constructKey(userChannelsPrefix, userID))
+	if err != nil {
+		return nil, err
+	}
+	channelIDs := make([]uint64, 0, len(members))
+	for _, channelIDStr := range members {
+		channelID, err := strconv.ParseUint(channelIDStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		channelIDs = append(channelIDs, channelID)
+	}
+	return channelIDs, nil
+}
+func (cache *UserRepoCacheImpl) RemoveUserChannels(ctx context.Context, channelID uint64, userIDs []uint64) error {
+	channelIDStr := strconv.FormatUint(channelID, 10)
+	for _, userID := range userIDs {
+		if err := cache.r.SRem(ctx, constructKey(userChannelsPrefix, userID), channelIDStr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackfillUserChannels adds memberships to the inverse index of channel users and drops
+// the legacy index of their users
+func (cache *UserRepoCacheImpl) BackfillUserChannels(ctx context.Context, channelUsers []ChannelUser) error {
+	for _, channelUser := range channelUsers {
+		if err := cache.r.SAdd(ctx, constructKey(userChannelsPrefix, channelUser.UserID), strconv.FormatUint(channelUser.ChannelID, 10)); err != nil {
+			return err
+		}
+		if err := cache.r.Delete(ctx, constructKey(legacyUserChannelsPrefix, channelUser.UserID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+func (cache *UserRepoCacheImpl) ListChannelUsers(ctx context.Context, pageState []byte, pageSize int) ([]ChannelUser, []byte, error) {
+	return cache.userRepo.ListChannelUsers(ctx, pageState, pageSize)
+}
+
+// AcquireUserChannelsBackfill reports whether the backfill of the inverse index of channel
+// users is up to this replica; it is done once per deployment
+func (cache *UserRepoCacheImpl) AcquireUserChannelsBackfill(ctx context.Context) (bool, error) {
+	return cache.r.SetNXWithExpiration(ctx, userChannelsBackfillKey, 1, 0)
+}
+
+// ReleaseUserChannelsBackfill lets a failed backfill be retried on the next start
+func (cache *UserRepoCacheImpl) ReleaseUserChannelsBackfill(ctx context.Context) error {
+	return cache.r.Delete(ctx, userChannelsBackfillKey)
 }
 func (cache *UserRepoCacheImpl) GetUserByID(ctx context.Context, userID uint64) (*User, error) {
 	return cache.userRepo.GetUserByID(ctx, userID)
 }
+func (cache *UserRepoCacheImpl) GetUserIDBySession(ctx context.Context, sid string) (uint64, error) {
+	return cache.userRepo.GetUserIDBySession(ctx, sid)
+}
 func (cache *UserRepoCacheImpl) IsChannelUserExist(ctx context.Context, channelID, userID uint64) (bool, error) {
 	key := constructKey(channelUsersPrefix, channelID)
 	var dummy int
@@ -85,6 +289,38 @@ func (cache *UserRepoCacheImpl) IsChannelUserExist(ctx context.Context, channelI
 	}
 	return channelUserExist, nil
 }
+func (cache *UserRepoCacheImpl) GetChannelCreator(ctx context.Context, channelID uint64) (uint64, error) {
+	return cache.userRepo.GetChannelCreator(ctx, channelID)
+}
+
+// SetChannelRole assigns a role to a user of the channel unless that demotes the last admin,
+// counting the creator as admin while no role is assigned to them. It reports whether the
+// role was set
+func (cache *UserRepoCacheImpl) SetChannelRole(ctx context.Context, channelID, creatorID, userID uint64, role Role) (bool, error) {
+	var creator string
+	if creatorID != 0 {
+		creator = strconv.FormatUint(creatorID, 10)
+	}
+	return cache.r.HSetUnlessLast(ctx, constructKey(channelRolesPrefix, channelID), strconv.FormatUint(userID, 10),
+		string(role), string(RoleAdmin), creator)
+}
+
+// GetChannelRoles returns the roles explicitly assigned to users of a channel
+func (cache *UserRepoCacheImpl) GetChannelRoles(ctx context.Context, channelID uint64) (map[uint64]Role, error) {
+	roleMap, err := cache.r.HGetAll(ctx, constructKey(channelRolesPrefix, channelID))
+	if err != nil {
+		return nil, err
+	}
+	roles := make(map[uint64]Role, len(roleMap))
+	for userIDStr, role := range roleMap {
+		userID, err := strconv.ParseUint(userIDStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		roles[userID] = Role(role)
+	}
+	return roles, nil
+}
 func (cache *UserRepoCacheImpl) GetChannelUserIDs(ctx context.Context, channelID uint64) ([]uint64, error) {
 	key := constructKey(channelUsersPrefix, channelID)
 	userMap, err := cache.r.HGetAll(ctx, key)
@@ -116,14 +352,26 @@ func (cache *UserRepoCacheImpl) GetChannelUserIDs(ctx context.Context, channelID
 	}
 	return userIDs, nil
 }
-func (cache *UserRepoCacheImpl) AddOnlineUser(ctx context.Context, channelID uint64, userID uint64) error {
+
+// AddOnlineUser counts a new connection of the user to the channel and returns the number
+// of connections the user now has, so that a user with several tabs stays online until
+// the last one closes
+func (cache *UserRepoCacheImpl) AddOnlineUser(ctx context.Context, channelID uint64, userID uint64) (int64, error) {
 	key := constructKey(onlineUsersPrefix, channelID)
-	return cache.r.HSet(ctx, key, strconv.FormatUint(userID, 10), 1)
+	return cache.r.HIncrBy(ctx, key, strconv.FormatUint(userID, 10), 1)
 }
-func (cache *UserRepoCacheImpl) DeleteOnlineUser(ctx context.Context, channelID, userID uint64) error {
+
+// DeleteOnlineUser uncounts a closed connection of the user and returns the number of
+// connections left; the user is offline once none is left
+func (cache *UserRepoCacheImpl) DeleteOnlineUser(ctx context.Context, channelID, userID uint64) (int64, error) {
 	key := constructKey(onlineUsersPrefix, channelID)
 	userKey := strconv.FormatUint(userID, 10)
-	return cache.r.HDel(ctx, key, userKey)
+	return cache.r.HDecrOrDel(ctx, key, userKey)
+}
+func (cache *UserRepoCacheImpl) IsOnlineUser(ctx context.Context, channelID, userID uint64) (bool, error) {
+	key := constructKey(onlineUsersPrefix, channelID)
+	var connections int64
+	return cache.r.HGet(ctx, key, strconv.FormatUint(userID, 10), &connections)
 }
 func (cache *UserRepoCacheImpl) GetOnlineUserIDs(ctx context.Context, channelID uint64) ([]uint64, error) {
 	key := constructKey(onlineUsersPrefix, channelID)
@@ -142,25 +390,688 @@ func (cache *UserRepoCacheImpl) GetOnlineUserIDs(ctx context.Context, channelID
 	return userIDs, nil
 }
 
+// SchedulePendingOffline holds back the offline presence of a user until at
+func (cache *UserRepoCacheImpl) SchedulePendingOffline(ctx context.Context, channelID, userID uint64, at time.Time) error {
+	return cache.r.ZAdd(ctx, pendingOfflineKey, float64(at.UnixMilli()), pendingOfflineMember(channelID, userID))
+}
+
+// CancelPendingOffline drops the held back offline presence of a user that reconnected and
+// reports whether there was one
+func (cache *UserRepoCacheImpl) CancelPendingOffline(ctx context.Context, channelID, userID uint64) (bool, error) {
+	return cache.r.ZRemIfExists(ctx, pendingOfflineKey, pendingOfflineMember(channelID, userID))
+}
+
+// PopDuePendingOffline atomically takes the offline presences due by now, so that each
+// one is sent by a single replica
+func (cache *UserRepoCacheImpl) PopDuePendingOffline(ctx context.Context, now time.Time) ([]ChannelUser, error) {
+	members, err := cache.r.ZPopByScore(ctx, pendingOfflineKey, float64(now.UnixMilli()))
+	if err != nil {
+		return nil, err
+	}
+	var users []ChannelUser
+	for _, member := range members {
+		// a malformed member is dropped rather than losing the users popped with it
+		channelIDStr, userIDStr, _ := strings.Cut(member, ":")
+		channelID, err := strconv.ParseUint(channelIDStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		userID, err := strconv.ParseUint(userIDStr, 10, 64)
+		if err != nil {
+			continue
+		}
+		users = append(users, ChannelUser{
+			ChannelID: channelID,
+			UserID:    userID,
+		})
+	}
+	return users, nil
+}
+
+func pendingOfflineMember(channelID, userID uint64) string {
+	return common.Join(strconv.FormatUint(channelID, 10), ":", strconv.FormatUint(userID, 10))
+}
+func (cache *UserRepoCacheImpl) AddFloodViolation(ctx context.Context, userID uint64, window time.Duration) (int64, error) {
+	return cache.r.IncrWithExpiration(ctx, constructKey(floodViolationsPrefix, userID), window)
+}
+func (cache *UserRepoCacheImpl) SetConnectionCooldown(ctx context.Context, userID uint64, cooldown time.Duration) error {
+	return cache.r.SetWithExpiration(ctx, constructKey(connCooldownPrefix, userID), 1, cooldown)
+}
+func (cache *UserRepoCacheImpl) IsInConnectionCooldown(ctx context.Context, userID uint64) (bool, error) {
+	return cache.r.Exists(ctx, constructKey(connCooldownPrefix, userID))
+}
+
+// RevokeToken adds the token id to the denylist until ttl elapses. It reports false if the
+// token was already revoked, so that only one caller can ever spend a token
+func (cache *UserRepoCacheImpl) RevokeToken(ctx context.Context, tokenID string, ttl time.Duration) (bool, error) {
+	return cache.r.SetNXWithExpiration(ctx, common.Join(revokedTokensPrefix, ":", tokenID), 1, ttl)
+}
+func (cache *UserRepoCacheImpl) SetTypingUser(ctx context.Context, channelID, userID uint64, typing bool) error {
+	key := constructKey(typingUsersPrefix, channelID)
+	userKey := strconv.FormatUint(userID, 10)
+	if !typing {
+		return cache.r.HDel(ctx, key, userKey)
+	}
+	return cache.r.HSet(ctx, key, userKey, time.Now().Unix())
+}
+
+// GetTypingUserIDs returns users who started typing after since and have not stopped
+func (cache *UserRepoCacheImpl) GetTypingUserIDs(ctx context.Context, channelID uint64, since time.Time) ([]uint64, error) {
+	key := constructKey(typingUsersPrefix, channelID)
+	userMap, err := cache.r.HGetAll(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var userIDs []uint64
+	for userIDStr, startedAtStr := range userMap {
+		startedAt, err := strconv.ParseInt(startedAtStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if startedAt < since.Unix() {
+			continue
+		}
+		userID, err := strconv.ParseUint(userIDStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
+}
+
+// AllowTypingBroadcast reports whether the typing state of the user may be broadcast,
+// allowing at most one broadcast per interval across all replicas
+func (cache *UserRepoCacheImpl) AllowTypingBroadcast(ctx context.Context, channelID, userID uint64, interval time.Duration) (bool, error) {
+	return cache.r.SetNXWithExpiration(ctx, constructTypingThrottleKey(channelID, userID), 1, interval)
+}
+
+// SetReadCursor advances the last message the user has seen in a channel
+func (cache *UserRepoCacheImpl) SetReadCursor(ctx context.Context, channelID, userID, messageID uint64) error {
+	return cache.r.HSetIfGreater(ctx, constructKey(readCursorPrefix, channelID), strconv.FormatUint(userID, 10), messageID)
+}
+
+// GetReadCursors returns the last message seen by each user of a channel
+func (cache *UserRepoCacheImpl) GetReadCursors(ctx context.Context, channelID uint64) (map[uint64]uint64, error) {
+	cursorMap, err := cache.r.HGetAll(ctx, constructKey(readCursorPrefix, channelID))
+	if err != nil {
+		return nil, err
+	}
+	cursors := make(map[uint64]uint64, len(cursorMap))
+	for userIDStr, messageIDStr := range cursorMap {
+		userID, err := strconv.ParseUint(userIDStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		messageID, err := strconv.ParseUint(messageIDStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		cursors[userID] = messageID
+	}
+	return cursors, nil
+}
+func (cache *UserRepoCacheImpl) SetReadReceiptsEnabled(ctx context.Context, userID uint64, enabled bool) error {
+	key := constructKey(hideReceiptsPrefix, userID)
+	if enabled {
+		return cache.r.Delete(ctx, key)
+	}
+	return cache.r.SetWithExpiration(ctx, key, 1, 0)
+}
+func (cache *UserRepoCacheImpl) IsReadReceiptsEnabled(ctx context.Context, userID uint64) (bool, error) {
+	hidden, err := cache.r.Exists(ctx, constructKey(hideReceiptsPrefix, userID))
+	if err != nil {
+		return false, err
+	}
+	return !hidden, nil
+}
+
+// SetBlocked adds the target to or removes it from the block list of the user. Block
+// lists do not expire, and an inverse index maps users to those who blocked them
+func (cache *UserRepoCacheImpl) SetBlocked(ctx context.Context, userID, targetID uint64, blocked bool) error {
+	blocksKey := constructKey(blocksPrefix, userID)
+	blockedByKey := constructKey(blockedByPrefix, targetID)
+	userIDStr := strconv.FormatUint(userID, 10)
+	targetIDStr := strconv.FormatUint(targetID, 10)
+	if !blocked {
+		if err := cache.r.HDel(ctx, blocksKey, targetIDStr); err != nil {
+			return err
+		}
+		return cache.r.HDel(ctx, blockedByKey, userIDStr)
+	}
+	if err := cache.r.HSet(ctx, blocksKey, targetIDStr, time.Now().UnixMilli()); err != nil {
+		return err
+	}
+	return cache.r.HSet(ctx, blockedByKey, userIDStr, 1)
+}
+
+// GetBlockedUsers returns the block list of the user, the most recently blocked first
+func (cache *UserRepoCacheImpl) GetBlockedUsers(ctx context.Context, userID uint64) ([]BlockedUser, error) {
+	blockMap, err := cache.r.HGetAll(ctx, constructKey(blocksPrefix, userID))
+	if err != nil {
+		return nil, err
+	}
+	blocked := make([]BlockedUser, 0, len(blockMap))
+	for targetIDStr, blockedAtStr := range blockMap {
+		targetID, err := strconv.ParseUint(targetIDStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		blockedAt, err := strconv.ParseInt(blockedAtStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		blocked = append(blocked, BlockedUser{
+			UserID:    targetID,
+			BlockedAt: blockedAt,
+		})
+	}
+	sort.Slice(blocked, func(i, j int) bool {
+		return blocked[i].BlockedAt > blocked[j].BlockedAt
+	})
+	return blocked, nil
+}
+
+// GetBlockerIDs returns the users who blocked the user
+func (cache *UserRepoCacheImpl) GetBlockerIDs(ctx context.Context, userID uint64) ([]uint64, error) {
+	blockerMap, err := cache.r.HGetAll(ctx, constructKey(blockedByPrefix, userID))
+	if err != nil {
+		return nil, err
+	}
+	blockerIDs := make([]uint64, 0, len(blockerMap))
+	for blockerIDStr := range blockerMap {
+		blockerID, err := strconv.ParseUint(blockerIDStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		blockerIDs = append(blockerIDs, blockerID)
+	}
+	return blockerIDs, nil
+}
+
+// TouchPresence records user activity. The presence key expires once the user has
+// neither been active nor answered a ping within the presence ttl
+func (cache *UserRepoCacheImpl) TouchPresence(ctx context.Context, userID uint64) error {
+	return cache.r.SetWithExpiration(ctx, constructKey(presencePrefix, userID), time.Now().Unix(), cache.presenceTTL)
+}
+
+// KeepPresence extends the presence of a connected user without counting as activity
+func (cache *UserRepoCacheImpl) KeepPresence(ctx context.Context, userID uint64) error {
+	return cache.r.Expire(ctx, constructKey(presencePrefix, userID), cache.presenceTTL)
+}
+
+// GetLastActiveTimes returns the last activity in unix seconds of each user, or 0 for offline users
+func (cache *UserRepoCacheImpl) GetLastActiveTimes(ctx context.Context, userIDs []uint64) ([]int64, error) {
+	keys := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		keys[i] = constructKey(presencePrefix, userID)
+	}
+	vals, err := cache.r.PipelinedGet(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+	lastActiveTimes := make([]int64, len(vals))
+	for i, val := range vals {
+		if val == "" {
+			continue
+		}
+		lastActiveTimes[i], err = strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return lastActiveTimes, nil
+}
+
 type MessageRepoCacheImpl struct {
-	messageRepo MessageRepo
+	r                 infra.RedisCache
+	messageRepo       MessageRepo
+	cipher            MessageCipher
+	maxOutboxMessages int64
+	outboxTTL         time.Duration
+	maxPending        int64
+	pendingTTL        time.Duration
+	maxTombstones     int64
+	tombstoneTTL      time.Duration
 }
 
-func NewMessageRepoCacheImpl(messageRepo MessageRepo) *MessageRepoCacheImpl {
-	return &MessageRepoCacheImpl{messageRepo}
+func NewMessageRepoCacheImpl(config *config.Config, r infra.RedisCache, messageRepo MessageRepo, cipher MessageCipher) *MessageRepoCacheImpl {
+	return &MessageRepoCacheImpl{
+		r:                 r,
+		messageRepo:       messageRepo,
+		cipher:            cipher,
+		maxOutboxMessages: config.Chat.Outbox.MaxMessages,
+		outboxTTL:         time.Duration(config.Chat.Outbox.TTLSecond) * time.Second,
+		maxPending:        config.Chat.PendingDelivery.MaxMessages,
+		pendingTTL:        time.Duration(config.Chat.PendingDelivery.TTLSecond) * time.Second,
+		maxTombstones:     config.Chat.MessageExpiry.MaxTombstones,
+		tombstoneTTL:      time.Duration(config.Chat.MessageExpiry.TombstoneTTLSecond) * time.Second,
+	}
 }
 
+// InsertMessage assigns the message the next sequence number of its channel and stores it.
+// The counter is never reset while the channel exists, so a message rejected by the
+// database leaves a gap rather than a reused number. Disappearing messages are indexed by
+// their expiry
 func (cache *MessageRepoCacheImpl) InsertMessage(ctx context.Context, msg *Message) error {
-	return cache.messageRepo.InsertMessage(ctx, msg)
+	seq, err := cache.nextSeq(ctx, msg.ChannelID)
+	if err != nil {
+		return err
+	}
+	msg.Seq = seq
+	if err := cache.messageRepo.InsertMessage(ctx, msg); err != nil {
+		return err
+	}
+	if msg.ExpiresAt > 0 {
+		if err := cache.r.ZAdd(ctx, messageExpiriesKey, float64(msg.ExpiresAt), channelMessageMember(msg.ChannelID, msg.MessageID)); err != nil {
+			return err
+		}
+	}
+	channelIDStr := strconv.FormatUint(msg.ChannelID, 10)
+	if err := cache.r.HSetIfGreater(ctx, lastMessageTimeKey, channelIDStr, uint64(msg.Time)); err != nil {
+		return err
+	}
+	return cache.r.ZAdd(ctx, channelActivityKey, float64(time.Now().Unix()), channelIDStr)
+}
+
+// nextSeq increments the sequence counter of the channel. A counter lost along with Redis
+// data is seeded from the latest sequence number in the database first, so that numbers
+// keep increasing
+func (cache *MessageRepoCacheImpl) nextSeq(ctx context.Context, channelID uint64) (uint64, error) {
+	key := constructKey(messageSeqPrefix, channelID)
+	seq, err := cache.r.IncrIfExists(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	if seq > 0 {
+		return uint64(seq), nil
+	}
+	latestSeq, err := cache.messageRepo.GetLatestSeq(ctx, channelID)
+	if err != nil {
+		return 0, err
+	}
+	seq, err = cache.r.IncrFrom(ctx, key, int64(latestSeq))
+	if err != nil {
+		return 0, err
+	}
+	return uint64(seq), nil
+}
+
+// GetLastMessageTimes returns the time of the latest message of each channel that has one
+func (cache *MessageRepoCacheImpl) GetLastMessageTimes(ctx context.Context, channelIDs []uint64) (map[uint64]int64, error) {
+	times := make(map[uint64]int64, len(channelIDs))
+	if len(channelIDs) == 0 {
+		return times, nil
+	}
+	fields := make([]string, len(channelIDs))
+	for i, channelID := range channelIDs {
+		fields[i] = strconv.FormatUint(channelID, 10)
+	}
+	vals, err := cache.r.HMGet(ctx, lastMessageTimeKey, fields)
+	if err != nil {
+		return nil, err
+	}
+	for i, val := range vals {
+		timeStr, ok := val.(string)
+		if !ok {
+			continue
+		}
+		lastMessageTime, err := strconv.ParseInt(timeStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		times[channelIDs[i]] = lastMessageTime
+	}
+	return times, nil
+}
+func (cache *MessageRepoCacheImpl) DeleteLastMessageTime(ctx context.Context, channelID uint64) error {
+	return cache.r.HDel(ctx, lastMessageTimeKey, strconv.FormatUint(channelID, 10))
+}
+func (cache *MessageRepoCacheImpl) RestoreMessages(ctx context.Context, msgs []*Message) error {
+	return cache.messageRepo.RestoreMessages(ctx, msgs)
+}
+func (cache *MessageRepoCacheImpl) DeleteMessages(ctx context.Context, channelID uint64) error {
+	return cache.messageRepo.DeleteMessages(ctx, channelID)
+}
+
+// TrimMessages removes messages together with their reactions
+func (cache *MessageRepoCacheImpl) TrimMessages(ctx context.Context, channelID uint64, messageIDs []uint64) error {
+	if err := cache.messageRepo.TrimMessages(ctx, channelID, messageIDs); err != nil {
+		return err
+	}
+	key := constructKey(reactionsPrefix, channelID)
+	for _, messageID := range messageIDs {
+		if err := cache.r.HDel(ctx, key, strconv.FormatUint(messageID, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 func (cache *MessageRepoCacheImpl) MarkMessageSeen(ctx context.Context, channelID, messageID uint64) error {
 	return cache.messageRepo.MarkMessageSeen(ctx, channelID, messageID)
 }
+func (cache *MessageRepoCacheImpl) GetMessage(ctx context.Context, channelID, messageID uint64) (*Message, error) {
+	return cache.messageRepo.GetMessage(ctx, channelID, messageID)
+}
+func (cache *MessageRepoCacheImpl) EditMessage(ctx context.Context, channelID, messageID uint64, payload string, editedTime int64) error {
+	return cache.messageRepo.EditMessage(ctx, channelID, messageID, payload, editedTime)
+}
+func (cache *MessageRepoCacheImpl) DeleteMessage(ctx context.Context, channelID, messageID uint64) error {
+	if err := cache.messageRepo.DeleteMessage(ctx, channelID, messageID); err != nil {
+		return err
+	}
+	if err := cache.UnpinMessage(ctx, channelID, messageID); err != nil {
+		return err
+	}
+	return cache.r.HDel(ctx, constructKey(reactionsPrefix, channelID), strconv.FormatUint(messageID, 10))
+}
+
+// PinMessage pins a message unless the channel already has maxPins pinned messages, and
+// reports whether the message is pinned. Pins are kept apart from the messages, so they
+// outlive the messages being archived and are back once the channel is restored
+func (cache *MessageRepoCacheImpl) PinMessage(ctx context.Context, channelID, messageID uint64, maxPins int64) (bool, error) {
+	return cache.r.ZAddCapped(ctx, constructKey(pinsPrefix, channelID), float64(time.Now().UnixMilli()), strconv.FormatUint(messageID, 10), maxPins)
+}
+func (cache *MessageRepoCacheImpl) UnpinMessage(ctx context.Context, channelID, messageID uint64) error {
+	return cache.r.ZRemOne(ctx, constructKey(pinsPrefix, channelID), strconv.FormatUint(messageID, 10))
+}
+
+// GetPinnedMessageIDs returns the pinned messages of a channel, most recently pinned first
+func (cache *MessageRepoCacheImpl) GetPinnedMessageIDs(ctx context.Context, channelID uint64) ([]uint64, error) {
+	messageIDStrs, err := cache.r.ZRevRange(ctx, constructKey(pinsPrefix, channelID), 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	messageIDs := make([]uint64, len(messageIDStrs))
+	for i, messageIDStr := range messageIDStrs {
+		messageID, err := strconv.ParseUint(messageIDStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		messageIDs[i] = messageID
+	}
+	return messageIDs, nil
+}
+
+// UpdateReaction adds or removes the reaction of a user to a message and returns the
+// reactions of the message after the change. Reactions of all messages in a channel are
+// kept in a single hash so that they are dropped together with the channel
+func (cache *MessageRepoCacheImpl) UpdateReaction(ctx context.Context, channelID, messageID, userID uint64, emoji string, add bool) (map[string][]uint64, error) {
+	data, err := cache.r.HUpdateSetMember(ctx, constructKey(reactionsPrefix, channelID), strconv.FormatUint(messageID, 10), emoji, strconv.FormatUint(userID, 10), add)
+	if err != nil {
+		return nil, err
+	}
+	return decodeReactions(data)
+}
+
+// GetReactions returns the reactions of each message in one round trip
+func (cache *MessageRepoCacheImpl) GetReactions(ctx context.Context, channelID uint64, messageIDs []uint64) ([]map[string][]uint64, error) {
+	reactions := make([]map[string][]uint64, len(messageIDs))
+	if len(messageIDs) == 0 {
+		return reactions, nil
+	}
+	vals, err := cache.r.HMGet(ctx, constructKey(reactionsPrefix, channelID), formatIDs(messageIDs))
+	if err != nil {
+		return nil, err
+	}
+	for i, val := range vals {
+		data, ok := val.(string)
+		if !ok {
+			continue
+		}
+		if reactions[i], err = decodeReactions(data); err != nil {
+			return nil, err
+		}
+	}
+	return reactions, nil
+}
 func (cache *MessageRepoCacheImpl) PublishMessage(ctx context.Context, msg *Message) error {
 	return cache.messageRepo.PublishMessage(ctx, msg)
 }
-func (cache *MessageRepoCacheImpl) ListMessages(ctx context.Context, channelID uint64, pageStateStr string) ([]*Message, string, error) {
-	return cache.messageRepo.ListMessages(ctx, channelID, pageStateStr)
+func (cache *MessageRepoCacheImpl) ListMessages(ctx context.Context, channelID uint64, pageStateStr string, pageSize int) ([]*Message, string, error) {
+	return cache.messageRepo.ListMessages(ctx, channelID, pageStateStr, pageSize)
+}
+func (cache *MessageRepoCacheImpl) GetLatestMessageID(ctx context.Context, channelID uint64) (uint64, error) {
+	return cache.messageRepo.GetLatestMessageID(ctx, channelID)
+}
+func (cache *MessageRepoCacheImpl) CountMessages(ctx context.Context, channelID uint64) (int64, error) {
+	return cache.messageRepo.CountMessages(ctx, channelID)
+}
+func (cache *MessageRepoCacheImpl) CountMessagesAfter(ctx context.Context, channelID, messageID, excludedUserID uint64) (int64, error) {
+	return cache.messageRepo.CountMessagesAfter(ctx, channelID, messageID, excludedUserID)
+}
+func (cache *MessageRepoCacheImpl) ListMessagesAfter(ctx context.Context, channelID, messageID uint64, limit int) ([]*Message, error) {
+	return cache.messageRepo.ListMessagesAfter(ctx, channelID, messageID, limit)
+}
+func (cache *MessageRepoCacheImpl) ListReplyIDs(ctx context.Context, channelID, rootID, after uint64, limit int) ([]uint64, error) {
+	return cache.messageRepo.ListReplyIDs(ctx, channelID, rootID, after, limit)
+}
+func (cache *MessageRepoCacheImpl) CountReplies(ctx context.Context, channelID uint64, rootIDs []uint64) (map[uint64]int64, error) {
+	return cache.messageRepo.CountReplies(ctx, channelID, rootIDs)
+}
+
+// AddToOutbox retains a message for a recipient. The outbox keeps only the latest messages
+// up to the configured cap and expires as a whole once untouched for the configured ttl
+func (cache *MessageRepoCacheImpl) AddToOutbox(ctx context.Context, userID uint64, msg *Message) error {
+	payload, err := cache.cipher.Encrypt(msg.ChannelID, msg.Payload)
+	if err != nil {
+		return err
+	}
+	encrypted := *msg
+	encrypted.Payload = payload
+	return cache.r.HSetCapped(ctx, constructOutboxKey(msg.ChannelID, userID), strconv.FormatUint(msg.MessageID, 10), encrypted.Encode(), cache.maxOutboxMessages, cache.outboxTTL)
+}
+func (cache *MessageRepoCacheImpl) GetOutbox(ctx context.Context, channelID, userID uint64) ([]*Message, error) {
+	outbox, err := cache.r.HGetAll(ctx, constructOutboxKey(channelID, userID))
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*Message
+	for _, encoded := range outbox {
+		msg, err := DecodeToMessage([]byte(encoded))
+		if err != nil {
+			return nil, err
+		}
+		decryptMessage(cache.cipher, msg)
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].MessageID < msgs[j].MessageID
+	})
+	return msgs, nil
+}
+func (cache *MessageRepoCacheImpl) RemoveFromOutbox(ctx context.Context, channelID, userID, messageID uint64) error {
+	return cache.r.HDel(ctx, constructOutboxKey(channelID, userID), strconv.FormatUint(messageID, 10))
+}
+
+// SetChannelMessageTTL sets the ttl of messages sent to the channel without their own;
+// a zero ttl turns it off
+func (cache *MessageRepoCacheImpl) SetChannelMessageTTL(ctx context.Context, channelID uint64, ttl time.Duration) error {
+	key := constructKey(messageTTLPrefix, channelID)
+	if ttl <= 0 {
+		return cache.r.Delete(ctx, key)
+	}
+	return cache.r.Set(ctx, key, int64(ttl.Seconds()))
+}
+func (cache *MessageRepoCacheImpl) GetChannelMessageTTL(ctx context.Context, channelID uint64) (time.Duration, error) {
+	var ttlSecond int64
+	if _, err := cache.r.Get(ctx, constructKey(messageTTLPrefix, channelID), &ttlSecond); err != nil {
+		return 0, err
+	}
+	return time.Duration(ttlSecond) * time.Second, nil
+}
+
+// PopExpiredMessages atomically takes messages expired by now off the expiry index, so
+// that each one is deleted by a single replica
+func (cache *MessageRepoCacheImpl) PopExpiredMessages(ctx context.Context, now time.Time) ([]ChannelMessage, error) {
+	members, err := cache.r.ZPopByScore(ctx, messageExpiriesKey, float64(now.UnixMilli()))
+	if err != nil {
+		return nil, err
+	}
+	var msgs []ChannelMessage
+	for _, member := range members {
+		channelIDStr, messageIDStr, _ := strings.Cut(member, ":")
+		channelID, err := strconv.ParseUint(channelIDStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		messageID, err := strconv.ParseUint(messageIDStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, ChannelMessage{
+			ChannelID: channelID,
+			MessageID: messageID,
+		})
+	}
+	return msgs, nil
+}
+
+// RetryMessageExpiry puts an expired message back on the expiry index after a failed deletion
+func (cache *MessageRepoCacheImpl) RetryMessageExpiry(ctx context.Context, channelID, messageID uint64) error {
+	return cache.r.ZAdd(ctx, messageExpiriesKey, float64(time.Now().UnixMilli()), channelMessageMember(channelID, messageID))
+}
+
+func channelMessageMember(channelID, messageID uint64) string {
+	return common.Join(strconv.FormatUint(channelID, 10), ":", strconv.FormatUint(messageID, 10))
+}
+
+// AddTombstone keeps the tombstone of an expired message for a user that was offline when
+// it expired. Like the outbox, tombstones are capped and expire once untouched for the
+// configured ttl
+func (cache *MessageRepoCacheImpl) AddTombstone(ctx context.Context, userID uint64, tombstone *Message) error {
+	return cache.r.HSetCapped(ctx, constructTombstonesKey(tombstone.ChannelID, userID), strconv.FormatUint(tombstone.MessageID, 10), tombstone.Encode(), cache.maxTombstones, cache.tombstoneTTL)
+}
+
+// GetTombstones returns the tombstones kept for a user in ascending order
+func (cache *MessageRepoCacheImpl) GetTombstones(ctx context.Context, channelID, userID uint64) ([]*Message, error) {
+	key := constructTombstonesKey(channelID, userID)
+	encoded, err := cache.r.HGetAll(ctx, key)
+	if err != nil || len(encoded) == 0 {
+		return nil, err
+	}
+	tombstones := make([]*Message, 0, len(encoded))
+	for _, data := range encoded {
+		tombstone, err := DecodeToMessage([]byte(data))
+		if err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, tombstone)
+	}
+	sort.Slice(tombstones, func(i, j int) bool {
+		return tombstones[i].MessageID < tombstones[j].MessageID
+	})
+	return tombstones, nil
+}
+
+// RemoveTombstone drops a tombstone once it is delivered to the user
+func (cache *MessageRepoCacheImpl) RemoveTombstone(ctx context.Context, channelID, userID, messageID uint64) error {
+	return cache.r.HDel(ctx, constructTombstonesKey(channelID, userID), strconv.FormatUint(messageID, 10))
+}
+
+// ReleaseAttachment gives the storage of a deleted attachment back to the channel quota
+// and drops the object from the digest index of the uploader, so that an upload of the
+// same file is stored again rather than pointed at the deleted object
+func (cache *MessageRepoCacheImpl) ReleaseAttachment(ctx context.Context, channelID uint64, objectKey string, size int64) error {
+	if err := cache.r.HDelLinked(ctx, constructKey(fileDigestPrefix, channelID), fileDigestKeyField+objectKey); err != nil {
+		return err
+	}
+	if size <= 0 {
+		return nil
+	}
+	return cache.r.DecrByOrDel(ctx, constructKey(channelStoragePrefix, channelID), size)
+}
+
+// AddPendingDelivery records the id of a message that could not be delivered to a user.
+// Like the outbox, the set is capped and expires once untouched for the configured ttl
+func (cache *MessageRepoCacheImpl) AddPendingDelivery(ctx context.Context, channelID, userID, messageID uint64) error {
+	return cache.r.HSetCapped(ctx, constructPendingDeliveryKey(channelID, userID), strconv.FormatUint(messageID, 10), 1, cache.maxPending, cache.pendingTTL)
+}
+
+// GetPendingDeliveries returns the ids of the undelivered messages of a user in ascending order
+func (cache *MessageRepoCacheImpl) GetPendingDeliveries(ctx context.Context, channelID, userID uint64) ([]uint64, error) {
+	pending, err := cache.r.HGetAll(ctx, constructPendingDeliveryKey(channelID, userID))
+	if err != nil {
+		return nil, err
+	}
+	messageIDs := make([]uint64, 0, len(pending))
+	for messageIDStr := range pending {
+		messageID, err := strconv.ParseUint(messageIDStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+	sort.Slice(messageIDs, func(i, j int) bool {
+		return messageIDs[i] < messageIDs[j]
+	})
+	return messageIDs, nil
+}
+func (cache *MessageRepoCacheImpl) RemovePendingDelivery(ctx context.Context, channelID, userID, messageID uint64) error {
+	return cache.r.HDel(ctx, constructPendingDeliveryKey(channelID, userID), strconv.FormatUint(messageID, 10))
+}
+
+// AddScheduledMessage stores the message body in a hash and queues its id in a sorted set
+// scored by the send time
+func (cache *MessageRepoCacheImpl) AddScheduledMessage(ctx context.Context, msg *ScheduledMessage) error {
+	payload, err := cache.cipher.Encrypt(msg.ChannelID, msg.Payload)
+	if err != nil {
+		return err
+	}
+	encrypted := *msg
+	encrypted.Payload = payload
+	id := strconv.FormatUint(msg.ID, 10)
+	if err := cache.r.HSet(ctx, scheduledMsgDataKey, id, encrypted.Encode()); err != nil {
+		return err
+	}
+	return cache.r.ZAdd(ctx, scheduledMsgsKey, float64(msg.SendAt), id)
+}
+func (cache *MessageRepoCacheImpl) GetScheduledMessage(ctx context.Context, id uint64) (bool, *ScheduledMessage, error) {
+	var msg ScheduledMessage
+	exist, err := cache.r.HGet(ctx, scheduledMsgDataKey, strconv.FormatUint(id, 10), &msg)
+	if err != nil || !exist {
+		return false, nil, err
+	}
+	if msg.Payload, err = cache.cipher.Decrypt(msg.ChannelID, msg.Payload); err != nil {
+		payloadDecryptFailuresTotal.Inc()
+		return false, nil, err
+	}
+	return true, &msg, nil
+}
+
+// ClaimScheduledMessage deletes the message body; only the caller that actually deleted it
+// may deliver or cancel the message
+func (cache *MessageRepoCacheImpl) ClaimScheduledMessage(ctx context.Context, id uint64) (bool, error) {
+	return cache.r.HDelIfExists(ctx, scheduledMsgDataKey, strconv.FormatUint(id, 10))
+}
+func (cache *MessageRepoCacheImpl) RemoveScheduledMessage(ctx context.Context, id uint64) error {
+	return cache.r.ZRemOne(ctx, scheduledMsgsKey, strconv.FormatUint(id, 10))
+}
+
+// PopDueScheduledMessageIDs atomically dequeues messages due by now, so that each id is
+// handed to exactly one replica
+func (cache *MessageRepoCacheImpl) PopDueScheduledMessageIDs(ctx context.Context, now time.Time) ([]uint64, error) {
+	members, err := cache.r.ZPopByScore(ctx, scheduledMsgsKey, float64(now.UnixMilli()))
+	if err != nil {
+		return nil, err
+	}
+	var ids []uint64
+	for _, member := range members {
+		id, err := strconv.ParseUint(member, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// RequeueScheduledMessage queues a dequeued message id again, due at sendAt
+func (cache *MessageRepoCacheImpl) RequeueScheduledMessage(ctx context.Context, id uint64, sendAt time.Time) error {
+	return cache.r.ZAdd(ctx, scheduledMsgsKey, float64(sendAt.UnixMilli()), strconv.FormatUint(id, 10))
+}
+func (cache *MessageRepoCacheImpl) CountScheduledMessages(ctx context.Context) (int64, error) {
+	return cache.r.ZCard(ctx, scheduledMsgsKey)
 }
 
 type ChannelRepoCacheImpl struct {
@@ -172,8 +1083,155 @@ func NewChannelRepoCacheImpl(r infra.RedisCache, channelRepo ChannelRepo) *Chann
 	return &ChannelRepoCacheImpl{r, channelRepo}
 }
 
-func (cache *ChannelRepoCacheImpl) CreateChannel(ctx context.Context, channelID uint64) (*Channel, error) {
-	return cache.channelRepo.CreateChannel(ctx, channelID)
+func (cache *ChannelRepoCacheImpl) CreateChannel(ctx context.Context, channelID uint64, name string, creatorID uint64) (*Channel, error) {
+	channel, err := cache.channelRepo.CreateChannel(ctx, channelID, name, creatorID)
+	if err != nil {
+		return nil, err
+	}
+	if err := cache.TouchChannelActivity(ctx, channelID); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+func (cache *ChannelRepoCacheImpl) GetChannelMetadata(ctx context.Context, channelID uint64) (*ChannelMetadata, error) {
+	return cache.channelRepo.GetChannelMetadata(ctx, channelID)
+}
+
+// TouchChannelActivity records the channel as active now, which postpones its archival
+func (cache *ChannelRepoCacheImpl) TouchChannelActivity(ctx context.Context, channelID uint64) error {
+	return cache.r.ZAdd(ctx, channelActivityKey, float64(time.Now().Unix()), strconv.FormatUint(channelID, 10))
+}
+
+// GetActiveChannelIDs returns the channels in the activity index, i.e. the channels with
+// messages that are not archived
+func (cache *ChannelRepoCacheImpl) GetActiveChannelIDs(ctx context.Context) ([]uint64, error) {
+	members, err := cache.r.ZRange(ctx, channelActivityKey, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	channelIDs := make([]uint64, len(members))
+	for i, member := range members {
+		channelID, err := strconv.ParseUint(member, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		channelIDs[i] = channelID
+	}
+	return channelIDs, nil
+}
+
+// AcquireRetentionRun reports whether this replica runs message retention for the current
+// interval, so that channels are trimmed by a single replica at a time
+func (cache *ChannelRepoCacheImpl) AcquireRetentionRun(ctx context.Context, interval time.Duration) (bool, error) {
+	return cache.r.SetNXWithExpiration(ctx, retentionLockKey, 1, interval)
+}
+
+// GetInactiveChannelIDs returns the channels of the activity index inactive since
+// lastActiveBefore, leaving them in the index
+func (cache *ChannelRepoCacheImpl) GetInactiveChannelIDs(ctx context.Context, lastActiveBefore time.Time) ([]uint64, error) {
+	members, err := cache.r.ZRangeByScore(ctx, channelActivityKey, float64(lastActiveBefore.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	channelIDs := make([]uint64, len(members))
+	for i, member := range members {
+		channelID, err := strconv.ParseUint(member, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		channelIDs[i] = channelID
+	}
+	return channelIDs, nil
+}
+
+// TakeChannelActivity takes a channel off the activity index and reports whether it was
+// there, so that a channel is reaped by a single replica
+func (cache *ChannelRepoCacheImpl) TakeChannelActivity(ctx context.Context, channelID uint64) (bool, error) {
+	return cache.r.ZRemIfExists(ctx, channelActivityKey, strconv.FormatUint(channelID, 10))
+}
+
+func (cache *ChannelRepoCacheImpl) SetChannelArchived(ctx context.Context, channelID uint64, archived bool) error {
+	key := constructKey(archivedPrefix, channelID)
+	if !archived {
+		return cache.r.Delete(ctx, key)
+	}
+	return cache.r.SetWithExpiration(ctx, key, 1, 0)
+}
+func (cache *ChannelRepoCacheImpl) IsChannelArchived(ctx context.Context, channelID uint64) (bool, error) {
+	return cache.r.Exists(ctx, constructKey(archivedPrefix, channelID))
+}
+
+// SetChannelSoftArchived marks the channel read-only. Unlike cold archival, its messages
+// stay where they are
+func (cache *ChannelRepoCacheImpl) SetChannelSoftArchived(ctx context.Context, channelID uint64, archived bool) error {
+	key := constructKey(softArchivedPrefix, channelID)
+	if !archived {
+		return cache.r.Delete(ctx, key)
+	}
+	return cache.r.SetWithExpiration(ctx, key, 1, 0)
+}
+func (cache *ChannelRepoCacheImpl) IsChannelSoftArchived(ctx context.Context, channelID uint64) (bool, error) {
+	return cache.r.Exists(ctx, constructKey(softArchivedPrefix, channelID))
+}
+
+// SetChannelExpiry makes the channel expire after ttl. The expiry is kept in a key that
+// Redis expires along with the channel, and the deadline is indexed so that the sweeper
+// can find the channel once it is due
+func (cache *ChannelRepoCacheImpl) SetChannelExpiry(ctx context.Context, channelID uint64, ttl time.Duration) error {
+	expiresAt := time.Now().Add(ttl)
+	if err := cache.r.SetWithExpiration(ctx, constructKey(channelExpiryPrefix, channelID), expiresAt.UnixMilli(), ttl); err != nil {
+		return err
+	}
+	return cache.r.ZAdd(ctx, channelExpiriesKey, float64(expiresAt.Unix()), strconv.FormatUint(channelID, 10))
+}
+
+// GetChannelExpiry returns when the channel expires, or the zero time if it never does
+func (cache *ChannelRepoCacheImpl) GetChannelExpiry(ctx context.Context, channelID uint64) (time.Time, error) {
+	var expiresAt int64
+	exist, err := cache.r.Get(ctx, constructKey(channelExpiryPrefix, channelID), &expiresAt)
+	if err != nil || !exist {
+		return time.Time{}, err
+	}
+	return time.UnixMilli(expiresAt), nil
+}
+
+// PopExpiredChannelIDs atomically takes channels expired by now off the expiry index, so
+// that each one is torn down by a single replica
+func (cache *ChannelRepoCacheImpl) PopExpiredChannelIDs(ctx context.Context, now time.Time) ([]uint64, error) {
+	members, err := cache.r.ZPopByScore(ctx, channelExpiriesKey, float64(now.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	var channelIDs []uint64
+	for _, member := range members {
+		channelID, err := strconv.ParseUint(member, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		channelIDs = append(channelIDs, channelID)
+	}
+	return channelIDs, nil
+}
+
+// RetryChannelExpiry puts an expired channel back on the expiry index after a failed teardown
+func (cache *ChannelRepoCacheImpl) RetryChannelExpiry(ctx context.Context, channelID uint64) error {
+	return cache.r.ZAdd(ctx, channelExpiriesKey, float64(time.Now().Unix()), strconv.FormatUint(channelID, 10))
+}
+
+// FreeChannelCache drops the hot keys of a channel; channel users are reloaded from
+// the database on demand. Read cursors are kept, so unread counts survive a restore
+func (cache *ChannelRepoCacheImpl) FreeChannelCache(ctx context.Context, channelID uint64) error {
+	cmds := []infra.RedisCmd{}
+	for _, prefix := range []string{onlineUsersPrefix, channelUsersPrefix, typingUsersPrefix} {
+		cmds = append(cmds, infra.RedisCmd{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(prefix, channelID),
+			},
+		})
+	}
+	return cache.r.ExecPipeLine(ctx, &cmds)
 }
 func (cache *ChannelRepoCacheImpl) DeleteChannel(ctx context.Context, channelID uint64) error {
 	if err := cache.channelRepo.DeleteChannel(ctx, channelID); err != nil {
@@ -192,10 +1250,165 @@ func (cache *ChannelRepoCacheImpl) DeleteChannel(ctx context.Context, channelID
 				Key: constructKey(channelUsersPrefix, channelID),
 			},
 		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(stickerPackPrefix, channelID),
+			},
+		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(typingUsersPrefix, channelID),
+			},
+		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(readCursorPrefix, channelID),
+			},
+		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(channelStoragePrefix, channelID),
+			},
+		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(fileDigestPrefix, channelID),
+			},
+		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(archivedPrefix, channelID),
+			},
+		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(softArchivedPrefix, channelID),
+			},
+		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(messageTTLPrefix, channelID),
+			},
+		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(reactionsPrefix, channelID),
+			},
+		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(pinsPrefix, channelID),
+			},
+		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(channelRolesPrefix, channelID),
+			},
+		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(channelExpiryPrefix, channelID),
+			},
+		},
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: constructKey(messageSeqPrefix, channelID),
+			},
+		},
+	}
+	if err := cache.r.ZRemOne(ctx, channelActivityKey, strconv.FormatUint(channelID, 10)); err != nil {
+		return err
+	}
+	if err := cache.r.ZRemOne(ctx, channelExpiriesKey, strconv.FormatUint(channelID, 10)); err != nil {
+		return err
 	}
 	return cache.r.ExecPipeLine(ctx, &cmds)
 }
+func (cache *ChannelRepoCacheImpl) SetStickerPack(ctx context.Context, channelID uint64, stickers []Sticker) error {
+	key := constructKey(stickerPackPrefix, channelID)
+	cmds := []infra.RedisCmd{
+		{
+			OpType: infra.DELETE,
+			Payload: infra.RedisDeletePayload{
+				Key: key,
+			},
+		},
+	}
+	for _, sticker := range stickers {
+		objectKey, err := json.Marshal(sticker.ObjectKey)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, infra.RedisCmd{
+			OpType: infra.HSETONE,
+			Payload: infra.RedisHsetOnePayload{
+				Key:   key,
+				Field: sticker.Name,
+				Val:   objectKey,
+			},
+		})
+	}
+	return cache.r.ExecPipeLine(ctx, &cmds)
+}
+
+// GetStickerPack returns the stickers of the channel sorted by name, since the hash keeps no order
+func (cache *ChannelRepoCacheImpl) GetStickerPack(ctx context.Context, channelID uint64) ([]Sticker, error) {
+	pack, err := cache.r.HGetAll(ctx, constructKey(stickerPackPrefix, channelID))
+	if err != nil {
+		return nil, err
+	}
+	var stickers []Sticker
+	for name, val := range pack {
+		var objectKey string
+		if err := json.Unmarshal([]byte(val), &objectKey); err != nil {
+			return nil, err
+		}
+		stickers = append(stickers, Sticker{
+			Name:      name,
+			ObjectKey: objectKey,
+		})
+	}
+	sort.Slice(stickers, func(i, j int) bool {
+		return stickers[i].Name < stickers[j].Name
+	})
+	return stickers, nil
+}
+
+// IsStickerInPack returns whether the channel has a sticker pack and whether the sticker is in it
+func (cache *ChannelRepoCacheImpl) IsStickerInPack(ctx context.Context, channelID uint64, name string) (bool, bool, error) {
+	var objectKey string
+	return cache.r.HGetIfKeyExists(ctx, constructKey(stickerPackPrefix, channelID), name, &objectKey)
+}
 
 func constructKey(prefix string, id uint64) string {
 	return common.Join(prefix, ":", strconv.FormatUint(id, 10))
 }
+
+func constructOutboxKey(channelID, userID uint64) string {
+	return common.Join(outboxPrefix, ":", strconv.FormatUint(channelID, 10), ":", strconv.FormatUint(userID, 10))
+}
+
+func constructTombstonesKey(channelID, userID uint64) string {
+	return common.Join(tombstonesPrefix, ":", strconv.FormatUint(channelID, 10), ":", strconv.FormatUint(userID, 10))
+}
+
+func constructPendingDeliveryKey(channelID, userID uint64) string {
+	return common.Join(pendingDeliveryPrefix, ":", strconv.FormatUint(channelID, 10), ":", strconv.FormatUint(userID, 10))
+}
+
+func constructTypingThrottleKey(channelID, userID uint64) string {
+	return common.Join(typingThrottlePrefix, ":", strconv.FormatUint(channelID, 10), ":", strconv.FormatUint(userID, 10))
+}
@@ -0,0 +1,166 @@
+package chat
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+)
+
+// ResumeClaims are the claims of a resume token.
+//
+// A resume token is an HS256 JWT handed to the client in a resume token event. It encodes
+// the channel, the user and the id of the last message delivered to the connection, and
+// expires once the connection has been gone for the configured window: every refreshed
+// token is valid for a full window from the time it is issued, and connections are handed
+// a renewed token every half window even when no message is delivered, so a token expires
+// at most one window after its connection dropped. Tokens are signed with a key derived
+// from the channel JWT secret so that they can never be used as access tokens.
+//
+// Tokens are stateless and refreshed at most once per refresh interval as messages are
+// delivered, so the encoded position may lag behind the last delivered message by up to
+// one interval. Replaying from a token is therefore at-least-once and clients should
+// de-duplicate by message id. Within a connection, the replayed messages always precede the
+// live ones, and a live message is not sent again if the replay included it.
+type ResumeClaims struct {
+	ChannelID     uint64 `json:"cid"`
+	UserID        uint64 `json:"uid"`
+	LastMessageID uint64 `json:"lmid"`
+	jwt.RegisteredClaims
+}
+
+func resumeTokenSecret() []byte {
+	return []byte(common.Join(common.JwtSecret, ":resume"))
+}
+
+func newResumeToken(channelID, userID, lastMessageID uint64, idleWindow time.Duration) (string, error) {
+	claims := &ResumeClaims{
+		ChannelID:     channelID,
+		UserID:        userID,
+		LastMessageID: lastMessageID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(idleWindow)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(resumeTokenSecret())
+}
+
+// parseResumeToken validates a resume token and returns its claims
+func parseResumeToken(resumeToken string) (*ResumeClaims, error) {
+	token, err := jwt.ParseWithClaims(resumeToken, &ResumeClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return resumeTokenSecret(), nil
+	})
+	if err != nil {
+		var v *jwt.ValidationError
+		if errors.As(err, &v) && v.Errors == jwt.ValidationErrorExpired {
+			return nil, ErrResumeTokenExpired
+		}
+		return nil, ErrInvalidResumeToken
+	}
+	claims, ok := token.Claims.(*ResumeClaims)
+	if !(ok && token.Valid) {
+		return nil, ErrInvalidResumeToken
+	}
+	return claims, nil
+}
+
+// resumeState tracks the delivery position of a connection
+type resumeState struct {
+	channelID     uint64
+	userID        uint64
+	lastMessageID atomic.Uint64
+	lastIssuedAt  atomic.Int64
+	// issuedMessageID is the position of the last issued token
+	issuedMessageID atomic.Uint64
+	// resumeFrom is the position of the token the connection resumes from, if any;
+	// resumeErr is why the token was rejected, in which case nothing is replayed
+	resumeFrom uint64
+	resumeErr  error
+}
+
+func newResumeState(channelID, userID uint64) *resumeState {
+	return &resumeState{
+		channelID: channelID,
+		userID:    userID,
+	}
+}
+
+// Resume validates the token the client reconnected with. The token must have been issued
+// to the same channel and user
+func (s *resumeState) Resume(resumeToken string) {
+	claims, err := parseResumeToken(resumeToken)
+	if err != nil {
+		s.resumeErr = err
+		return
+	}
+	if claims.ChannelID != s.channelID || claims.UserID != s.userID {
+		s.resumeErr = ErrInvalidResumeToken
+		return
+	}
+	s.resumeFrom = claims.LastMessageID
+}
+
+// Advance moves the position forward to messageID
+func (s *resumeState) Advance(messageID uint64) {
+	for {
+		last := s.lastMessageID.Load()
+		if messageID <= last || s.lastMessageID.CompareAndSwap(last, messageID) {
+			return
+		}
+	}
+}
+
+// Deliver records a delivered message and reports whether a refreshed token is due
+func (s *resumeState) Deliver(messageID uint64, refreshInterval time.Duration) bool {
+	s.Advance(messageID)
+	now := time.Now().UnixNano()
+	lastIssuedAt := s.lastIssuedAt.Load()
+	if now-lastIssuedAt < refreshInterval.Nanoseconds() {
+		return false
+	}
+	return s.lastIssuedAt.CompareAndSwap(lastIssuedAt, now)
+}
+
+// Renew reports whether the last token was issued more than interval ago, in which case the
+// token is due for renewal
+func (s *resumeState) Renew(interval time.Duration) bool {
+	now := time.Now().UnixNano()
+	lastIssuedAt := s.lastIssuedAt.Load()
+	if lastIssuedAt == 0 || now-lastIssuedAt < interval.Nanoseconds() {
+		return false
+	}
+	return s.lastIssuedAt.CompareAndSwap(lastIssuedAt, now)
+}
+
+// TokenFrame issues a resume token for the current position and wraps it in a resume token event
+func (s *resumeState) TokenFrame(idleWindow time.Duration) ([]byte, error) {
+	return s.tokenFrame(s.lastMessageID.Load(), idleWindow)
+}
+
+// RenewedTokenFrame issues a resume token for the position of the last issued token. The
+// renewal may be written before a message frame queued meanwhile, so it never accounts for
+// messages the last token did not
+func (s *resumeState) RenewedTokenFrame(idleWindow time.Duration) ([]byte, error) {
+	return s.tokenFrame(s.issuedMessageID.Load(), idleWindow)
+}
+
+func (s *resumeState) tokenFrame(lastMessageID uint64, idleWindow time.Duration) ([]byte, error) {
+	s.lastIssuedAt.Store(time.Now().UnixNano())
+	s.issuedMessageID.Store(lastMessageID)
+	token, err := newResumeToken(s.channelID, s.userID, lastMessageID, idleWindow)
+	if err != nil {
+		return nil, err
+	}
+	msgPresenter := &MessagePresenter{
+		Event:   EventResumeToken,
+		Payload: token,
+		Time:    time.Now().UnixMilli(),
+	}
+	return msgPresenter.Encode(), nil
+}
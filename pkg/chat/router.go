@@ -2,17 +2,20 @@ package chat
 
 import (
 	"context"
+	"time"
 
 	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
 )
 
 type Router struct {
-	httpServer common.HttpServer
-	grpcServer common.GrpcServer
+	httpServer      common.HttpServer
+	grpcServer      common.GrpcServer
+	shutdownTimeout time.Duration
 }
 
-func NewRouter(httpServer common.HttpServer, grpcServer common.GrpcServer) *Router {
-	return &Router{httpServer, grpcServer}
+func NewRouter(config *config.Config, httpServer common.HttpServer, grpcServer common.GrpcServer) *Router {
+	return &Router{httpServer, grpcServer, time.Duration(config.Chat.Http.Server.ShutdownTimeoutSecond) * time.Second}
 }
 
 func (r *Router) Run() {
@@ -22,6 +25,11 @@ func (r *Router) Run() {
 	r.grpcServer.Register()
 	r.grpcServer.Run()
 }
+
+// ShutdownTimeout implements common.ShutdownTimeouter
+func (r *Router) ShutdownTimeout() time.Duration {
+	return r.shutdownTimeout
+}
 func (r *Router) GracefulStop(ctx context.Context) error {
 	if err := r.grpcServer.GracefulStop(); err != nil {
 		return err
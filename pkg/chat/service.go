@@ -2,37 +2,121 @@ package chat
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
 )
 
 type MessageService interface {
-	BroadcastTextMessage(ctx context.Context, channelID, userID uint64, payload string) error
+	BroadcastTextMessage(ctx context.Context, channelID, userID, replyTo uint64, payload string, guaranteed bool, ttl time.Duration) (*Message, error)
 	BroadcastConnectMessage(ctx context.Context, channelID, userID uint64) error
 	BroadcastActionMessage(ctx context.Context, channelID, userID uint64, action Action) error
-	BroadcastFileMessage(ctx context.Context, channelID, userID uint64, payload string) error
+	BroadcastSystemMessage(ctx context.Context, channelID, userID uint64, action Action) (*Message, error)
+	BroadcastFileMessage(ctx context.Context, channelID, userID, replyTo uint64, payload string, guaranteed bool, ttl time.Duration) (*Message, error)
+	BroadcastAttachmentMessage(ctx context.Context, channelID, userID, replyTo uint64, attachment *Attachment, guaranteed bool, ttl time.Duration) (*Message, error)
+	BroadcastStickerMessage(ctx context.Context, channelID, userID, replyTo uint64, name string, ttl time.Duration) (*Message, error)
+	BroadcastDirectMessage(ctx context.Context, channelID, userID, recipientID uint64, payload string, ttl time.Duration) (*Message, error)
+	BroadcastTypingMessage(ctx context.Context, channelID, userID uint64, typing bool) error
+	BroadcastPresenceMessage(ctx context.Context, channelID, userID uint64, status PresenceState) error
+	BroadcastBlockMessage(ctx context.Context, userID, targetID uint64, blocked bool) error
 	MarkMessageSeen(ctx context.Context, channelID, userID, messageID uint64) error
+	EditTextMessage(ctx context.Context, channelID, userID, messageID uint64, payload string, maxAge time.Duration) error
+	DeleteMessage(ctx context.Context, channelID, userID, messageID uint64, verified bool) error
+	BulkDeleteMessages(ctx context.Context, channelID, userID uint64, messageIDs []uint64) ([]BulkDeleteResult, error)
+	ReactToMessage(ctx context.Context, channelID, userID, messageID uint64, emoji string, action ReactionAction) error
+	LoadReactions(ctx context.Context, channelID uint64, msgs []*Message) error
+	LoadReplyCounts(ctx context.Context, channelID uint64, msgs []*Message) error
+	ListThread(ctx context.Context, channelID, viewerID, rootID, after uint64, limit int) (*Message, []*Message, error)
+	PinMessage(ctx context.Context, channelID, userID, messageID uint64, maxPins int64) error
+	UnpinMessage(ctx context.Context, channelID, userID, messageID uint64) error
+	ListPinnedMessages(ctx context.Context, channelID uint64) ([]*Message, error)
 	InsertMessage(ctx context.Context, msg *Message) error
 	PublishMessage(ctx context.Context, msg *Message) error
-	ListMessages(ctx context.Context, channelID uint64, pageState string) ([]*Message, string, error)
+	ListMessages(ctx context.Context, channelID, viewerID uint64, pageState string, limit int) ([]*Message, string, error)
+	SearchMessages(ctx context.Context, channelID uint64, query string, from, to int64, limit, maxScanned int) ([]*Message, error)
+	ExportMessages(ctx context.Context, channelID, userID uint64, from, to int64, fn func(msgs []*Message) error) error
+	GetLatestMessageID(ctx context.Context, channelID uint64) (uint64, error)
+	CountMessages(ctx context.Context, channelID uint64) (int64, error)
+	CountUnreadMessages(ctx context.Context, channelID, userID, since uint64) (int64, error)
+	ListMissedMessages(ctx context.Context, channelID, since uint64, max int) ([]*Message, error)
+	GetOutboxMessages(ctx context.Context, channelID, userID uint64) ([]*Message, error)
+	AckOutboxMessage(ctx context.Context, channelID, userID, messageID uint64) error
+	GetPendingMessages(ctx context.Context, channelID, userID uint64) ([]*Message, error)
+	ScheduleTextMessage(ctx context.Context, channelID, userID uint64, payload string, sendAt time.Time) (*ScheduledMessage, error)
+	CancelScheduledMessage(ctx context.Context, channelID, userID, id uint64) error
+	DeliverDueScheduledMessages(ctx context.Context, moderate func(ctx context.Context, payload string) (bool, error)) (int, error)
+	CountScheduledMessages(ctx context.Context) (int64, error)
+	SetChannelMessageTTL(ctx context.Context, channelID, userID uint64, ttl time.Duration) error
+	GetChannelMessageTTL(ctx context.Context, channelID uint64) (time.Duration, error)
+	ExpireDueMessages(ctx context.Context, now time.Time) (int, error)
+	GetTombstones(ctx context.Context, channelID, userID uint64) ([]*Message, error)
+	RemoveTombstone(ctx context.Context, channelID, userID, messageID uint64) error
 }
 
 type UserService interface {
 	AddUserToChannel(ctx context.Context, channelID, userID uint64) error
 	GetUser(ctx context.Context, userID uint64) (*User, error)
+	GetUserIDBySession(ctx context.Context, sid string) (uint64, error)
 	IsChannelUserExist(ctx context.Context, channelID, userID uint64) (bool, error)
 	GetChannelUserIDs(ctx context.Context, channelID uint64) ([]uint64, error)
-	AddOnlineUser(ctx context.Context, channelID, userID uint64) error
-	DeleteOnlineUser(ctx context.Context, channelID, userID uint64) error
+	RemoveUserChannel(ctx context.Context, channelID, userID uint64) error
+	BackfillUserChannels(ctx context.Context) (int, error)
+	GetUserRole(ctx context.Context, channelID, userID uint64) (Role, error)
+	GetChannelRoles(ctx context.Context, channelID uint64) (map[uint64]Role, error)
+	SetUserRole(ctx context.Context, channelID, actorID, targetID uint64, role Role) error
+	AddOnlineUser(ctx context.Context, channelID, userID uint64) (bool, error)
+	DeleteOnlineUser(ctx context.Context, channelID, userID uint64) (bool, error)
 	GetOnlineUserIDs(ctx context.Context, channelID uint64) ([]uint64, error)
+	PopDueOfflineUsers(ctx context.Context, now time.Time) ([]ChannelUser, error)
+	IsAloneInChannel(ctx context.Context, channelID, userID uint64) (bool, error)
+	SetReadReceiptsEnabled(ctx context.Context, userID uint64, enabled bool) error
+	IsReadReceiptsEnabled(ctx context.Context, userID uint64) (bool, error)
+	GetReadReceipts(ctx context.Context, channelID, viewerID uint64) (map[uint64]uint64, error)
+	TouchPresence(ctx context.Context, userID uint64) error
+	KeepPresence(ctx context.Context, userID uint64) error
+	GetPresence(ctx context.Context, userIDs []uint64) (map[uint64]PresenceState, error)
+	AddFloodViolation(ctx context.Context, userID uint64, window time.Duration) (int64, error)
+	SetConnectionCooldown(ctx context.Context, userID uint64, cooldown time.Duration) error
+	IsInConnectionCooldown(ctx context.Context, userID uint64) (bool, error)
+	RevokeRefreshToken(ctx context.Context, claims *RefreshClaims) (bool, error)
+	SetTypingUser(ctx context.Context, channelID, userID uint64, typing bool) error
+	AllowTypingBroadcast(ctx context.Context, channelID, userID uint64, interval time.Duration) (bool, error)
+	GetSnapshot(ctx context.Context, channelID uint64) (*Snapshot, error)
+	BlockUser(ctx context.Context, userID, targetID uint64) error
+	UnblockUser(ctx context.Context, userID, targetID uint64) error
+	GetBlockedUsers(ctx context.Context, userID uint64) ([]BlockedUser, error)
+	GetBlockerIDs(ctx context.Context, userID uint64) ([]uint64, error)
 }
 
 type ChannelService interface {
-	CreateChannel(ctx context.Context) (*Channel, error)
-	DeleteChannel(ctx context.Context, channelID uint64) error
+	CreateChannel(ctx context.Context, name string, ttl time.Duration, creatorID uint64) (*Channel, error)
+	GetChannelInfo(ctx context.Context, channelID uint64) (*ChannelInfo, error)
+	PreviewChannelDeletion(ctx context.Context, channelID uint64) (*ChannelDeletion, error)
+	DeleteChannel(ctx context.Context, channelID uint64) (*ChannelDeletion, error)
+	GetChannelExpiry(ctx context.Context, channelID uint64) (time.Time, error)
+	ExpireChannel(ctx context.Context, channelID uint64) error
+	ExpireDueChannels(ctx context.Context, now time.Time) (int, error)
+	SetStickerPack(ctx context.Context, channelID uint64, stickers []Sticker) error
+	GetStickerPack(ctx context.Context, channelID uint64) ([]Sticker, bool, error)
+	IsStickerAllowed(ctx context.Context, channelID uint64, name string) (bool, error)
+	ArchiveInactiveChannels(ctx context.Context, lastActiveBefore time.Time) (int, error)
+	ReapEmptyChannels(ctx context.Context, lastActiveBefore time.Time, remove bool) (int, error)
+	ArchiveChannel(ctx context.Context, channelID uint64) error
+	RestoreChannel(ctx context.Context, channelID uint64) error
+	IsChannelArchived(ctx context.Context, channelID uint64) (bool, error)
+	SoftArchiveChannel(ctx context.Context, channelID uint64) error
+	UnarchiveChannel(ctx context.Context, channelID uint64) error
+	IsChannelSoftArchived(ctx context.Context, channelID uint64) (bool, error)
+	TrimChannelMessages(ctx context.Context, channelID uint64, before time.Time, maxMessages int64) (int, error)
+	TrimActiveChannels(ctx context.Context, before time.Time, maxMessages int64, interval time.Duration) (map[uint64]int, error)
+	ListUserChannels(ctx context.Context, userID uint64) ([]*UserChannel, error)
 }
 
 type ForwardService interface {
@@ -41,34 +125,83 @@ type ForwardService interface {
 }
 
 type MessageServiceImpl struct {
-	msgRepo  MessageRepoCache
-	userRepo UserRepoCache
-	sf       common.IDGenerator
+	msgRepo        MessageRepoCache
+	userRepo       UserRepoCache
+	chanRepo       ChannelRepoCache
+	attachmentRepo AttachmentRepo
+	sf             common.IDGenerator
 }
 
-func NewMessageServiceImpl(msgRepo MessageRepoCache, userRepo UserRepoCache, sf common.IDGenerator) *MessageServiceImpl {
-	return &MessageServiceImpl{msgRepo, userRepo, sf}
+func NewMessageServiceImpl(msgRepo MessageRepoCache, userRepo UserRepoCache, chanRepo ChannelRepoCache, attachmentRepo AttachmentRepo, sf common.IDGenerator) *MessageServiceImpl {
+	return &MessageServiceImpl{msgRepo, userRepo, chanRepo, attachmentRepo, sf}
 }
-func (svc *MessageServiceImpl) BroadcastTextMessage(ctx context.Context, channelID, userID uint64, payload string) error {
+func (svc *MessageServiceImpl) BroadcastTextMessage(ctx context.Context, channelID, userID, replyTo uint64, payload string, guaranteed bool, ttl time.Duration) (*Message, error) {
+	replyTo, err := svc.threadRoot(ctx, channelID, replyTo)
+	if err != nil {
+		return nil, err
+	}
 	messageID, err := svc.sf.NextID()
 	if err != nil {
-		return fmt.Errorf("error create snowflake ID for text message: %w", err)
+		return nil, fmt.Errorf("error create snowflake ID for text message: %w", err)
 	}
 	msg := Message{
-		MessageID: messageID,
-		Event:     EventText,
-		ChannelID: channelID,
-		UserID:    userID,
-		Payload:   payload,
-		Time:      time.Now().UnixMilli(),
+		MessageID:  messageID,
+		Event:      EventText,
+		ChannelID:  channelID,
+		UserID:     userID,
+		Payload:    payload,
+		Time:       time.Now().UnixMilli(),
+		Guaranteed: guaranteed,
+		ReplyTo:    replyTo,
+	}
+	if err := svc.setExpiry(ctx, &msg, ttl); err != nil {
+		return nil, err
 	}
 	if err := svc.msgRepo.InsertMessage(ctx, &msg); err != nil {
-		return fmt.Errorf("error broadcast text message: %w", err)
+		return nil, fmt.Errorf("error broadcast text message: %w", err)
 	}
 	if err := svc.PublishMessage(ctx, &msg); err != nil {
-		return fmt.Errorf("error broadcast text message: %w", err)
+		return nil, fmt.Errorf("error broadcast text message: %w", err)
 	}
-	return nil
+	if err := svc.addToOfflineOutboxes(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error broadcast text message: %w", err)
+	}
+	return &msg, nil
+}
+
+// BroadcastDirectMessage stores a text message to a member of the channel and publishes
+// it; only the sessions of the sender and the recipient receive it
+func (svc *MessageServiceImpl) BroadcastDirectMessage(ctx context.Context, channelID, userID, recipientID uint64, payload string, ttl time.Duration) (*Message, error) {
+	member, err := svc.userRepo.IsChannelUserExist(ctx, channelID, recipientID)
+	if err != nil {
+		return nil, fmt.Errorf("error check user %d in channel %d: %w", recipientID, channelID, err)
+	}
+	if !member {
+		return nil, ErrRecipientNotMember
+	}
+	messageID, err := svc.sf.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error create snowflake ID for direct message: %w", err)
+	}
+	msg := Message{
+		MessageID:   messageID,
+		Event:       EventDirect,
+		ChannelID:   channelID,
+		UserID:      userID,
+		Payload:     payload,
+		Time:        time.Now().UnixMilli(),
+		RecipientID: recipientID,
+	}
+	if err := svc.setExpiry(ctx, &msg, ttl); err != nil {
+		return nil, err
+	}
+	if err := svc.msgRepo.InsertMessage(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error broadcast direct message: %w", err)
+	}
+	if err := svc.PublishMessage(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error broadcast direct message: %w", err)
+	}
+	return &msg, nil
 }
 func (svc *MessageServiceImpl) BroadcastConnectMessage(ctx context.Context, channelID, userID uint64) error {
 	onnlineUserIDs, err := svc.userRepo.GetOnlineUserIDs(context.Background(), channelID)
@@ -98,28 +231,222 @@ func (svc *MessageServiceImpl) BroadcastActionMessage(ctx context.Context, chann
 	}
 	return nil
 }
-func (svc *MessageServiceImpl) BroadcastFileMessage(ctx context.Context, channelID, userID uint64, payload string) error {
+
+// BroadcastSystemMessage stores a system message about the user in the channel history and
+// publishes it. Unlike other action messages, it is listed along with the history, though
+// it is never counted as unread
+func (svc *MessageServiceImpl) BroadcastSystemMessage(ctx context.Context, channelID, userID uint64, action Action) (*Message, error) {
 	messageID, err := svc.sf.NextID()
 	if err != nil {
-		return fmt.Errorf("error create snowflake ID for file message: %w", err)
+		return nil, fmt.Errorf("error create snowflake ID for system message: %w", err)
 	}
 	msg := Message{
 		MessageID: messageID,
-		Event:     EventFile,
+		Event:     EventAction,
 		ChannelID: channelID,
 		UserID:    userID,
-		Payload:   payload,
+		Payload:   string(action),
+		Time:      time.Now().UnixMilli(),
+	}
+	if err := svc.setExpiry(ctx, &msg, 0); err != nil {
+		return nil, err
+	}
+	if err := svc.msgRepo.InsertMessage(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error broadcast system message: %w", err)
+	}
+	if err := svc.PublishMessage(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error broadcast system message: %w", err)
+	}
+	return &msg, nil
+}
+func (svc *MessageServiceImpl) BroadcastFileMessage(ctx context.Context, channelID, userID, replyTo uint64, payload string, guaranteed bool, ttl time.Duration) (*Message, error) {
+	replyTo, err := svc.threadRoot(ctx, channelID, replyTo)
+	if err != nil {
+		return nil, err
+	}
+	messageID, err := svc.sf.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error create snowflake ID for file message: %w", err)
+	}
+	msg := Message{
+		MessageID:  messageID,
+		Event:      EventFile,
+		ChannelID:  channelID,
+		UserID:     userID,
+		Payload:    payload,
+		Time:       time.Now().UnixMilli(),
+		Guaranteed: guaranteed,
+		ReplyTo:    replyTo,
+	}
+	if err := svc.setExpiry(ctx, &msg, ttl); err != nil {
+		return nil, err
+	}
+	if err := svc.msgRepo.InsertMessage(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error broadcast file message: %w", err)
+	}
+	if err := svc.PublishMessage(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error broadcast file message: %w", err)
+	}
+	if err := svc.addToOfflineOutboxes(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error broadcast file message: %w", err)
+	}
+	return &msg, nil
+}
+
+// BroadcastAttachmentMessage sends a message referring to a file uploaded to the channel.
+// The content type and size are taken from the stored object rather than from the client
+func (svc *MessageServiceImpl) BroadcastAttachmentMessage(ctx context.Context, channelID, userID, replyTo uint64, attachment *Attachment, guaranteed bool, ttl time.Duration) (*Message, error) {
+	if !strings.HasPrefix(attachment.Key, common.Join(strconv.FormatUint(channelID, 10), "/")) {
+		return nil, ErrAttachmentNotInChannel
+	}
+	replyTo, err := svc.threadRoot(ctx, channelID, replyTo)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := svc.attachmentRepo.StatAttachment(ctx, attachment.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error stat attachment %s: %w", attachment.Key, err)
+	}
+	if stat.ContentType != "" {
+		attachment.ContentType = stat.ContentType
+	}
+	attachment.Size = stat.Size
+	payload, err := json.Marshal(attachment)
+	if err != nil {
+		return nil, fmt.Errorf("error encode attachment: %w", err)
+	}
+	messageID, err := svc.sf.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error create snowflake ID for attachment message: %w", err)
+	}
+	msg := Message{
+		MessageID:  messageID,
+		Event:      EventAttachment,
+		ChannelID:  channelID,
+		UserID:     userID,
+		Payload:    string(payload),
+		Time:       time.Now().UnixMilli(),
+		Guaranteed: guaranteed,
+		ReplyTo:    replyTo,
+	}
+	if err := svc.setExpiry(ctx, &msg, ttl); err != nil {
+		return nil, err
+	}
+	if err := svc.msgRepo.InsertMessage(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error broadcast attachment message: %w", err)
+	}
+	if err := svc.PublishMessage(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error broadcast attachment message: %w", err)
+	}
+	if err := svc.addToOfflineOutboxes(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error broadcast attachment message: %w", err)
+	}
+	return &msg, nil
+}
+func (svc *MessageServiceImpl) BroadcastStickerMessage(ctx context.Context, channelID, userID, replyTo uint64, name string, ttl time.Duration) (*Message, error) {
+	replyTo, err := svc.threadRoot(ctx, channelID, replyTo)
+	if err != nil {
+		return nil, err
+	}
+	messageID, err := svc.sf.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error create snowflake ID for sticker message: %w", err)
+	}
+	msg := Message{
+		MessageID: messageID,
+		Event:     EventSticker,
+		ChannelID: channelID,
+		UserID:    userID,
+		Payload:   name,
 		Time:      time.Now().UnixMilli(),
+		ReplyTo:   replyTo,
+	}
+	if err := svc.setExpiry(ctx, &msg, ttl); err != nil {
+		return nil, err
 	}
 	if err := svc.msgRepo.InsertMessage(ctx, &msg); err != nil {
-		return fmt.Errorf("error broadcast file message: %w", err)
+		return nil, fmt.Errorf("error broadcast sticker message: %w", err)
+	}
+	if err := svc.PublishMessage(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error broadcast sticker message: %w", err)
+	}
+	return &msg, nil
+}
+
+// BroadcastTypingMessage publishes the typing state of a user without persisting it,
+// so typing never shows up in the message history, outboxes or unread counts
+func (svc *MessageServiceImpl) BroadcastTypingMessage(ctx context.Context, channelID, userID uint64, typing bool) error {
+	event := EventStopTyping
+	if typing {
+		event = EventTyping
+	}
+	msg := Message{
+		Event:     event,
+		ChannelID: channelID,
+		UserID:    userID,
+		Time:      time.Now().UnixMilli(),
+	}
+	if err := svc.PublishMessage(ctx, &msg); err != nil {
+		return fmt.Errorf("error broadcast typing message: %w", err)
+	}
+	return nil
+}
+
+// BroadcastPresenceMessage publishes a user coming online or going offline in the channel.
+// Like typing, presence is never persisted
+func (svc *MessageServiceImpl) BroadcastPresenceMessage(ctx context.Context, channelID, userID uint64, status PresenceState) error {
+	msg := Message{
+		Event:     EventPresence,
+		ChannelID: channelID,
+		UserID:    userID,
+		Status:    status,
+		Time:      time.Now().UnixMilli(),
 	}
 	if err := svc.PublishMessage(ctx, &msg); err != nil {
-		return fmt.Errorf("error broadcast file message: %w", err)
+		return fmt.Errorf("error broadcast presence message: %w", err)
+	}
+	return nil
+}
+
+// BroadcastBlockMessage tells the sessions in the channels of a user that the user blocked
+// or unblocked the target, so that they update their block lists without reconnecting
+func (svc *MessageServiceImpl) BroadcastBlockMessage(ctx context.Context, userID, targetID uint64, blocked bool) error {
+	channelIDs, err := svc.userRepo.GetUserChannelIDs(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("error get channels of user %d: %w", userID, err)
+	}
+	event := EventUnblock
+	if blocked {
+		event = EventBlock
+	}
+	for _, channelID := range channelIDs {
+		msg := Message{
+			Event:     event,
+			ChannelID: channelID,
+			UserID:    userID,
+			Payload:   strconv.FormatUint(targetID, 10),
+			Time:      time.Now().UnixMilli(),
+		}
+		if err := svc.PublishMessage(ctx, &msg); err != nil {
+			return fmt.Errorf("error broadcast block message: %w", err)
+		}
 	}
 	return nil
 }
+
+// MarkMessageSeen always advances the user's own read cursor, but only marks the message
+// seen and broadcasts a receipt if the user shares read receipts
 func (svc *MessageServiceImpl) MarkMessageSeen(ctx context.Context, channelID, userID, messageID uint64) error {
+	if err := svc.userRepo.SetReadCursor(ctx, channelID, userID, messageID); err != nil {
+		return fmt.Errorf("error set read cursor of user %d in channel %d: %w", userID, channelID, err)
+	}
+	receiptsEnabled, err := svc.userRepo.IsReadReceiptsEnabled(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("error get read receipts preference of user %d: %w", userID, err)
+	}
+	if !receiptsEnabled {
+		return nil
+	}
 	if err := svc.msgRepo.MarkMessageSeen(ctx, channelID, messageID); err != nil {
 		return fmt.Errorf("error mark message %d seen in channel %d: %w", messageID, channelID, err)
 	}
@@ -141,118 +468,1977 @@ func (svc *MessageServiceImpl) MarkMessageSeen(ctx context.Context, channelID, u
 	}
 	return nil
 }
-func (svc *MessageServiceImpl) InsertMessage(ctx context.Context, msg *Message) error {
-	if err := svc.msgRepo.InsertMessage(ctx, msg); err != nil {
-		return fmt.Errorf("error insert message: %w", err)
+
+// EditTextMessage replaces the payload of a text message sent by the user and broadcasts
+// the edited message with the edit event. A max age of 0 allows editing at any time
+func (svc *MessageServiceImpl) EditTextMessage(ctx context.Context, channelID, userID, messageID uint64, payload string, maxAge time.Duration) error {
+	msg, err := svc.msgRepo.GetMessage(ctx, channelID, messageID)
+	if err != nil {
+		return fmt.Errorf("error get message %d in channel %d: %w", messageID, channelID, err)
 	}
-	return nil
-}
-func (svc *MessageServiceImpl) PublishMessage(ctx context.Context, msg *Message) error {
-	if err := svc.msgRepo.PublishMessage(ctx, msg); err != nil {
-		return fmt.Errorf("error publish message: %w", err)
+	if msg.Deleted {
+		return ErrMessageNotFound
+	}
+	if msg.UserID != userID {
+		return ErrNotMessageOwner
+	}
+	if msg.Event != EventText {
+		return ErrMessageNotEditable
+	}
+	now := time.Now()
+	if maxAge > 0 && now.Sub(time.UnixMilli(msg.Time)) > maxAge {
+		return ErrEditWindowExpired
+	}
+	msg.Payload = payload
+	msg.EditedTime = now.UnixMilli()
+	if err := svc.msgRepo.EditMessage(ctx, channelID, messageID, msg.Payload, msg.EditedTime); err != nil {
+		return fmt.Errorf("error edit message %d in channel %d: %w", messageID, channelID, err)
+	}
+	msg.Event = EventEdit
+	if err := svc.PublishMessage(ctx, msg); err != nil {
+		return fmt.Errorf("error edit message %d in channel %d: %w", messageID, channelID, err)
 	}
 	return nil
 }
-func (svc *MessageServiceImpl) ListMessages(ctx context.Context, channelID uint64, pageState string) ([]*Message, string, error) {
-	msgs, nextPageState, err := svc.msgRepo.ListMessages(ctx, channelID, pageState)
+
+// DeleteMessage replaces a message with a tombstone and broadcasts the tombstone with the
+// delete event. Besides the sender, channel admins may delete any message if verified
+// reports that userID was authenticated by a token bound to the user
+func (svc *MessageServiceImpl) DeleteMessage(ctx context.Context, channelID, userID, messageID uint64, verified bool) error {
+	msg, err := svc.msgRepo.GetMessage(ctx, channelID, messageID)
 	if err != nil {
-		return nil, "", fmt.Errorf("error list messages in channel %d with page state %s: %w", channelID, pageState, err)
+		return fmt.Errorf("error get message %d in channel %d: %w", messageID, channelID, err)
+	}
+	if msg.Deleted {
+		return ErrMessageNotFound
+	}
+	// system messages are about their user rather than sent by them
+	if msg.UserID != userID || msg.ContentType() == ContentTypeSystem {
+		if !verified {
+			return ErrDeleteNotAllowed
+		}
+		role, err := getUserRole(ctx, svc.userRepo, channelID, userID)
+		if err != nil {
+			return err
+		}
+		if role != RoleAdmin {
+			return ErrDeleteNotAllowed
+		}
+	}
+	if err := svc.msgRepo.DeleteMessage(ctx, channelID, messageID); err != nil {
+		return fmt.Errorf("error delete message %d in channel %d: %w", messageID, channelID, err)
+	}
+	// guaranteed messages may still wait in the outboxes of offline users
+	userIDs, err := svc.userRepo.GetChannelUserIDs(ctx, channelID)
+	if err != nil {
+		return fmt.Errorf("error get users in channel %d: %w", channelID, err)
 	}
-	return msgs, nextPageState, nil
+	// the message is deleted by now, so the tombstone goes out even if an outbox keeps it;
+	// redelivered from there, it is dropped as deleted
+	var errs []error
+	for _, uid := range userIDs {
+		if err := svc.msgRepo.RemoveFromOutbox(ctx, channelID, uid, messageID); err != nil {
+			errs = append(errs, fmt.Errorf("error remove message %d from outbox of user %d: %w", messageID, uid, err))
+		}
+	}
+	msg.Event = EventDeleteMessage
+	msg.Payload = ""
+	msg.Deleted = true
+	if err := svc.PublishMessage(ctx, msg); err != nil {
+		errs = append(errs, fmt.Errorf("error delete message %d in channel %d: %w", messageID, channelID, err))
+	}
+	return errors.Join(errs...)
 }
 
-type UserServiceImpl struct {
-	userRepo UserRepoCache
+// BulkDeleteMessages replaces messages with tombstones and broadcasts the ids of the newly
+// deleted messages in a single bulk delete event. Only channel admins can bulk delete.
+// Every message gets a result, so that a failure to delete some messages does not hide
+// the messages that were deleted
+func (svc *MessageServiceImpl) BulkDeleteMessages(ctx context.Context, channelID, userID uint64, messageIDs []uint64) ([]BulkDeleteResult, error) {
+	role, err := getUserRole(ctx, svc.userRepo, channelID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if role != RoleAdmin {
+		return nil, ErrBulkDeleteNotAllowed
+	}
+	var (
+		results    []BulkDeleteResult
+		deletedIDs []uint64
+	)
+	seen := make(map[uint64]bool, len(messageIDs))
+	for _, messageID := range messageIDs {
+		if seen[messageID] {
+			continue
+		}
+		seen[messageID] = true
+		result := BulkDeleteResult{
+			MessageID: messageID,
+			Status:    BulkDeleteDeleted,
+		}
+		deleted, err := svc.tombstoneMessage(ctx, channelID, messageID)
+		switch {
+		case errors.Is(err, ErrMessageNotFound):
+			result.Status = BulkDeleteNotFound
+		case err != nil:
+			result.Status = BulkDeleteFailed
+			result.Err = err
+		case deleted:
+			deletedIDs = append(deletedIDs, messageID)
+		}
+		results = append(results, result)
+	}
+	if len(deletedIDs) == 0 {
+		return results, nil
+	}
+	// guaranteed messages may still wait in the outboxes of offline users
+	userIDs, err := svc.userRepo.GetChannelUserIDs(ctx, channelID)
+	if err != nil {
+		return results, fmt.Errorf("error get users in channel %d: %w", channelID, err)
+	}
+	for _, uid := range userIDs {
+		for _, messageID := range deletedIDs {
+			if err := svc.msgRepo.RemoveFromOutbox(ctx, channelID, uid, messageID); err != nil {
+				return results, fmt.Errorf("error remove message %d from outbox of user %d: %w", messageID, uid, err)
+			}
+		}
+	}
+	msg := Message{
+		Event:      EventBulkDelete,
+		ChannelID:  channelID,
+		UserID:     userID,
+		Time:       time.Now().UnixMilli(),
+		DeletedIDs: deletedIDs,
+	}
+	if err := svc.PublishMessage(ctx, &msg); err != nil {
+		return results, fmt.Errorf("error broadcast bulk delete in channel %d: %w", channelID, err)
+	}
+	return results, nil
 }
 
-func NewUserServiceImpl(userRepo UserRepoCache) *UserServiceImpl {
-	return &UserServiceImpl{userRepo}
-}
-func (svc *UserServiceImpl) AddUserToChannel(ctx context.Context, channelID, userID uint64) error {
-	if err := svc.userRepo.AddUserToChannel(ctx, channelID, userID); err != nil {
-		return fmt.Errorf("error add user %d to channel %d: %w", userID, channelID, err)
+// tombstoneMessage deletes a message and reports whether it was deleted by this call,
+// i.e. whether it was not deleted before
+func (svc *MessageServiceImpl) tombstoneMessage(ctx context.Context, channelID, messageID uint64) (bool, error) {
+	msg, err := svc.msgRepo.GetMessage(ctx, channelID, messageID)
+	if errors.Is(err, ErrMessageNotFound) {
+		return false, err
 	}
-	return nil
-}
-func (svc *UserServiceImpl) GetUser(ctx context.Context, userID uint64) (*User, error) {
-	user, err := svc.userRepo.GetUserByID(ctx, userID)
 	if err != nil {
-		return nil, fmt.Errorf("error get user %d: %w", userID, err)
+		return false, fmt.Errorf("error get message %d in channel %d: %w", messageID, channelID, err)
 	}
-	return user, nil
+	if msg.Deleted {
+		return false, nil
+	}
+	if err := svc.msgRepo.DeleteMessage(ctx, channelID, messageID); err != nil {
+		if errors.Is(err, ErrMessageNotFound) {
+			return false, err
+		}
+		return false, fmt.Errorf("error delete message %d in channel %d: %w", messageID, channelID, err)
+	}
+	return true, nil
 }
-func (svc *UserServiceImpl) IsChannelUserExist(ctx context.Context, channelID, userID uint64) (bool, error) {
-	exist, err := svc.userRepo.IsChannelUserExist(ctx, channelID, userID)
+
+// ReactToMessage adds or removes the reaction of a user and broadcasts the resulting
+// reactions of the message to the channel
+func (svc *MessageServiceImpl) ReactToMessage(ctx context.Context, channelID, userID, messageID uint64, emoji string, action ReactionAction) error {
+	msg, err := svc.msgRepo.GetMessage(ctx, channelID, messageID)
 	if err != nil {
-		return false, fmt.Errorf("error check user %d in channel %d: %w", userID, channelID, err)
+		return fmt.Errorf("error get message %d in channel %d: %w", messageID, channelID, err)
 	}
-	return exist, nil
-}
-func (svc *UserServiceImpl) GetChannelUserIDs(ctx context.Context, channelID uint64) ([]uint64, error) {
-	users, err := svc.userRepo.GetChannelUserIDs(ctx, channelID)
+	if msg.Deleted {
+		return ErrMessageNotFound
+	}
+	reactions, err := svc.msgRepo.UpdateReaction(ctx, channelID, messageID, userID, emoji, action == ReactionAdd)
 	if err != nil {
-		return nil, fmt.Errorf("error get users in channel %d: %w", channelID, err)
+		return fmt.Errorf("error update reactions of message %d in channel %d: %w", messageID, channelID, err)
 	}
-	return users, nil
+	reactionMsg := Message{
+		MessageID:      messageID,
+		Event:          EventReaction,
+		ChannelID:      channelID,
+		UserID:         userID,
+		Time:           time.Now().UnixMilli(),
+		Reactions:      reactions,
+		Emoji:          emoji,
+		ReactionAction: action,
+	}
+	if err := svc.PublishMessage(ctx, &reactionMsg); err != nil {
+		return fmt.Errorf("error broadcast reaction to message %d in channel %d: %w", messageID, channelID, err)
+	}
+	return nil
 }
-func (svc *UserServiceImpl) AddOnlineUser(ctx context.Context, channelID, userID uint64) error {
-	if err := svc.userRepo.AddOnlineUser(ctx, channelID, userID); err != nil {
-		return fmt.Errorf("error add online user %d to channel %d: %w", userID, channelID, err)
+
+// LoadReactions fills in the current reactions of the messages
+func (svc *MessageServiceImpl) LoadReactions(ctx context.Context, channelID uint64, msgs []*Message) error {
+	messageIDs := make([]uint64, len(msgs))
+	for i, msg := range msgs {
+		messageIDs[i] = msg.MessageID
+	}
+	reactions, err := svc.msgRepo.GetReactions(ctx, channelID, messageIDs)
+	if err != nil {
+		return fmt.Errorf("error get reactions in channel %d: %w", channelID, err)
+	}
+	for i, msg := range msgs {
+		msg.Reactions = reactions[i]
 	}
 	return nil
 }
-func (svc *UserServiceImpl) DeleteOnlineUser(ctx context.Context, channelID, userID uint64) error {
-	if err := svc.userRepo.DeleteOnlineUser(ctx, channelID, userID); err != nil {
-		return fmt.Errorf("error delete online user %d from channel %d: %w", userID, channelID, err)
+
+// LoadReplyCounts fills in the number of replies of the thread roots among the messages
+func (svc *MessageServiceImpl) LoadReplyCounts(ctx context.Context, channelID uint64, msgs []*Message) error {
+	var rootIDs []uint64
+	for _, msg := range msgs {
+		if msg.ReplyTo == 0 && isContentEvent(msg.Event) {
+			rootIDs = append(rootIDs, msg.MessageID)
+		}
+	}
+	counts, err := svc.msgRepo.CountReplies(ctx, channelID, rootIDs)
+	if err != nil {
+		return fmt.Errorf("error count replies in channel %d: %w", channelID, err)
+	}
+	for _, msg := range msgs {
+		msg.ReplyCount = counts[msg.MessageID]
 	}
 	return nil
 }
-func (svc *UserServiceImpl) GetOnlineUserIDs(ctx context.Context, channelID uint64) ([]uint64, error) {
-	users, err := svc.userRepo.GetOnlineUserIDs(ctx, channelID)
+
+// threadRoot resolves the message a new message replies to into the root of its thread.
+// Threads are one level deep, so replying to a reply joins the thread of its root.
+// It returns 0 if the message is not a reply
+func (svc *MessageServiceImpl) threadRoot(ctx context.Context, channelID, replyTo uint64) (uint64, error) {
+	if replyTo == 0 {
+		return 0, nil
+	}
+	parent, err := svc.msgRepo.GetMessage(ctx, channelID, replyTo)
+	if errors.Is(err, ErrMessageNotFound) {
+		return 0, ErrReplyNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("error get message %d in channel %d: %w", replyTo, channelID, err)
+	}
+	if parent.Deleted || !isContentEvent(parent.Event) {
+		return 0, ErrReplyNotFound
+	}
+	if parent.ReplyTo != 0 {
+		return parent.ReplyTo, nil
+	}
+	return parent.MessageID, nil
+}
+
+// ListThread returns the root of a thread with up to limit of its replies after the given
+// reply, oldest first. Asking for the thread of a reply returns the thread it belongs to.
+// Direct messages are only listed to their sender and recipient; a root the viewer cannot
+// see is not found
+func (svc *MessageServiceImpl) ListThread(ctx context.Context, channelID, viewerID, rootID, after uint64, limit int) (*Message, []*Message, error) {
+	root, err := svc.msgRepo.GetMessage(ctx, channelID, rootID)
 	if err != nil {
-		return nil, fmt.Errorf("error get online users in channel %d: %w", channelID, err)
+		return nil, nil, fmt.Errorf("error get message %d in channel %d: %w", rootID, channelID, err)
 	}
-	return users, nil
+	if root.ReplyTo != 0 {
+		if root, err = svc.msgRepo.GetMessage(ctx, channelID, root.ReplyTo); err != nil {
+			return nil, nil, fmt.Errorf("error get message %d in channel %d: %w", rootID, channelID, err)
+		}
+	}
+	if !root.VisibleTo(viewerID) {
+		return nil, nil, ErrMessageNotFound
+	}
+	replyIDs, err := svc.msgRepo.ListReplyIDs(ctx, channelID, root.MessageID, after, limit)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error list replies of message %d in channel %d: %w", root.MessageID, channelID, err)
+	}
+	replies := []*Message{}
+	for _, replyID := range replyIDs {
+		reply, err := svc.msgRepo.GetMessage(ctx, channelID, replyID)
+		if errors.Is(err, ErrMessageNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error get message %d in channel %d: %w", replyID, channelID, err)
+		}
+		if reply.Deleted || !reply.VisibleTo(viewerID) {
+			continue
+		}
+		replies = append(replies, reply)
+	}
+	return root, replies, nil
 }
 
-type ChannelServiceImpl struct {
-	chanRepo ChannelRepoCache
-	userRepo UserRepoCache
-	sf       common.IDGenerator
+// PinMessage pins a message of the channel and broadcasts the pin; only channel admins
+// can pin messages. Direct messages cannot be pinned, since pins are listed to everyone
+func (svc *MessageServiceImpl) PinMessage(ctx context.Context, channelID, userID, messageID uint64, maxPins int64) error {
+	if err := svc.checkChannelAdmin(ctx, channelID, userID); err != nil {
+		return err
+	}
+	msg, err := svc.msgRepo.GetMessage(ctx, channelID, messageID)
+	if err != nil {
+		return fmt.Errorf("error get message %d in channel %d: %w", messageID, channelID, err)
+	}
+	if msg.Deleted {
+		return ErrMessageNotFound
+	}
+	if msg.Event == EventDirect {
+		return ErrPinDirectMessage
+	}
+	pinned, err := svc.msgRepo.PinMessage(ctx, channelID, messageID, maxPins)
+	if err != nil {
+		return fmt.Errorf("error pin message %d in channel %d: %w", messageID, channelID, err)
+	}
+	if !pinned {
+		return ErrExceedPinLimit
+	}
+	msg.Event = EventPin
+	msg.UserID = userID
+	msg.Time = time.Now().UnixMilli()
+	if err := svc.PublishMessage(ctx, msg); err != nil {
+		return fmt.Errorf("error broadcast pin of message %d in channel %d: %w", messageID, channelID, err)
+	}
+	return nil
 }
 
-func NewChannelServiceImpl(chanRepo ChannelRepoCache, userRepo UserRepoCache, sf common.IDGenerator) *ChannelServiceImpl {
-	return &ChannelServiceImpl{chanRepo, userRepo, sf}
+// UnpinMessage unpins a message of the channel and broadcasts the unpin; only channel
+// admins can unpin messages
+func (svc *MessageServiceImpl) UnpinMessage(ctx context.Context, channelID, userID, messageID uint64) error {
+	if err := svc.checkChannelAdmin(ctx, channelID, userID); err != nil {
+		return err
+	}
+	if err := svc.msgRepo.UnpinMessage(ctx, channelID, messageID); err != nil {
+		return fmt.Errorf("error unpin message %d in channel %d: %w", messageID, channelID, err)
+	}
+	msg := Message{
+		MessageID: messageID,
+		Event:     EventUnpin,
+		ChannelID: channelID,
+		UserID:    userID,
+		Time:      time.Now().UnixMilli(),
+	}
+	if err := svc.PublishMessage(ctx, &msg); err != nil {
+		return fmt.Errorf("error broadcast unpin of message %d in channel %d: %w", messageID, channelID, err)
+	}
+	return nil
 }
-func (svc *ChannelServiceImpl) CreateChannel(ctx context.Context) (*Channel, error) {
-	channelID, err := svc.sf.NextID()
+
+// ListPinnedMessages returns the pinned messages of a channel, most recently pinned first
+func (svc *MessageServiceImpl) ListPinnedMessages(ctx context.Context, channelID uint64) ([]*Message, error) {
+	messageIDs, err := svc.msgRepo.GetPinnedMessageIDs(ctx, channelID)
 	if err != nil {
-		return nil, fmt.Errorf("error create snowflake ID for new channel: %w", err)
+		return nil, fmt.Errorf("error get pinned messages of channel %d: %w", channelID, err)
 	}
-	channel, err := svc.chanRepo.CreateChannel(ctx, channelID)
+	msgs := []*Message{}
+	for _, messageID := range messageIDs {
+		msg, err := svc.msgRepo.GetMessage(ctx, channelID, messageID)
+		if errors.Is(err, ErrMessageNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error get message %d in channel %d: %w", messageID, channelID, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+
+func (svc *MessageServiceImpl) checkChannelAdmin(ctx context.Context, channelID, userID uint64) error {
+	role, err := getUserRole(ctx, svc.userRepo, channelID, userID)
 	if err != nil {
-		return nil, fmt.Errorf("error create channel %d: %w", channelID, err)
+		return err
 	}
-	return channel, nil
+	if role != RoleAdmin {
+		return ErrPinNotAllowed
+	}
+	return nil
 }
-func (svc *ChannelServiceImpl) DeleteChannel(ctx context.Context, channelID uint64) error {
-	if err := svc.chanRepo.DeleteChannel(ctx, channelID); err != nil {
-		return fmt.Errorf("error delete channel %d: %w", channelID, err)
+func (svc *MessageServiceImpl) InsertMessage(ctx context.Context, msg *Message) error {
+	if err := svc.msgRepo.InsertMessage(ctx, msg); err != nil {
+		return fmt.Errorf("error insert message: %w", err)
+	}
+	return nil
+}
+func (svc *MessageServiceImpl) PublishMessage(ctx context.Context, msg *Message) error {
+	if err := svc.msgRepo.PublishMessage(ctx, msg); err != nil {
+		return fmt.Errorf("error publish message: %w", err)
 	}
 	return nil
 }
 
-type ForwardServiceImpl struct {
-	forwardRepo ForwardRepo
+// ListMessages returns a page of messages. Disappearing messages that expired but are not
+// deleted yet are left out, and so are direct messages the viewer is not part of
+func (svc *MessageServiceImpl) ListMessages(ctx context.Context, channelID, viewerID uint64, pageState string, limit int) ([]*Message, string, error) {
+	msgs, nextPageState, err := svc.msgRepo.ListMessages(ctx, channelID, pageState, limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("error list messages in channel %d with page state %s: %w", channelID, pageState, err)
+	}
+	msgs = dropExpiredMessages(msgs, time.Now())
+	visible := msgs[:0]
+	for _, msg := range msgs {
+		if msg.VisibleTo(viewerID) {
+			visible = append(visible, msg)
+		}
+	}
+	return visible, nextPageState, nil
 }
 
-func NewForwardServiceImpl(forwardRepo ForwardRepo) *ForwardServiceImpl {
-	return &ForwardServiceImpl{forwardRepo}
+// dropExpiredMessages filters out the expired messages that the sweeper has not deleted yet
+func dropExpiredMessages(msgs []*Message, now time.Time) []*Message {
+	nowMilli := now.UnixMilli()
+	kept := msgs[:0]
+	for _, msg := range msgs {
+		if !msg.Expired(nowMilli) {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
 }
 
-func (svc *ForwardServiceImpl) RegisterChannelSession(ctx context.Context, channelID, userID uint64, subscriber string) error {
-	return svc.forwardRepo.RegisterChannelSession(ctx, channelID, userID, subscriber)
+// SearchMessages returns up to limit text messages of the channel whose payload contains
+// the query, ignoring case, newest first. Messages are scanned page by page and the scan
+// stops as soon as the limit is reached, messages get older than from, or maxScanned
+// messages were scanned, so that a rare query cannot walk the whole history of a channel
+func (svc *MessageServiceImpl) SearchMessages(ctx context.Context, channelID uint64, query string, from, to int64, limit, maxScanned int) ([]*Message, error) {
+	if limit <= 0 || maxScanned <= 0 {
+		return nil, fmt.Errorf("error search messages in channel %d: limit %d and max scanned %d must be positive", channelID, limit, maxScanned)
+	}
+	query = strings.ToLower(query)
+	results := []*Message{}
+	now := time.Now().UnixMilli()
+	pageState := ""
+	scanned := 0
+	for {
+		msgs, nextPageState, err := svc.msgRepo.ListMessages(ctx, channelID, pageState, 0)
+		if err != nil {
+			return nil, fmt.Errorf("error search messages in channel %d: %w", channelID, err)
+		}
+		for _, msg := range msgs {
+			if scanned >= maxScanned {
+				return results, nil
+			}
+			scanned++
+			if from > 0 && msg.Time < from {
+				return results, nil
+			}
+			if (to > 0 && msg.Time > to) || msg.Event != EventText || msg.Deleted || msg.Expired(now) {
+				continue
+			}
+			if !strings.Contains(strings.ToLower(msg.Payload), query) {
+				continue
+			}
+			results = append(results, msg)
+			if len(results) >= limit {
+				return results, nil
+			}
+		}
+		if nextPageState == "" {
+			return results, nil
+		}
+		pageState = nextPageState
+	}
+}
+
+// ExportMessages passes the messages of the channel sent between from and to, newest first,
+// to fn one page at a time. Only channel admins can export, and deleted messages are left out
+// along with direct messages between other users
+func (svc *MessageServiceImpl) ExportMessages(ctx context.Context, channelID, userID uint64, from, to int64, fn func(msgs []*Message) error) error {
+	role, err := getUserRole(ctx, svc.userRepo, channelID, userID)
+	if err != nil {
+		return err
+	}
+	if role != RoleAdmin {
+		return ErrExportNotAllowed
+	}
+	pageState := ""
+	for {
+		msgs, nextPageState, err := svc.msgRepo.ListMessages(ctx, channelID, pageState, 0)
+		if err != nil {
+			return fmt.Errorf("error export messages in channel %d: %w", channelID, err)
+		}
+		page := make([]*Message, 0, len(msgs))
+		done := nextPageState == ""
+		now := time.Now().UnixMilli()
+		for _, msg := range msgs {
+			if from > 0 && msg.Time < from {
+				done = true
+				break
+			}
+			if (to > 0 && msg.Time > to) || msg.Deleted || msg.Expired(now) || !msg.VisibleTo(userID) {
+				continue
+			}
+			page = append(page, msg)
+		}
+		if len(page) > 0 {
+			if err := fn(page); err != nil {
+				return err
+			}
+		}
+		if done {
+			return nil
+		}
+		pageState = nextPageState
+	}
+}
+func (svc *MessageServiceImpl) GetLatestMessageID(ctx context.Context, channelID uint64) (uint64, error) {
+	messageID, err := svc.msgRepo.GetLatestMessageID(ctx, channelID)
+	if err != nil {
+		return 0, fmt.Errorf("error get latest message id in channel %d: %w", channelID, err)
+	}
+	return messageID, nil
+}
+func (svc *MessageServiceImpl) CountMessages(ctx context.Context, channelID uint64) (int64, error) {
+	count, err := svc.msgRepo.CountMessages(ctx, channelID)
+	if err != nil {
+		return 0, fmt.Errorf("error count messages in channel %d: %w", channelID, err)
+	}
+	return count, nil
+}
+
+// CountUnreadMessages counts the messages of other users after since that are not deleted
+func (svc *MessageServiceImpl) CountUnreadMessages(ctx context.Context, channelID, userID, since uint64) (int64, error) {
+	count, err := svc.msgRepo.CountMessagesAfter(ctx, channelID, since, userID)
+	if err != nil {
+		return 0, fmt.Errorf("error count unread messages of user %d in channel %d: %w", userID, channelID, err)
+	}
+	return count, nil
+}
+
+// ListMissedMessages returns the messages after since that are not deleted, oldest first.
+// It fails with ErrResumeGapTooLarge if more than max messages follow since
+func (svc *MessageServiceImpl) ListMissedMessages(ctx context.Context, channelID, since uint64, max int) ([]*Message, error) {
+	msgs, err := svc.msgRepo.ListMessagesAfter(ctx, channelID, since, max+1)
+	if err != nil {
+		return nil, fmt.Errorf("error list messages after %d in channel %d: %w", since, channelID, err)
+	}
+	if len(msgs) > max {
+		return nil, ErrResumeGapTooLarge
+	}
+	missed := msgs[:0]
+	now := time.Now().UnixMilli()
+	for _, msg := range msgs {
+		if !msg.Deleted && !msg.Expired(now) {
+			missed = append(missed, msg)
+		}
+	}
+	return missed, nil
+}
+
+// setExpiry makes a message disappear after ttl, or after the default message ttl of its
+// channel if ttl is 0
+func (svc *MessageServiceImpl) setExpiry(ctx context.Context, msg *Message, ttl time.Duration) error {
+	if ttl <= 0 {
+		var err error
+		if ttl, err = svc.msgRepo.GetChannelMessageTTL(ctx, msg.ChannelID); err != nil {
+			return fmt.Errorf("error get message ttl of channel %d: %w", msg.ChannelID, err)
+		}
+	}
+	if ttl > 0 {
+		msg.ExpiresAt = msg.Time + ttl.Milliseconds()
+	}
+	return nil
+}
+
+// SetChannelMessageTTL sets the ttl of messages sent to the channel without their own. Only
+// channel admins can set it, and a zero ttl turns it off
+func (svc *MessageServiceImpl) SetChannelMessageTTL(ctx context.Context, channelID, userID uint64, ttl time.Duration) error {
+	role, err := getUserRole(ctx, svc.userRepo, channelID, userID)
+	if err != nil {
+		return err
+	}
+	if role != RoleAdmin {
+		return ErrMessageTTLNotAllowed
+	}
+	if err := svc.msgRepo.SetChannelMessageTTL(ctx, channelID, ttl); err != nil {
+		return fmt.Errorf("error set message ttl of channel %d: %w", channelID, err)
+	}
+	return nil
+}
+func (svc *MessageServiceImpl) GetChannelMessageTTL(ctx context.Context, channelID uint64) (time.Duration, error) {
+	ttl, err := svc.msgRepo.GetChannelMessageTTL(ctx, channelID)
+	if err != nil {
+		return 0, fmt.Errorf("error get message ttl of channel %d: %w", channelID, err)
+	}
+	return ttl, nil
+}
+
+// ExpireDueMessages deletes the disappearing messages whose ttl elapsed by now
+func (svc *MessageServiceImpl) ExpireDueMessages(ctx context.Context, now time.Time) (int, error) {
+	msgs, err := svc.msgRepo.PopExpiredMessages(ctx, now)
+	if err != nil {
+		return 0, fmt.Errorf("error pop expired messages: %w", err)
+	}
+	expired := 0
+	for i, msg := range msgs {
+		if err := svc.expireMessage(ctx, msg.ChannelID, msg.MessageID); err != nil {
+			// put the remaining messages back so that their deletion is retried
+			for _, msg := range msgs[i:] {
+				if err := svc.msgRepo.RetryMessageExpiry(ctx, msg.ChannelID, msg.MessageID); err != nil {
+					return expired, fmt.Errorf("error requeue expiry of message %d in channel %d: %w", msg.MessageID, msg.ChannelID, err)
+				}
+			}
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// expireMessage replaces an expired message with a tombstone and broadcasts the tombstone.
+// Channel users that are offline get the tombstone kept for their next connect, so that
+// they drop their local copies of the message as well
+func (svc *MessageServiceImpl) expireMessage(ctx context.Context, channelID, messageID uint64) error {
+	msg, err := svc.msgRepo.GetMessage(ctx, channelID, messageID)
+	if errors.Is(err, ErrMessageNotFound) {
+		// trimmed, or the channel is gone
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error get message %d in channel %d: %w", messageID, channelID, err)
+	}
+	if msg.Deleted {
+		return nil
+	}
+	// the file goes first, so that a failure is retried while the message still refers to it
+	if err := svc.deleteAttachmentOf(ctx, msg); err != nil {
+		return err
+	}
+	if err := svc.msgRepo.DeleteMessage(ctx, channelID, messageID); err != nil {
+		if errors.Is(err, ErrMessageNotFound) {
+			return nil
+		}
+		return fmt.Errorf("error delete message %d in channel %d: %w", messageID, channelID, err)
+	}
+	msg.Event = EventDeleteMessage
+	msg.Payload = ""
+	msg.Deleted = true
+	userIDs, err := svc.userRepo.GetChannelUserIDs(ctx, channelID)
+	if err != nil {
+		return fmt.Errorf("error get users in channel %d: %w", channelID, err)
+	}
+	onlineUserIDs, err := svc.userRepo.GetOnlineUserIDs(ctx, channelID)
+	if err != nil {
+		return fmt.Errorf("error get online users in channel %d: %w", channelID, err)
+	}
+	online := make(map[uint64]struct{}, len(onlineUserIDs))
+	for _, userID := range onlineUserIDs {
+		online[userID] = struct{}{}
+	}
+	for _, userID := range userIDs {
+		if err := svc.msgRepo.RemoveFromOutbox(ctx, channelID, userID, messageID); err != nil {
+			return fmt.Errorf("error remove message %d from outbox of user %d: %w", messageID, userID, err)
+		}
+		if _, ok := online[userID]; ok || userID == 0 {
+			continue
+		}
+		if err := svc.msgRepo.AddTombstone(ctx, userID, msg); err != nil {
+			return fmt.Errorf("error add tombstone of message %d for user %d: %w", messageID, userID, err)
+		}
+	}
+	if err := svc.PublishMessage(ctx, msg); err != nil {
+		return fmt.Errorf("error expire message %d in channel %d: %w", messageID, channelID, err)
+	}
+	return nil
+}
+
+// GetTombstones returns the tombstones of the messages that expired while the user was offline
+func (svc *MessageServiceImpl) GetTombstones(ctx context.Context, channelID, userID uint64) ([]*Message, error) {
+	tombstones, err := svc.msgRepo.GetTombstones(ctx, channelID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error get tombstones of user %d in channel %d: %w", userID, channelID, err)
+	}
+	return tombstones, nil
+}
+
+// deleteAttachmentOf deletes the uploaded file of an attachment message. A file uploaded
+// again to the channel is stored once, so other messages with the same file lose it too
+func (svc *MessageServiceImpl) deleteAttachmentOf(ctx context.Context, msg *Message) error {
+	if msg.Event != EventAttachment {
+		return nil
+	}
+	var attachment Attachment
+	if err := json.Unmarshal([]byte(msg.Payload), &attachment); err != nil {
+		return nil
+	}
+	if !strings.HasPrefix(attachment.Key, common.Join(strconv.FormatUint(msg.ChannelID, 10), "/")) {
+		return nil
+	}
+	size, err := svc.attachmentRepo.DeleteAttachment(ctx, attachment.Key)
+	if err != nil {
+		return fmt.Errorf("error delete attachment %s of message %d: %w", attachment.Key, msg.MessageID, err)
+	}
+	if err := svc.msgRepo.ReleaseAttachment(ctx, msg.ChannelID, attachment.Key, size); err != nil {
+		return fmt.Errorf("error release attachment %s of message %d: %w", attachment.Key, msg.MessageID, err)
+	}
+	return nil
+}
+
+// RemoveTombstone drops a tombstone delivered to the user
+func (svc *MessageServiceImpl) RemoveTombstone(ctx context.Context, channelID, userID, messageID uint64) error {
+	if err := svc.msgRepo.RemoveTombstone(ctx, channelID, userID, messageID); err != nil {
+		return fmt.Errorf("error remove tombstone of message %d for user %d: %w", messageID, userID, err)
+	}
+	return nil
+}
+
+// addToOfflineOutboxes retains a guaranteed message for every channel member that is offline.
+// Unlike the message history, an outbox only holds messages a recipient has not acked yet
+func (svc *MessageServiceImpl) addToOfflineOutboxes(ctx context.Context, msg *Message) error {
+	if !msg.Guaranteed {
+		return nil
+	}
+	userIDs, err := svc.userRepo.GetChannelUserIDs(ctx, msg.ChannelID)
+	if err != nil {
+		return fmt.Errorf("error get users in channel %d: %w", msg.ChannelID, err)
+	}
+	onlineUserIDs, err := svc.userRepo.GetOnlineUserIDs(ctx, msg.ChannelID)
+	if err != nil {
+		return fmt.Errorf("error get online users in channel %d: %w", msg.ChannelID, err)
+	}
+	online := make(map[uint64]struct{}, len(onlineUserIDs))
+	for _, userID := range onlineUserIDs {
+		online[userID] = struct{}{}
+	}
+	for _, userID := range userIDs {
+		if _, ok := online[userID]; ok || userID == msg.UserID || userID == 0 {
+			continue
+		}
+		if err := svc.msgRepo.AddToOutbox(ctx, userID, msg); err != nil {
+			return fmt.Errorf("error add message %d to outbox of user %d: %w", msg.MessageID, userID, err)
+		}
+	}
+	return nil
+}
+func (svc *MessageServiceImpl) GetOutboxMessages(ctx context.Context, channelID, userID uint64) ([]*Message, error) {
+	msgs, err := svc.msgRepo.GetOutbox(ctx, channelID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error get outbox of user %d in channel %d: %w", userID, channelID, err)
+	}
+	return msgs, nil
+}
+
+// AckOutboxMessage marks a message as delivered to a user, removing it from both the
+// outbox and the pending deliveries of the user
+func (svc *MessageServiceImpl) AckOutboxMessage(ctx context.Context, channelID, userID, messageID uint64) error {
+	if err := svc.msgRepo.RemoveFromOutbox(ctx, channelID, userID, messageID); err != nil {
+		return fmt.Errorf("error ack message %d of user %d in channel %d: %w", messageID, userID, channelID, err)
+	}
+	if err := svc.msgRepo.RemovePendingDelivery(ctx, channelID, userID, messageID); err != nil {
+		return fmt.Errorf("error ack message %d of user %d in channel %d: %w", messageID, userID, channelID, err)
+	}
+	return nil
+}
+
+// GetPendingMessages returns the messages that could not be delivered to a user. Messages
+// deleted since are acked on the user's behalf
+func (svc *MessageServiceImpl) GetPendingMessages(ctx context.Context, channelID, userID uint64) ([]*Message, error) {
+	messageIDs, err := svc.msgRepo.GetPendingDeliveries(ctx, channelID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error get pending deliveries of user %d in channel %d: %w", userID, channelID, err)
+	}
+	var msgs []*Message
+	for _, messageID := range messageIDs {
+		msg, err := svc.msgRepo.GetMessage(ctx, channelID, messageID)
+		if errors.Is(err, ErrMessageNotFound) || (err == nil && msg.Deleted) {
+			if err := svc.msgRepo.RemovePendingDelivery(ctx, channelID, userID, messageID); err != nil {
+				return nil, fmt.Errorf("error remove pending delivery %d of user %d: %w", messageID, userID, err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error get pending message %d in channel %d: %w", messageID, channelID, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, nil
+}
+func (svc *MessageServiceImpl) ScheduleTextMessage(ctx context.Context, channelID, userID uint64, payload string, sendAt time.Time) (*ScheduledMessage, error) {
+	id, err := svc.sf.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error create snowflake ID for scheduled message: %w", err)
+	}
+	msg := ScheduledMessage{
+		ID:        id,
+		ChannelID: channelID,
+		UserID:    userID,
+		Payload:   payload,
+		SendAt:    sendAt.UnixMilli(),
+	}
+	if err := svc.msgRepo.AddScheduledMessage(ctx, &msg); err != nil {
+		return nil, fmt.Errorf("error schedule message: %w", err)
+	}
+	return &msg, nil
+}
+func (svc *MessageServiceImpl) CancelScheduledMessage(ctx context.Context, channelID, userID, id uint64) error {
+	exist, msg, err := svc.msgRepo.GetScheduledMessage(ctx, id)
+	if err != nil {
+		return fmt.Errorf("error get scheduled message %d: %w", id, err)
+	}
+	if !exist || msg.ChannelID != channelID || msg.UserID != userID {
+		return ErrScheduledMsgNotFound
+	}
+	claimed, err := svc.msgRepo.ClaimScheduledMessage(ctx, id)
+	if err != nil {
+		return fmt.Errorf("error cancel scheduled message %d: %w", id, err)
+	}
+	if !claimed {
+		// already picked up by the delivery worker
+		return ErrScheduledMsgNotFound
+	}
+	if err := svc.msgRepo.RemoveScheduledMessage(ctx, id); err != nil {
+		return fmt.Errorf("error cancel scheduled message %d: %w", id, err)
+	}
+	return nil
+}
+
+// DeliverDueScheduledMessages broadcasts scheduled messages whose send time has come.
+// Messages get a fresh id at delivery so that they are ordered by actual send time in the history.
+// A message that fails is queued again and retried on a later poll, without holding back the others.
+// Messages are moderated again at delivery and dropped if moderate rejects them
+func (svc *MessageServiceImpl) DeliverDueScheduledMessages(ctx context.Context, moderate func(ctx context.Context, payload string) (bool, error)) (int, error) {
+	ids, err := svc.msgRepo.PopDueScheduledMessageIDs(ctx, time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("error pop due scheduled messages: %w", err)
+	}
+	delivered := 0
+	var errs []error
+	for _, id := range ids {
+		ok, err := svc.deliverScheduledMessage(ctx, id, moderate)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			delivered++
+		}
+	}
+	return delivered, errors.Join(errs...)
+}
+
+// deliverScheduledMessage broadcasts a dequeued scheduled message and reports whether it was
+// delivered. On failure the message is queued again, with its body if it was already claimed
+func (svc *MessageServiceImpl) deliverScheduledMessage(ctx context.Context, id uint64, moderate func(ctx context.Context, payload string) (bool, error)) (bool, error) {
+	exist, msg, err := svc.msgRepo.GetScheduledMessage(ctx, id)
+	if err != nil {
+		return false, svc.requeueScheduledMessage(ctx, id, nil, fmt.Errorf("error get scheduled message %d: %w", id, err))
+	}
+	if !exist {
+		return false, nil
+	}
+	claimed, err := svc.msgRepo.ClaimScheduledMessage(ctx, id)
+	if err != nil {
+		return false, svc.requeueScheduledMessage(ctx, id, nil, fmt.Errorf("error claim scheduled message %d: %w", id, err))
+	}
+	if !claimed {
+		return false, nil
+	}
+	// the sender may have left or the channel may have been deleted meanwhile
+	inChannel, err := svc.userRepo.IsChannelUserExist(ctx, msg.ChannelID, msg.UserID)
+	if err != nil {
+		return false, svc.requeueScheduledMessage(ctx, id, msg, fmt.Errorf("error check user %d in channel %d: %w", msg.UserID, msg.ChannelID, err))
+	}
+	if !inChannel {
+		return false, nil
+	}
+	// soft-archived channels are read-only, so messages due while archived are dropped
+	softArchived, err := svc.chanRepo.IsChannelSoftArchived(ctx, msg.ChannelID)
+	if err != nil {
+		return false, svc.requeueScheduledMessage(ctx, id, msg, fmt.Errorf("error check soft archival of channel %d: %w", msg.ChannelID, err))
+	}
+	if softArchived {
+		return false, nil
+	}
+	allowed, err := moderate(ctx, msg.Payload)
+	if err != nil {
+		return false, svc.requeueScheduledMessage(ctx, id, msg, fmt.Errorf("error moderate scheduled message %d: %w", id, err))
+	}
+	if !allowed {
+		return false, nil
+	}
+	if _, err := svc.BroadcastTextMessage(ctx, msg.ChannelID, msg.UserID, 0, msg.Payload, false, 0); err != nil {
+		return false, svc.requeueScheduledMessage(ctx, id, msg, fmt.Errorf("error deliver scheduled message %d: %w", id, err))
+	}
+	return true, nil
+}
+
+// requeueScheduledMessage queues a scheduled message again after a failed delivery. A claimed
+// message is stored again from msg, since claiming deleted its body
+func (svc *MessageServiceImpl) requeueScheduledMessage(ctx context.Context, id uint64, msg *ScheduledMessage, cause error) error {
+	var err error
+	if msg != nil {
+		err = svc.msgRepo.AddScheduledMessage(ctx, msg)
+	} else {
+		err = svc.msgRepo.RequeueScheduledMessage(ctx, id, time.Now())
+	}
+	if err != nil {
+		return errors.Join(cause, fmt.Errorf("error requeue scheduled message %d: %w", id, err))
+	}
+	return cause
+}
+func (svc *MessageServiceImpl) CountScheduledMessages(ctx context.Context) (int64, error) {
+	count, err := svc.msgRepo.CountScheduledMessages(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error count scheduled messages: %w", err)
+	}
+	return count, nil
+}
+
+type UserServiceImpl struct {
+	userRepo        UserRepoCache
+	awayAfter       time.Duration
+	offlineDebounce time.Duration
+}
+
+func NewUserServiceImpl(config *config.Config, userRepo UserRepoCache) *UserServiceImpl {
+	return &UserServiceImpl{
+		userRepo:        userRepo,
+		awayAfter:       time.Duration(config.Chat.Presence.AwaySecond) * time.Second,
+		offlineDebounce: time.Duration(config.Chat.Presence.DebounceSecond) * time.Second,
+	}
+}
+func (svc *UserServiceImpl) AddUserToChannel(ctx context.Context, channelID, userID uint64) error {
+	if err := svc.userRepo.AddUserToChannel(ctx, channelID, userID); err != nil {
+		return fmt.Errorf("error add user %d to channel %d: %w", userID, channelID, err)
+	}
+	return nil
+}
+func (svc *UserServiceImpl) GetUser(ctx context.Context, userID uint64) (*User, error) {
+	user, err := svc.userRepo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error get user %d: %w", userID, err)
+	}
+	return user, nil
+}
+func (svc *UserServiceImpl) GetUserIDBySession(ctx context.Context, sid string) (uint64, error) {
+	userID, err := svc.userRepo.GetUserIDBySession(ctx, sid)
+	if err != nil {
+		return 0, fmt.Errorf("error get user id by sid %s: %w", sid, err)
+	}
+	return userID, nil
+}
+func (svc *UserServiceImpl) IsChannelUserExist(ctx context.Context, channelID, userID uint64) (bool, error) {
+	exist, err := svc.userRepo.IsChannelUserExist(ctx, channelID, userID)
+	if err != nil {
+		return false, fmt.Errorf("error check user %d in channel %d: %w", userID, channelID, err)
+	}
+	return exist, nil
+}
+func (svc *UserServiceImpl) GetChannelUserIDs(ctx context.Context, channelID uint64) ([]uint64, error) {
+	users, err := svc.userRepo.GetChannelUserIDs(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get users in channel %d: %w", channelID, err)
+	}
+	return users, nil
+}
+
+// RemoveUserChannel takes a channel the user left out of the channels of the user
+func (svc *UserServiceImpl) RemoveUserChannel(ctx context.Context, channelID, userID uint64) error {
+	if err := svc.userRepo.RemoveUserChannels(ctx, channelID, []uint64{userID}); err != nil {
+		return fmt.Errorf("error remove channel %d from user %d: %w", channelID, userID, err)
+	}
+	return nil
+}
+
+// userChannelsBackfillPage is the number of memberships backfilled at once
+const userChannelsBackfillPage = 1000
+
+// BackfillUserChannels indexes the memberships of all channels by user, so that channels
+// joined before the index was kept are listed too, and returns the number of memberships.
+// Only one replica backfills, once; a failed backfill is retried on the next start
+func (svc *UserServiceImpl) BackfillUserChannels(ctx context.Context) (int, error) {
+	acquired, err := svc.userRepo.AcquireUserChannelsBackfill(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error acquire user channels backfill: %w", err)
+	}
+	if !acquired {
+		return 0, nil
+	}
+	var (
+		backfilled int
+		pageState  []byte
+	)
+	for {
+		channelUsers, nextPageState, err := svc.userRepo.ListChannelUsers(ctx, pageState, userChannelsBackfillPage)
+		if err == nil {
+			err = svc.userRepo.BackfillUserChannels(ctx, channelUsers)
+		}
+		if err != nil {
+			if releaseErr := svc.userRepo.ReleaseUserChannelsBackfill(ctx); releaseErr != nil {
+				err = errors.Join(err, releaseErr)
+			}
+			return backfilled, fmt.Errorf("error backfill user channels: %w", err)
+		}
+		backfilled += len(channelUsers)
+		if len(nextPageState) == 0 {
+			return backfilled, nil
+		}
+		pageState = nextPageState
+	}
+}
+
+func (svc *UserServiceImpl) GetUserRole(ctx context.Context, channelID, userID uint64) (Role, error) {
+	return getUserRole(ctx, svc.userRepo, channelID, userID)
+}
+
+// GetChannelRoles returns the role of every user of a channel
+func (svc *UserServiceImpl) GetChannelRoles(ctx context.Context, channelID uint64) (map[uint64]Role, error) {
+	userIDs, err := svc.userRepo.GetChannelUserIDs(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get users in channel %d: %w", channelID, err)
+	}
+	assigned, err := svc.userRepo.GetChannelRoles(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get roles in channel %d: %w", channelID, err)
+	}
+	creatorID, err := svc.userRepo.GetChannelCreator(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get creator of channel %d: %w", channelID, err)
+	}
+	roles := make(map[uint64]Role, len(userIDs))
+	for _, userID := range userIDs {
+		roles[userID] = resolveRole(assigned, creatorID, userID)
+	}
+	return roles, nil
+}
+
+// SetUserRole promotes or demotes a user of the channel. Only admins can change roles,
+// and the last admin of a channel cannot be demoted
+func (svc *UserServiceImpl) SetUserRole(ctx context.Context, channelID, actorID, targetID uint64, role Role) error {
+	if role != RoleAdmin && role != RoleMember {
+		return ErrInvalidRole
+	}
+	roles, err := svc.GetChannelRoles(ctx, channelID)
+	if err != nil {
+		return err
+	}
+	if roles[actorID] != RoleAdmin {
+		return ErrRoleChangeNotAllowed
+	}
+	current, ok := roles[targetID]
+	if !ok {
+		return ErrChannelOrUserNotFound
+	}
+	if current == role {
+		return nil
+	}
+	creatorID, err := svc.userRepo.GetChannelCreator(ctx, channelID)
+	if err != nil {
+		return fmt.Errorf("error get creator of channel %d: %w", channelID, err)
+	}
+	// the admins are counted again along with the write, so that concurrent demotions
+	// cannot leave the channel without an admin
+	set, err := svc.userRepo.SetChannelRole(ctx, channelID, creatorID, targetID, role)
+	if err != nil {
+		return fmt.Errorf("error set role of user %d in channel %d: %w", targetID, channelID, err)
+	}
+	if !set {
+		return ErrLastAdmin
+	}
+	return nil
+}
+
+// AddOnlineUser counts a connection of the user and reports whether the user came online,
+// i.e. opened its first connection without just having dropped another one
+func (svc *UserServiceImpl) AddOnlineUser(ctx context.Context, channelID, userID uint64) (bool, error) {
+	connections, err := svc.userRepo.AddOnlineUser(ctx, channelID, userID)
+	if err != nil {
+		return false, fmt.Errorf("error add online user %d to channel %d: %w", userID, channelID, err)
+	}
+	if connections > 1 {
+		return false, nil
+	}
+	if svc.offlineDebounce <= 0 {
+		return true, nil
+	}
+	// a reconnect within the debounce period was never announced offline
+	reconnected, err := svc.userRepo.CancelPendingOffline(ctx, channelID, userID)
+	if err != nil {
+		return false, fmt.Errorf("error cancel pending offline of user %d in channel %d: %w", userID, channelID, err)
+	}
+	return !reconnected, nil
+}
+
+// DeleteOnlineUser uncounts a closed connection of the user and reports whether the user
+// went offline right away. With a debounce period the offline presence is held back and
+// later returned by PopDueOfflineUsers instead
+func (svc *UserServiceImpl) DeleteOnlineUser(ctx context.Context, channelID, userID uint64) (bool, error) {
+	connections, err := svc.userRepo.DeleteOnlineUser(ctx, channelID, userID)
+	if err != nil {
+		return false, fmt.Errorf("error delete online user %d from channel %d: %w", userID, channelID, err)
+	}
+	if connections > 0 {
+		return false, nil
+	}
+	if svc.offlineDebounce <= 0 {
+		return true, nil
+	}
+	if err := svc.userRepo.SchedulePendingOffline(ctx, channelID, userID, time.Now().Add(svc.offlineDebounce)); err != nil {
+		return false, fmt.Errorf("error schedule pending offline of user %d in channel %d: %w", userID, channelID, err)
+	}
+	return false, nil
+}
+
+// PopDueOfflineUsers returns the users whose debounce period elapsed without reconnecting.
+// Users that could not be checked are held back again for the next sweep
+func (svc *UserServiceImpl) PopDueOfflineUsers(ctx context.Context, now time.Time) ([]ChannelUser, error) {
+	users, err := svc.userRepo.PopDuePendingOffline(ctx, now)
+	if err != nil {
+		return nil, fmt.Errorf("error pop pending offline users: %w", err)
+	}
+	var offlineUsers []ChannelUser
+	var errs []error
+	for _, user := range users {
+		// the user may have reconnected to another replica since being popped
+		online, err := svc.userRepo.IsOnlineUser(ctx, user.ChannelID, user.UserID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error check online user %d in channel %d: %w", user.UserID, user.ChannelID, err))
+			if err := svc.userRepo.SchedulePendingOffline(ctx, user.ChannelID, user.UserID, now); err != nil {
+				errs = append(errs, fmt.Errorf("error reschedule pending offline of user %d in channel %d: %w", user.UserID, user.ChannelID, err))
+			}
+			continue
+		}
+		if !online {
+			offlineUsers = append(offlineUsers, user)
+		}
+	}
+	return offlineUsers, errors.Join(errs...)
+}
+func (svc *UserServiceImpl) GetOnlineUserIDs(ctx context.Context, channelID uint64) ([]uint64, error) {
+	users, err := svc.userRepo.GetOnlineUserIDs(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get online users in channel %d: %w", channelID, err)
+	}
+	return users, nil
+}
+func (svc *UserServiceImpl) SetReadReceiptsEnabled(ctx context.Context, userID uint64, enabled bool) error {
+	if err := svc.userRepo.SetReadReceiptsEnabled(ctx, userID, enabled); err != nil {
+		return fmt.Errorf("error set read receipts preference of user %d: %w", userID, err)
+	}
+	return nil
+}
+func (svc *UserServiceImpl) IsReadReceiptsEnabled(ctx context.Context, userID uint64) (bool, error) {
+	enabled, err := svc.userRepo.IsReadReceiptsEnabled(ctx, userID)
+	if err != nil {
+		return false, fmt.Errorf("error get read receipts preference of user %d: %w", userID, err)
+	}
+	return enabled, nil
+}
+
+// BlockUser adds the target to the block list of the user. Blocking is global rather
+// than per channel
+func (svc *UserServiceImpl) BlockUser(ctx context.Context, userID, targetID uint64) error {
+	if userID == targetID {
+		return ErrBlockSelf
+	}
+	if _, err := svc.userRepo.GetUserByID(ctx, targetID); err != nil {
+		return fmt.Errorf("error get user %d: %w", targetID, err)
+	}
+	if err := svc.userRepo.SetBlocked(ctx, userID, targetID, true); err != nil {
+		return fmt.Errorf("error block user %d for user %d: %w", targetID, userID, err)
+	}
+	return nil
+}
+func (svc *UserServiceImpl) UnblockUser(ctx context.Context, userID, targetID uint64) error {
+	if err := svc.userRepo.SetBlocked(ctx, userID, targetID, false); err != nil {
+		return fmt.Errorf("error unblock user %d for user %d: %w", targetID, userID, err)
+	}
+	return nil
+}
+func (svc *UserServiceImpl) GetBlockedUsers(ctx context.Context, userID uint64) ([]BlockedUser, error) {
+	blocked, err := svc.userRepo.GetBlockedUsers(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error get blocked users of user %d: %w", userID, err)
+	}
+	return blocked, nil
+}
+func (svc *UserServiceImpl) GetBlockerIDs(ctx context.Context, userID uint64) ([]uint64, error) {
+	blockerIDs, err := svc.userRepo.GetBlockerIDs(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error get users who blocked user %d: %w", userID, err)
+	}
+	return blockerIDs, nil
+}
+
+// GetReadReceipts returns the last message seen by each user of a channel who shares read
+// receipts. The read cursor of the viewer is always included; viewerID 0 stands for no viewer
+func (svc *UserServiceImpl) GetReadReceipts(ctx context.Context, channelID, viewerID uint64) (map[uint64]uint64, error) {
+	cursors, err := svc.userRepo.GetReadCursors(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get read cursors of channel %d: %w", channelID, err)
+	}
+	for userID := range cursors {
+		if userID == viewerID {
+			continue
+		}
+		enabled, err := svc.userRepo.IsReadReceiptsEnabled(ctx, userID)
+		if err != nil {
+			return nil, fmt.Errorf("error get read receipts preference of user %d: %w", userID, err)
+		}
+		if !enabled {
+			delete(cursors, userID)
+		}
+	}
+	return cursors, nil
+}
+func (svc *UserServiceImpl) TouchPresence(ctx context.Context, userID uint64) error {
+	if err := svc.userRepo.TouchPresence(ctx, userID); err != nil {
+		return fmt.Errorf("error touch presence of user %d: %w", userID, err)
+	}
+	return nil
+}
+func (svc *UserServiceImpl) KeepPresence(ctx context.Context, userID uint64) error {
+	if err := svc.userRepo.KeepPresence(ctx, userID); err != nil {
+		return fmt.Errorf("error keep presence of user %d: %w", userID, err)
+	}
+	return nil
+}
+
+// GetPresence reports users active within the away threshold as online, connected but
+// idle users as away, and everyone else, including unknown users, as offline
+func (svc *UserServiceImpl) GetPresence(ctx context.Context, userIDs []uint64) (map[uint64]PresenceState, error) {
+	lastActiveTimes, err := svc.userRepo.GetLastActiveTimes(ctx, userIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error get presence of %d users: %w", len(userIDs), err)
+	}
+	now := time.Now()
+	presence := make(map[uint64]PresenceState, len(userIDs))
+	for i, userID := range userIDs {
+		switch {
+		case lastActiveTimes[i] == 0:
+			presence[userID] = PresenceOffline
+		case now.Sub(time.Unix(lastActiveTimes[i], 0)) < svc.awayAfter:
+			presence[userID] = PresenceOnline
+		default:
+			presence[userID] = PresenceAway
+		}
+	}
+	return presence, nil
+}
+func (svc *UserServiceImpl) IsAloneInChannel(ctx context.Context, channelID, userID uint64) (bool, error) {
+	userIDs, err := svc.userRepo.GetOnlineUserIDs(ctx, channelID)
+	if err != nil {
+		return false, fmt.Errorf("error get online users in channel %d: %w", channelID, err)
+	}
+	for _, id := range userIDs {
+		if id != userID {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+func (svc *UserServiceImpl) AddFloodViolation(ctx context.Context, userID uint64, window time.Duration) (int64, error) {
+	violations, err := svc.userRepo.AddFloodViolation(ctx, userID, window)
+	if err != nil {
+		return 0, fmt.Errorf("error add flood violation of user %d: %w", userID, err)
+	}
+	return violations, nil
+}
+func (svc *UserServiceImpl) SetConnectionCooldown(ctx context.Context, userID uint64, cooldown time.Duration) error {
+	if err := svc.userRepo.SetConnectionCooldown(ctx, userID, cooldown); err != nil {
+		return fmt.Errorf("error set connection cooldown of user %d: %w", userID, err)
+	}
+	return nil
+}
+func (svc *UserServiceImpl) IsInConnectionCooldown(ctx context.Context, userID uint64) (bool, error) {
+	cooling, err := svc.userRepo.IsInConnectionCooldown(ctx, userID)
+	if err != nil {
+		return false, fmt.Errorf("error check connection cooldown of user %d: %w", userID, err)
+	}
+	return cooling, nil
+}
+
+// RevokeRefreshToken denylists a refresh token until it expires. It reports false if the
+// token had already been revoked or spent
+func (svc *UserServiceImpl) RevokeRefreshToken(ctx context.Context, claims *RefreshClaims) (bool, error) {
+	ttl := time.Minute
+	if claims.ExpiresAt != nil {
+		ttl = time.Until(claims.ExpiresAt.Time) + time.Minute
+	}
+	revoked, err := svc.userRepo.RevokeToken(ctx, claims.ID, ttl)
+	if err != nil {
+		return false, fmt.Errorf("error revoke refresh token of user %d: %w", claims.UserID, err)
+	}
+	return revoked, nil
+}
+func (svc *UserServiceImpl) SetTypingUser(ctx context.Context, channelID, userID uint64, typing bool) error {
+	if err := svc.userRepo.SetTypingUser(ctx, channelID, userID, typing); err != nil {
+		return fmt.Errorf("error set typing state of user %d in channel %d: %w", userID, channelID, err)
+	}
+	return nil
+}
+func (svc *UserServiceImpl) AllowTypingBroadcast(ctx context.Context, channelID, userID uint64, interval time.Duration) (bool, error) {
+	allowed, err := svc.userRepo.AllowTypingBroadcast(ctx, channelID, userID, interval)
+	if err != nil {
+		return false, fmt.Errorf("error throttle typing broadcast of user %d in channel %d: %w", userID, channelID, err)
+	}
+	return allowed, nil
+}
+
+// typingStateTTL bounds how long a typing state is reported if the client never sends endtyping
+const typingStateTTL = 10 * time.Second
+
+func (svc *UserServiceImpl) GetSnapshot(ctx context.Context, channelID uint64) (*Snapshot, error) {
+	userIDs, err := svc.userRepo.GetChannelUserIDs(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get users in channel %d: %w", channelID, err)
+	}
+	onlineUserIDs, err := svc.userRepo.GetOnlineUserIDs(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get online users in channel %d: %w", channelID, err)
+	}
+	typingUserIDs, err := svc.userRepo.GetTypingUserIDs(ctx, channelID, time.Now().Add(-typingStateTTL))
+	if err != nil {
+		return nil, fmt.Errorf("error get typing users in channel %d: %w", channelID, err)
+	}
+	return &Snapshot{
+		ChannelID:     channelID,
+		UserIDs:       userIDs,
+		OnlineUserIDs: onlineUserIDs,
+		TypingUserIDs: typingUserIDs,
+	}, nil
+}
+
+type ChannelServiceImpl struct {
+	chanRepo       ChannelRepoCache
+	userRepo       UserRepoCache
+	msgRepo        MessageRepoCache
+	archiveRepo    ArchiveRepo
+	attachmentRepo AttachmentRepo
+	sf             common.IDGenerator
+}
+
+func NewChannelServiceImpl(chanRepo ChannelRepoCache, userRepo UserRepoCache, msgRepo MessageRepoCache, archiveRepo ArchiveRepo, attachmentRepo AttachmentRepo, sf common.IDGenerator) *ChannelServiceImpl {
+	return &ChannelServiceImpl{chanRepo, userRepo, msgRepo, archiveRepo, attachmentRepo, sf}
+}
+
+// CreateChannel creates a channel with an optional name and creator that expires after ttl,
+// or never expires if ttl is zero. Without a creator, the first user added becomes it
+func (svc *ChannelServiceImpl) CreateChannel(ctx context.Context, name string, ttl time.Duration, creatorID uint64) (*Channel, error) {
+	channelID, err := svc.sf.NextID()
+	if err != nil {
+		return nil, fmt.Errorf("error create snowflake ID for new channel: %w", err)
+	}
+	channel, err := svc.chanRepo.CreateChannel(ctx, channelID, name, creatorID)
+	if err != nil {
+		return nil, fmt.Errorf("error create channel %d: %w", channelID, err)
+	}
+	if ttl > 0 {
+		if err := svc.chanRepo.SetChannelExpiry(ctx, channelID, ttl); err != nil {
+			return nil, fmt.Errorf("error set expiry of channel %d: %w", channelID, err)
+		}
+	}
+	return channel, nil
+}
+
+// GetChannelInfo returns the metadata of the channel along with its member and online counts
+func (svc *ChannelServiceImpl) GetChannelInfo(ctx context.Context, channelID uint64) (*ChannelInfo, error) {
+	metadata, err := svc.chanRepo.GetChannelMetadata(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get metadata of channel %d: %w", channelID, err)
+	}
+	creatorID, err := svc.userRepo.GetChannelCreator(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get creator of channel %d: %w", channelID, err)
+	}
+	userIDs, err := svc.userRepo.GetChannelUserIDs(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get users in channel %d: %w", channelID, err)
+	}
+	onlineUserIDs, err := svc.userRepo.GetOnlineUserIDs(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get online users in channel %d: %w", channelID, err)
+	}
+	return &ChannelInfo{
+		ChannelID:   channelID,
+		Name:        metadata.Name,
+		CreatedAt:   metadata.CreatedAt,
+		CreatorID:   creatorID,
+		MemberCount: len(userIDs),
+		OnlineCount: len(onlineUserIDs),
+	}, nil
+}
+
+// PreviewChannelDeletion returns what deleting the channel would remove, without deleting it
+func (svc *ChannelServiceImpl) PreviewChannelDeletion(ctx context.Context, channelID uint64) (*ChannelDeletion, error) {
+	userIDs, err := svc.userRepo.GetChannelUserIDs(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get users in channel %d: %w", channelID, err)
+	}
+	messageCount, err := svc.msgRepo.CountMessages(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error count messages of channel %d: %w", channelID, err)
+	}
+	attachmentCount, err := svc.attachmentRepo.CountChannelAttachments(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error count attachments of channel %d: %w", channelID, err)
+	}
+	return &ChannelDeletion{
+		MessageCount:    messageCount,
+		AttachmentCount: attachmentCount,
+		MemberCount:     len(userIDs),
+	}, nil
+}
+
+// DeleteChannel purges the channel along with its members, its messages, its archive and
+// the files uploaded to it, and returns what was removed
+func (svc *ChannelServiceImpl) DeleteChannel(ctx context.Context, channelID uint64) (*ChannelDeletion, error) {
+	userIDs, err := svc.userRepo.GetChannelUserIDs(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error get users in channel %d: %w", channelID, err)
+	}
+	messageCount, err := svc.msgRepo.CountMessages(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error count messages of channel %d: %w", channelID, err)
+	}
+	if err := svc.chanRepo.DeleteChannel(ctx, channelID); err != nil {
+		return nil, fmt.Errorf("error delete channel %d: %w", channelID, err)
+	}
+	if err := svc.userRepo.RemoveUserChannels(ctx, channelID, userIDs); err != nil {
+		return nil, fmt.Errorf("error remove channel %d from its users: %w", channelID, err)
+	}
+	if err := svc.msgRepo.DeleteLastMessageTime(ctx, channelID); err != nil {
+		return nil, fmt.Errorf("error delete last message time of channel %d: %w", channelID, err)
+	}
+	if err := svc.msgRepo.DeleteMessages(ctx, channelID); err != nil {
+		return nil, fmt.Errorf("error delete messages of channel %d: %w", channelID, err)
+	}
+	if err := svc.archiveRepo.DeleteArchive(ctx, channelID); err != nil {
+		return nil, fmt.Errorf("error delete archive of channel %d: %w", channelID, err)
+	}
+	attachmentCount, err := svc.attachmentRepo.DeleteChannelAttachments(ctx, channelID)
+	if err != nil {
+		return nil, fmt.Errorf("error delete attachments of channel %d: %w", channelID, err)
+	}
+	return &ChannelDeletion{
+		MessageCount:    messageCount,
+		AttachmentCount: attachmentCount,
+		MemberCount:     len(userIDs),
+	}, nil
+}
+
+func (svc *ChannelServiceImpl) GetChannelExpiry(ctx context.Context, channelID uint64) (time.Time, error) {
+	expiresAt, err := svc.chanRepo.GetChannelExpiry(ctx, channelID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error get expiry of channel %d: %w", channelID, err)
+	}
+	return expiresAt, nil
+}
+
+// ExpireChannel notifies the connected clients of a channel that it expired, which makes
+// them disconnect, and then purges the channel along with its messages, its archive and
+// the files uploaded to it
+func (svc *ChannelServiceImpl) ExpireChannel(ctx context.Context, channelID uint64) error {
+	msg := Message{
+		Event:     EventChannelExpired,
+		ChannelID: channelID,
+		Time:      time.Now().UnixMilli(),
+	}
+	if err := svc.msgRepo.PublishMessage(ctx, &msg); err != nil {
+		return fmt.Errorf("error broadcast expiry of channel %d: %w", channelID, err)
+	}
+	_, err := svc.DeleteChannel(ctx, channelID)
+	return err
+}
+
+// ExpireDueChannels tears down the channels expired by now and returns the number of
+// expired channels. A channel whose teardown fails is retried on a later run
+func (svc *ChannelServiceImpl) ExpireDueChannels(ctx context.Context, now time.Time) (int, error) {
+	channelIDs, err := svc.chanRepo.PopExpiredChannelIDs(ctx, now)
+	if err != nil {
+		return 0, fmt.Errorf("error pop expired channels: %w", err)
+	}
+	expired := 0
+	for i, channelID := range channelIDs {
+		if err := svc.ExpireChannel(ctx, channelID); err != nil {
+			// put the remaining channels back so that their teardown is retried
+			for _, channelID := range channelIDs[i:] {
+				if err := svc.chanRepo.RetryChannelExpiry(ctx, channelID); err != nil {
+					return expired, fmt.Errorf("error requeue expiry of channel %d: %w", channelID, err)
+				}
+			}
+			return expired, err
+		}
+		expired++
+	}
+	return expired, nil
+}
+
+// ListUserChannels returns the active channels of a user, the most recently active first.
+// Soft-archived channels are left out
+func (svc *ChannelServiceImpl) ListUserChannels(ctx context.Context, userID uint64) ([]*UserChannel, error) {
+	allChannelIDs, err := svc.userRepo.GetUserChannelIDs(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("error get channels of user %d: %w", userID, err)
+	}
+	channelIDs := make([]uint64, 0, len(allChannelIDs))
+	for _, channelID := range allChannelIDs {
+		softArchived, err := svc.chanRepo.IsChannelSoftArchived(ctx, channelID)
+		if err != nil {
+			return nil, fmt.Errorf("error check soft archival of channel %d: %w", channelID, err)
+		}
+		if !softArchived {
+			channelIDs = append(channelIDs, channelID)
+		}
+	}
+	lastMessageTimes, err := svc.msgRepo.GetLastMessageTimes(ctx, channelIDs)
+	if err != nil {
+		return nil, fmt.Errorf("error get last message times of user %d: %w", userID, err)
+	}
+	channels := make([]*UserChannel, len(channelIDs))
+	for i, channelID := range channelIDs {
+		channels[i] = &UserChannel{
+			ChannelID:       channelID,
+			LastMessageTime: lastMessageTimes[channelID],
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		if channels[i].LastMessageTime != channels[j].LastMessageTime {
+			return channels[i].LastMessageTime > channels[j].LastMessageTime
+		}
+		return channels[i].ChannelID > channels[j].ChannelID
+	})
+	return channels, nil
+}
+func (svc *ChannelServiceImpl) SetStickerPack(ctx context.Context, channelID uint64, stickers []Sticker) error {
+	if err := svc.chanRepo.SetStickerPack(ctx, channelID, stickers); err != nil {
+		return fmt.Errorf("error set sticker pack of channel %d: %w", channelID, err)
+	}
+	return nil
+}
+
+// GetStickerPack returns the sticker pack of a channel, falling back to the default stickers
+// if the channel has no custom pack. The boolean indicates whether the default set is returned
+func (svc *ChannelServiceImpl) GetStickerPack(ctx context.Context, channelID uint64) ([]Sticker, bool, error) {
+	stickers, err := svc.chanRepo.GetStickerPack(ctx, channelID)
+	if err != nil {
+		return nil, false, fmt.Errorf("error get sticker pack of channel %d: %w", channelID, err)
+	}
+	if len(stickers) > 0 {
+		return stickers, false, nil
+	}
+	stickers = make([]Sticker, 0, len(DefaultStickers))
+	for _, name := range DefaultStickers {
+		stickers = append(stickers, Sticker{Name: name})
+	}
+	return stickers, true, nil
+}
+func (svc *ChannelServiceImpl) IsStickerAllowed(ctx context.Context, channelID uint64, name string) (bool, error) {
+	hasPack, inPack, err := svc.chanRepo.IsStickerInPack(ctx, channelID, name)
+	if err != nil {
+		return false, fmt.Errorf("error check sticker %s in channel %d: %w", name, channelID, err)
+	}
+	if hasPack {
+		return inPack, nil
+	}
+	for _, defaultName := range DefaultStickers {
+		if name == defaultName {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type ForwardServiceImpl struct {
+	forwardRepo ForwardRepo
+}
+
+func NewForwardServiceImpl(forwardRepo ForwardRepo) *ForwardServiceImpl {
+	return &ForwardServiceImpl{forwardRepo}
+}
+
+func (svc *ForwardServiceImpl) RegisterChannelSession(ctx context.Context, channelID, userID uint64, subscriber string) error {
+	return svc.forwardRepo.RegisterChannelSession(ctx, channelID, userID, subscriber)
 }
 func (svc *ForwardServiceImpl) RemoveChannelSession(ctx context.Context, channelID, userID uint64) error {
 	return svc.forwardRepo.RemoveChannelSession(ctx, channelID, userID)
 }
+
+// ArchiveInactiveChannels archives every channel without activity since lastActiveBefore
+// that nobody is connected to. Channels are taken off the activity index one at a time, and
+// a channel that fails is put back and retried on a later run without stopping the others
+func (svc *ChannelServiceImpl) ArchiveInactiveChannels(ctx context.Context, lastActiveBefore time.Time) (int, error) {
+	channelIDs, err := svc.chanRepo.GetInactiveChannelIDs(ctx, lastActiveBefore)
+	if err != nil {
+		return 0, fmt.Errorf("error get inactive channels: %w", err)
+	}
+	archived := 0
+	var errs []error
+	for _, channelID := range channelIDs {
+		ok, err := svc.archiveInactiveChannel(ctx, channelID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			archived++
+		}
+	}
+	return archived, errors.Join(errs...)
+}
+
+// archiveInactiveChannel archives a channel of the activity index unless it is soft-archived
+// or has users online, and reports whether it was archived
+func (svc *ChannelServiceImpl) archiveInactiveChannel(ctx context.Context, channelID uint64) (bool, error) {
+	// soft-archived channels keep their history in place for export; the activity index
+	// picks them up again once they are unarchived
+	softArchived, err := svc.chanRepo.IsChannelSoftArchived(ctx, channelID)
+	if err != nil {
+		return false, fmt.Errorf("error check soft archival of channel %d: %w", channelID, err)
+	}
+	if softArchived {
+		return false, nil
+	}
+	online, err := svc.hasOnlineUsers(ctx, channelID)
+	if err != nil || online {
+		return false, err
+	}
+	taken, err := svc.chanRepo.TakeChannelActivity(ctx, channelID)
+	if err != nil {
+		return false, fmt.Errorf("error take activity of channel %d: %w", channelID, err)
+	}
+	if !taken {
+		// archived by another replica, or active again, meanwhile
+		return false, nil
+	}
+	// a user may have connected between the check and taking the channel
+	online, err = svc.hasOnlineUsers(ctx, channelID)
+	if err == nil && !online {
+		err = svc.ArchiveChannel(ctx, channelID)
+		if err == nil {
+			return true, nil
+		}
+	}
+	// put the channel back so that archival is retried on a later run
+	if touchErr := svc.chanRepo.TouchChannelActivity(ctx, channelID); touchErr != nil {
+		return false, errors.Join(err, fmt.Errorf("error touch activity of channel %d: %w", channelID, touchErr))
+	}
+	return false, err
+}
+
+// hasOnlineUsers reports whether any user is connected to the channel
+func (svc *ChannelServiceImpl) hasOnlineUsers(ctx context.Context, channelID uint64) (bool, error) {
+	onlineUserIDs, err := svc.userRepo.GetOnlineUserIDs(ctx, channelID)
+	if err != nil {
+		return false, fmt.Errorf("error get online users in channel %d: %w", channelID, err)
+	}
+	return len(onlineUserIDs) > 0, nil
+}
+
+// ReapEmptyChannels archives, or deletes if remove is set, every channel that nobody is
+// connected to and that had no activity or messages since lastActiveBefore, and returns the
+// number of reaped channels. Users never leave the members of a channel, so a channel counts
+// as empty once nobody is connected to it. Soft-archived channels are kept. A channel that
+// fails is retried on a later run without holding back the others
+func (svc *ChannelServiceImpl) ReapEmptyChannels(ctx context.Context, lastActiveBefore time.Time, remove bool) (int, error) {
+	channelIDs, err := svc.chanRepo.GetInactiveChannelIDs(ctx, lastActiveBefore)
+	if err != nil {
+		return 0, fmt.Errorf("error get inactive channels: %w", err)
+	}
+	reaped := 0
+	var errs []error
+	for _, channelID := range channelIDs {
+		ok, err := svc.reapEmptyChannel(ctx, channelID, lastActiveBefore, remove)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if ok {
+			reaped++
+		}
+	}
+	return reaped, errors.Join(errs...)
+}
+
+// reapEmptyChannel archives or deletes a channel of the activity index if it is abandoned,
+// and reports whether it was reaped
+func (svc *ChannelServiceImpl) reapEmptyChannel(ctx context.Context, channelID uint64, lastActiveBefore time.Time, remove bool) (bool, error) {
+	abandoned, err := svc.isChannelAbandoned(ctx, channelID, lastActiveBefore)
+	if err != nil || !abandoned {
+		return false, err
+	}
+	taken, err := svc.chanRepo.TakeChannelActivity(ctx, channelID)
+	if err != nil {
+		return false, fmt.Errorf("error take activity of channel %d: %w", channelID, err)
+	}
+	if !taken {
+		// reaped or archived by another replica, or active again, meanwhile
+		return false, nil
+	}
+	// a user may have connected between the check and taking the channel
+	online, err := svc.hasOnlineUsers(ctx, channelID)
+	if err == nil && !online {
+		if remove {
+			_, err = svc.DeleteChannel(ctx, channelID)
+		} else {
+			err = svc.ArchiveChannel(ctx, channelID)
+		}
+		if err == nil {
+			return true, nil
+		}
+	}
+	// put the channel back so that it is reaped on a later run
+	if touchErr := svc.chanRepo.TouchChannelActivity(ctx, channelID); touchErr != nil {
+		return false, errors.Join(err, fmt.Errorf("error touch activity of channel %d: %w", channelID, touchErr))
+	}
+	return false, err
+}
+
+// isChannelAbandoned reports whether a channel is not soft-archived, nobody is connected to
+// it and it had no message since lastActiveBefore
+func (svc *ChannelServiceImpl) isChannelAbandoned(ctx context.Context, channelID uint64, lastActiveBefore time.Time) (bool, error) {
+	// soft-archived channels are kept read-only on purpose until they are unarchived
+	softArchived, err := svc.chanRepo.IsChannelSoftArchived(ctx, channelID)
+	if err != nil {
+		return false, fmt.Errorf("error check soft archival of channel %d: %w", channelID, err)
+	}
+	if softArchived {
+		return false, nil
+	}
+	online, err := svc.hasOnlineUsers(ctx, channelID)
+	if err != nil || online {
+		return false, err
+	}
+	lastMessageTimes, err := svc.msgRepo.GetLastMessageTimes(ctx, []uint64{channelID})
+	if err != nil {
+		return false, fmt.Errorf("error get last message time of channel %d: %w", channelID, err)
+	}
+	return lastMessageTimes[channelID] < lastActiveBefore.UnixMilli(), nil
+}
+
+// trimReplyBatch is the number of replies of a trimmed thread root listed at once
+const trimReplyBatch = 500
+
+// TrimChannelMessages removes the messages of a channel sent before the given time or beyond
+// the newest maxMessages messages, and returns the number of trimmed messages. A zero time or
+// maxMessages disables the respective bound. Pinned messages are neither trimmed nor counted.
+// Trimming a thread root trims its replies too
+func (svc *ChannelServiceImpl) TrimChannelMessages(ctx context.Context, channelID uint64, before time.Time, maxMessages int64) (int, error) {
+	pinnedIDs, err := svc.msgRepo.GetPinnedMessageIDs(ctx, channelID)
+	if err != nil {
+		return 0, fmt.Errorf("error get pinned messages of channel %d: %w", channelID, err)
+	}
+	pinned := make(map[uint64]bool, len(pinnedIDs))
+	for _, messageID := range pinnedIDs {
+		pinned[messageID] = true
+	}
+	var (
+		trimIDs []uint64
+		rootIDs []uint64
+		trimmed = make(map[uint64]bool)
+		seen    int64
+	)
+	// messages are listed newest first
+	pageState := ""
+	for {
+		msgs, nextPageState, err := svc.msgRepo.ListMessages(ctx, channelID, pageState, 0)
+		if err != nil {
+			return 0, fmt.Errorf("error list messages of channel %d: %w", channelID, err)
+		}
+		for _, msg := range msgs {
+			if pinned[msg.MessageID] {
+				continue
+			}
+			seen++
+			if (maxMessages > 0 && seen > maxMessages) || (!before.IsZero() && msg.Time < before.UnixMilli()) {
+				trimIDs = append(trimIDs, msg.MessageID)
+				trimmed[msg.MessageID] = true
+				if msg.ReplyTo == 0 {
+					rootIDs = append(rootIDs, msg.MessageID)
+				}
+			}
+		}
+		if nextPageState == "" {
+			break
+		}
+		pageState = nextPageState
+	}
+	// replies are newer than their root, so they would outlive it otherwise
+	for _, rootID := range rootIDs {
+		var after uint64
+		for {
+			replyIDs, err := svc.msgRepo.ListReplyIDs(ctx, channelID, rootID, after, trimReplyBatch)
+			if err != nil {
+				return 0, fmt.Errorf("error list replies of message %d in channel %d: %w", rootID, channelID, err)
+			}
+			for _, replyID := range replyIDs {
+				if !pinned[replyID] && !trimmed[replyID] {
+					trimIDs = append(trimIDs, replyID)
+					trimmed[replyID] = true
+				}
+			}
+			if len(replyIDs) < trimReplyBatch {
+				break
+			}
+			after = replyIDs[len(replyIDs)-1]
+		}
+	}
+	if err := svc.msgRepo.TrimMessages(ctx, channelID, trimIDs); err != nil {
+		return 0, fmt.Errorf("error trim messages of channel %d: %w", channelID, err)
+	}
+	return len(trimIDs), nil
+}
+
+// TrimActiveChannels trims the messages of every active channel and returns the number of
+// trimmed messages per channel. Only one replica trims per interval; the others return
+// right away. A channel that fails to trim does not stop the others
+func (svc *ChannelServiceImpl) TrimActiveChannels(ctx context.Context, before time.Time, maxMessages int64, interval time.Duration) (map[uint64]int, error) {
+	acquired, err := svc.chanRepo.AcquireRetentionRun(ctx, interval)
+	if err != nil {
+		return nil, fmt.Errorf("error acquire retention run: %w", err)
+	}
+	if !acquired {
+		return nil, nil
+	}
+	channelIDs, err := svc.chanRepo.GetActiveChannelIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error get active channels: %w", err)
+	}
+	trimmed := make(map[uint64]int)
+	var errs []error
+	for _, channelID := range channelIDs {
+		n, err := svc.TrimChannelMessages(ctx, channelID, before, maxMessages)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		trimmed[channelID] = n
+	}
+	return trimmed, errors.Join(errs...)
+}
+
+// ArchiveChannel makes a channel read-only, moves its messages to cold storage and frees
+// its hot cache keys
+func (svc *ChannelServiceImpl) ArchiveChannel(ctx context.Context, channelID uint64) error {
+	if err := svc.chanRepo.SetChannelArchived(ctx, channelID, true); err != nil {
+		return fmt.Errorf("error mark channel %d archived: %w", channelID, err)
+	}
+	archive := ChannelArchive{
+		ChannelID:  channelID,
+		ArchivedAt: time.Now().UnixMilli(),
+	}
+	pageState := ""
+	for {
+		msgs, nextPageState, err := svc.msgRepo.ListMessages(ctx, channelID, pageState, 0)
+		if err != nil {
+			return svc.abortArchive(ctx, channelID, fmt.Errorf("error list messages of channel %d: %w", channelID, err))
+		}
+		archive.Messages = append(archive.Messages, msgs...)
+		if nextPageState == "" {
+			break
+		}
+		pageState = nextPageState
+	}
+	data, err := json.Marshal(&archive)
+	if err != nil {
+		return svc.abortArchive(ctx, channelID, fmt.Errorf("error encode archive of channel %d: %w", channelID, err))
+	}
+	if err := svc.archiveRepo.PutArchive(ctx, channelID, data); err != nil {
+		return svc.abortArchive(ctx, channelID, fmt.Errorf("error upload archive of channel %d: %w", channelID, err))
+	}
+	if err := svc.msgRepo.DeleteMessages(ctx, channelID); err != nil {
+		return fmt.Errorf("error delete archived messages of channel %d: %w", channelID, err)
+	}
+	if err := svc.chanRepo.FreeChannelCache(ctx, channelID); err != nil {
+		return fmt.Errorf("error free cache of channel %d: %w", channelID, err)
+	}
+	return nil
+}
+
+func (svc *ChannelServiceImpl) abortArchive(ctx context.Context, channelID uint64, cause error) error {
+	if err := svc.chanRepo.SetChannelArchived(ctx, channelID, false); err != nil {
+		return fmt.Errorf("error unmark channel %d archived: %w (archive failed: %v)", channelID, err, cause)
+	}
+	return cause
+}
+
+// RestoreChannel rehydrates the messages of an archived channel and makes it writable again.
+// Restoring a channel that is not archived is a no-op
+func (svc *ChannelServiceImpl) RestoreChannel(ctx context.Context, channelID uint64) error {
+	archived, err := svc.chanRepo.IsChannelArchived(ctx, channelID)
+	if err != nil {
+		return fmt.Errorf("error check archival of channel %d: %w", channelID, err)
+	}
+	if !archived {
+		return nil
+	}
+	exist, data, err := svc.archiveRepo.GetArchive(ctx, channelID)
+	if err != nil {
+		return fmt.Errorf("error download archive of channel %d: %w", channelID, err)
+	}
+	if exist {
+		var archive ChannelArchive
+		if err := json.Unmarshal(data, &archive); err != nil {
+			return fmt.Errorf("error decode archive of channel %d: %w", channelID, err)
+		}
+		if err := svc.msgRepo.RestoreMessages(ctx, archive.Messages); err != nil {
+			return fmt.Errorf("error restore messages of channel %d: %w", channelID, err)
+		}
+	}
+	if err := svc.chanRepo.SetChannelArchived(ctx, channelID, false); err != nil {
+		return fmt.Errorf("error unmark channel %d archived: %w", channelID, err)
+	}
+	if err := svc.chanRepo.TouchChannelActivity(ctx, channelID); err != nil {
+		return fmt.Errorf("error touch activity of channel %d: %w", channelID, err)
+	}
+	if exist {
+		if err := svc.archiveRepo.DeleteArchive(ctx, channelID); err != nil {
+			return fmt.Errorf("error delete archive of channel %d: %w", channelID, err)
+		}
+	}
+	return nil
+}
+func (svc *ChannelServiceImpl) IsChannelArchived(ctx context.Context, channelID uint64) (bool, error) {
+	archived, err := svc.chanRepo.IsChannelArchived(ctx, channelID)
+	if err != nil {
+		return false, fmt.Errorf("error check archival of channel %d: %w", channelID, err)
+	}
+	return archived, nil
+}
+
+// SoftArchiveChannel makes a channel read-only and hides it from the channel lists of its
+// users while keeping its message history readable
+func (svc *ChannelServiceImpl) SoftArchiveChannel(ctx context.Context, channelID uint64) error {
+	if err := svc.chanRepo.SetChannelSoftArchived(ctx, channelID, true); err != nil {
+		return fmt.Errorf("error mark channel %d soft archived: %w", channelID, err)
+	}
+	return nil
+}
+
+// UnarchiveChannel makes a soft-archived channel writable again
+func (svc *ChannelServiceImpl) UnarchiveChannel(ctx context.Context, channelID uint64) error {
+	if err := svc.chanRepo.SetChannelSoftArchived(ctx, channelID, false); err != nil {
+		return fmt.Errorf("error unmark channel %d soft archived: %w", channelID, err)
+	}
+	if err := svc.chanRepo.TouchChannelActivity(ctx, channelID); err != nil {
+		return fmt.Errorf("error touch activity of channel %d: %w", channelID, err)
+	}
+	return nil
+}
+func (svc *ChannelServiceImpl) IsChannelSoftArchived(ctx context.Context, channelID uint64) (bool, error) {
+	softArchived, err := svc.chanRepo.IsChannelSoftArchived(ctx, channelID)
+	if err != nil {
+		return false, fmt.Errorf("error check soft archival of channel %d: %w", channelID, err)
+	}
+	return softArchived, nil
+}
+
+// getUserRole returns the role of a user in a channel
+func getUserRole(ctx context.Context, userRepo UserRepoCache, channelID, userID uint64) (Role, error) {
+	assigned, err := userRepo.GetChannelRoles(ctx, channelID)
+	if err != nil {
+		return "", fmt.Errorf("error get roles in channel %d: %w", channelID, err)
+	}
+	if role, ok := assigned[userID]; ok {
+		return role, nil
+	}
+	creatorID, err := userRepo.GetChannelCreator(ctx, channelID)
+	if err != nil {
+		return "", fmt.Errorf("error get creator of channel %d: %w", channelID, err)
+	}
+	return resolveRole(assigned, creatorID, userID), nil
+}
+
+// resolveRole falls back to admin for the channel creator and member for everyone else
+// when no role is assigned to the user
+func resolveRole(assigned map[uint64]Role, creatorID, userID uint64) Role {
+	if role, ok := assigned[userID]; ok {
+		return role
+	}
+	if userID == creatorID {
+		return RoleAdmin
+	}
+	return RoleMember
+}
@@ -0,0 +1,130 @@
+package chat
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/olahol/melody.v1"
+)
+
+var (
+	shapedFramesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "ws_shaped_frames_total",
+		Help:      "Total number of outbound frames delayed or dropped by per-connection send shaping.",
+	}, []string{"outcome"})
+	shapedDropsPerConn = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "chat",
+		Name:      "ws_shaped_drops_per_connection",
+		Help:      "Number of frames dropped by send shaping over the lifetime of a connection.",
+		Buckets:   []float64{0, 1, 4, 16, 64, 256, 1024},
+	})
+)
+
+var (
+	errShaperQueueFull = errors.New("error send shaping queue is full")
+	errShaperClosed    = errors.New("error send shaper is closed")
+)
+
+// sendShaper caps the rate at which frames are written to a single connection.
+// Frames above the rate wait in a bounded queue and are released one per interval;
+// once the queue is full, new frames are dropped, the same way melody drops frames
+// of a slow consumer whose send buffer is full.
+type sendShaper struct {
+	mu       sync.Mutex
+	sess     *melody.Session
+	interval time.Duration
+	maxQueue int
+	queue    [][]byte
+	lastSend time.Time
+	timer    *time.Timer
+	dropped  int
+	isClosed bool
+}
+
+func newSendShaper(maxPerSecond int, maxQueue int) *sendShaper {
+	return &sendShaper{
+		interval: time.Second / time.Duration(maxPerSecond),
+		maxQueue: maxQueue,
+	}
+}
+
+// Add writes the frame immediately if the connection is under its rate,
+// otherwise it queues or drops the frame
+func (s *sendShaper) Add(sess *melody.Session, frame []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed {
+		return errShaperClosed
+	}
+	s.sess = sess
+	now := time.Now()
+	if len(s.queue) == 0 && now.Sub(s.lastSend) >= s.interval {
+		s.lastSend = now
+		return sess.Write(frame)
+	}
+	if len(s.queue) >= s.maxQueue {
+		s.dropped++
+		shapedFramesTotal.WithLabelValues("dropped").Inc()
+		return errShaperQueueFull
+	}
+	s.queue = append(s.queue, frame)
+	shapedFramesTotal.WithLabelValues("delayed").Inc()
+	if s.timer == nil {
+		s.timer = time.AfterFunc(s.interval-now.Sub(s.lastSend), s.release)
+	}
+	return nil
+}
+
+func (s *sendShaper) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timer = nil
+	if s.isClosed || len(s.queue) == 0 {
+		return
+	}
+	frame := s.queue[0]
+	s.queue = s.queue[1:]
+	s.lastSend = time.Now()
+	if err := s.sess.Write(frame); err != nil {
+		slog.Error(err.Error())
+	}
+	if len(s.queue) > 0 {
+		s.timer = time.AfterFunc(s.interval, s.release)
+	}
+}
+
+// Close drops queued frames and stops shaping
+func (s *sendShaper) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.isClosed {
+		return
+	}
+	s.isClosed = true
+	s.queue = nil
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	shapedDropsPerConn.Observe(float64(s.dropped))
+}
+
+// isShapingDrop reports whether the frame was dropped by send shaping, which counts its
+// drops itself
+func isShapingDrop(err error) bool {
+	return errors.Is(err, errShaperQueueFull) || errors.Is(err, errShaperClosed)
+}
+
+// writeShaped writes a broadcast frame to the session, going through its
+// shaper if the session has one
+func writeShaped(sess *melody.Session, frame []byte) error {
+	if shaper, ok := sess.Get(sessShaperKey); ok {
+		return shaper.(*sendShaper).Add(sess, frame)
+	}
+	return sess.Write(frame)
+}
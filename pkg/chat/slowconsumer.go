@@ -0,0 +1,104 @@
+package chat
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/olahol/melody.v1"
+)
+
+const (
+	// SlowConsumerPolicyReplay drops the frames that do not fit in the send buffer of a
+	// connection; with pending delivery enabled, dropped messages are replayed on reconnect
+	SlowConsumerPolicyReplay = "replay"
+	// SlowConsumerPolicyEvict closes a connection with a notice once its send buffer is full
+	SlowConsumerPolicyEvict = "evict"
+)
+
+// sendBufferFullError is the error melody reports, without failing the write, when a frame
+// is dropped because the send buffer of a session is full
+const sendBufferFullError = "session message buffer is full"
+
+// evictRetryInterval is how long to wait for the send buffer of an evicted connection to
+// drain before queueing its close frame again
+const evictRetryInterval = 100 * time.Millisecond
+
+var errSlowConsumerEvicted = errors.New("error slow consumer evicted")
+
+var slowConsumersEvictedTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "chat",
+	Name:      "ws_slow_consumers_evicted_total",
+	Help:      "Total number of websocket connections closed because their send buffer was full.",
+})
+
+// slowConsumer is the eviction state of a connection under the evict policy. Once evicted,
+// a connection is left out of broadcasts so that its buffer drains and the close frame
+// can be queued
+type slowConsumer struct {
+	evicted atomic.Bool
+	// dropped is set when a frame is dropped after the eviction, i.e. the close frame
+	dropped atomic.Bool
+}
+
+func newSlowConsumer() *slowConsumer {
+	return &slowConsumer{}
+}
+
+// Overflowed records that the send buffer is full and reports whether the connection has
+// to be evicted, which happens only once
+func (c *slowConsumer) Overflowed() bool {
+	if c.evicted.Load() {
+		c.dropped.Store(true)
+		return false
+	}
+	return c.evicted.CompareAndSwap(false, true)
+}
+
+// Evicted reports whether the connection was evicted
+func (c *slowConsumer) Evicted() bool {
+	return c.evicted.Load()
+}
+
+// Close queues the close frame of an evicted connection, retrying while its buffer is
+// full until the connection is closed or the timeout elapses
+func (c *slowConsumer) Close(sess *melody.Session, timeout time.Duration) {
+	closeMsg := melody.FormatCloseMessage(websocket.CloseTryAgainLater, ErrSlowConsumer.Error())
+	deadline := time.Now().Add(timeout)
+	for !sess.IsClosed() && time.Now().Before(deadline) {
+		c.dropped.Store(false)
+		if err := sess.CloseWithMsg(closeMsg); err != nil {
+			return
+		}
+		// melody reports a dropped frame synchronously within the write
+		if !c.dropped.Load() {
+			return
+		}
+		time.Sleep(evictRetryInterval)
+	}
+}
+
+func isSendBufferFull(err error) bool {
+	return err != nil && err.Error() == sendBufferFullError
+}
+
+// isEvicted reports whether the session was evicted as a slow consumer
+func isEvicted(sess *melody.Session) bool {
+	consumer, ok := sess.Get(sessEvictKey)
+	return ok && consumer.(*slowConsumer).Evicted()
+}
+
+// evictSlowConsumer evicts a session whose send buffer is full under the evict policy,
+// and reports whether it did
+func evictSlowConsumer(sess *melody.Session, timeout time.Duration) bool {
+	consumer, ok := sess.Get(sessEvictKey)
+	if !ok || !consumer.(*slowConsumer).Overflowed() {
+		return false
+	}
+	slowConsumersEvictedTotal.Inc()
+	go consumer.(*slowConsumer).Close(sess, timeout)
+	return true
+}
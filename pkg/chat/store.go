@@ -0,0 +1,847 @@
+package chat
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gocql/gocql"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+const (
+	MessageStoreCassandra = "cassandra"
+	MessageStoreMemory    = "memory"
+)
+
+// MessageStore persists the messages of channels along with the reply index of their
+// threads. Page states returned by List are opaque cursors that are only meaningful to the
+// store that issued them
+type MessageStore interface {
+	// Save stores a new message, counting it towards the message limit of the channel
+	Save(ctx context.Context, msg *Message) error
+	Get(ctx context.Context, channelID, messageID uint64) (*Message, error)
+	// List returns at most limit messages of the channel in descending sequence order and
+	// the page state of the next page, which is empty once the channel is exhausted
+	List(ctx context.Context, channelID uint64, pageState string, limit int) ([]*Message, string, error)
+	// ListAfter returns up to limit messages newer than messageID in sequence order
+	ListAfter(ctx context.Context, channelID, messageID uint64, limit int) ([]*Message, error)
+	// Edit replaces the payload of an existing message without bringing back one deleted
+	// in the meantime
+	Edit(ctx context.Context, channelID, messageID uint64, payload string, editedTime int64) error
+	MarkSeen(ctx context.Context, channelID, messageID uint64) error
+	// Delete turns a message into a tombstone and takes it out of the thread it replies to
+	Delete(ctx context.Context, channelID, messageID uint64) error
+	// LatestID returns the id of the newest message of the channel, or 0 if it has none
+	LatestID(ctx context.Context, channelID uint64) (uint64, error)
+	// LatestSeq returns the highest sequence number of the channel, or 0 if it has none
+	LatestSeq(ctx context.Context, channelID uint64) (uint64, error)
+	// Count returns the number of messages counted towards the message limit of the channel
+	Count(ctx context.Context, channelID uint64) (int64, error)
+	// CountAfter counts the unread messages newer than messageID for excludedUserID
+	CountAfter(ctx context.Context, channelID, messageID, excludedUserID uint64) (int64, error)
+	// Restore writes back archived messages as they were, without counting them again
+	// towards the message limit of the channel
+	Restore(ctx context.Context, msgs []*Message) error
+	// Trim removes messages for good and gives their slots back to the message limit
+	Trim(ctx context.Context, channelID uint64, messageIDs []uint64) error
+	// DeleteChannel removes all messages of the channel
+	DeleteChannel(ctx context.Context, channelID uint64) error
+	// ListReplyIDs returns up to limit replies to a thread root after the given reply,
+	// oldest first
+	ListReplyIDs(ctx context.Context, channelID, rootID, after uint64, limit int) ([]uint64, error)
+	// CountReplies counts the replies of each thread root; roots without replies are left out
+	CountReplies(ctx context.Context, channelID uint64, rootIDs []uint64) (map[uint64]int64, error)
+}
+
+// NewMessageStore returns the message store selected by chat.message.store
+func NewMessageStore(config *config.Config, s *gocql.Session, cipher MessageCipher) (MessageStore, error) {
+	switch config.Chat.Message.Store {
+	case MessageStoreCassandra, "":
+		return NewCassandraMessageStore(config, s, cipher), nil
+	case MessageStoreMemory:
+		return NewMemoryMessageStore(config, cipher), nil
+	}
+	return nil, ErrUnknownMessageStore
+}
+
+// isUnreadFor reports whether a message counts as unread for a user: it is neither deleted
+// nor sent by the user, and is not a direct message to another user. The only stored action
+// messages are system messages, which are not unread messages either
+func isUnreadFor(msg *Message, userID uint64) bool {
+	return !msg.Deleted && msg.Event != EventAction && msg.UserID != userID && msg.VisibleTo(userID)
+}
+
+// CassandraMessageStore stores messages in the messages table, with payloads encrypted by
+// cipher, and threads in the message_replies table
+type CassandraMessageStore struct {
+	s           *gocql.Session
+	cipher      MessageCipher
+	maxMessages int64
+	pageSize    int
+}
+
+func NewCassandraMessageStore(config *config.Config, s *gocql.Session, cipher MessageCipher) *CassandraMessageStore {
+	return &CassandraMessageStore{s, cipher, config.Chat.Message.MaxNum, config.Chat.Message.PaginationNum}
+}
+
+func (store *CassandraMessageStore) Save(ctx context.Context, msg *Message) error {
+	var messageNum int64
+	err := store.s.Query("SELECT msgnum FROM chanmsg_counters WHERE channel_id = ? LIMIT 1", msg.ChannelID).
+		WithContext(ctx).Idempotent(true).Scan(&messageNum)
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			messageNum = 0
+		} else {
+			return err
+		}
+	}
+	if messageNum >= store.maxMessages {
+		return ErrExceedMessageNumLimits
+	}
+	payload, err := store.cipher.Encrypt(msg.ChannelID, msg.Payload)
+	if err != nil {
+		return err
+	}
+	if err := store.s.Query("INSERT INTO messages (id, event, channel_id, user_id, payload, seen, timestamp, reply_to, seq, expires_at, recipient_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		msg.MessageID,
+		msg.Event,
+		msg.ChannelID,
+		msg.UserID,
+		payload,
+		false,
+		msg.Time,
+		msg.ReplyTo,
+		msg.Seq,
+		msg.ExpiresAt,
+		msg.RecipientID).WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	if err := store.insertSeq(ctx, msg); err != nil {
+		return err
+	}
+	if err := store.s.Query("UPDATE chanmsg_counters SET msgnum = msgnum + 1 WHERE channel_id = ?", msg.ChannelID).WithContext(ctx).Exec(); err != nil {
+		return err
+	}
+	return store.insertReply(ctx, msg)
+}
+
+func (store *CassandraMessageStore) Get(ctx context.Context, channelID, messageID uint64) (*Message, error) {
+	var message Message
+	if err := store.s.Query("SELECT id, event, channel_id, user_id, payload, seen, timestamp, edited_time, deleted, reply_to, seq, expires_at, recipient_id FROM messages WHERE channel_id = ? AND id = ?", channelID, messageID).
+		WithContext(ctx).Idempotent(true).Scan(
+		&message.MessageID,
+		&message.Event,
+		&message.ChannelID,
+		&message.UserID,
+		&message.Payload,
+		&message.Seen,
+		&message.Time,
+		&message.EditedTime,
+		&message.Deleted,
+		&message.ReplyTo,
+		&message.Seq,
+		&message.ExpiresAt,
+		&message.RecipientID); err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, ErrMessageNotFound
+		}
+		return nil, err
+	}
+	decryptMessage(store.cipher, &message)
+	return &message, nil
+}
+
+// Edit updates the payload conditionally, since an upsert would bring back a deleted row
+func (store *CassandraMessageStore) Edit(ctx context.Context, channelID, messageID uint64, payload string, editedTime int64) error {
+	payload, err := store.cipher.Encrypt(channelID, payload)
+	if err != nil {
+		return err
+	}
+	applied, err := store.s.Query("UPDATE messages SET payload = ?, edited_time = ? WHERE channel_id = ? AND id = ? IF EXISTS", payload, editedTime, channelID, messageID).
+		WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+func (store *CassandraMessageStore) MarkSeen(ctx context.Context, channelID, messageID uint64) error {
+	return store.s.Query("UPDATE messages SET seen = ? WHERE channel_id = ? AND id = ?", true, channelID, messageID).
+		WithContext(ctx).Idempotent(true).Exec()
+}
+
+// Delete turns a message into a tombstone, keeping the row for audit but
+// dropping its payload
+func (store *CassandraMessageStore) Delete(ctx context.Context, channelID, messageID uint64) error {
+	applied, err := store.s.Query("UPDATE messages SET payload = '', deleted = true WHERE channel_id = ? AND id = ? IF EXISTS", channelID, messageID).
+		WithContext(ctx).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return ErrMessageNotFound
+	}
+	var replyTo uint64
+	if err := store.s.Query("SELECT reply_to FROM messages WHERE channel_id = ? AND id = ?", channelID, messageID).
+		WithContext(ctx).Idempotent(true).Scan(&replyTo); err != nil && err != gocql.ErrNotFound {
+		return err
+	}
+	if replyTo == 0 {
+		return nil
+	}
+	return store.s.Query("DELETE FROM message_replies WHERE channel_id = ? AND root_id = ? AND id = ?", channelID, replyTo, messageID).
+		WithContext(ctx).Idempotent(true).Exec()
+}
+
+func (store *CassandraMessageStore) List(ctx context.Context, channelID uint64, pageStateBase64 string, limit int) ([]*Message, string, error) {
+	var messages []*Message
+	pageState, err := b64.URLEncoding.DecodeString(pageStateBase64)
+	if err != nil {
+		return nil, "", err
+	}
+	// pages are cut from the sequence index, since messages created on different replicas
+	// within the same millisecond may be stored out of sequence order
+	iter := store.s.Query(`SELECT id FROM message_seqs WHERE channel_id = ?`, channelID).
+		WithContext(ctx).Idempotent(true).PageSize(limit).PageState(pageState).Iter()
+	nextPageStateBase64 := b64.URLEncoding.EncodeToString(iter.PageState())
+	scanner := iter.Scanner()
+	var messageIDs []uint64
+	for scanner.Next() {
+		var messageID uint64
+		if err := scanner.Scan(&messageID); err != nil {
+			return nil, "", err
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(messageIDs) == 0 {
+		return nil, nextPageStateBase64, nil
+	}
+	iter = store.s.Query(`SELECT id, event, channel_id, user_id, payload, seen, timestamp, edited_time, deleted, reply_to, seq, expires_at, recipient_id FROM messages WHERE channel_id = ? AND id IN ?`, channelID, messageIDs).
+		WithContext(ctx).Idempotent(true).PageSize(store.pageSize).Iter()
+	scanner = iter.Scanner()
+	for scanner.Next() {
+		var message Message
+		if err = scanner.Scan(
+			&message.MessageID,
+			&message.Event,
+			&message.ChannelID,
+			&message.UserID,
+			&message.Payload,
+			&message.Seen,
+			&message.Time,
+			&message.EditedTime,
+			&message.Deleted,
+			&message.ReplyTo,
+			&message.Seq,
+			&message.ExpiresAt,
+			&message.RecipientID); err != nil {
+			return nil, "", err
+		}
+		decryptMessage(store.cipher, &message)
+		messages = append(messages, &message)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, "", err
+	}
+	// messages are read back in id order; a message trimmed in the meantime is left out
+	sortMessagesBySeq(messages, true)
+	return messages, nextPageStateBase64, nil
+}
+
+func (store *CassandraMessageStore) ListAfter(ctx context.Context, channelID, messageID uint64, limit int) ([]*Message, error) {
+	iter := store.s.Query(`SELECT id, event, channel_id, user_id, payload, seen, timestamp, edited_time, deleted, reply_to, seq, expires_at, recipient_id FROM messages WHERE channel_id = ? AND id > ? ORDER BY id ASC LIMIT ?`, channelID, messageID, limit).
+		WithContext(ctx).Idempotent(true).PageSize(store.pageSize).Iter()
+	scanner := iter.Scanner()
+	var messages []*Message
+	for scanner.Next() {
+		var message Message
+		if err := scanner.Scan(
+			&message.MessageID,
+			&message.Event,
+			&message.ChannelID,
+			&message.UserID,
+			&message.Payload,
+			&message.Seen,
+			&message.Time,
+			&message.EditedTime,
+			&message.Deleted,
+			&message.ReplyTo,
+			&message.Seq,
+			&message.ExpiresAt,
+			&message.RecipientID); err != nil {
+			return nil, err
+		}
+		decryptMessage(store.cipher, &message)
+		messages = append(messages, &message)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sortMessagesBySeq(messages, false)
+	return messages, nil
+}
+
+func (store *CassandraMessageStore) LatestID(ctx context.Context, channelID uint64) (uint64, error) {
+	var messageID uint64
+	if err := store.s.Query("SELECT id FROM messages WHERE channel_id = ? LIMIT 1", channelID).
+		WithContext(ctx).Idempotent(true).Scan(&messageID); err != nil {
+		if err == gocql.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return messageID, nil
+}
+
+func (store *CassandraMessageStore) LatestSeq(ctx context.Context, channelID uint64) (uint64, error) {
+	var seq uint64
+	if err := store.s.Query("SELECT seq FROM message_seqs WHERE channel_id = ? LIMIT 1", channelID).
+		WithContext(ctx).Idempotent(true).Scan(&seq); err != nil {
+		if err == gocql.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return seq, nil
+}
+
+// Count returns the message counter of the channel
+func (store *CassandraMessageStore) Count(ctx context.Context, channelID uint64) (int64, error) {
+	var messageNum int64
+	if err := store.s.Query("SELECT msgnum FROM chanmsg_counters WHERE channel_id = ? LIMIT 1", channelID).
+		WithContext(ctx).Idempotent(true).Scan(&messageNum); err != nil {
+		if err == gocql.ErrNotFound {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return messageNum, nil
+}
+
+// CountAfter only reads the columns needed for filtering, never the payloads. The bound
+// does not need to exist, so a trimmed message counts from the earliest retained one
+func (store *CassandraMessageStore) CountAfter(ctx context.Context, channelID, messageID, excludedUserID uint64) (int64, error) {
+	iter := store.s.Query(`SELECT event, user_id, deleted, recipient_id FROM messages WHERE channel_id = ? AND id > ?`, channelID, messageID).
+		WithContext(ctx).Idempotent(true).PageSize(store.pageSize).Iter()
+	scanner := iter.Scanner()
+	var count int64
+	for scanner.Next() {
+		var msg Message
+		if err := scanner.Scan(&msg.Event, &msg.UserID, &msg.Deleted, &msg.RecipientID); err != nil {
+			return 0, err
+		}
+		if isUnreadFor(&msg, excludedUserID) {
+			count++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (store *CassandraMessageStore) Restore(ctx context.Context, msgs []*Message) error {
+	for _, msg := range msgs {
+		payload, err := store.cipher.Encrypt(msg.ChannelID, msg.Payload)
+		if err != nil {
+			return err
+		}
+		if err := store.s.Query("INSERT INTO messages (id, event, channel_id, user_id, payload, seen, timestamp, edited_time, deleted, reply_to, seq, expires_at, recipient_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			msg.MessageID,
+			msg.Event,
+			msg.ChannelID,
+			msg.UserID,
+			payload,
+			msg.Seen,
+			msg.Time,
+			msg.EditedTime,
+			msg.Deleted,
+			msg.ReplyTo,
+			msg.Seq,
+			msg.ExpiresAt,
+			msg.RecipientID).WithContext(ctx).Idempotent(true).Exec(); err != nil {
+			return err
+		}
+		if err := store.insertSeq(ctx, msg); err != nil {
+			return err
+		}
+		if err := store.insertReply(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *CassandraMessageStore) Trim(ctx context.Context, channelID uint64, messageIDs []uint64) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+	for _, messageID := range messageIDs {
+		var seq uint64
+		if err := store.s.Query("SELECT seq FROM messages WHERE channel_id = ? AND id = ?", channelID, messageID).
+			WithContext(ctx).Idempotent(true).Scan(&seq); err != nil && err != gocql.ErrNotFound {
+			return err
+		}
+		if err := store.s.Query("DELETE FROM message_seqs WHERE channel_id = ? AND seq = ? AND id = ?", channelID, seq, messageID).
+			WithContext(ctx).Idempotent(true).Exec(); err != nil {
+			return err
+		}
+		if err := store.s.Query("DELETE FROM messages WHERE channel_id = ? AND id = ?", channelID, messageID).
+			WithContext(ctx).Idempotent(true).Exec(); err != nil {
+			return err
+		}
+		// replies are newer than their root, so a trimmed root takes its thread along
+		if err := store.s.Query("DELETE FROM message_replies WHERE channel_id = ? AND root_id = ?", channelID, messageID).
+			WithContext(ctx).Idempotent(true).Exec(); err != nil {
+			return err
+		}
+	}
+	return store.s.Query("UPDATE chanmsg_counters SET msgnum = msgnum - ? WHERE channel_id = ?", int64(len(messageIDs)), channelID).WithContext(ctx).Exec()
+}
+
+func (store *CassandraMessageStore) DeleteChannel(ctx context.Context, channelID uint64) error {
+	if err := store.s.Query("DELETE FROM messages WHERE channel_id = ?", channelID).
+		WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	if err := store.s.Query("DELETE FROM message_seqs WHERE channel_id = ?", channelID).
+		WithContext(ctx).Idempotent(true).Exec(); err != nil {
+		return err
+	}
+	return store.s.Query("DELETE FROM message_replies WHERE channel_id = ?", channelID).
+		WithContext(ctx).Idempotent(true).Exec()
+}
+
+// insertSeq adds a message to the sequence index of its channel
+func (store *CassandraMessageStore) insertSeq(ctx context.Context, msg *Message) error {
+	return store.s.Query("INSERT INTO message_seqs (channel_id, seq, id) VALUES (?, ?, ?)", msg.ChannelID, msg.Seq, msg.MessageID).
+		WithContext(ctx).Idempotent(true).Exec()
+}
+
+// insertReply adds a reply to the thread of its root; deleted replies are left out
+func (store *CassandraMessageStore) insertReply(ctx context.Context, msg *Message) error {
+	if msg.ReplyTo == 0 || msg.Deleted {
+		return nil
+	}
+	return store.s.Query("INSERT INTO message_replies (channel_id, root_id, id) VALUES (?, ?, ?)", msg.ChannelID, msg.ReplyTo, msg.MessageID).
+		WithContext(ctx).Idempotent(true).Exec()
+}
+
+func (store *CassandraMessageStore) ListReplyIDs(ctx context.Context, channelID, rootID, after uint64, limit int) ([]uint64, error) {
+	iter := store.s.Query("SELECT id FROM message_replies WHERE channel_id = ? AND root_id = ? AND id > ? LIMIT ?", channelID, rootID, after, limit).
+		WithContext(ctx).Idempotent(true).Iter()
+	scanner := iter.Scanner()
+	var replyIDs []uint64
+	for scanner.Next() {
+		var replyID uint64
+		if err := scanner.Scan(&replyID); err != nil {
+			return nil, err
+		}
+		replyIDs = append(replyIDs, replyID)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return replyIDs, nil
+}
+
+// CountReplies counts the replies of all roots in a single query
+func (store *CassandraMessageStore) CountReplies(ctx context.Context, channelID uint64, rootIDs []uint64) (map[uint64]int64, error) {
+	counts := make(map[uint64]int64)
+	if len(rootIDs) == 0 {
+		return counts, nil
+	}
+	iter := store.s.Query("SELECT root_id, COUNT(*) FROM message_replies WHERE channel_id = ? AND root_id IN ? GROUP BY root_id", channelID, rootIDs).
+		WithContext(ctx).Idempotent(true).Iter()
+	scanner := iter.Scanner()
+	for scanner.Next() {
+		var (
+			rootID uint64
+			count  int64
+		)
+		if err := scanner.Scan(&rootID, &count); err != nil {
+			return nil, err
+		}
+		counts[rootID] = count
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// MemoryMessageStore keeps messages in process memory. It is meant for development and
+// tests; messages are lost on restart and not shared between instances. Payloads are kept
+// encrypted by cipher like in the other stores
+type MemoryMessageStore struct {
+	mu          sync.RWMutex
+	cipher      MessageCipher
+	channels    map[uint64]*memoryChannel
+	maxMessages int64
+}
+
+type memoryChannel struct {
+	messages map[uint64]*Message
+	// replies maps thread roots to the ids of their replies
+	replies map[uint64][]uint64
+	// counted is the number of messages counted towards the message limit; restored
+	// messages are not counted again
+	counted int64
+}
+
+func NewMemoryMessageStore(config *config.Config, cipher MessageCipher) *MemoryMessageStore {
+	return &MemoryMessageStore{
+		cipher:      cipher,
+		channels:    make(map[uint64]*memoryChannel),
+		maxMessages: config.Chat.Message.MaxNum,
+	}
+}
+
+// channel returns the messages of a channel, creating them if create is set. It must be
+// called with the lock held
+func (store *MemoryMessageStore) channel(channelID uint64, create bool) *memoryChannel {
+	ch, ok := store.channels[channelID]
+	if !ok && create {
+		ch = &memoryChannel{
+			messages: make(map[uint64]*Message),
+			replies:  make(map[uint64][]uint64),
+		}
+		store.channels[channelID] = ch
+	}
+	return ch
+}
+
+func (store *MemoryMessageStore) Save(ctx context.Context, msg *Message) error {
+	payload, err := store.cipher.Encrypt(msg.ChannelID, msg.Payload)
+	if err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	ch := store.channel(msg.ChannelID, true)
+	if ch.counted >= store.maxMessages {
+		return ErrExceedMessageNumLimits
+	}
+	stored := storedMessage(msg)
+	stored.Payload = payload
+	stored.Seen = false
+	ch.put(stored)
+	ch.counted++
+	return nil
+}
+
+// put stores a message and adds it to the thread of its root unless it is deleted
+func (ch *memoryChannel) put(msg *Message) {
+	if _, ok := ch.messages[msg.MessageID]; !ok && msg.ReplyTo != 0 && !msg.Deleted {
+		ch.replies[msg.ReplyTo] = append(ch.replies[msg.ReplyTo], msg.MessageID)
+	}
+	ch.messages[msg.MessageID] = msg
+}
+
+func (store *MemoryMessageStore) Get(ctx context.Context, channelID, messageID uint64) (*Message, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	ch := store.channel(channelID, false)
+	if ch == nil || ch.messages[messageID] == nil {
+		return nil, ErrMessageNotFound
+	}
+	return store.load(ch.messages[messageID]), nil
+}
+
+// load copies a stored message with its payload decrypted
+func (store *MemoryMessageStore) load(msg *Message) *Message {
+	loaded := storedMessage(msg)
+	decryptMessage(store.cipher, loaded)
+	return loaded
+}
+
+// List pages through the channel by sequence number; the page state is the sequence number
+// and id of the message the previous page ended at, so messages saved meanwhile do not
+// shift later pages
+func (store *MemoryMessageStore) List(ctx context.Context, channelID uint64, pageStateBase64 string, limit int) ([]*Message, string, error) {
+	var before *Message
+	if pageStateBase64 != "" {
+		pageState, err := b64.URLEncoding.DecodeString(pageStateBase64)
+		if err != nil {
+			return nil, "", err
+		}
+		seq, id, _ := strings.Cut(string(pageState), ":")
+		before = &Message{}
+		if before.Seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+			return nil, "", err
+		}
+		if before.MessageID, err = strconv.ParseUint(id, 10, 64); err != nil {
+			return nil, "", err
+		}
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	var stored []*Message
+	if ch := store.channel(channelID, false); ch != nil {
+		for _, msg := range ch.messages {
+			if before == nil || seqLess(msg, before) {
+				stored = append(stored, msg)
+			}
+		}
+	}
+	sortMessagesBySeq(stored, true)
+	nextPageStateBase64 := ""
+	if len(stored) > limit {
+		stored = stored[:limit]
+		last := stored[limit-1]
+		nextPageStateBase64 = b64.URLEncoding.EncodeToString([]byte(strconv.FormatUint(last.Seq, 10) + ":" + strconv.FormatUint(last.MessageID, 10)))
+	}
+	messages := make([]*Message, 0, len(stored))
+	for _, msg := range stored {
+		messages = append(messages, store.load(msg))
+	}
+	return messages, nextPageStateBase64, nil
+}
+
+func (store *MemoryMessageStore) ListAfter(ctx context.Context, channelID, messageID uint64, limit int) ([]*Message, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	ids := store.messageIDs(channelID, func(id uint64) bool { return id > messageID })
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	messages := store.loadAll(channelID, ids)
+	sortMessagesBySeq(messages, false)
+	return messages, nil
+}
+
+// messageIDs returns the ids of the messages of a channel that match. It must be called with
+// the lock held
+func (store *MemoryMessageStore) messageIDs(channelID uint64, match func(id uint64) bool) []uint64 {
+	ch := store.channel(channelID, false)
+	if ch == nil {
+		return nil
+	}
+	ids := make([]uint64, 0, len(ch.messages))
+	for id := range ch.messages {
+		if match(id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// loadAll loads the messages of the ids, which must exist. It must be called with the lock held
+func (store *MemoryMessageStore) loadAll(channelID uint64, ids []uint64) []*Message {
+	ch := store.channel(channelID, false)
+	messages := make([]*Message, 0, len(ids))
+	for _, id := range ids {
+		messages = append(messages, store.load(ch.messages[id]))
+	}
+	return messages
+}
+
+func (store *MemoryMessageStore) Edit(ctx context.Context, channelID, messageID uint64, payload string, editedTime int64) error {
+	payload, err := store.cipher.Encrypt(channelID, payload)
+	if err != nil {
+		return err
+	}
+	return store.update(channelID, messageID, func(msg *Message) {
+		msg.Payload = payload
+		msg.EditedTime = editedTime
+	})
+}
+
+func (store *MemoryMessageStore) MarkSeen(ctx context.Context, channelID, messageID uint64) error {
+	err := store.update(channelID, messageID, func(msg *Message) {
+		msg.Seen = true
+	})
+	if err == ErrMessageNotFound {
+		// like an update in Cassandra, marking a missing message is not an error
+		return nil
+	}
+	return err
+}
+
+// Delete turns a message into a tombstone, like CassandraMessageStore.Delete
+func (store *MemoryMessageStore) Delete(ctx context.Context, channelID, messageID uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	ch := store.channel(channelID, false)
+	if ch == nil || ch.messages[messageID] == nil {
+		return ErrMessageNotFound
+	}
+	msg := ch.messages[messageID]
+	msg.Payload = ""
+	msg.Deleted = true
+	if msg.ReplyTo != 0 {
+		ch.replies[msg.ReplyTo] = slices.DeleteFunc(ch.replies[msg.ReplyTo], func(id uint64) bool { return id == messageID })
+	}
+	return nil
+}
+
+func (store *MemoryMessageStore) update(channelID, messageID uint64, apply func(msg *Message)) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	ch := store.channel(channelID, false)
+	if ch == nil || ch.messages[messageID] == nil {
+		return ErrMessageNotFound
+	}
+	apply(ch.messages[messageID])
+	return nil
+}
+
+func (store *MemoryMessageStore) LatestID(ctx context.Context, channelID uint64) (uint64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	var latestID uint64
+	for _, id := range store.messageIDs(channelID, func(uint64) bool { return true }) {
+		latestID = max(latestID, id)
+	}
+	return latestID, nil
+}
+
+func (store *MemoryMessageStore) LatestSeq(ctx context.Context, channelID uint64) (uint64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	var latestSeq uint64
+	if ch := store.channel(channelID, false); ch != nil {
+		for _, msg := range ch.messages {
+			latestSeq = max(latestSeq, msg.Seq)
+		}
+	}
+	return latestSeq, nil
+}
+
+func (store *MemoryMessageStore) Count(ctx context.Context, channelID uint64) (int64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	ch := store.channel(channelID, false)
+	if ch == nil {
+		return 0, nil
+	}
+	return ch.counted, nil
+}
+
+func (store *MemoryMessageStore) CountAfter(ctx context.Context, channelID, messageID, excludedUserID uint64) (int64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	ch := store.channel(channelID, false)
+	if ch == nil {
+		return 0, nil
+	}
+	var count int64
+	for id, msg := range ch.messages {
+		if id > messageID && isUnreadFor(msg, excludedUserID) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (store *MemoryMessageStore) Restore(ctx context.Context, msgs []*Message) error {
+	for _, msg := range msgs {
+		payload, err := store.cipher.Encrypt(msg.ChannelID, msg.Payload)
+		if err != nil {
+			return err
+		}
+		stored := storedMessage(msg)
+		stored.Payload = payload
+		store.mu.Lock()
+		store.channel(msg.ChannelID, true).put(stored)
+		store.mu.Unlock()
+	}
+	return nil
+}
+
+func (store *MemoryMessageStore) Trim(ctx context.Context, channelID uint64, messageIDs []uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	ch := store.channel(channelID, false)
+	if ch == nil {
+		return nil
+	}
+	for _, messageID := range messageIDs {
+		delete(ch.messages, messageID)
+		// replies are newer than their root, so a trimmed root takes its thread along
+		delete(ch.replies, messageID)
+	}
+	ch.counted -= int64(len(messageIDs))
+	return nil
+}
+
+func (store *MemoryMessageStore) DeleteChannel(ctx context.Context, channelID uint64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	ch := store.channel(channelID, false)
+	if ch == nil {
+		return nil
+	}
+	// the message counter outlives the messages, as in Cassandra
+	ch.messages = make(map[uint64]*Message)
+	ch.replies = make(map[uint64][]uint64)
+	return nil
+}
+
+func (store *MemoryMessageStore) ListReplyIDs(ctx context.Context, channelID, rootID, after uint64, limit int) ([]uint64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	ch := store.channel(channelID, false)
+	if ch == nil {
+		return nil, nil
+	}
+	var replyIDs []uint64
+	for _, replyID := range ch.replies[rootID] {
+		if replyID > after {
+			replyIDs = append(replyIDs, replyID)
+		}
+	}
+	sort.Slice(replyIDs, func(i, j int) bool { return replyIDs[i] < replyIDs[j] })
+	if len(replyIDs) > limit {
+		replyIDs = replyIDs[:limit]
+	}
+	return replyIDs, nil
+}
+
+func (store *MemoryMessageStore) CountReplies(ctx context.Context, channelID uint64, rootIDs []uint64) (map[uint64]int64, error) {
+	counts := make(map[uint64]int64)
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	ch := store.channel(channelID, false)
+	if ch == nil {
+		return counts, nil
+	}
+	for _, rootID := range rootIDs {
+		if n := len(ch.replies[rootID]); n > 0 {
+			counts[rootID] = int64(n)
+		}
+	}
+	return counts, nil
+}
+
+// storedMessage copies the persisted fields of a message
+func storedMessage(msg *Message) *Message {
+	return &Message{
+		MessageID:   msg.MessageID,
+		Event:       msg.Event,
+		ChannelID:   msg.ChannelID,
+		UserID:      msg.UserID,
+		Payload:     msg.Payload,
+		Seen:        msg.Seen,
+		Time:        msg.Time,
+		EditedTime:  msg.EditedTime,
+		Deleted:     msg.Deleted,
+		ReplyTo:     msg.ReplyTo,
+		Seq:         msg.Seq,
+		ExpiresAt:   msg.ExpiresAt,
+		RecipientID: msg.RecipientID,
+	}
+}
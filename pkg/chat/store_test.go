@@ -0,0 +1,230 @@
+package chat
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+func newTestMemoryStore(t *testing.T, maxMessages int64, cipher MessageCipher) *MemoryMessageStore {
+	t.Helper()
+	c := config.Config{Chat: &config.ChatConfig{}}
+	c.Chat.Message.MaxNum = maxMessages
+	return NewMemoryMessageStore(&c, cipher)
+}
+
+func saveTestMessages(t *testing.T, store MessageStore, channelID uint64, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		msg := &Message{
+			MessageID: uint64(i),
+			Event:     EventText,
+			ChannelID: channelID,
+			UserID:    1,
+			Payload:   strings.Repeat("m", i),
+			Seq:       uint64(i),
+		}
+		if err := store.Save(context.Background(), msg); err != nil {
+			t.Fatalf("save message %d: %v", i, err)
+		}
+	}
+}
+
+func TestMemoryMessageStoreSaveGet(t *testing.T) {
+	store := newTestMemoryStore(t, 10, NoopCipher{})
+	saveTestMessages(t, store, 1, 1)
+
+	msg, err := store.Get(context.Background(), 1, 1)
+	if err != nil {
+		t.Fatalf("get message: %v", err)
+	}
+	if msg.Payload != "m" || msg.UserID != 1 || msg.Event != EventText {
+		t.Errorf("got %+v, want the saved message", msg)
+	}
+	// a copy is returned, so changing it does not change the store
+	msg.Payload = "changed"
+	if msg, _ := store.Get(context.Background(), 1, 1); msg.Payload != "m" {
+		t.Errorf("got payload %q after changing a returned copy, want %q", msg.Payload, "m")
+	}
+	if _, err := store.Get(context.Background(), 1, 2); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("get missing message: got %v, want %v", err, ErrMessageNotFound)
+	}
+	if _, err := store.Get(context.Background(), 2, 1); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("get message of another channel: got %v, want %v", err, ErrMessageNotFound)
+	}
+}
+
+func TestMemoryMessageStoreSaveLimit(t *testing.T) {
+	store := newTestMemoryStore(t, 2, NoopCipher{})
+	saveTestMessages(t, store, 1, 2)
+
+	err := store.Save(context.Background(), &Message{MessageID: 3, ChannelID: 1})
+	if !errors.Is(err, ErrExceedMessageNumLimits) {
+		t.Errorf("save beyond the limit: got %v, want %v", err, ErrExceedMessageNumLimits)
+	}
+	if err := store.Trim(context.Background(), 1, []uint64{1}); err != nil {
+		t.Fatalf("trim message: %v", err)
+	}
+	if err := store.Save(context.Background(), &Message{MessageID: 3, ChannelID: 1}); err != nil {
+		t.Errorf("save after trim: %v", err)
+	}
+}
+
+func TestMemoryMessageStoreListPaging(t *testing.T) {
+	store := newTestMemoryStore(t, 10, NoopCipher{})
+	saveTestMessages(t, store, 1, 5)
+
+	var (
+		ids       []uint64
+		pageState string
+		pages     int
+	)
+	for {
+		msgs, next, err := store.List(context.Background(), 1, pageState, 2)
+		if err != nil {
+			t.Fatalf("list page %d: %v", pages, err)
+		}
+		if len(msgs) > 2 {
+			t.Fatalf("page %d has %d messages, want at most 2", pages, len(msgs))
+		}
+		for _, msg := range msgs {
+			ids = append(ids, msg.MessageID)
+		}
+		pages++
+		if next == "" {
+			break
+		}
+		// messages saved meanwhile do not shift later pages
+		if pages == 1 {
+			saveTestMessages(t, store, 2, 1)
+			if err := store.Save(context.Background(), &Message{MessageID: 6, ChannelID: 1, Seq: 6}); err != nil {
+				t.Fatalf("save message: %v", err)
+			}
+		}
+		pageState = next
+	}
+	want := []uint64{5, 4, 3, 2, 1}
+	if len(ids) != len(want) {
+		t.Fatalf("listed %v, want %v", ids, want)
+	}
+	for i := range want {
+		if ids[i] != want[i] {
+			t.Fatalf("listed %v, want %v", ids, want)
+		}
+	}
+	if pages != 3 {
+		t.Errorf("listed %d pages, want 3", pages)
+	}
+
+	if _, _, err := store.List(context.Background(), 1, "not base64!", 2); err == nil {
+		t.Error("list with an invalid page state: got no error")
+	}
+	msgs, next, err := store.List(context.Background(), 3, "", 2)
+	if err != nil || len(msgs) != 0 || next != "" {
+		t.Errorf("list empty channel: got %d messages, next %q, err %v", len(msgs), next, err)
+	}
+}
+
+func TestMemoryMessageStoreListBySeq(t *testing.T) {
+	store := newTestMemoryStore(t, 10, NoopCipher{})
+	// ids generated on different nodes need not follow the sequence numbers
+	for _, msg := range []*Message{
+		{MessageID: 30, ChannelID: 1, Seq: 1},
+		{MessageID: 10, ChannelID: 1, Seq: 2},
+		{MessageID: 20, ChannelID: 1, Seq: 3},
+	} {
+		if err := store.Save(context.Background(), msg); err != nil {
+			t.Fatalf("save message %d: %v", msg.MessageID, err)
+		}
+	}
+	first, next, err := store.List(context.Background(), 1, "", 2)
+	if err != nil {
+		t.Fatalf("list first page: %v", err)
+	}
+	second, _, err := store.List(context.Background(), 1, next, 2)
+	if err != nil {
+		t.Fatalf("list second page: %v", err)
+	}
+	var ids []uint64
+	for _, msg := range append(first, second...) {
+		ids = append(ids, msg.MessageID)
+	}
+	if len(ids) != 3 || ids[0] != 20 || ids[1] != 10 || ids[2] != 30 {
+		t.Errorf("listed %v, want [20 10 30]", ids)
+	}
+	if seq, _ := store.LatestSeq(context.Background(), 1); seq != 3 {
+		t.Errorf("got latest seq %d, want 3", seq)
+	}
+}
+
+func TestMemoryMessageStoreDelete(t *testing.T) {
+	store := newTestMemoryStore(t, 10, NoopCipher{})
+	saveTestMessages(t, store, 1, 2)
+
+	if err := store.Delete(context.Background(), 1, 2); err != nil {
+		t.Fatalf("delete message: %v", err)
+	}
+	msg, err := store.Get(context.Background(), 1, 2)
+	if err != nil {
+		t.Fatalf("get deleted message: %v", err)
+	}
+	if !msg.Deleted || msg.Payload != "" {
+		t.Errorf("got %+v, want a tombstone without payload", msg)
+	}
+	if err := store.Delete(context.Background(), 1, 3); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("delete missing message: got %v, want %v", err, ErrMessageNotFound)
+	}
+	if err := store.Edit(context.Background(), 1, 3, "edited", 1); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("edit missing message: got %v, want %v", err, ErrMessageNotFound)
+	}
+	if n, err := store.CountAfter(context.Background(), 1, 0, 2); err != nil || n != 1 {
+		t.Errorf("count unread messages: got %d, %v, want 1", n, err)
+	}
+}
+
+func TestMemoryMessageStoreDeleteReply(t *testing.T) {
+	store := newTestMemoryStore(t, 10, NoopCipher{})
+	saveTestMessages(t, store, 1, 1)
+	for _, id := range []uint64{2, 3} {
+		if err := store.Save(context.Background(), &Message{MessageID: id, ChannelID: 1, ReplyTo: 1, Seq: id}); err != nil {
+			t.Fatalf("save reply %d: %v", id, err)
+		}
+	}
+	if err := store.Delete(context.Background(), 1, 2); err != nil {
+		t.Fatalf("delete reply: %v", err)
+	}
+	// a deleted reply is neither counted nor listed
+	if counts, err := store.CountReplies(context.Background(), 1, []uint64{1}); err != nil || counts[1] != 1 {
+		t.Errorf("count replies: got %v, %v, want 1", counts[1], err)
+	}
+	if ids, err := store.ListReplyIDs(context.Background(), 1, 1, 0, 10); err != nil || len(ids) != 1 || ids[0] != 3 {
+		t.Errorf("list replies: got %v, %v, want [3]", ids, err)
+	}
+}
+
+func TestMemoryMessageStoreEncryptsPayloads(t *testing.T) {
+	c := config.Config{Chat: &config.ChatConfig{}}
+	c.Chat.Message.EncryptionKey = b64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	c.Chat.Message.EncryptAtRest = true
+	cipher, err := NewMessageCipher(&c)
+	if err != nil {
+		t.Fatalf("create cipher: %v", err)
+	}
+	store := newTestMemoryStore(t, 10, cipher)
+	saveTestMessages(t, store, 1, 1)
+
+	if stored := store.channels[1].messages[1].Payload; stored == "m" {
+		t.Error("payload is stored in plaintext")
+	}
+	msg, err := store.Get(context.Background(), 1, 1)
+	if err != nil {
+		t.Fatalf("get message: %v", err)
+	}
+	if msg.Payload != "m" {
+		t.Errorf("got payload %q, want %q", msg.Payload, "m")
+	}
+}
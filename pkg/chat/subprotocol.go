@@ -0,0 +1,31 @@
+package chat
+
+import (
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+const SubprotocolV1 = "randomchat.v1"
+
+// supportedSubprotocols are the versions of the event schema the server speaks. A client
+// requesting no subprotocol speaks the implicit randomchat.v1
+var supportedSubprotocols = []string{SubprotocolV1}
+
+// negotiateSubprotocol picks the first subprotocol requested by the client that the server
+// supports, which the upgrader echoes in Sec-WebSocket-Protocol. It returns false if the
+// client only requests unsupported ones
+func negotiateSubprotocol(req *http.Request) (string, bool) {
+	requested := websocket.Subprotocols(req)
+	if len(requested) == 0 {
+		return SubprotocolV1, true
+	}
+	for _, protocol := range requested {
+		for _, supported := range supportedSubprotocols {
+			if protocol == supported {
+				return protocol, true
+			}
+		}
+	}
+	return "", false
+}
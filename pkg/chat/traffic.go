@@ -0,0 +1,125 @@
+package chat
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/olahol/melody.v1"
+)
+
+// otherChannelsLabel aggregates the traffic of channels beyond the label cap
+const otherChannelsLabel = "other"
+
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+var (
+	channelMessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "ws_channel_messages_total",
+		Help:      "Total number of websocket frames received from or written to the connections of a channel.",
+	}, []string{"channel", "direction"})
+	channelBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "chat",
+		Name:      "ws_channel_bytes_total",
+		Help:      "Total number of websocket payload bytes received from or written to the connections of a channel.",
+	}, []string{"channel", "direction"})
+	channelConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "chat",
+		Name:      "ws_channel_connections",
+		Help:      "Number of websocket connections to a channel on this instance.",
+	}, []string{"channel"})
+)
+
+// channelTraffic labels websocket metrics by channel id for at most maxLabels channels at a
+// time. A channel holds its label while it has connections on this instance and is
+// labeled "other" if no label is free when its first connection opens. The series of a
+// channel are dropped with its last connection, so its label can be reused
+type channelTraffic struct {
+	mu        sync.Mutex
+	maxLabels int
+	conns     map[uint64]int
+}
+
+func newChannelTraffic(maxLabels int) *channelTraffic {
+	return &channelTraffic{
+		maxLabels: maxLabels,
+		conns:     make(map[uint64]int),
+	}
+}
+
+// channelConn accounts the traffic of a session to the label of its channel
+type channelConn struct {
+	traffic   *channelTraffic
+	channelID uint64
+	label     string
+	closed    bool
+}
+
+// Open counts a new connection to the channel
+func (t *channelTraffic) Open(channelID uint64) *channelConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	label := otherChannelsLabel
+	if n, ok := t.conns[channelID]; ok || len(t.conns) < t.maxLabels {
+		t.conns[channelID] = n + 1
+		label = strconv.FormatUint(channelID, 10)
+	}
+	channelConnections.WithLabelValues(label).Inc()
+	return &channelConn{
+		traffic:   t,
+		channelID: channelID,
+		label:     label,
+	}
+}
+
+// Observe counts a frame of the connection
+func (c *channelConn) Observe(direction string, size int) {
+	c.traffic.mu.Lock()
+	defer c.traffic.mu.Unlock()
+	// series of a closed channel must not be recreated after they were dropped
+	if c.closed {
+		return
+	}
+	channelMessagesTotal.WithLabelValues(c.label, direction).Inc()
+	channelBytesTotal.WithLabelValues(c.label, direction).Add(float64(size))
+}
+
+// Close uncounts the connection; it is a no-op on a closed connection
+func (c *channelConn) Close() {
+	t := c.traffic
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	channelConnections.WithLabelValues(c.label).Dec()
+	if c.label == otherChannelsLabel {
+		return
+	}
+	if t.conns[c.channelID]--; t.conns[c.channelID] > 0 {
+		return
+	}
+	delete(t.conns, c.channelID)
+	channelConnections.DeleteLabelValues(c.label)
+	for _, direction := range []string{directionIn, directionOut} {
+		channelMessagesTotal.DeleteLabelValues(c.label, direction)
+		channelBytesTotal.DeleteLabelValues(c.label, direction)
+	}
+}
+
+// observeTraffic counts frames of a session whose channel is known
+func observeTraffic(sess *melody.Session, direction string, frames ...[]byte) {
+	conn, ok := sess.Get(sessTrafficKey)
+	if !ok {
+		return
+	}
+	for _, frame := range frames {
+		conn.(*channelConn).Observe(direction, len(frame))
+	}
+}
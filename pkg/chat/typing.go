@@ -0,0 +1,65 @@
+package chat
+
+import (
+	"sync"
+	"time"
+)
+
+// typingTimer emits a stop typing event once a connection has not reported typing
+// for the stop timeout, so that other members are not left with a stale indicator
+// when the client never sends one itself
+type typingTimer struct {
+	mu       sync.Mutex
+	timer    *time.Timer
+	isClosed bool
+}
+
+func newTypingTimer() *typingTimer {
+	return &typingTimer{}
+}
+
+// Touch (re)starts the timer; onStop runs if Touch is not called again within timeout
+func (t *typingTimer) Touch(timeout time.Duration, onStop func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.isClosed {
+		return
+	}
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+	t.timer = time.AfterFunc(timeout, func() {
+		t.mu.Lock()
+		if t.isClosed {
+			t.mu.Unlock()
+			return
+		}
+		t.timer = nil
+		t.mu.Unlock()
+		onStop()
+	})
+}
+
+// Stop cancels the pending timeout, reporting whether one was pending, i.e. whether the
+// user was still typing
+func (t *typingTimer) Stop() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.timer == nil {
+		return false
+	}
+	stopped := t.timer.Stop()
+	t.timer = nil
+	return stopped
+}
+
+// Close stops the timer without emitting a stop typing event
+func (t *typingTimer) Close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.isClosed = true
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
@@ -2,6 +2,35 @@ package chat
 
 import (
 	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const (
+	// ControlCharPolicyAllow keeps null bytes and control characters as they are
+	ControlCharPolicyAllow = "allow"
+	// ControlCharPolicyStrip removes null bytes and control characters from the payload
+	ControlCharPolicyStrip = "strip"
+	// ControlCharPolicyReject rejects payloads containing null bytes or control characters
+	ControlCharPolicyReject = "reject"
+)
+
+const (
+	// UnknownEventPolicyIgnore logs and drops events the server does not know
+	UnknownEventPolicyIgnore = "ignore"
+	// UnknownEventPolicyNack answers unknown events with a nack listing the supported events
+	UnknownEventPolicyNack = "nack"
+)
+
+const (
+	// SoloPolicyAllow delivers messages even if no one else is online in the channel
+	SoloPolicyAllow = "allow"
+	// SoloPolicyDrop silently discards messages sent to a channel with no one else online
+	SoloPolicyDrop = "drop"
+	// SoloPolicyReject nacks messages sent to a channel with no one else online
+	SoloPolicyReject = "reject"
 )
 
 func DecodeToMessagePresenter(data []byte) (*MessagePresenter, error) {
@@ -19,3 +48,79 @@ func DecodeToMessage(data []byte) (*Message, error) {
 	}
 	return &msg, nil
 }
+
+func splitNonEmpty(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func formatIDs(ids []uint64) []string {
+	strs := []string{}
+	for _, id := range ids {
+		strs = append(strs, strconv.FormatUint(id, 10))
+	}
+	return strs
+}
+
+func hasCapability(caps, capability string) bool {
+	for _, c := range splitNonEmpty(caps) {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeTextPayload applies the control character policy to a text payload.
+// Tabs and line breaks are regarded as regular text
+func sanitizeTextPayload(payload, policy string) (string, error) {
+	isControl := func(r rune) bool {
+		return unicode.IsControl(r) && r != '\t' && r != '\n' && r != '\r'
+	}
+	switch policy {
+	case ControlCharPolicyStrip:
+		return strings.Map(func(r rune) rune {
+			if isControl(r) {
+				return -1
+			}
+			return r
+		}, payload), nil
+	case ControlCharPolicyReject:
+		if strings.IndexFunc(payload, isControl) >= 0 {
+			return "", ErrInvalidPayloadCharacter
+		}
+	}
+	return payload, nil
+}
+
+func truncate(s string, maxLen int) string {
+	if len(s) <= maxLen {
+		return s
+	}
+	return strings.ToValidUTF8(s[:maxLen], "")
+}
+
+// sortMessagesBySeq orders messages by their sequence number, newest first if desc.
+// Messages stored before sequence numbers were assigned have none and are ordered by id,
+// ahead of every numbered message
+func sortMessagesBySeq(msgs []*Message, desc bool) {
+	sort.SliceStable(msgs, func(i, j int) bool {
+		if desc {
+			return seqLess(msgs[j], msgs[i])
+		}
+		return seqLess(msgs[i], msgs[j])
+	})
+}
+
+// seqLess reports whether message a comes before message b in sequence order
+func seqLess(a, b *Message) bool {
+	if a.Seq != b.Seq {
+		return a.Seq < b.Seq
+	}
+	return a.MessageID < b.MessageID
+}
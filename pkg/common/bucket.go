@@ -0,0 +1,106 @@
+package common
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+// BucketRouter picks the S3 bucket an upload is stored in by its content type. Objects in
+// the default bucket are keyed <channel id>/<name> while objects in a routed bucket are
+// keyed <channel id>/<bucket>/<name>, so that the bucket of a key is known without a lookup
+type BucketRouter struct {
+	defaultBucket string
+	exact         map[string]string
+	wildcard      map[string]string
+	any           string
+	routed        map[string]struct{}
+}
+
+// NewBucketRouter creates a router from rules mapping content type patterns to bucket names.
+// Patterns are exact media types, wildcard subtypes such as image/* or */*. The first rule
+// of a pattern wins
+func NewBucketRouter(defaultBucket string, rules []config.BucketRule) *BucketRouter {
+	router := &BucketRouter{
+		defaultBucket: defaultBucket,
+		exact:         make(map[string]string),
+		wildcard:      make(map[string]string),
+		any:           defaultBucket,
+		routed:        make(map[string]struct{}),
+	}
+	anySet := false
+	for _, rule := range rules {
+		pattern := strings.ToLower(strings.TrimSpace(rule.Pattern))
+		bucket := strings.TrimSpace(rule.Bucket)
+		if pattern == "" || bucket == "" {
+			continue
+		}
+		if pattern == "*/*" {
+			if anySet {
+				continue
+			}
+			router.any, anySet = bucket, true
+		} else if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if _, ok := router.wildcard[prefix]; ok {
+				continue
+			}
+			router.wildcard[prefix] = bucket
+		} else {
+			if _, ok := router.exact[pattern]; ok {
+				continue
+			}
+			router.exact[pattern] = bucket
+		}
+		if bucket != defaultBucket {
+			router.routed[bucket] = struct{}{}
+		}
+	}
+	return router
+}
+
+// Route returns the bucket for the media type of contentType, ignoring parameters such as
+// charset. Exact rules take precedence over wildcard ones, and types matching no rule go
+// to the default bucket
+func (router *BucketRouter) Route(contentType string) string {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if bucket, ok := router.exact[mediaType]; ok {
+		return bucket
+	}
+	typ, _, _ := strings.Cut(mediaType, "/")
+	if bucket, ok := router.wildcard[typ]; ok {
+		return bucket
+	}
+	return router.any
+}
+
+// ObjectKey returns the key of an object of the channel named name and stored in bucket
+func (router *BucketRouter) ObjectKey(channelID uint64, bucket, name string) string {
+	if bucket == router.defaultBucket {
+		return Join(strconv.FormatUint(channelID, 10), "/", name)
+	}
+	return Join(strconv.FormatUint(channelID, 10), "/", bucket, "/", name)
+}
+
+// Bucket returns the bucket an object key lives in
+func (router *BucketRouter) Bucket(objectKey string) string {
+	segments := strings.SplitN(objectKey, "/", 3)
+	if len(segments) == 3 {
+		if _, ok := router.routed[segments[1]]; ok {
+			return segments[1]
+		}
+	}
+	return router.defaultBucket
+}
+
+// Buckets returns the default bucket followed by the routed buckets in name order
+func (router *BucketRouter) Buckets() []string {
+	buckets := make([]string, 0, len(router.routed)+1)
+	for bucket := range router.routed {
+		buckets = append(buckets, bucket)
+	}
+	sort.Strings(buckets)
+	return append([]string{router.defaultBucket}, buckets...)
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+)
+
+// ErrorCode is a stable machine-readable error identifier returned in ErrResponse.
+// Clients should branch on the code rather than on the human-readable message
+type ErrorCode string
+
+const (
+	CodeInvalidParam         ErrorCode = "INVALID_PARAMETER"
+	CodeUnauthorized         ErrorCode = "UNAUTHORIZED"
+	CodeTokenExpired         ErrorCode = "TOKEN_EXPIRED"
+	CodeForbidden            ErrorCode = "FORBIDDEN"
+	CodeNotFound             ErrorCode = "NOT_FOUND"
+	CodeUserNotFound         ErrorCode = "USER_NOT_FOUND"
+	CodeChannelNotFound      ErrorCode = "CHANNEL_NOT_FOUND"
+	CodeMessageNotFound      ErrorCode = "MESSAGE_NOT_FOUND"
+	CodeSessionNotFound      ErrorCode = "SESSION_NOT_FOUND"
+	CodeFileNotFound         ErrorCode = "FILE_NOT_FOUND"
+	CodeUploadNotFound       ErrorCode = "UPLOAD_NOT_FOUND"
+	CodeConflict             ErrorCode = "CONFLICT"
+	CodeChannelArchived      ErrorCode = "CHANNEL_ARCHIVED"
+	CodeLimitExceeded        ErrorCode = "LIMIT_EXCEEDED"
+	CodeQuotaExceeded        ErrorCode = "QUOTA_EXCEEDED"
+	CodePayloadTooLarge      ErrorCode = "PAYLOAD_TOO_LARGE"
+	CodeUnsupportedMediaType ErrorCode = "UNSUPPORTED_MEDIA_TYPE"
+	CodeFileFlagged          ErrorCode = "FILE_FLAGGED"
+	CodeUnprocessable        ErrorCode = "UNPROCESSABLE"
+	CodeRateLimited          ErrorCode = "RATE_LIMITED"
+	CodeServerError          ErrorCode = "SERVER_ERROR"
+	CodeUnavailable          ErrorCode = "SERVICE_UNAVAILABLE"
+)
+
+// commonErrorCodes holds the codes of errors shared by all services
+var commonErrorCodes = map[error]ErrorCode{
+	ErrInvalidParam:  CodeInvalidParam,
+	ErrServer:        CodeServerError,
+	ErrUnauthorized:  CodeUnauthorized,
+	ErrInvalidToken:  CodeUnauthorized,
+	ErrTokenExpired:  CodeTokenExpired,
+	ErrReadOnlyToken: CodeForbidden,
+}
+
+// ErrorCodeOf returns the code of err from the given service codes or the shared ones,
+// falling back to a generic code for the http status. The chain of err is walked from the
+// outermost error, so an error wrapping several coded ones always gets the code of the
+// first, rather than whichever a map iteration happens to reach first
+func ErrorCodeOf(err error, httpCode int, codes map[error]ErrorCode) ErrorCode {
+	if code, ok := lookupErrorCode(err, codes); ok {
+		return code
+	}
+	if code, ok := lookupErrorCode(err, commonErrorCodes); ok {
+		return code
+	}
+	return statusErrorCode(httpCode)
+}
+
+// lookupErrorCode finds the first error in the chain of err that has a code, visiting the
+// errors joined by errors.Join or fmt.Errorf with several %w in order
+func lookupErrorCode(err error, codes map[error]ErrorCode) (ErrorCode, bool) {
+	for err != nil {
+		// map lookups panic on errors of uncomparable types
+		if reflect.TypeOf(err).Comparable() {
+			if code, ok := codes[err]; ok {
+				return code, true
+			}
+		}
+		switch wrapped := err.(type) {
+		case interface{ Unwrap() error }:
+			err = wrapped.Unwrap()
+		case interface{ Unwrap() []error }:
+			for _, err := range wrapped.Unwrap() {
+				if code, ok := lookupErrorCode(err, codes); ok {
+					return code, true
+				}
+			}
+			return "", false
+		default:
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func statusErrorCode(httpCode int) ErrorCode {
+	switch httpCode {
+	case http.StatusBadRequest:
+		return CodeInvalidParam
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodePayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return CodeUnsupportedMediaType
+	case http.StatusUnprocessableEntity:
+		return CodeUnprocessable
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	if httpCode >= http.StatusInternalServerError {
+		return CodeServerError
+	}
+	return CodeInvalidParam
+}
+
+// NewErrResponse builds the error response of err with its code
+func NewErrResponse(err error, httpCode int, codes map[error]ErrorCode) ErrResponse {
+	return ErrResponse{
+		Code:    ErrorCodeOf(err, httpCode, codes),
+		Message: err.Error(),
+	}
+}
+
+// NewRequestErrResponse builds the error response of err to a request, carrying the id of
+// the request so that the error can be looked up in the server logs
+func NewRequestErrResponse(ctx context.Context, err error, httpCode int, codes map[error]ErrorCode) ErrResponse {
+	resp := NewErrResponse(err, httpCode, codes)
+	resp.RequestID = RequestID(ctx)
+	return resp
+}
@@ -10,6 +10,10 @@ import (
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type HTTPContextKey string
@@ -18,10 +22,15 @@ var (
 	JWTAuthHeader                  = "Authorization"
 	JaegerHeader                   = "Uber-Trace-Id"
 	ChannelIdHeader                = "X-Channel-Id"
+	RequestIDHeader                = "X-Request-ID"
 	ChannelKey      HTTPContextKey = "channel_key"
 	UserKey         HTTPContextKey = "user_key"
+	RequestIDKey    HTTPContextKey = "request_id_key"
 )
 
+// maxRequestIDLength bounds request ids taken from clients, which end up in every log line
+const maxRequestIDLength = 128
+
 func MaxAllowed(n int64) gin.HandlerFunc {
 	sem := make(chan struct{}, n)
 	acquire := func() { sem <- struct{}{} }
@@ -34,15 +43,105 @@ func MaxAllowed(n int64) gin.HandlerFunc {
 	}
 }
 
-func CorsMiddleware() gin.HandlerFunc {
-	config := cors.Config{
-		AllowAllOrigins:  true,
-		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Length", "Content-Type", JWTAuthHeader},
+// CorsMiddleware allows cross-origin requests from the configured origins. An origin of
+// "*" allows all origins, and "*.example.com" allows any subdomain of example.com. Requests
+// from other origins are served without CORS headers, so browsers block the response
+func CorsMiddleware(corsConfig config.CorsConfig) gin.HandlerFunc {
+	origins := splitList(corsConfig.AllowedOrigins)
+	allowAll := false
+	for _, origin := range origins {
+		if origin == "*" {
+			allowAll = true
+		}
+	}
+	corsCfg := cors.Config{
+		AllowMethods:     splitList(corsConfig.AllowedMethods),
+		AllowHeaders:     splitList(corsConfig.AllowedHeaders),
+		ExposeHeaders:    []string{RequestIDHeader},
 		AllowCredentials: false,
 		MaxAge:           12 * time.Hour,
 	}
-	return cors.New(config)
+	if allowAll {
+		corsCfg.AllowAllOrigins = true
+		return cors.New(corsCfg)
+	}
+	corsCfg.AllowOriginFunc = func(origin string) bool {
+		return isOriginAllowed(origin, origins)
+	}
+	corsHandler := cors.New(corsCfg)
+	return func(c *gin.Context) {
+		if origin := c.GetHeader("Origin"); origin != "" && !isOriginAllowed(origin, origins) {
+			c.Next()
+			return
+		}
+		corsHandler(c)
+	}
+}
+
+// isOriginAllowed matches an origin such as "https://app.example.com" against allowed
+// origins, which are either exact origins or host patterns with a leading "*." that
+// optionally carry a scheme
+func isOriginAllowed(origin string, allowed []string) bool {
+	scheme, host, ok := strings.Cut(origin, "://")
+	if !ok {
+		return false
+	}
+	for _, pattern := range allowed {
+		if pattern == origin {
+			return true
+		}
+		patternScheme, patternHost, hasScheme := strings.Cut(pattern, "://")
+		if !hasScheme {
+			patternScheme, patternHost = "", pattern
+		}
+		if !strings.HasPrefix(patternHost, "*.") || (hasScheme && patternScheme != scheme) {
+			continue
+		}
+		if strings.HasSuffix(host, patternHost[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// OriginAllowlist matches request origins against a comma-separated list in the format of
+// CorsConfig.AllowedOrigins
+type OriginAllowlist struct {
+	allowAll bool
+	origins  []string
+}
+
+// NewOriginAllowlist parses allowed origins. An empty list or "*" allows all origins
+func NewOriginAllowlist(allowedOrigins string) OriginAllowlist {
+	origins := splitList(allowedOrigins)
+	allowAll := len(origins) == 0
+	for _, origin := range origins {
+		if origin == "*" {
+			allowAll = true
+		}
+	}
+	return OriginAllowlist{allowAll, origins}
+}
+
+// AllowAll reports whether every origin is allowed
+func (l OriginAllowlist) AllowAll() bool {
+	return l.allowAll
+}
+
+// Allowed reports whether a request from the origin is allowed. Requests without an origin
+// do not come from a browser and are always allowed
+func (l OriginAllowlist) Allowed(origin string) bool {
+	return l.allowAll || origin == "" || isOriginAllowed(origin, l.origins)
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
 }
 
 func LoggingMiddleware(logger HttpLog) gin.HandlerFunc {
@@ -50,6 +149,14 @@ func LoggingMiddleware(logger HttpLog) gin.HandlerFunc {
 		// Start timer
 		start := time.Now()
 
+		requestID := c.GetHeader(RequestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = uuid.New().String()
+		}
+		c.Header(RequestIDHeader, requestID)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), RequestIDKey, requestID))
+		trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("http.request_id", requestID))
+
 		// Process Request
 		c.Next()
 
@@ -62,10 +169,34 @@ func LoggingMiddleware(logger HttpLog) gin.HandlerFunc {
 			slog.String("path", c.Request.RequestURI),
 			slog.Int("status", c.Writer.Status()),
 			slog.String("referrer", c.Request.Referer()),
-			slog.String("trace_id", getTraceID(c)))
+			slog.String("trace_id", getTraceID(c)),
+			slog.String("request_id", requestID))
 	}
 }
 
+// RequestID returns the id of the request a context belongs to, or an empty string
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(RequestIDKey).(string)
+	return requestID
+}
+
+// isValidRequestID reports whether a client supplied request id can be used as is. Ids
+// are limited to a safe charset so that they cannot forge log fields
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+	for _, ch := range requestID {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-', ch == '_', ch == '.', ch == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
 func LimitBodySize(maxBodyBytes int64) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBodyBytes)
@@ -88,12 +219,19 @@ func JWTAuth() gin.HandlerFunc {
 			return
 		}
 		if authResult.Expired {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrResponse{
-				Message: ErrTokenExpired.Error(),
-			})
+			c.AbortWithStatusJSON(http.StatusUnauthorized, NewRequestErrResponse(c.Request.Context(), ErrTokenExpired, http.StatusUnauthorized, nil))
 			return
 		}
-		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), ChannelKey, authResult.ChannelID))
+		// guest tokens are only good for watching a channel over its websocket
+		if authResult.ReadOnly() {
+			c.AbortWithStatusJSON(http.StatusForbidden, NewRequestErrResponse(c.Request.Context(), ErrReadOnlyToken, http.StatusForbidden, nil))
+			return
+		}
+		ctx := context.WithValue(c.Request.Context(), ChannelKey, authResult.ChannelID)
+		if authResult.UserID != 0 {
+			ctx = context.WithValue(ctx, UserKey, authResult.UserID)
+		}
+		c.Request = c.Request.WithContext(ctx)
 		c.Next()
 	}
 }
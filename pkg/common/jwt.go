@@ -3,6 +3,7 @@ package common
 import (
 	"errors"
 	"fmt"
+	"log/slog"
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -11,15 +12,26 @@ import (
 var (
 	JwtSecret           string
 	JwtExpirationSecond int64
+	// JwtLeewaySecond is the clock skew tolerated when validating exp, nbf and iat
+	JwtLeewaySecond int64
 )
 
 var (
-	ErrInvalidToken = errors.New("invalid token")
-	ErrTokenExpired = errors.New("token expired")
+	ErrInvalidToken  = errors.New("invalid token")
+	ErrTokenExpired  = errors.New("token expired")
+	ErrReadOnlyToken = errors.New("token is read-only")
 )
 
+// ScopeReadOnly is the scope of guest tokens, which can only watch a channel over its
+// websocket. Tokens without a scope have full access
+const ScopeReadOnly = "read"
+
 type JWTClaims struct {
 	ChannelID uint64
+	// UserID binds the token to a user of the channel; it is unset for the channel token
+	// shared by both users of a match
+	UserID uint64 `json:",omitempty"`
+	Scope  string `json:",omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -29,18 +41,20 @@ type AuthPayload struct {
 
 type AuthResponse struct {
 	ChannelID uint64
+	UserID    uint64
+	Scope     string
+	ExpiresAt time.Time
 	Expired   bool
 }
 
+// ReadOnly reports whether the token only grants read access
+func (r *AuthResponse) ReadOnly() bool {
+	return r.Scope == ScopeReadOnly
+}
+
 func Auth(authPayload *AuthPayload) (*AuthResponse, error) {
 	token, err := parseToken(authPayload.AccessToken)
 	if err != nil {
-		v := err.(*jwt.ValidationError)
-		if v.Errors == jwt.ValidationErrorExpired {
-			return &AuthResponse{
-				Expired: true,
-			}, nil
-		}
 		return nil, ErrInvalidToken
 	}
 
@@ -48,21 +62,56 @@ func Auth(authPayload *AuthPayload) (*AuthResponse, error) {
 	if !(ok && token.Valid) {
 		return nil, ErrInvalidToken
 	}
+	if err := validateClaims(claims, time.Now(), time.Duration(JwtLeewaySecond)*time.Second); err != nil {
+		if errors.Is(err, ErrTokenExpired) {
+			return &AuthResponse{
+				Expired: true,
+			}, nil
+		}
+		return nil, err
+	}
 
-	return &AuthResponse{
+	authResponse := &AuthResponse{
 		ChannelID: claims.ChannelID,
+		UserID:    claims.UserID,
+		Scope:     claims.Scope,
 		Expired:   false,
-	}, nil
+	}
+	if claims.ExpiresAt != nil {
+		authResponse.ExpiresAt = claims.ExpiresAt.Time
+	}
+	return authResponse, nil
 }
 
 func NewJWT(channelID uint64) (string, error) {
+	return NewUserJWT(channelID, 0)
+}
+
+// NewUserJWT issues an access token bound to a user of the channel
+func NewUserJWT(channelID, userID uint64) (string, error) {
 	expiresAt := time.Now().Add(time.Duration(JwtExpirationSecond) * time.Second)
-	jwtClaims := &JWTClaims{
+	return newJWT(&JWTClaims{
 		ChannelID: channelID,
+		UserID:    userID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expiresAt),
 		},
-	}
+	})
+}
+
+// NewGuestJWT issues a read-only access token of the channel for a guest, expiring after ttl
+func NewGuestJWT(channelID, guestID uint64, ttl time.Duration) (string, error) {
+	return newJWT(&JWTClaims{
+		ChannelID: channelID,
+		UserID:    guestID,
+		Scope:     ScopeReadOnly,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	})
+}
+
+func newJWT(jwtClaims *JWTClaims) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims)
 	accessToken, err := token.SignedString([]byte(JwtSecret))
 	if err != nil {
@@ -71,11 +120,31 @@ func NewJWT(channelID uint64) (string, error) {
 	return accessToken, nil
 }
 
+// parseToken verifies the signature of a token only; time-based claims are checked by
+// validateClaims so that clock skew can be tolerated
 func parseToken(accessToken string) (*jwt.Token, error) {
 	return jwt.ParseWithClaims(accessToken, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 		return []byte(JwtSecret), nil
-	})
+	}, jwt.WithoutClaimsValidation())
+}
+
+// validateClaims checks exp, nbf and iat against now, tolerating the given leeway. Tokens
+// that are only accepted thanks to the leeway are logged, since they hint at clock drift
+// between the client and the server
+func validateClaims(claims *JWTClaims, now time.Time, leeway time.Duration) error {
+	if !claims.VerifyExpiresAt(now.Add(-leeway), false) {
+		return ErrTokenExpired
+	}
+	if !claims.VerifyNotBefore(now.Add(leeway), false) || !claims.VerifyIssuedAt(now.Add(leeway), false) {
+		return ErrInvalidToken
+	}
+	if !claims.VerifyExpiresAt(now, false) || !claims.VerifyNotBefore(now, false) || !claims.VerifyIssuedAt(now, false) {
+		slog.Warn("token accepted within clock skew leeway",
+			slog.Uint64("channel_id", claims.ChannelID),
+			slog.Duration("leeway", leeway))
+	}
+	return nil
 }
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"io"
 	"os"
 
@@ -24,14 +25,39 @@ func init() {
 	})))
 }
 
+// requestIDHandler adds the request id to records logged with the context of a request
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := RequestID(ctx); requestID != "" {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
 func NewHttpLog(config *config.Config) (HttpLog, error) {
-	logHandler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	opts := &slog.HandlerOptions{
 		Level:     slog.LevelInfo,
 		AddSource: false,
-	}).WithAttrs([]slog.Attr{
+	}
+	var logHandler slog.Handler = slog.NewTextHandler(os.Stdout, opts)
+	if config.Observability != nil && config.Observability.Log.Format == "json" {
+		logHandler = slog.NewJSONHandler(os.Stdout, opts)
+	}
+	logHandler = logHandler.WithAttrs([]slog.Attr{
 		slog.String("proto", "http"),
 	})
-	logger := slog.New(logHandler)
+	logger := slog.New(requestIDHandler{logHandler})
 
 	gin.SetMode(gin.ReleaseMode)
 	gin.DefaultWriter = io.Writer(os.Stderr)
@@ -1,10 +1,12 @@
 package common
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/minghsu0107/go-random-chat/pkg/config"
 	"github.com/prometheus/client_golang/prometheus"
@@ -23,12 +25,18 @@ var TracerProvider *tracesdk.TracerProvider
 
 type ObservabilityInjector struct {
 	promPort  string
+	promAuth  metricsAuth
 	jaegerUrl string
 }
 
 func NewObservabilityInjector(config *config.Config) *ObservabilityInjector {
 	return &ObservabilityInjector{
-		promPort:  config.Observability.Prometheus.Port,
+		promPort: config.Observability.Prometheus.Port,
+		promAuth: metricsAuth{
+			bearerToken: config.Observability.Prometheus.Auth.BearerToken,
+			username:    config.Observability.Prometheus.Auth.Username,
+			password:    config.Observability.Prometheus.Auth.Password,
+		},
 		jaegerUrl: config.Observability.Tracing.JaegerUrl,
 	}
 }
@@ -47,13 +55,13 @@ func (injector *ObservabilityInjector) Register(service string) error {
 			promHttpSrv := &http.Server{Addr: fmt.Sprintf(":%s", injector.promPort)}
 			m := http.NewServeMux()
 			// Create HTTP handler for Prometheus metrics.
-			m.Handle("/metrics", promhttp.HandlerFor(
+			m.Handle("/metrics", injector.promAuth.Wrap(promhttp.HandlerFor(
 				prometheus.DefaultGatherer,
 				promhttp.HandlerOpts{
 					// Opt into OpenMetrics e.g. to support exemplars.
 					EnableOpenMetrics: true,
 				},
-			))
+			)))
 			promHttpSrv.Handler = m
 			slog.Info("starting prom metrics on  :" + injector.promPort)
 			err := promHttpSrv.ListenAndServe()
@@ -66,6 +74,51 @@ func (injector *ObservabilityInjector) Register(service string) error {
 	return nil
 }
 
+// metricsAuth protects the metrics endpoint with a bearer token, basic auth or both, in
+// which case either is accepted. It is open if neither is configured
+type metricsAuth struct {
+	bearerToken string
+	username    string
+	password    string
+}
+
+func (a metricsAuth) Wrap(h http.Handler) http.Handler {
+	if a.bearerToken == "" && a.username == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !a.authorized(req) {
+			if a.username != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func (a metricsAuth) authorized(req *http.Request) bool {
+	if a.bearerToken != "" {
+		if token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer "); ok && secureEqual(token, a.bearerToken) {
+			return true
+		}
+	}
+	if a.username != "" {
+		if username, password, ok := req.BasicAuth(); ok && secureEqual(username, a.username) && secureEqual(password, a.password) {
+			return true
+		}
+	}
+	return false
+}
+
+// secureEqual compares secrets in constant time
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
 func otelReqFilter(req *http.Request) bool {
 	filters := []string{"/metrics", "/", "/healthcheck"}
 	for _, filter := range filters {
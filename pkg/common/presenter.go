@@ -12,7 +12,12 @@ var (
 
 // ErrResponse is the error response type
 type ErrResponse struct {
-	Message string `json:"msg"`
+	Code    ErrorCode `json:"code" example:"INVALID_PARAMETER"`
+	Message string    `json:"msg"`
+	// Details carries extra context of some errors, such as the current usage of an exceeded quota
+	Details map[string]interface{} `json:"details,omitempty"`
+	// RequestID is the id the request is logged with
+	RequestID string `json:"request_id,omitempty"`
 }
 
 // SuccessMessage is the success response type
@@ -11,6 +11,7 @@ const rateLimitRedisKeyPrefix = "rc:ratelimit"
 
 type RateLimiter struct {
 	rc         redis.UniversalClient
+	keyPrefix  string
 	rate       int
 	burst      int
 	expiration time.Duration
@@ -45,10 +46,11 @@ return { allowed, new_tokens }
 `)
 
 // NewRateLimiter returns a new Limiter that allows events up to rate r
-// and permits bursts of at most b tokens
-func NewRateLimiter(rc redis.UniversalClient, rate, burst int, expiration time.Duration) *RateLimiter {
+// and permits bursts of at most b tokens. Its keys are namespaced with keyPrefix
+func NewRateLimiter(rc redis.UniversalClient, keyPrefix string, rate, burst int, expiration time.Duration) *RateLimiter {
 	return &RateLimiter{
 		rc:         rc,
+		keyPrefix:  keyPrefix,
 		rate:       rate,
 		burst:      burst,
 		expiration: expiration,
@@ -60,7 +62,7 @@ func (rl *RateLimiter) Allow(ctx context.Context, key string) (bool, error) {
 }
 
 func (rl *RateLimiter) AllowN(ctx context.Context, key string, now time.Time, n int) (bool, error) {
-	reservation, err := rl.reserveN(ctx, Join(rateLimitRedisKeyPrefix, ":", key), now, n)
+	reservation, err := rl.reserveN(ctx, PrefixRedisKey(rl.keyPrefix, Join(rateLimitRedisKeyPrefix, ":", key)), now, n)
 	if err != nil {
 		return false, err
 	}
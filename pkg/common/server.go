@@ -26,6 +26,14 @@ type Router interface {
 	GracefulStop(ctx context.Context) error
 }
 
+// ShutdownTimeouter is implemented by routers with a configured shutdown timeout
+type ShutdownTimeouter interface {
+	ShutdownTimeout() time.Duration
+}
+
+// defaultShutdownTimeout bounds the shutdown of routers without a configured timeout
+const defaultShutdownTimeout = 5 * time.Second
+
 type InfraCloser interface {
 	Close() error
 }
@@ -54,7 +62,11 @@ func (s *Server) Serve() {
 		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 		<-sig
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		timeout := defaultShutdownTimeout
+		if t, ok := s.router.(ShutdownTimeouter); ok && t.ShutdownTimeout() > 0 {
+			timeout = t.ShutdownTimeout()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
 		defer cancel()
 		s.GracefulStop(ctx, done)
 	}()
@@ -0,0 +1,109 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// InFlightRequests keeps track of the requests being served, so that the ones cut off by
+// a shutdown timeout can be logged
+type InFlightRequests struct {
+	mu       sync.Mutex
+	nextID   uint64
+	requests map[uint64]inFlightRequest
+}
+
+type inFlightRequest struct {
+	method    string
+	path      string
+	requestID string
+	start     time.Time
+}
+
+func NewInFlightRequests() *InFlightRequests {
+	return &InFlightRequests{
+		requests: make(map[uint64]inFlightRequest),
+	}
+}
+
+// Middleware records a request for as long as it is being served
+func (t *InFlightRequests) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID, _ := c.Request.Context().Value(RequestIDKey).(string)
+		t.mu.Lock()
+		id := t.nextID
+		t.nextID++
+		t.requests[id] = inFlightRequest{
+			method:    c.Request.Method,
+			path:      c.Request.URL.Path,
+			requestID: requestID,
+			start:     time.Now(),
+		}
+		t.mu.Unlock()
+		defer func() {
+			t.mu.Lock()
+			delete(t.requests, id)
+			t.mu.Unlock()
+		}()
+		c.Next()
+	}
+}
+
+func (t *InFlightRequests) log(logger *slog.Logger) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for _, req := range t.requests {
+		logger.Warn("request terminated by shutdown",
+			slog.String("method", req.method),
+			slog.String("path", req.path),
+			slog.String("request_id", req.requestID),
+			slog.Duration("elapsed", now.Sub(req.start)),
+		)
+	}
+}
+
+// Shutdown gracefully shuts srv down. Requests still in flight once ctx expires are logged
+// and their connections closed
+func Shutdown(ctx context.Context, srv *http.Server, inFlight *InFlightRequests, logger *slog.Logger) error {
+	err := srv.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	inFlight.log(logger)
+	return errors.Join(err, srv.Close())
+}
+
+// Workers runs background loops, which are stopped on shutdown, and waits for them to return
+type Workers struct {
+	wg sync.WaitGroup
+}
+
+func (w *Workers) Go(worker func()) {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		worker()
+	}()
+}
+
+// Wait waits for the workers to return, or until ctx is done
+func (w *Workers) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+// ListenAndServe serves plain http, or https if TLS is enabled in tlsConfig. The
+// certificate is reloaded whenever its files change on disk, so that rotated certificates
+// are picked up without a restart
+func ListenAndServe(srv *http.Server, tlsConfig config.TLSConfig) error {
+	if !tlsConfig.Enabled {
+		return srv.ListenAndServe()
+	}
+	reloader, err := NewCertReloader(tlsConfig.CertFile, tlsConfig.KeyFile, time.Duration(tlsConfig.ReloadIntervalSecond)*time.Second)
+	if err != nil {
+		return err
+	}
+	srv.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	return srv.ListenAndServeTLS("", "")
+}
+
+// CertReloader serves a certificate loaded from a cert and key file pair. The files are
+// checked for changes at most once per interval during handshakes, and a changed pair is
+// loaded in place of the old one. A pair that fails to load, e.g. because only one of the
+// files was replaced so far, is retried on the next check while the old one stays in use
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+	lastCheck   time.Time
+}
+
+func NewCertReloader(certFile, keyFile string, interval time.Duration) (*CertReloader, error) {
+	reloader := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		interval: interval,
+	}
+	if err := reloader.reload(time.Now()); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if r.interval > 0 && now.Sub(r.lastCheck) >= r.interval {
+		if err := r.reload(now); err != nil {
+			slog.Error("reload tls certificate failed", slog.String("cert_file", r.certFile), slog.String("error", err.Error()))
+		}
+	}
+	return r.cert, nil
+}
+
+// reload loads the key pair if either file changed since it was last loaded
+func (r *CertReloader) reload(now time.Time) error {
+	r.lastCheck = now
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certModTime) && keyInfo.ModTime().Equal(r.keyModTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil {
+		slog.Info("tls certificate reloaded", slog.String("cert_file", r.certFile))
+	}
+	r.cert = &cert
+	r.certModTime = certInfo.ModTime()
+	r.keyModTime = keyInfo.ModTime()
+	return nil
+}
@@ -32,3 +32,11 @@ func Join(strs ...string) string {
 	}
 	return sb.String()
 }
+
+// PrefixRedisKey namespaces a redis key with the configured key prefix, if any
+func PrefixRedisKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return Join(prefix, ":", key)
+}
@@ -23,6 +23,7 @@ type WebConfig struct {
 	Http struct {
 		Server struct {
 			Port string
+			TLS  TLSConfig
 		}
 	}
 }
@@ -33,6 +34,14 @@ type ChatConfig struct {
 			Port    string
 			MaxConn int64
 			Swag    bool
+			// Debug serves debug endpoints such as the websocket connections of the instance to
+			// requests bearing DebugToken
+			Debug      bool
+			DebugToken string
+			Cors       CorsConfig
+			TLS        TLSConfig
+			// ShutdownTimeoutSecond bounds the graceful shutdown, including closing websocket sessions
+			ShutdownTimeoutSecond int64
 		}
 	}
 	Grpc struct {
@@ -52,13 +61,185 @@ type ChatConfig struct {
 		Id string
 	}
 	Message struct {
-		MaxNum        int64
-		PaginationNum int
-		MaxSizeByte   int64
+		// Store is the backend of messages, cassandra or memory
+		Store             string
+		MaxNum            int64
+		PaginationNum     int
+		MaxPageSize       int
+		EncryptAtRest     bool
+		EncryptionKey     string
+		MaxSizeByte       int64
+		MaxPayloadBytes   int
+		ControlCharPolicy string
+		SoloPolicy        string
+		MaxEditAgeSecond  int64
+		MaxBulkDelete     int
+		// RetentionDays and MaxPerChannel bound the messages kept per channel; 0 disables the bound
+		RetentionDays      int64
+		MaxPerChannel      int64
+		TrimIntervalSecond int64
 	}
 	JWT struct {
-		Secret           string
-		ExpirationSecond int64
+		Secret                  string
+		ExpirationSecond        int64
+		LeewaySecond            int64
+		RefreshExpirationSecond int64
+		GuestExpirationSecond   int64
+	}
+	Sticker struct {
+		MaxPackSize int
+	}
+	// SystemMessages toggles the system messages stored in channel histories
+	SystemMessages struct {
+		JoinLeave bool
+	}
+	Archive struct {
+		Enabled            bool
+		InactiveSecond     int64
+		ScanIntervalSecond int64
+		S3                 struct {
+			Endpoint  string
+			Region    string
+			Bucket    string
+			AccessKey string
+			SecretKey string
+		}
+	}
+	// EmptyChannels reaps channels nobody is connected to, soft-deleted ones included, that
+	// had no activity for InactiveSecond, looked for every ScanIntervalSecond; 0 disables
+	// reaping. Action is either archive, which requires Archive.Enabled, or delete
+	EmptyChannels struct {
+		InactiveSecond     int64
+		ScanIntervalSecond int64
+		Action             string
+	}
+	Ephemeral struct {
+		MaxTTLSecond        int64
+		SweepIntervalSecond int64
+	}
+	// MessageExpiry bounds disappearing messages. Users offline when a message expires get
+	// its tombstone on their next connect; MaxTombstones and TombstoneTTLSecond bound how
+	// many tombstones are kept per user and for how long
+	MessageExpiry struct {
+		MaxTTLSecond        int64
+		SweepIntervalSecond int64
+		MaxTombstones       int64
+		TombstoneTTLSecond  int64
+	}
+	// Moderation checks text payloads before they are stored. BlockedKeywords is a
+	// comma-separated blocklist; a non-empty Webhook.Url also asks an external service.
+	// FailOpen lets messages through when the webhook fails instead of rejecting them
+	Moderation struct {
+		Enabled         bool
+		BlockedKeywords string
+		Webhook         struct {
+			Url                string
+			TimeoutMilliSecond int64
+		}
+		FailOpen bool
+	}
+	Search struct {
+		MaxResults         int
+		MaxScannedMessages int
+	}
+	Typing struct {
+		ThrottleMilliSecond int64
+		StopTimeoutSecond   int64
+	}
+	Reaction struct {
+		AllowedEmojis string
+	}
+	Pin struct {
+		MaxPinned int64
+	}
+	Role struct {
+		// AdminOnlyChannelDeletion restricts deleting a channel to its admins
+		AdminOnlyChannelDeletion bool
+	}
+	Block struct {
+		// HidePresence keeps blocked users from seeing the presence of those who blocked them
+		HidePresence bool
+	}
+	Presence struct {
+		AwaySecond    int64
+		OfflineSecond int64
+		MaxBatchSize  int
+		// DebounceSecond delays offline presence events so that quick reconnects emit none
+		DebounceSecond int64
+	}
+	Scheduled struct {
+		MaxHorizonSecond        int64
+		PollIntervalMilliSecond int64
+	}
+	Outbox struct {
+		Enabled     bool
+		MaxMessages int64
+		TTLSecond   int64
+	}
+	PendingDelivery struct {
+		Enabled     bool
+		MaxMessages int64
+		TTLSecond   int64
+	}
+	Resume struct {
+		Enabled               bool
+		IdleWindowSecond      int64
+		RefreshIntervalSecond int64
+		MaxReplayMessages     int
+		// MaxHeldLiveMessages bounds the live messages held back while a connection replays
+		// missed, outbox and pending messages
+		MaxHeldLiveMessages int
+	}
+	Websocket struct {
+		// AllowedOrigins lists the origins browsers may open websockets from, in the format
+		// of CorsConfig.AllowedOrigins
+		AllowedOrigins string
+		Metadata       struct {
+			Headers     string
+			QueryParams string
+			// VersionKey is the captured header or query param carrying the client version
+			VersionKey string
+			// EventMinVersions lists comma-separated event:version pairs; events are only
+			// delivered to clients reporting at least that version
+			EventMinVersions string
+		}
+		Coalesce struct {
+			Enabled           bool
+			WindowMilliSecond int64
+			MaxBatchSize      int
+		}
+		Shaping struct {
+			MaxMessagesPerSecond int
+			QueueSize            int
+		}
+		Heartbeat struct {
+			PingIntervalSecond int64
+			PongTimeoutSecond  int64
+		}
+		Compression struct {
+			Enabled bool
+		}
+		Metrics struct {
+			MaxChannelLabels int
+		}
+		SlowConsumer struct {
+			BufferSize int
+			Policy     string
+		}
+		Chunking struct {
+			MaxChunks      int
+			MaxBufferBytes int
+			TimeoutSecond  int64
+		}
+		UnknownEventPolicy string
+	}
+	RateLimit struct {
+		Message RateLimitConfig
+		Flood   struct {
+			MaxViolations  int64
+			WindowSecond   int64
+			CooldownSecond int64
+		}
 	}
 }
 
@@ -76,6 +257,8 @@ type MatchConfig struct {
 			Port    string
 			MaxConn int64
 			Swag    bool
+			Cors    CorsConfig
+			TLS     TLSConfig
 		}
 	}
 	Grpc struct {
@@ -88,6 +271,29 @@ type MatchConfig struct {
 			}
 		}
 	}
+	Queue struct {
+		IdleTimeoutSecond   int64
+		SweepIntervalSecond int64
+	}
+	Channel struct {
+		TTLSecond int64
+	}
+}
+
+// TLSConfig turns on https for an http server. The certificate is reloaded when CertFile
+// or KeyFile change, checked at most every ReloadIntervalSecond; 0 disables reloading
+type TLSConfig struct {
+	Enabled              bool
+	CertFile             string
+	KeyFile              string
+	ReloadIntervalSecond int64
+}
+
+// CorsConfig holds comma-separated lists of what cross-origin requests may use
+type CorsConfig struct {
+	AllowedOrigins string
+	AllowedMethods string
+	AllowedHeaders string
 }
 
 type RateLimitConfig struct {
@@ -102,21 +308,138 @@ type UploaderConfig struct {
 			Swag          bool
 			MaxBodyByte   int64
 			MaxMemoryByte int64
+			Cors          CorsConfig
+			TLS           TLSConfig
+			// ReadinessCacheSecond is how long a readiness check result is reused
+			ReadinessCacheSecond int64
+			// ShutdownTimeoutSecond bounds the graceful shutdown of the service
+			ShutdownTimeoutSecond int64
+			// PerChannelMaxBodyByte overrides MaxBodyByte for the channels it is keyed by
+			PerChannelMaxBodyByte map[string]int64
+			// MaxConcurrentUploads caps the uploads to S3 in flight on an instance; 0 disables the cap
+			MaxConcurrentUploads int
+			// UploadQueueTimeoutMillisecond is how long an upload waits for a free slot before
+			// failing with 503; 0 fails right away
+			UploadQueueTimeoutMillisecond int64
 		}
 	}
 	S3 struct {
-		Endpoint              string
-		Region                string
-		Bucket                string
-		AccessKey             string
-		SecretKey             string
-		PresignLifetimeSecond int64
+		Endpoint string
+		// PublicEndpoint is the endpoint presigned URLs are signed for when clients reach S3
+		// through a reverse proxy instead of Endpoint
+		PublicEndpoint         string
+		Region                 string
+		Bucket                 string
+		AccessKey              string
+		SecretKey              string
+		PresignLifetimeSecond  int64
+		PresignClockSkewSecond int64
+		PresignBatchMaxSize    int
+		AllowedContentTypes    string
+		// KeyTemplate is the name of uploaded objects under their channel prefix
+		KeyTemplate string
+		// BucketRouting lists the buckets uploads are stored in instead of Bucket by content type
+		BucketRouting []BucketRule
+		SSE           struct {
+			Algorithm string
+			KMSKeyID  string
+		}
+		// Throttle bounds the Retry-After returned while S3 is throttling uploads
+		Throttle struct {
+			RetryAfterBaseSecond int64
+			RetryAfterMaxSecond  int64
+		}
+		ConnectivityCheck struct {
+			Enabled               bool
+			FailFast              bool
+			RecheckIntervalSecond int64
+		}
+		// Client tunes the retries, timeout and connection pool of requests to S3
+		Client struct {
+			RetryMaxAttempts      int
+			RequestTimeoutSecond  int64
+			MaxIdleConns          int
+			MaxIdleConnsPerHost   int
+			MaxConnsPerHost       int
+			IdleConnTimeoutSecond int64
+		}
+		// UploadTimeoutSecond bounds the S3 writes of an upload request, and
+		// OperationTimeoutSecond bounds presigning and reading object metadata
+		UploadTimeoutSecond    int64
+		OperationTimeoutSecond int64
 	}
 	RateLimit struct {
-		ChannelUpload RateLimitConfig
+		ChannelUpload   RateLimitConfig
+		Presign         RateLimitConfig
+		UserUploadQuota struct {
+			MaxBytesPerWindow int64
+			WindowSecond      int64
+		}
+	}
+	Quota struct {
+		MaxBytesPerChannel      int64
+		ReconcileIntervalSecond int64
+	}
+	Dedup struct {
+		Enabled bool
+	}
+	Idempotency struct {
+		Enabled              bool
+		PendingTimeoutSecond int64
+	}
+	Multipart struct {
+		Enabled             bool
+		MaxPartByte         int64
+		SessionTTLSecond    int64
+		SweepIntervalSecond int64
+	}
+	Concurrency struct {
+		MaxPerUser    int64
+		SlotTTLSecond int64
+	}
+	Scan struct {
+		Enabled bool
+		ClamAV  struct {
+			Address       string
+			TimeoutSecond int64
+			ChunkByte     int
+		}
+	}
+	Thumbnail struct {
+		Enabled         bool
+		MaxWidth        int
+		MaxHeight       int
+		MaxSourcePixels int
+		JpegQuality     int
+		OutputFormat    string
+		FfmpegPath      string
+	}
+	Transcode struct {
+		Audio struct {
+			Enabled           bool
+			FfmpegPath        string
+			FfprobePath       string
+			MaxConcurrent     int
+			MaxDurationSecond int64
+			AllowedExtensions string
+		}
+	}
+	Grpc struct {
+		Client struct {
+			User struct {
+				Endpoint string
+			}
+		}
 	}
 }
 
+// BucketRule routes uploads whose content type matches Pattern to Bucket. Rules are a list
+// rather than a map since viper splits map keys on dots, which content types may contain
+type BucketRule struct {
+	Pattern string
+	Bucket  string
+}
+
 type CookieConfig struct {
 	MaxAge int
 	Path   string
@@ -128,6 +451,8 @@ type UserConfig struct {
 		Server struct {
 			Port string
 			Swag bool
+			Cors CorsConfig
+			TLS  TLSConfig
 		}
 	}
 	Grpc struct {
@@ -165,6 +490,7 @@ type CassandraConfig struct {
 type RedisConfig struct {
 	Password                string
 	Addrs                   string
+	KeyPrefix               string
 	ExpirationHour          int64
 	MinIdleConn             int
 	PoolSize                int
@@ -175,48 +501,233 @@ type RedisConfig struct {
 type ObservabilityConfig struct {
 	Prometheus struct {
 		Port string
+		// Auth requires scrapers of the metrics endpoint to send the bearer token or the
+		// basic auth credentials; the endpoint is open if neither is set
+		Auth struct {
+			BearerToken string
+			Username    string
+			Password    string
+		}
 	}
 	Tracing struct {
 		JaegerUrl string
 	}
+	Log struct {
+		Format string
+	}
 }
 
 func setDefault() {
 	viper.SetDefault("web.http.server.port", "5000")
+	viper.SetDefault("web.http.server.tls.enabled", false)
+	viper.SetDefault("web.http.server.tls.reloadIntervalSecond", 60)
 
 	viper.SetDefault("chat.http.server.port", "5001")
+	viper.SetDefault("chat.http.server.tls.enabled", false)
+	viper.SetDefault("chat.http.server.tls.reloadIntervalSecond", 60)
+	viper.SetDefault("chat.http.server.cors.allowedOrigins", "*")
+	viper.SetDefault("chat.http.server.cors.allowedMethods", "GET,POST,PUT,PATCH,DELETE,HEAD,OPTIONS")
+	viper.SetDefault("chat.http.server.cors.allowedHeaders", "Origin,Content-Length,Content-Type,Authorization")
 	viper.SetDefault("chat.http.server.maxConn", 200)
 	viper.SetDefault("chat.http.server.swag", false)
+	viper.SetDefault("chat.http.server.debug", false)
+	viper.SetDefault("chat.http.server.shutdownTimeoutSecond", 5)
 	viper.SetDefault("chat.grpc.server.port", "4000")
 	viper.SetDefault("chat.grpc.client.user.endpoint", "localhost:4001")
 	viper.SetDefault("chat.grpc.client.forwarder.endpoint", "localhost:4002")
 	viper.SetDefault("chat.subscriber.id", "rc.msg."+os.Getenv("HOSTNAME"))
 	viper.SetDefault("chat.message.maxNum", 5000)
 	viper.SetDefault("chat.message.paginationNum", 5000)
+	viper.SetDefault("chat.message.maxPageSize", 5000)
+	viper.SetDefault("chat.message.encryptAtRest", false)
+	viper.SetDefault("chat.message.encryptionKey", "")
 	viper.SetDefault("chat.message.maxSizeByte", 4096)
+	viper.SetDefault("chat.message.maxPayloadBytes", 4096)
+	viper.SetDefault("chat.message.store", "cassandra")
+	viper.SetDefault("chat.message.controlCharPolicy", "reject")
+	viper.SetDefault("chat.message.soloPolicy", "allow")
+	viper.SetDefault("chat.message.maxEditAgeSecond", 900)
+	viper.SetDefault("chat.message.maxBulkDelete", 100)
+	viper.SetDefault("chat.message.retentionDays", 0)
+	viper.SetDefault("chat.message.maxPerChannel", 0)
+	viper.SetDefault("chat.message.trimIntervalSecond", 3600)
 	viper.SetDefault("chat.jwt.secret", "replaceme")
 	viper.SetDefault("chat.jwt.expirationSecond", 86400)
+	viper.SetDefault("chat.jwt.leewaySecond", 30)
+	viper.SetDefault("chat.jwt.refreshExpirationSecond", 604800)
+	viper.SetDefault("chat.jwt.guestExpirationSecond", 900)
+	viper.SetDefault("chat.sticker.maxPackSize", 50)
+	viper.SetDefault("chat.systemMessages.joinLeave", false)
+	viper.SetDefault("chat.archive.enabled", false)
+	viper.SetDefault("chat.archive.inactiveSecond", 2592000)
+	viper.SetDefault("chat.archive.scanIntervalSecond", 3600)
+	viper.SetDefault("chat.archive.s3.endpoint", "http://localhost:9000")
+	viper.SetDefault("chat.archive.s3.region", "us-east-1")
+	viper.SetDefault("chat.archive.s3.bucket", "mychatarchive")
+	viper.SetDefault("chat.archive.s3.accessKey", "")
+	viper.SetDefault("chat.archive.s3.secretKey", "")
+	viper.SetDefault("chat.emptyChannels.inactiveSecond", 0)
+	viper.SetDefault("chat.emptyChannels.scanIntervalSecond", 300)
+	viper.SetDefault("chat.emptyChannels.action", "archive")
+	viper.SetDefault("chat.ephemeral.maxTtlSecond", 86400)
+	viper.SetDefault("chat.ephemeral.sweepIntervalSecond", 10)
+	viper.SetDefault("chat.messageExpiry.maxTtlSecond", 604800)
+	viper.SetDefault("chat.messageExpiry.sweepIntervalSecond", 1)
+	viper.SetDefault("chat.messageExpiry.maxTombstones", 1000)
+	viper.SetDefault("chat.messageExpiry.tombstoneTtlSecond", 604800)
+	viper.SetDefault("chat.moderation.enabled", false)
+	viper.SetDefault("chat.moderation.blockedKeywords", "")
+	viper.SetDefault("chat.moderation.webhook.url", "")
+	viper.SetDefault("chat.moderation.webhook.timeoutMilliSecond", 500)
+	viper.SetDefault("chat.moderation.failOpen", false)
+	viper.SetDefault("chat.search.maxResults", 50)
+	viper.SetDefault("chat.search.maxScannedMessages", 5000)
+	viper.SetDefault("chat.typing.throttleMilliSecond", 2000)
+	viper.SetDefault("chat.typing.stopTimeoutSecond", 5)
+	viper.SetDefault("chat.reaction.allowedEmojis", "👍,❤️,😂,😮,😢,🎉,🙏,🔥")
+	viper.SetDefault("chat.pin.maxPinned", 50)
+	viper.SetDefault("chat.role.adminOnlyChannelDeletion", false)
+	viper.SetDefault("chat.block.hidePresence", false)
+	viper.SetDefault("chat.presence.awaySecond", 60)
+	viper.SetDefault("chat.presence.offlineSecond", 120)
+	viper.SetDefault("chat.presence.maxBatchSize", 100)
+	viper.SetDefault("chat.presence.debounceSecond", 5)
+	viper.SetDefault("chat.scheduled.maxHorizonSecond", 604800)
+	viper.SetDefault("chat.scheduled.pollIntervalMilliSecond", 1000)
+	viper.SetDefault("chat.outbox.enabled", false)
+	viper.SetDefault("chat.outbox.maxMessages", 100)
+	viper.SetDefault("chat.outbox.ttlSecond", 604800)
+	viper.SetDefault("chat.pendingDelivery.enabled", false)
+	viper.SetDefault("chat.pendingDelivery.maxMessages", 500)
+	viper.SetDefault("chat.pendingDelivery.ttlSecond", 604800)
+	viper.SetDefault("chat.resume.enabled", false)
+	viper.SetDefault("chat.resume.idleWindowSecond", 300)
+	viper.SetDefault("chat.resume.refreshIntervalSecond", 5)
+	viper.SetDefault("chat.resume.maxReplayMessages", 500)
+	viper.SetDefault("chat.resume.maxHeldLiveMessages", 1000)
+	viper.SetDefault("chat.websocket.allowedOrigins", "*")
+	viper.SetDefault("chat.websocket.metadata.headers", "")
+	viper.SetDefault("chat.websocket.metadata.queryParams", "")
+	viper.SetDefault("chat.websocket.metadata.versionKey", "")
+	viper.SetDefault("chat.websocket.metadata.eventMinVersions", "")
+	viper.SetDefault("chat.websocket.coalesce.enabled", false)
+	viper.SetDefault("chat.websocket.coalesce.windowMilliSecond", 10)
+	viper.SetDefault("chat.websocket.coalesce.maxBatchSize", 64)
+	viper.SetDefault("chat.websocket.shaping.maxMessagesPerSecond", 0)
+	viper.SetDefault("chat.websocket.shaping.queueSize", 256)
+	viper.SetDefault("chat.websocket.heartbeat.pingIntervalSecond", 25)
+	viper.SetDefault("chat.websocket.heartbeat.pongTimeoutSecond", 60)
+	viper.SetDefault("chat.websocket.compression.enabled", false)
+	viper.SetDefault("chat.websocket.metrics.maxChannelLabels", 100)
+	viper.SetDefault("chat.websocket.slowConsumer.bufferSize", 256)
+	viper.SetDefault("chat.websocket.slowConsumer.policy", "replay")
+	viper.SetDefault("chat.websocket.chunking.maxChunks", 64)
+	viper.SetDefault("chat.websocket.chunking.maxBufferBytes", 262144)
+	viper.SetDefault("chat.websocket.chunking.timeoutSecond", 30)
+	viper.SetDefault("chat.websocket.unknownEventPolicy", "ignore")
+	viper.SetDefault("chat.rateLimit.message.rps", 5)
+	viper.SetDefault("chat.rateLimit.message.burst", 10)
+	viper.SetDefault("chat.rateLimit.flood.maxViolations", 20)
+	viper.SetDefault("chat.rateLimit.flood.windowSecond", 60)
+	viper.SetDefault("chat.rateLimit.flood.cooldownSecond", 300)
 
 	viper.SetDefault("match.http.server.port", "5002")
+	viper.SetDefault("match.http.server.tls.enabled", false)
+	viper.SetDefault("match.http.server.tls.reloadIntervalSecond", 60)
+	viper.SetDefault("match.http.server.cors.allowedOrigins", "*")
+	viper.SetDefault("match.http.server.cors.allowedMethods", "GET,POST,PUT,PATCH,DELETE,HEAD,OPTIONS")
+	viper.SetDefault("match.http.server.cors.allowedHeaders", "Origin,Content-Length,Content-Type,Authorization")
 	viper.SetDefault("match.http.server.maxConn", 200)
 	viper.SetDefault("match.http.server.swag", false)
 	viper.SetDefault("match.grpc.client.chat.endpoint", "localhost:4000")
 	viper.SetDefault("match.grpc.client.user.endpoint", "localhost:4001")
+	viper.SetDefault("match.queue.idleTimeoutSecond", 60)
+	viper.SetDefault("match.queue.sweepIntervalSecond", 15)
+	viper.SetDefault("match.channel.ttlSecond", 0)
 
 	viper.SetDefault("uploader.http.server.port", "5003")
+	viper.SetDefault("uploader.http.server.tls.enabled", false)
+	viper.SetDefault("uploader.http.server.tls.reloadIntervalSecond", 60)
+	viper.SetDefault("uploader.http.server.cors.allowedOrigins", "*")
+	viper.SetDefault("uploader.http.server.cors.allowedMethods", "GET,POST,PUT,PATCH,DELETE,HEAD,OPTIONS")
+	viper.SetDefault("uploader.http.server.cors.allowedHeaders", "Origin,Content-Length,Content-Type,Authorization,X-Content-SHA256,Idempotency-Key")
 	viper.SetDefault("uploader.http.server.swag", false)
 	viper.SetDefault("uploader.http.server.maxBodyByte", "67108864")   // 64MB
 	viper.SetDefault("uploader.http.server.maxMemoryByte", "16777216") // 16MB
+	viper.SetDefault("uploader.http.server.readinessCacheSecond", 2)
+	viper.SetDefault("uploader.http.server.shutdownTimeoutSecond", 5)
+	viper.SetDefault("uploader.http.server.perChannelMaxBodyByte", map[string]int64{})
+	viper.SetDefault("uploader.http.server.maxConcurrentUploads", 0)
+	viper.SetDefault("uploader.http.server.uploadQueueTimeoutMillisecond", 0)
 	viper.SetDefault("uploader.s3.endpoint", "http://localhost:9000")
+	viper.SetDefault("uploader.s3.publicEndpoint", "")
 	viper.SetDefault("uploader.s3.region", "us-east-1")
 	viper.SetDefault("uploader.s3.bucket", "myfilebucket")
 	viper.SetDefault("uploader.s3.accessKey", "")
 	viper.SetDefault("uploader.s3.secretKey", "")
 	viper.SetDefault("uploader.s3.presignLifetimeSecond", 86400)
+	viper.SetDefault("uploader.s3.presignClockSkewSecond", 0)
+	viper.SetDefault("uploader.s3.presignBatchMaxSize", 30)
+	viper.SetDefault("uploader.s3.allowedContentTypes", "")
+	viper.SetDefault("uploader.s3.keyTemplate", "{uuid}{ext}")
+	viper.SetDefault("uploader.s3.bucketRouting", []BucketRule{})
+	viper.SetDefault("uploader.s3.sse.algorithm", "")
+	viper.SetDefault("uploader.s3.sse.kmsKeyId", "")
+	viper.SetDefault("uploader.s3.throttle.retryAfterBaseSecond", 1)
+	viper.SetDefault("uploader.s3.throttle.retryAfterMaxSecond", 30)
+	viper.SetDefault("uploader.s3.connectivityCheck.enabled", false)
+	viper.SetDefault("uploader.s3.connectivityCheck.failFast", false)
+	viper.SetDefault("uploader.s3.connectivityCheck.recheckIntervalSecond", 30)
+	viper.SetDefault("uploader.s3.client.retryMaxAttempts", 3)
+	viper.SetDefault("uploader.s3.client.requestTimeoutSecond", 0)
+	viper.SetDefault("uploader.s3.client.maxIdleConns", 100)
+	viper.SetDefault("uploader.s3.client.maxIdleConnsPerHost", 10)
+	viper.SetDefault("uploader.s3.client.maxConnsPerHost", 0)
+	viper.SetDefault("uploader.s3.client.idleConnTimeoutSecond", 90)
+	viper.SetDefault("uploader.s3.uploadTimeoutSecond", 300)
+	viper.SetDefault("uploader.s3.operationTimeoutSecond", 10)
 	viper.SetDefault("uploader.rateLimit.channelUpload.rps", 200)
 	viper.SetDefault("uploader.rateLimit.channelUpload.burst", 50)
+	viper.SetDefault("uploader.rateLimit.presign.rps", 10)
+	viper.SetDefault("uploader.rateLimit.presign.burst", 30)
+	viper.SetDefault("uploader.rateLimit.userUploadQuota.maxBytesPerWindow", 0)
+	viper.SetDefault("uploader.rateLimit.userUploadQuota.windowSecond", 3600)
+	viper.SetDefault("uploader.quota.maxBytesPerChannel", 0)
+	viper.SetDefault("uploader.quota.reconcileIntervalSecond", 60)
+	viper.SetDefault("uploader.dedup.enabled", false)
+	viper.SetDefault("uploader.idempotency.enabled", false)
+	viper.SetDefault("uploader.idempotency.pendingTimeoutSecond", 600)
+	viper.SetDefault("uploader.multipart.enabled", false)
+	viper.SetDefault("uploader.multipart.maxPartByte", 16777216) // 16MB
+	viper.SetDefault("uploader.multipart.sessionTTLSecond", 86400)
+	viper.SetDefault("uploader.multipart.sweepIntervalSecond", 60)
+	viper.SetDefault("uploader.concurrency.maxPerUser", 0)
+	viper.SetDefault("uploader.concurrency.slotTTLSecond", 600)
+	viper.SetDefault("uploader.scan.enabled", false)
+	viper.SetDefault("uploader.scan.clamav.address", "localhost:3310")
+	viper.SetDefault("uploader.scan.clamav.timeoutSecond", 30)
+	viper.SetDefault("uploader.scan.clamav.chunkByte", 32768)
+	viper.SetDefault("uploader.thumbnail.enabled", false)
+	viper.SetDefault("uploader.thumbnail.maxWidth", 320)
+	viper.SetDefault("uploader.thumbnail.maxHeight", 320)
+	viper.SetDefault("uploader.thumbnail.maxSourcePixels", 16000000)
+	viper.SetDefault("uploader.thumbnail.jpegQuality", 80)
+	viper.SetDefault("uploader.thumbnail.outputFormat", "")
+	viper.SetDefault("uploader.thumbnail.ffmpegPath", "ffmpeg")
+	viper.SetDefault("uploader.transcode.audio.enabled", false)
+	viper.SetDefault("uploader.transcode.audio.ffmpegPath", "ffmpeg")
+	viper.SetDefault("uploader.transcode.audio.ffprobePath", "ffprobe")
+	viper.SetDefault("uploader.transcode.audio.maxConcurrent", 2)
+	viper.SetDefault("uploader.transcode.audio.maxDurationSecond", 300)
+	viper.SetDefault("uploader.transcode.audio.allowedExtensions", ".webm,.ogg,.opus,.m4a,.mp3")
+	viper.SetDefault("uploader.grpc.client.user.endpoint", "localhost:4001")
 
 	viper.SetDefault("user.http.server.port", "5004")
+	viper.SetDefault("user.http.server.tls.enabled", false)
+	viper.SetDefault("user.http.server.tls.reloadIntervalSecond", 60)
+	viper.SetDefault("user.http.server.cors.allowedOrigins", "*")
+	viper.SetDefault("user.http.server.cors.allowedMethods", "GET,POST,PUT,PATCH,DELETE,HEAD,OPTIONS")
+	viper.SetDefault("user.http.server.cors.allowedHeaders", "Origin,Content-Length,Content-Type,Authorization")
 	viper.SetDefault("user.http.server.swag", false)
 	viper.SetDefault("user.grpc.server.port", "4001")
 	viper.SetDefault("user.oauth.cookie.maxAge", 3600)
@@ -243,6 +754,7 @@ func setDefault() {
 
 	viper.SetDefault("redis.password", "")
 	viper.SetDefault("redis.addrs", "localhost:6379")
+	viper.SetDefault("redis.keyPrefix", "")
 	viper.SetDefault("redis.expirationHour", 24)
 	viper.SetDefault("redis.minIdleConn", 16)
 	viper.SetDefault("redis.poolSize", 64)
@@ -250,7 +762,11 @@ func setDefault() {
 	viper.SetDefault("redis.writeTimeoutMilliSecond", 3000)
 
 	viper.SetDefault("observability.prometheus.port", "8080")
+	viper.SetDefault("observability.prometheus.auth.bearerToken", "")
+	viper.SetDefault("observability.prometheus.auth.username", "")
+	viper.SetDefault("observability.prometheus.auth.password", "")
 	viper.SetDefault("observability.tracing.jaegerUrl", "")
+	viper.SetDefault("observability.log.format", "text")
 }
 
 func NewConfig() (*Config, error) {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"strconv"
 	"time"
 
 	"github.com/minghsu0107/go-random-chat/pkg/common"
@@ -26,24 +27,55 @@ var (
 type RedisCache interface {
 	Get(ctx context.Context, key string, dst interface{}) (bool, error)
 	Set(ctx context.Context, key string, val interface{}) error
+	SetWithExpiration(ctx context.Context, key string, val interface{}, expiration time.Duration) error
+	SetNXWithExpiration(ctx context.Context, key string, val interface{}, expiration time.Duration) (bool, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Expire(ctx context.Context, key string, expiration time.Duration) error
+	PipelinedGet(ctx context.Context, keys []string) ([]string, error)
+	Incr(ctx context.Context, key string) (int64, error)
+	IncrIfExists(ctx context.Context, key string) (int64, error)
+	IncrFrom(ctx context.Context, key string, base int64) (int64, error)
+	IncrWithExpiration(ctx context.Context, key string, expiration time.Duration) (int64, error)
 	Delete(ctx context.Context, key string) error
 	HGet(ctx context.Context, key, field string, dst interface{}) (bool, error)
 	HMGet(ctx context.Context, key string, fields []string) ([]interface{}, error)
 	HGetAll(ctx context.Context, key string) (map[string]string, error)
 	HSet(ctx context.Context, key string, values ...interface{}) error
 	HDel(ctx context.Context, key, field string) error
+	HDelIfExists(ctx context.Context, key, field string) (bool, error)
+	HIncrBy(ctx context.Context, key, field string, incr int64) (int64, error)
+	HDecrOrDel(ctx context.Context, key, field string) (int64, error)
+	HDelLinked(ctx context.Context, key, field string) error
+	DecrByOrDel(ctx context.Context, key string, n int64) error
+	HSetCapped(ctx context.Context, key, field string, val interface{}, maxFields int64, expiration time.Duration) error
+	HSetIfGreater(ctx context.Context, key, field string, val uint64) error
+	HSetUnlessLast(ctx context.Context, key, field, val, guarded, defaultField string) (bool, error)
+	HUpdateSetMember(ctx context.Context, key, field, set, member string, add bool) (string, error)
 	RPush(ctx context.Context, key string, val interface{}) error
 	LRange(ctx context.Context, key string, start, stop int64) ([]string, error)
+	SAdd(ctx context.Context, key string, members ...interface{}) error
+	SRem(ctx context.Context, key string, members ...interface{}) error
+	SMembers(ctx context.Context, key string) ([]string, error)
 	Publish(ctx context.Context, topic string, payload interface{}) error
 	ZPopMinOrAddOne(ctx context.Context, key string, score float64, member interface{}) (bool, string, error)
 	ZRemOne(ctx context.Context, key string, member interface{}) error
+	ZRemIfExists(ctx context.Context, key string, member interface{}) (bool, error)
+	ZAdd(ctx context.Context, key string, score float64, member interface{}) error
+	ZAddIfExists(ctx context.Context, key string, score float64, member interface{}) error
+	ZAddCapped(ctx context.Context, key string, score float64, member interface{}, maxMembers int64) (bool, error)
+	ZRevRange(ctx context.Context, key string, start, stop int64) ([]string, error)
+	ZRange(ctx context.Context, key string, start, stop int64) ([]string, error)
+	ZPopByScore(ctx context.Context, key string, max float64) ([]string, error)
+	ZRangeByScore(ctx context.Context, key string, max float64) ([]string, error)
+	ZCard(ctx context.Context, key string) (int64, error)
 	HGetIfKeyExists(ctx context.Context, key, field string, dst interface{}) (bool, bool, error)
 	ExecPipeLine(ctx context.Context, cmds *[]RedisCmd) error
 }
 
 // RedisCacheImpl is the redis cache client type
 type RedisCacheImpl struct {
-	client redis.UniversalClient
+	client    redis.UniversalClient
+	keyPrefix string
 }
 
 // RedisOpType is the redis operation type
@@ -122,13 +154,17 @@ func NewRedisClient(config *config.Config) (redis.UniversalClient, error) {
 }
 
 // NewRedisCache is the factory of redis cache
-func NewRedisCacheImpl(client redis.UniversalClient) *RedisCacheImpl {
-	return &RedisCacheImpl{client}
+func NewRedisCacheImpl(client redis.UniversalClient, config *config.Config) *RedisCacheImpl {
+	return &RedisCacheImpl{client, config.Redis.KeyPrefix}
+}
+
+func (rc *RedisCacheImpl) key(key string) string {
+	return common.PrefixRedisKey(rc.keyPrefix, key)
 }
 
 // Get returns true if the key already exists and set dst to the corresponding value
 func (rc *RedisCacheImpl) Get(ctx context.Context, key string, dst interface{}) (bool, error) {
-	val, err := rc.client.Get(ctx, key).Result()
+	val, err := rc.client.Get(ctx, rc.key(key)).Result()
 	if err == redis.Nil {
 		return false, nil
 	} else if err != nil {
@@ -143,22 +179,124 @@ func (rc *RedisCacheImpl) Get(ctx context.Context, key string, dst interface{})
 
 // Set sets a key-value pair
 func (rc *RedisCacheImpl) Set(ctx context.Context, key string, val interface{}) error {
-	if err := rc.client.Set(ctx, key, val, expiration).Err(); err != nil {
+	if err := rc.client.Set(ctx, rc.key(key), val, expiration).Err(); err != nil {
 		return err
 	}
 	return nil
 }
 
+// SetWithExpiration sets a key-value pair that expires after the given duration
+func (rc *RedisCacheImpl) SetWithExpiration(ctx context.Context, key string, val interface{}, expiration time.Duration) error {
+	return rc.client.Set(ctx, rc.key(key), val, expiration).Err()
+}
+
+// SetNXWithExpiration sets a key-value pair that expires after the given duration
+// if the key does not exist, and reports whether it was set
+func (rc *RedisCacheImpl) SetNXWithExpiration(ctx context.Context, key string, val interface{}, expiration time.Duration) (bool, error) {
+	return rc.client.SetNX(ctx, rc.key(key), val, expiration).Result()
+}
+
+// Expire sets the expiration of a key
+func (rc *RedisCacheImpl) Expire(ctx context.Context, key string, expiration time.Duration) error {
+	return rc.client.Expire(ctx, rc.key(key), expiration).Err()
+}
+
+// PipelinedGet gets multiple keys in a single pipeline; missing keys yield empty strings.
+// Unlike MGET, the keys do not need to share a hash slot
+func (rc *RedisCacheImpl) PipelinedGet(ctx context.Context, keys []string) ([]string, error) {
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := rc.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Get(ctx, rc.key(key))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	vals := make([]string, len(keys))
+	for i, cmd := range cmds {
+		val, err := cmd.Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		vals[i] = val
+	}
+	return vals, nil
+}
+
+// Exists returns true if the key exists
+func (rc *RedisCacheImpl) Exists(ctx context.Context, key string) (bool, error) {
+	n, err := rc.client.Exists(ctx, rc.key(key)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+var incrWithExpiration = redis.NewScript(`
+local key = KEYS[1]
+local ttl = ARGV[1]
+
+local count = redis.call("INCR", key)
+if count == 1 then
+  redis.call("EXPIRE", key, ttl)
+end
+return count
+`)
+
+// Incr increments a counter that never expires and returns its new value
+func (rc *RedisCacheImpl) Incr(ctx context.Context, key string) (int64, error) {
+	return rc.client.Incr(ctx, rc.key(key)).Result()
+}
+
+var incrIfExists = redis.NewScript(`
+local key = KEYS[1]
+
+if redis.call("EXISTS", key) == 0 then
+  return 0
+end
+return redis.call("INCR", key)
+`)
+
+// IncrIfExists increments an existing counter and returns its new value, or 0 without
+// creating the counter if it does not exist
+func (rc *RedisCacheImpl) IncrIfExists(ctx context.Context, key string) (int64, error) {
+	return incrIfExists.Run(ctx, rc.client, []string{rc.key(key)}).Int64()
+}
+
+var incrFrom = redis.NewScript(`
+local key = KEYS[1]
+local base = ARGV[1]
+
+redis.call("SET", key, base, "NX")
+return redis.call("INCR", key)
+`)
+
+// IncrFrom increments a counter that never expires and returns its new value; a missing
+// counter starts from base
+func (rc *RedisCacheImpl) IncrFrom(ctx context.Context, key string, base int64) (int64, error) {
+	return incrFrom.Run(ctx, rc.client, []string{rc.key(key)}, base).Int64()
+}
+
+// IncrWithExpiration increments a counter and sets its expiration when the counter is created,
+// so that the counter is reset once the window elapses
+func (rc *RedisCacheImpl) IncrWithExpiration(ctx context.Context, key string, expiration time.Duration) (int64, error) {
+	return incrWithExpiration.Run(ctx, rc.client, []string{rc.key(key)}, int64(expiration.Seconds())).Int64()
+}
+
 // Delete deletes a key
 func (rc *RedisCacheImpl) Delete(ctx context.Context, key string) error {
-	if err := rc.client.Del(ctx, key).Err(); err != nil {
+	if err := rc.client.Del(ctx, rc.key(key)).Err(); err != nil {
 		return err
 	}
 	return nil
 }
 
 func (rc *RedisCacheImpl) HGet(ctx context.Context, key, field string, dst interface{}) (bool, error) {
-	val, err := rc.client.HGet(ctx, key, field).Result()
+	val, err := rc.client.HGet(ctx, rc.key(key), field).Result()
 	if err == redis.Nil {
 		return false, nil
 	} else if err != nil {
@@ -172,31 +310,256 @@ func (rc *RedisCacheImpl) HGet(ctx context.Context, key, field string, dst inter
 }
 
 func (rc *RedisCacheImpl) HMGet(ctx context.Context, key string, fields []string) ([]interface{}, error) {
-	return rc.client.HMGet(ctx, key, fields...).Result()
+	return rc.client.HMGet(ctx, rc.key(key), fields...).Result()
 }
 
 func (rc *RedisCacheImpl) HGetAll(ctx context.Context, key string) (map[string]string, error) {
-	return rc.client.HGetAll(ctx, key).Result()
+	return rc.client.HGetAll(ctx, rc.key(key)).Result()
 }
 
 func (rc *RedisCacheImpl) HSet(ctx context.Context, key string, values ...interface{}) error {
-	return rc.client.HSet(ctx, key, values).Err()
+	return rc.client.HSet(ctx, rc.key(key), values).Err()
 }
 
 func (rc *RedisCacheImpl) HDel(ctx context.Context, key, field string) error {
-	return rc.client.HDel(ctx, key, field).Err()
+	return rc.client.HDel(ctx, rc.key(key), field).Err()
+}
+
+// HDelIfExists deletes a hash field and reports whether the field existed
+func (rc *RedisCacheImpl) HDelIfExists(ctx context.Context, key, field string) (bool, error) {
+	n, err := rc.client.HDel(ctx, rc.key(key), field).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (rc *RedisCacheImpl) HIncrBy(ctx context.Context, key, field string, incr int64) (int64, error) {
+	return rc.client.HIncrBy(ctx, rc.key(key), field, incr).Result()
+}
+
+var hdecrOrDel = redis.NewScript(`
+local key = KEYS[1]
+local field = ARGV[1]
+
+if redis.call("HEXISTS", key, field) == 0 then
+  return 0
+end
+local n = redis.call("HINCRBY", key, field, -1)
+if n <= 0 then
+  redis.call("HDEL", key, field)
+  return 0
+end
+return n
+`)
+
+// HDecrOrDel decrements a counter in a hash and deletes the field once it drops to zero.
+// It returns the remaining count, which is 0 if the field did not exist
+func (rc *RedisCacheImpl) HDecrOrDel(ctx context.Context, key, field string) (int64, error) {
+	return hdecrOrDel.Run(ctx, rc.client, []string{rc.key(key)}, field).Int64()
+}
+
+var hdelLinked = redis.NewScript(`
+local key = KEYS[1]
+local field = ARGV[1]
+
+local linked = redis.call("HGET", key, field)
+if not linked then
+  return 0
+end
+redis.call("HDEL", key, field, linked)
+return 1
+`)
+
+// HDelLinked deletes a hash field along with the field named by its value, as in hashes
+// that map values both ways
+func (rc *RedisCacheImpl) HDelLinked(ctx context.Context, key, field string) error {
+	return hdelLinked.Run(ctx, rc.client, []string{rc.key(key)}, field).Err()
+}
+
+var decrByOrDel = redis.NewScript(`
+local key = KEYS[1]
+local n = tonumber(ARGV[1])
+
+local val = tonumber(redis.call("GET", key) or "0")
+if val <= n then
+  redis.call("DEL", key)
+  return 0
+end
+return redis.call("DECRBY", key, n)
+`)
+
+// DecrByOrDel decrements a counter by n and deletes it instead of letting it drop below zero
+func (rc *RedisCacheImpl) DecrByOrDel(ctx context.Context, key string, n int64) error {
+	return decrByOrDel.Run(ctx, rc.client, []string{rc.key(key)}, n).Err()
+}
+
+var hsetCapped = redis.NewScript(`
+local key = KEYS[1]
+local field = ARGV[1]
+local val = ARGV[2]
+local max_fields = tonumber(ARGV[3])
+local ttl = tonumber(ARGV[4])
+
+redis.call("HSET", key, field, val)
+redis.call("EXPIRE", key, ttl)
+
+local n = redis.call("HLEN", key)
+if n <= max_fields then
+  return n
+end
+-- fields are numeric ids; evict the smallest ones
+local fields = redis.call("HKEYS", key)
+table.sort(fields, function(a, b)
+  if #a ~= #b then
+    return #a < #b
+  end
+  return a < b
+end)
+for i = 1, n - max_fields do
+  redis.call("HDEL", key, fields[i])
+end
+return max_fields
+`)
+
+var hsetIfGreater = redis.NewScript(`
+local key = KEYS[1]
+local field = ARGV[1]
+local val = ARGV[2]
+
+-- compare as decimal strings since lua numbers cannot hold 64-bit ids exactly
+local cur = redis.call("HGET", key, field)
+if cur and (#cur > #val or (#cur == #val and cur >= val)) then
+  return 0
+end
+redis.call("HSET", key, field, val)
+return 1
+`)
+
+// HSetIfGreater sets a hash field to val only if val is greater than its current numeric value
+func (rc *RedisCacheImpl) HSetIfGreater(ctx context.Context, key, field string, val uint64) error {
+	return hsetIfGreater.Run(ctx, rc.client, []string{rc.key(key)}, field, strconv.FormatUint(val, 10)).Err()
+}
+
+var hsetUnlessLast = redis.NewScript(`
+local key = KEYS[1]
+local field = ARGV[1]
+local val = ARGV[2]
+local guarded = ARGV[3]
+local default_field = ARGV[4]
+
+-- the default field holds the guarded value as long as it has no value of its own
+local default_unset = default_field ~= "" and redis.call("HEXISTS", key, default_field) == 0
+local cur = redis.call("HGET", key, field)
+if not cur and field == default_field then
+  cur = guarded
+end
+if cur == guarded and val ~= guarded then
+  local n = 0
+  if default_unset then
+    n = 1
+  end
+  for _, v in ipairs(redis.call("HVALS", key)) do
+    if v == guarded then
+      n = n + 1
+    end
+  end
+  if n <= 1 then
+    return 0
+  end
+end
+redis.call("HSET", key, field, val)
+return 1
+`)
+
+// HSetUnlessLast sets a hash field to val unless that replaces the last guarded value in
+// the hash. defaultField, if not empty, counts as holding the guarded value while unset
+func (rc *RedisCacheImpl) HSetUnlessLast(ctx context.Context, key, field, val, guarded, defaultField string) (bool, error) {
+	set, err := hsetUnlessLast.Run(ctx, rc.client, []string{rc.key(key)}, field, val, guarded, defaultField).Int()
+	if err != nil {
+		return false, err
+	}
+	return set == 1, nil
+}
+
+var hupdateSetMember = redis.NewScript(`
+local key = KEYS[1]
+local field = ARGV[1]
+local set = ARGV[2]
+local member = ARGV[3]
+local add = ARGV[4] == "1"
+
+local sets = {}
+local data = redis.call("HGET", key, field)
+if data then
+  sets = cjson.decode(data)
+end
+local members = sets[set] or {}
+local idx
+for i, m in ipairs(members) do
+  if m == member then
+    idx = i
+    break
+  end
+end
+if add and not idx then
+  table.insert(members, member)
+elseif not add and idx then
+  table.remove(members, idx)
+end
+if #members > 0 then
+  sets[set] = members
+else
+  sets[set] = nil
+end
+if next(sets) == nil then
+  redis.call("HDEL", key, field)
+  return ""
+end
+data = cjson.encode(sets)
+redis.call("HSET", key, field, data)
+return data
+`)
+
+// HUpdateSetMember atomically adds member to or removes it from a named set inside the hash field,
+// which holds a json object of sets. It returns the updated json object, or an empty string if
+// no set is left and the field is deleted
+func (rc *RedisCacheImpl) HUpdateSetMember(ctx context.Context, key, field, set, member string, add bool) (string, error) {
+	addArg := "0"
+	if add {
+		addArg = "1"
+	}
+	return hupdateSetMember.Run(ctx, rc.client, []string{rc.key(key)}, field, set, member, addArg).Text()
+}
+
+// HSetCapped sets a hash field, refreshes the expiration of the hash, and evicts the fields
+// with the smallest numeric names once the hash holds more than maxFields fields
+func (rc *RedisCacheImpl) HSetCapped(ctx context.Context, key, field string, val interface{}, maxFields int64, expiration time.Duration) error {
+	return hsetCapped.Run(ctx, rc.client, []string{rc.key(key)}, field, val, maxFields, int64(expiration.Seconds())).Err()
 }
 
 func (rc *RedisCacheImpl) RPush(ctx context.Context, key string, val interface{}) error {
-	return rc.client.RPush(ctx, key, val).Err()
+	return rc.client.RPush(ctx, rc.key(key), val).Err()
 }
 
 func (rc *RedisCacheImpl) LRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
-	return rc.client.LRange(ctx, key, start, stop).Result()
+	return rc.client.LRange(ctx, rc.key(key), start, stop).Result()
+}
+
+func (rc *RedisCacheImpl) SAdd(ctx context.Context, key string, members ...interface{}) error {
+	return rc.client.SAdd(ctx, rc.key(key), members...).Err()
+}
+
+func (rc *RedisCacheImpl) SRem(ctx context.Context, key string, members ...interface{}) error {
+	return rc.client.SRem(ctx, rc.key(key), members...).Err()
+}
+
+func (rc *RedisCacheImpl) SMembers(ctx context.Context, key string) ([]string, error) {
+	return rc.client.SMembers(ctx, rc.key(key)).Result()
 }
 
 func (rc *RedisCacheImpl) Publish(ctx context.Context, topic string, payload interface{}) error {
-	return rc.client.Publish(ctx, topic, payload).Err()
+	return rc.client.Publish(ctx, rc.key(topic), payload).Err()
 }
 
 var zPopMinOrAddOne = redis.NewScript(`
@@ -220,14 +583,98 @@ return ""
 `)
 
 func (rc *RedisCacheImpl) ZPopMinOrAddOne(ctx context.Context, key string, score float64, member interface{}) (bool, string, error) {
-	poppedMember, err := zPopMinOrAddOne.Run(ctx, rc.client, []string{key}, score, member).Text()
+	poppedMember, err := zPopMinOrAddOne.Run(ctx, rc.client, []string{rc.key(key)}, score, member).Text()
 	if err != nil {
 		return false, "", err
 	}
 	return (poppedMember != ""), poppedMember, nil
 }
 func (rc *RedisCacheImpl) ZRemOne(ctx context.Context, key string, member interface{}) error {
-	return rc.client.ZRem(ctx, key, member).Err()
+	return rc.client.ZRem(ctx, rc.key(key), member).Err()
+}
+
+// ZRemIfExists removes a member from a sorted set and reports whether it was a member
+func (rc *RedisCacheImpl) ZRemIfExists(ctx context.Context, key string, member interface{}) (bool, error) {
+	n, err := rc.client.ZRem(ctx, rc.key(key), member).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (rc *RedisCacheImpl) ZAdd(ctx context.Context, key string, score float64, member interface{}) error {
+	return rc.client.ZAdd(ctx, rc.key(key), redis.Z{Score: score, Member: member}).Err()
+}
+
+// ZAddIfExists updates the score of a member only if the member is already in the sorted set
+func (rc *RedisCacheImpl) ZAddIfExists(ctx context.Context, key string, score float64, member interface{}) error {
+	return rc.client.ZAddXX(ctx, rc.key(key), redis.Z{Score: score, Member: member}).Err()
+}
+
+var zAddCapped = redis.NewScript(`
+local key = KEYS[1]
+local score = ARGV[1]
+local member = ARGV[2]
+local max_members = tonumber(ARGV[3])
+
+if redis.call("ZSCORE", key, member) then
+  return 1
+end
+if max_members > 0 and redis.call("ZCARD", key) >= max_members then
+  return 0
+end
+redis.call("ZADD", key, score, member)
+return 1
+`)
+
+// ZAddCapped adds a member unless the sorted set already holds maxMembers members, or
+// without a cap if maxMembers is not positive, and reports whether the member is in the
+// sorted set afterwards
+func (rc *RedisCacheImpl) ZAddCapped(ctx context.Context, key string, score float64, member interface{}, maxMembers int64) (bool, error) {
+	added, err := zAddCapped.Run(ctx, rc.client, []string{rc.key(key)}, score, member, maxMembers).Int()
+	if err != nil {
+		return false, err
+	}
+	return added == 1, nil
+}
+
+// ZRevRange returns the members of a sorted set from the highest to the lowest score
+func (rc *RedisCacheImpl) ZRevRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return rc.client.ZRevRange(ctx, rc.key(key), start, stop).Result()
+}
+
+// ZRange returns the members of a sorted set from the lowest to the highest score
+func (rc *RedisCacheImpl) ZRange(ctx context.Context, key string, start, stop int64) ([]string, error) {
+	return rc.client.ZRange(ctx, rc.key(key), start, stop).Result()
+}
+
+var zPopByScore = redis.NewScript(`
+local key = KEYS[1]
+local max = ARGV[1]
+
+local members = redis.call("ZRANGEBYSCORE", key, "-inf", max)
+if #members > 0 then
+  redis.call("ZREMRANGEBYSCORE", key, "-inf", max)
+end
+return members
+`)
+
+// ZPopByScore atomically removes and returns all members whose score is less than or equal to max
+func (rc *RedisCacheImpl) ZPopByScore(ctx context.Context, key string, max float64) ([]string, error) {
+	return zPopByScore.Run(ctx, rc.client, []string{rc.key(key)}, max).StringSlice()
+}
+
+// ZRangeByScore returns all members whose score is less than or equal to max, from the lowest
+// to the highest score
+func (rc *RedisCacheImpl) ZRangeByScore(ctx context.Context, key string, max float64) ([]string, error) {
+	return rc.client.ZRangeByScore(ctx, rc.key(key), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatFloat(max, 'f', -1, 64),
+	}).Result()
+}
+
+func (rc *RedisCacheImpl) ZCard(ctx context.Context, key string) (int64, error) {
+	return rc.client.ZCard(ctx, rc.key(key)).Result()
 }
 
 var hgetIfKeyExists = redis.NewScript(`
@@ -242,7 +689,7 @@ return redis.call("HGET", key, field)
 `)
 
 func (rc *RedisCacheImpl) HGetIfKeyExists(ctx context.Context, key, field string, dst interface{}) (bool, bool, error) {
-	val, err := hgetIfKeyExists.Run(ctx, rc.client, []string{key}, field).Text()
+	val, err := hgetIfKeyExists.Run(ctx, rc.client, []string{rc.key(key)}, field).Text()
 	if err == redis.Nil {
 		return true, false, nil
 	} else if err != nil {
@@ -265,19 +712,19 @@ func (rc *RedisCacheImpl) ExecPipeLine(ctx context.Context, cmds *[]RedisCmd) er
 		case DELETE:
 			pipelineCmds = append(pipelineCmds, RedisPipelineCmd{
 				OpType: DELETE,
-				Cmd:    pipe.Del(ctx, cmd.Payload.(RedisDeletePayload).Key),
+				Cmd:    pipe.Del(ctx, rc.key(cmd.Payload.(RedisDeletePayload).Key)),
 			})
 		case HSETONE:
 			payload := cmd.Payload.(RedisHsetOnePayload)
 			pipelineCmds = append(pipelineCmds, RedisPipelineCmd{
 				OpType: HSETONE,
-				Cmd:    pipe.HSet(ctx, payload.Key, payload.Field, payload.Val),
+				Cmd:    pipe.HSet(ctx, rc.key(payload.Key), payload.Field, payload.Val),
 			})
 		case RPUSH:
 			payload := cmd.Payload.(RedisRpushPayload)
 			pipelineCmds = append(pipelineCmds, RedisPipelineCmd{
 				OpType: RPUSH,
-				Cmd:    pipe.RPush(ctx, payload.Key, payload.Val),
+				Cmd:    pipe.RPush(ctx, rc.key(payload.Key), payload.Val),
 			})
 		default:
 			return ErrRedisPipelineCmdNotFound
@@ -2,6 +2,7 @@ package match
 
 import (
 	"encoding/json"
+	"time"
 )
 
 type User struct {
@@ -26,3 +27,15 @@ func (r *MatchResult) ToPresenter() *MatchResultPresenter {
 		AccessToken: r.AccessToken,
 	}
 }
+
+// QueueEviction lists the users evicted from the wait list because their heartbeat was
+// last seen before LastSeenBefore
+type QueueEviction struct {
+	UserIDs        []uint64
+	LastSeenBefore time.Time
+}
+
+func (e *QueueEviction) Encode() []byte {
+	result, _ := json.Marshal(e)
+	return result
+}
@@ -1,7 +1,16 @@
 package match
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+)
 
 var (
 	ErrUserNotFound = errors.New("error user not found")
+	ErrIdleEvicted  = errors.New("error evicted from the wait list for inactivity")
 )
+
+var errorCodes = map[error]common.ErrorCode{
+	ErrUserNotFound: common.CodeUserNotFound,
+}
@@ -5,10 +5,13 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/minghsu0107/go-random-chat/pkg/common"
 	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	metrics "github.com/slok/go-http-metrics/metrics/prometheus"
 	prommiddleware "github.com/slok/go-http-metrics/middleware"
 	ginmiddleware "github.com/slok/go-http-metrics/middleware/gin"
@@ -20,11 +23,41 @@ import (
 )
 
 var (
-	sessUidKey = "sessuid"
+	sessUidKey      = "sessuid"
+	sessLastSeenKey = "sesslastseen"
 
 	MelodyMatch MelodyMatchConn
+
+	queueIdleEvictionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "match",
+		Name:      "queue_idle_evictions_total",
+		Help:      "Total number of users evicted from the matching queue due to inactivity.",
+	})
 )
 
+const (
+	defaultQueueIdleTimeout   = 60 * time.Second
+	defaultQueueSweepInterval = 15 * time.Second
+)
+
+// queueIdleTimeout is how long a queued user may go without answering pings, falling back
+// to the default when the configured value is not positive
+func queueIdleTimeout(config *config.Config) time.Duration {
+	if config.Match.Queue.IdleTimeoutSecond <= 0 {
+		return defaultQueueIdleTimeout
+	}
+	return time.Duration(config.Match.Queue.IdleTimeoutSecond) * time.Second
+}
+
+// queueSweepInterval is how often idle users are evicted, falling back to the default when
+// the configured value is not positive
+func queueSweepInterval(config *config.Config) time.Duration {
+	if config.Match.Queue.SweepIntervalSecond <= 0 {
+		return defaultQueueSweepInterval
+	}
+	return time.Duration(config.Match.Queue.SweepIntervalSecond) * time.Second
+}
+
 type MelodyMatchConn struct {
 	*melody.Melody
 }
@@ -35,24 +68,31 @@ type HttpServer struct {
 	svr             *gin.Engine
 	mm              MelodyMatchConn
 	httpPort        string
+	tlsConfig       config.TLSConfig
 	httpServer      *http.Server
 	matchSubscriber *MatchSubscriber
 	userSvc         UserService
 	matchSvc        MatchingService
 	serveSwag       bool
+	idleTimeout     time.Duration
+	sweepInterval   time.Duration
+	stopSweep       chan struct{}
 }
 
-func NewMelodyMatchConn() MelodyMatchConn {
-	MelodyMatch = MelodyMatchConn{
-		melody.New(),
-	}
+func NewMelodyMatchConn(config *config.Config) MelodyMatchConn {
+	m := melody.New()
+	// a connection that fails to answer pings within the idle timeout is dropped,
+	// which in turn removes the user from the wait list
+	m.Config.PongWait = queueIdleTimeout(config)
+	m.Config.PingPeriod = (m.Config.PongWait * 9) / 10
+	MelodyMatch = MelodyMatchConn{m}
 	return MelodyMatch
 }
 
 func NewGinServer(name string, logger common.HttpLog, config *config.Config) *gin.Engine {
 	svr := gin.New()
 	svr.Use(gin.Recovery())
-	svr.Use(common.CorsMiddleware())
+	svr.Use(common.CorsMiddleware(config.Match.Http.Server.Cors))
 	svr.Use(common.LoggingMiddleware(logger))
 	svr.Use(common.MaxAllowed(config.Match.Http.Server.MaxConn))
 
@@ -66,16 +106,26 @@ func NewGinServer(name string, logger common.HttpLog, config *config.Config) *gi
 }
 
 func NewHttpServer(name string, logger common.HttpLog, config *config.Config, svr *gin.Engine, mm MelodyMatchConn, matchSubscriber *MatchSubscriber, userSvc UserService, matchSvc MatchingService) *HttpServer {
+	if config.Match.Queue.IdleTimeoutSecond <= 0 {
+		logger.Warn("match.queue.idleTimeoutSecond must be positive, using the default", slog.Duration("idleTimeout", defaultQueueIdleTimeout))
+	}
+	if config.Match.Queue.SweepIntervalSecond <= 0 {
+		logger.Warn("match.queue.sweepIntervalSecond must be positive, using the default", slog.Duration("sweepInterval", defaultQueueSweepInterval))
+	}
 	return &HttpServer{
 		name:            name,
 		logger:          logger,
 		svr:             svr,
 		mm:              mm,
 		httpPort:        config.Match.Http.Server.Port,
+		tlsConfig:       config.Match.Http.Server.TLS,
 		matchSubscriber: matchSubscriber,
 		userSvc:         userSvc,
 		matchSvc:        matchSvc,
 		serveSwag:       config.Match.Http.Server.Swag,
+		idleTimeout:     queueIdleTimeout(config),
+		sweepInterval:   queueSweepInterval(config),
+		stopSweep:       make(chan struct{}),
 	}
 }
 
@@ -115,7 +165,8 @@ func (r *HttpServer) RegisterRoutes() {
 	}
 
 	r.mm.HandleConnect(r.HandleMatchOnConnect)
-	r.mm.HandleClose(r.HandleMatchOnClose)
+	r.mm.HandleDisconnect(r.HandleMatchOnDisconnect)
+	r.mm.HandlePong(r.HandleMatchOnPong)
 
 	if r.serveSwag {
 		matchGroup.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler, ginSwagger.InstanceName(doc.SwaggerInfomatch.InfoInstanceName)))
@@ -129,8 +180,8 @@ func (r *HttpServer) Run() {
 			Addr:    addr,
 			Handler: common.NewOtelHttpHandler(r.svr, r.name+"_http"),
 		}
-		r.logger.Info("http server listening", slog.String("addr", addr))
-		err := r.httpServer.ListenAndServe()
+		r.logger.Info("http server listening", slog.String("addr", addr), slog.Bool("tls", r.tlsConfig.Enabled))
+		err := common.ListenAndServe(r.httpServer, r.tlsConfig)
 		if err != nil && err != http.ErrServerClosed {
 			r.logger.Error(err.Error())
 			os.Exit(1)
@@ -143,8 +194,34 @@ func (r *HttpServer) Run() {
 			os.Exit(1)
 		}
 	}()
+	go r.sweepIdleUsers()
+}
+
+// sweepIdleUsers periodically evicts users whose heartbeat has expired, which covers
+// queue entries left behind by connections that never got a chance to clean up. The
+// eviction is broadcast so that every instance closes the stale websockets of those users
+func (r *HttpServer) sweepIdleUsers() {
+	ticker := time.NewTicker(r.sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			userIDs, err := r.matchSvc.EvictIdleUsers(context.Background(), time.Now().Add(-r.idleTimeout))
+			if err != nil {
+				r.logger.Error(err.Error())
+			}
+			if len(userIDs) > 0 {
+				queueIdleEvictionsTotal.Add(float64(len(userIDs)))
+				r.logger.Info("evicted idle users from wait list", slog.Int("count", len(userIDs)))
+			}
+		case <-r.stopSweep:
+			return
+		}
+	}
 }
+
 func (r *HttpServer) GracefulStop(ctx context.Context) error {
+	close(r.stopSweep)
 	err := MelodyMatch.Close()
 	if err != nil {
 		return err
@@ -161,8 +238,5 @@ func (r *HttpServer) GracefulStop(ctx context.Context) error {
 }
 
 func response(c *gin.Context, httpCode int, err error) {
-	message := err.Error()
-	c.JSON(httpCode, common.ErrResponse{
-		Message: message,
-	})
+	c.JSON(httpCode, common.NewRequestErrResponse(c.Request.Context(), err, httpCode, errorCodes))
 }
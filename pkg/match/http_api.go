@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/minghsu0107/go-random-chat/pkg/common"
@@ -69,12 +70,25 @@ func (r *HttpServer) HandleMatchOnConnect(sess *melody.Session) {
 }
 func (r *HttpServer) initializeMatchSession(sess *melody.Session, userID uint64) error {
 	sess.Set(sessUidKey, userID)
+	sess.Set(sessLastSeenKey, time.Now())
 	return nil
 }
-func (r *HttpServer) HandleMatchOnClose(sess *melody.Session, i int, s string) error {
+func (r *HttpServer) HandleMatchOnDisconnect(sess *melody.Session) {
 	userID, ok := sess.Request.Context().Value(common.UserKey).(uint64)
 	if !ok {
-		return nil
+		return
+	}
+	if err := r.matchSvc.RemoveUserFromWaitList(context.Background(), userID); err != nil {
+		r.logger.Error(err.Error())
+	}
+}
+func (r *HttpServer) HandleMatchOnPong(sess *melody.Session) {
+	userID, ok := sess.Request.Context().Value(common.UserKey).(uint64)
+	if !ok {
+		return
+	}
+	sess.Set(sessLastSeenKey, time.Now())
+	if err := r.matchSvc.KeepUserAlive(context.Background(), userID); err != nil {
+		r.logger.Error(err.Error())
 	}
-	return r.matchSvc.RemoveUserFromWaitList(context.Background(), userID)
 }
@@ -3,8 +3,10 @@ package match
 import (
 	"context"
 	"log/slog"
+	"time"
 
 	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/gorilla/websocket"
 	"gopkg.in/olahol/melody.v1"
 )
 
@@ -32,6 +34,14 @@ func (s *MatchSubscriber) HandleMatchResult(msg *message.Message) error {
 	return s.sendMatchResult(context.Background(), result)
 }
 
+func (s *MatchSubscriber) HandleQueueEviction(msg *message.Message) error {
+	eviction, err := DecodeToQueueEviction([]byte(msg.Payload))
+	if err != nil {
+		return err
+	}
+	return s.closeEvictedSessions(eviction)
+}
+
 func (s *MatchSubscriber) RegisterHandler() {
 	s.router.AddNoPublisherHandler(
 		"randomchat_match_result_handler",
@@ -39,6 +49,12 @@ func (s *MatchSubscriber) RegisterHandler() {
 		s.sub,
 		s.HandleMatchResult,
 	)
+	s.router.AddNoPublisherHandler(
+		"randomchat_match_eviction_handler",
+		matchEvictionPubSubTopic,
+		s.sub,
+		s.HandleQueueEviction,
+	)
 }
 
 func (s *MatchSubscriber) Run() error {
@@ -66,3 +82,30 @@ func (s *MatchSubscriber) sendMatchResult(ctx context.Context, result *MatchResu
 		return false
 	})
 }
+
+// closeEvictedSessions closes the websockets of evicted users with a notice. Sessions that
+// answered a ping after the eviction cutoff belong to a reconnect and are kept. Closing
+// runs the usual disconnect cleanup, so eviction and dropped connections leave the wait
+// list through the same path
+func (s *MatchSubscriber) closeEvictedSessions(eviction *QueueEviction) error {
+	evicted := make(map[uint64]struct{}, len(eviction.UserIDs))
+	for _, userID := range eviction.UserIDs {
+		evicted[userID] = struct{}{}
+	}
+	return s.m.BroadcastFilter(nil, func(sess *melody.Session) bool {
+		uid, exist := sess.Get(sessUidKey)
+		if !exist {
+			return false
+		}
+		if _, ok := evicted[uid.(uint64)]; !ok {
+			return false
+		}
+		if lastSeen, exist := sess.Get(sessLastSeenKey); exist && !lastSeen.(time.Time).Before(eviction.LastSeenBefore) {
+			return false
+		}
+		if err := sess.CloseWithMsg(melody.FormatCloseMessage(websocket.CloseNormalClosure, ErrIdleEvicted.Error())); err != nil {
+			slog.Error(err.Error())
+		}
+		return false
+	})
+}
@@ -15,12 +15,14 @@ import (
 )
 
 var (
-	matchPubSubTopic = "rc.match"
-	userWaitList     = "rc:userwait"
+	matchPubSubTopic         = "rc.match"
+	matchEvictionPubSubTopic = "rc.match.eviction"
+	userWaitList             = "rc:userwait"
+	userHeartbeats           = "rc:userwait:heartbeat"
 )
 
 type ChannelRepo interface {
-	CreateChannel(ctx context.Context) (uint64, string, error)
+	CreateChannel(ctx context.Context, ttl time.Duration, creatorID uint64) (uint64, string, error)
 }
 
 type UserRepo interface {
@@ -33,6 +35,9 @@ type MatchingRepo interface {
 	PopOrPushWaitList(ctx context.Context, userID uint64) (bool, uint64, error)
 	PublishMatchResult(ctx context.Context, result *MatchResult) error
 	RemoveFromWaitList(ctx context.Context, userID uint64) error
+	RefreshHeartbeat(ctx context.Context, userID uint64) error
+	RemoveIdleFromWaitList(ctx context.Context, lastSeenBefore time.Time) ([]uint64, error)
+	PublishQueueEviction(ctx context.Context, eviction *QueueEviction) error
 }
 
 type ChannelRepoImpl struct {
@@ -51,8 +56,13 @@ func NewChannelRepoImpl(chatConn *ChatClientConn) *ChannelRepoImpl {
 	}
 }
 
-func (repo *ChannelRepoImpl) CreateChannel(ctx context.Context) (uint64, string, error) {
-	res, err := repo.createChannel(ctx, &chatpb.CreateChannelRequest{})
+// CreateChannel creates a chat channel administered by the creator that expires after ttl,
+// or never expires if ttl is zero
+func (repo *ChannelRepoImpl) CreateChannel(ctx context.Context, ttl time.Duration, creatorID uint64) (uint64, string, error) {
+	res, err := repo.createChannel(ctx, &chatpb.CreateChannelRequest{
+		TtlSeconds: int64(ttl / time.Second),
+		CreatorId:  creatorID,
+	})
 	if err != nil {
 		return 0, "", err
 	}
@@ -139,21 +149,49 @@ func NewMatchingRepoImpl(r infra.RedisCache, p message.Publisher) *MatchingRepoI
 	return &MatchingRepoImpl{r, p}
 }
 func (repo *MatchingRepoImpl) PopOrPushWaitList(ctx context.Context, userID uint64) (bool, uint64, error) {
-	match, peerIDStr, err := repo.r.ZPopMinOrAddOne(ctx, userWaitList, float64(time.Now().Unix()), userID)
+	now := float64(time.Now().Unix())
+	match, peerIDStr, err := repo.r.ZPopMinOrAddOne(ctx, userWaitList, now, userID)
 	if err != nil {
 		return false, 0, err
 	}
 	if !match {
-		return false, 0, nil
+		return false, 0, repo.r.ZAdd(ctx, userHeartbeats, now, userID)
 	}
 	peerID, err := strconv.ParseUint(peerIDStr, 10, 64)
 	if err != nil {
 		return false, 0, err
 	}
+	if err := repo.r.ZRemOne(ctx, userHeartbeats, peerID); err != nil {
+		return false, 0, err
+	}
 	return true, peerID, nil
 }
 func (repo *MatchingRepoImpl) RemoveFromWaitList(ctx context.Context, userID uint64) error {
-	return repo.r.ZRemOne(ctx, userWaitList, userID)
+	if err := repo.r.ZRemOne(ctx, userWaitList, userID); err != nil {
+		return err
+	}
+	return repo.r.ZRemOne(ctx, userHeartbeats, userID)
+}
+func (repo *MatchingRepoImpl) RefreshHeartbeat(ctx context.Context, userID uint64) error {
+	return repo.r.ZAddIfExists(ctx, userHeartbeats, float64(time.Now().Unix()), userID)
+}
+func (repo *MatchingRepoImpl) RemoveIdleFromWaitList(ctx context.Context, lastSeenBefore time.Time) ([]uint64, error) {
+	members, err := repo.r.ZPopByScore(ctx, userHeartbeats, float64(lastSeenBefore.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	var userIDs []uint64
+	for _, member := range members {
+		userID, err := strconv.ParseUint(member, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if err := repo.r.ZRemOne(ctx, userWaitList, userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, nil
 }
 func (repo *MatchingRepoImpl) PublishMatchResult(ctx context.Context, result *MatchResult) error {
 	return repo.p.Publish(matchPubSubTopic, message.NewMessage(
@@ -161,3 +199,9 @@ func (repo *MatchingRepoImpl) PublishMatchResult(ctx context.Context, result *Ma
 		result.Encode(),
 	))
 }
+func (repo *MatchingRepoImpl) PublishQueueEviction(ctx context.Context, eviction *QueueEviction) error {
+	return repo.p.Publish(matchEvictionPubSubTopic, message.NewMessage(
+		watermill.NewUUID(),
+		eviction.Encode(),
+	))
+}
@@ -3,6 +3,9 @@ package match
 import (
 	"context"
 	"fmt"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/config"
 )
 
 type UserService interface {
@@ -15,6 +18,8 @@ type MatchingService interface {
 	Match(ctx context.Context, userID uint64) (*MatchResult, error)
 	BroadcastMatchResult(ctx context.Context, result *MatchResult) error
 	RemoveUserFromWaitList(ctx context.Context, userID uint64) error
+	KeepUserAlive(ctx context.Context, userID uint64) error
+	EvictIdleUsers(ctx context.Context, lastSeenBefore time.Time) ([]uint64, error)
 }
 
 type UserServiceImpl struct {
@@ -49,12 +54,17 @@ func (svc *UserServiceImpl) AddUserToChannel(ctx context.Context, channelID, use
 }
 
 type MatchingServiceImpl struct {
-	matchRepo MatchingRepo
-	chanRepo  ChannelRepo
+	matchRepo  MatchingRepo
+	chanRepo   ChannelRepo
+	channelTTL time.Duration
 }
 
-func NewMatchingServiceImpl(matchRepo MatchingRepo, chanRepo ChannelRepo) *MatchingServiceImpl {
-	return &MatchingServiceImpl{matchRepo, chanRepo}
+func NewMatchingServiceImpl(config *config.Config, matchRepo MatchingRepo, chanRepo ChannelRepo) *MatchingServiceImpl {
+	return &MatchingServiceImpl{
+		matchRepo:  matchRepo,
+		chanRepo:   chanRepo,
+		channelTTL: time.Duration(config.Match.Channel.TTLSecond) * time.Second,
+	}
 }
 func (svc *MatchingServiceImpl) Match(ctx context.Context, userID uint64) (*MatchResult, error) {
 	matched, peerID, err := svc.matchRepo.PopOrPushWaitList(ctx, userID)
@@ -62,7 +72,8 @@ func (svc *MatchingServiceImpl) Match(ctx context.Context, userID uint64) (*Matc
 		return nil, fmt.Errorf("error match user %d: %w", userID, err)
 	}
 	if matched {
-		newChannelID, accessToken, err := svc.chanRepo.CreateChannel(ctx)
+		// the user completing the match creates the channel
+		newChannelID, accessToken, err := svc.chanRepo.CreateChannel(ctx, svc.channelTTL, userID)
 		if err != nil {
 			return nil, fmt.Errorf("error create channel: %w", err)
 		}
@@ -90,3 +101,27 @@ func (svc *MatchingServiceImpl) RemoveUserFromWaitList(ctx context.Context, user
 	}
 	return nil
 }
+func (svc *MatchingServiceImpl) KeepUserAlive(ctx context.Context, userID uint64) error {
+	if err := svc.matchRepo.RefreshHeartbeat(ctx, userID); err != nil {
+		return fmt.Errorf("error refresh heartbeat of user %d: %w", userID, err)
+	}
+	return nil
+}
+func (svc *MatchingServiceImpl) EvictIdleUsers(ctx context.Context, lastSeenBefore time.Time) ([]uint64, error) {
+	userIDs, err := svc.matchRepo.RemoveIdleFromWaitList(ctx, lastSeenBefore)
+	if err != nil {
+		return nil, fmt.Errorf("error evict idle users: %w", err)
+	}
+	if len(userIDs) == 0 {
+		return userIDs, nil
+	}
+	// the users are already out of the wait list, so their websockets are closed on a best
+	// effort basis; a connection that is really gone is dropped by its missing pongs anyway
+	if err := svc.matchRepo.PublishQueueEviction(ctx, &QueueEviction{
+		UserIDs:        userIDs,
+		LastSeenBefore: lastSeenBefore,
+	}); err != nil {
+		return userIDs, fmt.Errorf("error publish eviction of idle users: %w", err)
+	}
+	return userIDs, nil
+}
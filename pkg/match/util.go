@@ -11,3 +11,11 @@ func DecodeToMatchResult(data []byte) (*MatchResult, error) {
 	}
 	return &result, nil
 }
+
+func DecodeToQueueEviction(data []byte) (*QueueEviction, error) {
+	var eviction QueueEviction
+	if err := json.Unmarshal(data, &eviction); err != nil {
+		return nil, err
+	}
+	return &eviction, nil
+}
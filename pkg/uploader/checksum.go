@@ -0,0 +1,84 @@
+package uploader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	contentSHA256Header = "X-Content-SHA256"
+	// checksumMetadataKey is returned on downloads as the x-amz-meta-sha256 header
+	checksumMetadataKey = "sha256"
+)
+
+var checksumMismatchesTotal = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: "uploader",
+	Name:      "checksum_mismatches_total",
+	Help:      "Total number of uploaded files rejected for not matching their declared SHA-256.",
+})
+
+// parseContentSHA256 parses the comma-separated hex SHA-256 checksums declared for n files,
+// in the order of the files. It returns nil if no checksum is declared
+func parseContentSHA256(header string, n int) ([]string, error) {
+	if strings.TrimSpace(header) == "" {
+		return nil, nil
+	}
+	checksums := strings.Split(header, ",")
+	if len(checksums) != n {
+		return nil, ErrInvalidChecksum
+	}
+	for i, checksum := range checksums {
+		checksum = strings.ToLower(strings.TrimSpace(checksum))
+		if b, err := hex.DecodeString(checksum); err != nil || len(b) != sha256.Size {
+			return nil, ErrInvalidChecksum
+		}
+		checksums[i] = checksum
+	}
+	return checksums, nil
+}
+
+// checksumReader hashes the bytes read through it and fails the read hitting the end of
+// the stream with ErrChecksumMismatch if they do not match the expected checksum, so that
+// an upload streaming from it is never completed
+type checksumReader struct {
+	r        io.Reader
+	h        hash.Hash
+	expected string
+	mismatch bool
+}
+
+func newChecksumReader(r io.Reader, expected string) *checksumReader {
+	return &checksumReader{
+		r:        r,
+		h:        sha256.New(),
+		expected: expected,
+	}
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(c.h.Sum(nil)) != c.expected {
+		c.mismatch = true
+		return n, ErrChecksumMismatch
+	}
+	return n, err
+}
+
+// Verify hashes whatever has not been read yet and checks the checksum
+func (c *checksumReader) Verify() error {
+	_, err := io.Copy(io.Discard, c)
+	return err
+}
+
+// Mismatched reports whether the stream was read to the end and did not match, as
+// opposed to failing for another reason
+func (c *checksumReader) Mismatched() bool {
+	return c.mismatch
+}
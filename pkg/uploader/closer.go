@@ -1,6 +1,8 @@
 package uploader
 
 import (
+	"errors"
+
 	"github.com/minghsu0107/go-random-chat/pkg/infra"
 )
 
@@ -10,6 +12,7 @@ func NewInfraCloser() *InfraCloser {
 	return &InfraCloser{}
 }
 
+// Close closes every connection even if closing one of them fails
 func (closer *InfraCloser) Close() error {
-	return infra.RedisClient.Close()
+	return errors.Join(UserConn.Conn.Close(), infra.RedisClient.Close())
 }
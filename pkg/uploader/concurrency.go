@@ -0,0 +1,149 @@
+package uploader
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+const userUploadsPrefix = "rc:useruploads"
+
+// a per-user label would be unbounded, so only the total is exported
+var inflightUploads = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "uploader",
+	Name:      "inflight_uploads",
+	Help:      "Number of uploads in flight on this instance that hold a per-user upload slot.",
+})
+
+var inflightS3Uploads = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "uploader",
+	Name:      "inflight_s3_uploads",
+	Help:      "Number of uploads to S3 in flight on this instance.",
+})
+
+// InstanceUploadLimiter caps the number of concurrent uploads to S3 on this instance, so
+// that many large uploads arriving at once cannot exhaust its memory. A zero value is unbounded
+type InstanceUploadLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+func NewInstanceUploadLimiter(config *config.Config) InstanceUploadLimiter {
+	var slots chan struct{}
+	if n := config.Uploader.Http.Server.MaxConcurrentUploads; n > 0 {
+		slots = make(chan struct{}, n)
+	}
+	return InstanceUploadLimiter{
+		slots:        slots,
+		queueTimeout: time.Duration(config.Uploader.Http.Server.UploadQueueTimeoutMillisecond) * time.Millisecond,
+	}
+}
+
+// Acquire takes an upload slot, waiting up to the queue timeout for one to free up. It
+// fails with ErrInstanceBusy once the timeout passes, or right away without a timeout
+func (l InstanceUploadLimiter) Acquire(ctx context.Context) error {
+	if l.slots == nil {
+		inflightS3Uploads.Inc()
+		return nil
+	}
+	select {
+	case l.slots <- struct{}{}:
+		inflightS3Uploads.Inc()
+		return nil
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		return ErrInstanceBusy
+	}
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		inflightS3Uploads.Inc()
+		return nil
+	case <-timer.C:
+		return ErrInstanceBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l InstanceUploadLimiter) Release() {
+	inflightS3Uploads.Dec()
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// UserUploadLimiter caps the number of concurrent uploads of a user across all channels
+type UserUploadLimiter struct {
+	rc            redis.UniversalClient
+	keyPrefix     string
+	maxConcurrent int64
+	slotTTL       time.Duration
+}
+
+var acquireUploadSlotScript = redis.NewScript(`
+local key = KEYS[1]
+local max_concurrent = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+local n = tonumber(redis.call("GET", key) or "0")
+if n >= max_concurrent then
+  return 0
+end
+redis.call("INCR", key)
+redis.call("EXPIRE", key, ttl)
+return 1
+`)
+
+var releaseUploadSlotScript = redis.NewScript(`
+local key = KEYS[1]
+local n = tonumber(redis.call("GET", key) or "0")
+if n <= 1 then
+  redis.call("DEL", key)
+  return 0
+end
+return redis.call("DECR", key)
+`)
+
+func NewUserUploadLimiter(rc redis.UniversalClient, config *config.Config) UserUploadLimiter {
+	return UserUploadLimiter{
+		rc:            rc,
+		keyPrefix:     config.Redis.KeyPrefix,
+		maxConcurrent: config.Uploader.Concurrency.MaxPerUser,
+		slotTTL:       time.Duration(config.Uploader.Concurrency.SlotTTLSecond) * time.Second,
+	}
+}
+
+// Enabled reports whether a per-user limit is configured
+func (l UserUploadLimiter) Enabled() bool {
+	return l.maxConcurrent > 0
+}
+
+// Acquire takes an upload slot of the user if one is free. Slots expire after the
+// configured ttl so that a crashed instance cannot leak them forever
+func (l UserUploadLimiter) Acquire(ctx context.Context, userID uint64) (bool, error) {
+	ok, err := acquireUploadSlotScript.Run(ctx, l.rc, []string{userUploadsKey(l.keyPrefix, userID)}, l.maxConcurrent, int64(l.slotTTL.Seconds())).Bool()
+	if err != nil {
+		return false, err
+	}
+	if ok {
+		inflightUploads.Inc()
+	}
+	return ok, nil
+}
+
+func (l UserUploadLimiter) Release(ctx context.Context, userID uint64) error {
+	inflightUploads.Dec()
+	return releaseUploadSlotScript.Run(ctx, l.rc, []string{userUploadsKey(l.keyPrefix, userID)}).Err()
+}
+
+func userUploadsKey(prefix string, userID uint64) string {
+	return common.PrefixRedisKey(prefix, common.Join(userUploadsPrefix, ":", strconv.FormatUint(userID, 10)))
+}
@@ -0,0 +1,115 @@
+package uploader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"mime/multipart"
+	"strconv"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// fileDigestPrefix is shared with the chat service, which drops the index on channel deletion
+const fileDigestPrefix = "rc:filedigests"
+
+// objectKeyFieldPrefix marks the reverse entries of the index, which map an object key
+// back to its digest so that deleting a file can drop its entry
+const objectKeyFieldPrefix = "key:"
+
+// UploadDedupIndex maps the sha256 digest of every file uploaded to a channel through
+// /upload/files to the object key it was stored under
+type UploadDedupIndex struct {
+	rc        redis.UniversalClient
+	keyPrefix string
+	enabled   bool
+}
+
+var forgetDigestScript = redis.NewScript(`
+local key = KEYS[1]
+local field = ARGV[1]
+local digest = redis.call("HGET", key, field)
+if not digest then
+  return 0
+end
+redis.call("HDEL", key, field, digest)
+return 1
+`)
+
+func NewUploadDedupIndex(rc redis.UniversalClient, config *config.Config) UploadDedupIndex {
+	return UploadDedupIndex{
+		rc:        rc,
+		keyPrefix: config.Redis.KeyPrefix,
+		enabled:   config.Uploader.Dedup.Enabled,
+	}
+}
+
+// Enabled reports whether uploads are deduplicated
+func (d UploadDedupIndex) Enabled() bool {
+	return d.enabled
+}
+
+// Lookup returns the object key stored for each digest in one round trip;
+// the key is empty for digests that are not stored yet
+func (d UploadDedupIndex) Lookup(ctx context.Context, channelID uint64, digests []string) ([]string, error) {
+	objectKeys := make([]string, len(digests))
+	if len(digests) == 0 {
+		return objectKeys, nil
+	}
+	vals, err := d.rc.HMGet(ctx, fileDigestKey(d.keyPrefix, channelID), digests...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, val := range vals {
+		if objectKey, ok := val.(string); ok {
+			objectKeys[i] = objectKey
+		}
+	}
+	return objectKeys, nil
+}
+
+// Record stores the object keys of newly uploaded files by digest in one round trip
+func (d UploadDedupIndex) Record(ctx context.Context, channelID uint64, objectKeys map[string]string) error {
+	if len(objectKeys) == 0 {
+		return nil
+	}
+	fields := make([]interface{}, 0, 4*len(objectKeys))
+	for digest, objectKey := range objectKeys {
+		fields = append(fields, digest, objectKey, objectKeyFieldPrefix+objectKey, digest)
+	}
+	return d.rc.HSet(ctx, fileDigestKey(d.keyPrefix, channelID), fields...).Err()
+}
+
+// Forget drops the entry of a deleted object
+func (d UploadDedupIndex) Forget(ctx context.Context, channelID uint64, objectKey string) error {
+	if !d.enabled {
+		return nil
+	}
+	return forgetDigestScript.Run(ctx, d.rc, []string{fileDigestKey(d.keyPrefix, channelID)}, objectKeyFieldPrefix+objectKey).Err()
+}
+
+func fileDigestKey(prefix string, channelID uint64) string {
+	return common.PrefixRedisKey(prefix, common.Join(fileDigestPrefix, ":", strconv.FormatUint(channelID, 10)))
+}
+
+// digestFiles returns the hex-encoded sha256 digest of each uploaded file
+func digestFiles(fileHeaders []*multipart.FileHeader) ([]string, error) {
+	digests := make([]string, len(fileHeaders))
+	for i, fileHeader := range fileHeaders {
+		f, err := fileHeader.Open()
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		digests[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	return digests, nil
+}
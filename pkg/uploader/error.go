@@ -1,10 +1,59 @@
 package uploader
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+)
 
 var (
-	ErrOpenFile       = errors.New("fail to open file")
-	ErrReceiveFile    = errors.New("no file is received")
-	ErrUploadFile     = errors.New("fail to upload file")
-	ErrTooManyUploads = errors.New("too many uploads")
+	ErrOpenFile              = errors.New("fail to open file")
+	ErrReceiveFile           = errors.New("no file is received")
+	ErrUploadFile            = errors.New("fail to upload file")
+	ErrTooManyUploads        = errors.New("too many uploads")
+	ErrTooManyPresigns       = errors.New("too many presigned url requests")
+	ErrS3Unavailable         = errors.New("storage is temporarily unavailable")
+	ErrS3Throttled           = errors.New("storage is busy, retry later")
+	ErrS3Timeout             = errors.New("storage timed out, retry later")
+	ErrInstanceBusy          = errors.New("too many uploads in progress, retry later")
+	ErrQuotaExceeded         = errors.New("channel storage quota exceeded")
+	ErrUserQuotaExceeded     = errors.New("user upload quota exceeded")
+	ErrFileNotFound          = errors.New("file not found")
+	ErrTooManyInFlight       = errors.New("too many concurrent uploads")
+	ErrAudioTooLong          = errors.New("audio exceeds max duration")
+	ErrTranscodeAudio        = errors.New("fail to transcode audio")
+	ErrUploadNotFound        = errors.New("upload not found")
+	ErrInvalidContentRange   = errors.New("invalid content range")
+	ErrPartTooLarge          = errors.New("part exceeds max part size")
+	ErrPartTooSmall          = errors.New("every part but the last must be at least 5 MiB")
+	ErrIncompleteUpload      = errors.New("uploaded parts do not cover the whole file")
+	ErrUnsupportedType       = errors.New("unsupported file content type")
+	ErrFileFlagged           = errors.New("file flagged by scanner")
+	ErrScanFile              = errors.New("fail to scan file")
+	ErrBatchTooLarge         = errors.New("too many keys in batch")
+	ErrBodyTooLarge          = errors.New("request body too large")
+	ErrInvalidChecksum       = errors.New("invalid file checksum")
+	ErrChecksumMismatch      = errors.New("file does not match its checksum")
+	ErrInvalidIdempotencyKey = errors.New("invalid idempotency key")
+	ErrIdempotencyKeyInUse   = errors.New("an upload with the same idempotency key is in progress")
 )
+
+var errorCodes = map[error]common.ErrorCode{
+	ErrTooManyUploads:      common.CodeRateLimited,
+	ErrTooManyPresigns:     common.CodeRateLimited,
+	ErrBatchTooLarge:       common.CodeLimitExceeded,
+	ErrBodyTooLarge:        common.CodePayloadTooLarge,
+	ErrTooManyInFlight:     common.CodeRateLimited,
+	ErrS3Unavailable:       common.CodeUnavailable,
+	ErrS3Throttled:         common.CodeUnavailable,
+	ErrS3Timeout:           common.CodeUnavailable,
+	ErrInstanceBusy:        common.CodeUnavailable,
+	ErrQuotaExceeded:       common.CodeQuotaExceeded,
+	ErrUserQuotaExceeded:   common.CodeQuotaExceeded,
+	ErrFileNotFound:        common.CodeFileNotFound,
+	ErrUploadNotFound:      common.CodeUploadNotFound,
+	ErrPartTooLarge:        common.CodePayloadTooLarge,
+	ErrUnsupportedType:     common.CodeUnsupportedMediaType,
+	ErrFileFlagged:         common.CodeFileFlagged,
+	ErrIdempotencyKeyInUse: common.CodeConflict,
+}
@@ -0,0 +1,24 @@
+package uploader
+
+import (
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/minghsu0107/go-random-chat/pkg/transport"
+	"google.golang.org/grpc"
+)
+
+var UserConn *UserClientConn
+
+type UserClientConn struct {
+	Conn *grpc.ClientConn
+}
+
+func NewUserClientConn(config *config.Config) (*UserClientConn, error) {
+	conn, err := transport.InitializeGrpcClient(config.Uploader.Grpc.Client.User.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	UserConn = &UserClientConn{
+		Conn: conn,
+	}
+	return UserConn, nil
+}
@@ -0,0 +1,68 @@
+package uploader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const readinessCheckTimeout = 2 * time.Second
+
+// readinessChecker checks the dependencies the uploader needs to serve traffic. Results
+// are cached for the configured ttl, and concurrent probes share a single check, so
+// frequent probes do not hammer Redis or S3
+type readinessChecker struct {
+	mu        sync.Mutex
+	rc        redis.UniversalClient
+	checkS3   func(ctx context.Context) error
+	ttl       time.Duration
+	checkedAt time.Time
+	failed    []string
+}
+
+func newReadinessChecker(rc redis.UniversalClient, checkS3 func(ctx context.Context) error, ttl time.Duration) *readinessChecker {
+	return &readinessChecker{
+		rc:      rc,
+		checkS3: checkS3,
+		ttl:     ttl,
+	}
+}
+
+// Check returns the names of the dependencies that are unreachable
+func (c *readinessChecker) Check(ctx context.Context) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.checkedAt.IsZero() && time.Since(c.checkedAt) < c.ttl {
+		return c.failed
+	}
+	ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+	defer cancel()
+
+	var (
+		wg              sync.WaitGroup
+		redisErr, s3Err error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		redisErr = c.rc.Ping(ctx).Err()
+	}()
+	go func() {
+		defer wg.Done()
+		s3Err = c.checkS3(ctx)
+	}()
+	wg.Wait()
+
+	failed := []string{}
+	if redisErr != nil {
+		failed = append(failed, "redis")
+	}
+	if s3Err != nil {
+		failed = append(failed, "s3")
+	}
+	c.failed = failed
+	c.checkedAt = time.Now()
+	return failed
+}
@@ -2,17 +2,20 @@ package uploader
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"log/slog"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/gin-gonic/gin"
 	"github.com/minghsu0107/go-random-chat/pkg/common"
 	"github.com/minghsu0107/go-random-chat/pkg/config"
@@ -34,6 +37,7 @@ func NewChannelUploadRateLimiter(rc redis.UniversalClient, config *config.Config
 	return ChannelUploadRateLimiter{
 		common.NewRateLimiter(
 			rc,
+			config.Redis.KeyPrefix,
 			config.Uploader.RateLimit.ChannelUpload.Rps,
 			config.Uploader.RateLimit.ChannelUpload.Burst,
 			time.Duration(config.Redis.ExpirationHour)*time.Hour,
@@ -41,27 +45,83 @@ func NewChannelUploadRateLimiter(rc redis.UniversalClient, config *config.Config
 	}
 }
 
+// PresignRateLimiter limits the presigned urls a user can generate
+type PresignRateLimiter struct {
+	*common.RateLimiter
+}
+
+func NewPresignRateLimiter(rc redis.UniversalClient, config *config.Config) PresignRateLimiter {
+	return PresignRateLimiter{
+		common.NewRateLimiter(
+			rc,
+			config.Redis.KeyPrefix,
+			config.Uploader.RateLimit.Presign.Rps,
+			config.Uploader.RateLimit.Presign.Burst,
+			time.Duration(config.Redis.ExpirationHour)*time.Hour,
+		),
+	}
+}
+
 type HttpServer struct {
 	name                     string
 	logger                   common.HttpLog
 	svr                      *gin.Engine
 	s3Endpoint               string
-	s3Bucket                 string
+	buckets                  *common.BucketRouter
 	maxMemory                int64
+	maxBodyByte              int64
+	channelMaxBodyByte       map[uint64]int64
 	uploader                 *manager.Uploader
+	instanceUploadLimiter    InstanceUploadLimiter
 	presigner                *Presigner
 	httpPort                 string
+	tlsConfig                config.TLSConfig
 	httpServer               *http.Server
 	channelUploadRateLimiter ChannelUploadRateLimiter
+	presignRateLimiter       PresignRateLimiter
+	presignBatchMaxSize      int
+	channelStorageQuota      ChannelStorageQuota
+	uploadDedupIndex         UploadDedupIndex
+	uploadIdempotencyStore   UploadIdempotencyStore
+	multipartUploadStore     MultipartUploadStore
+	maxPartSize              int64
+	multipartSweepPeriod     time.Duration
+	stopMultipartSweep       chan struct{}
+	storageReconcilePeriod   time.Duration
+	stopStorageReconcile     chan struct{}
+	userUploadLimiter        UserUploadLimiter
+	userUploadQuota          UserUploadQuota
+	userSvc                  UserService
+	audioTranscoder          *AudioTranscoder
+	uploadScanner            UploadScanner
+	thumbnailer              Thumbnailer
+	allowedContentTypes      []string
+	sse                      serverSideEncryption
+	keyTemplate              objectKeyTemplate
+	s3Backoff                *s3Backoff
 	serveSwag                bool
+
+	s3Client           *s3.Client
+	s3Available        atomic.Bool
+	s3RecheckEnabled   bool
+	s3RecheckPeriod    time.Duration
+	stopS3Recheck      chan struct{}
+	s3UploadTimeout    time.Duration
+	s3OperationTimeout time.Duration
+
+	readiness *readinessChecker
+	workers   common.Workers
+	inFlight  *common.InFlightRequests
 }
 
 func NewGinServer(name string, logger common.HttpLog, config *config.Config) *gin.Engine {
 	svr := gin.New()
 	svr.Use(gin.Recovery())
-	svr.Use(common.CorsMiddleware())
+	svr.Use(common.CorsMiddleware(config.Uploader.Http.Server.Cors))
 	svr.Use(common.LoggingMiddleware(logger))
-	svr.Use(common.LimitBodySize(config.Uploader.Http.Server.MaxBodyByte))
+	// per-channel overrides are enforced on file uploads once the channel is authenticated,
+	// so the global cap must admit the largest of them; BodySizeLimit caps the other routes
+	svr.Use(common.LimitBodySize(maxBodyByte(config)))
 
 	mdlw := prommiddleware.New(prommiddleware.Config{
 		Recorder: metrics.NewRecorder(metrics.Config{
@@ -72,40 +132,272 @@ func NewGinServer(name string, logger common.HttpLog, config *config.Config) *gi
 	return svr
 }
 
-func NewHttpServer(name string, logger common.HttpLog, config *config.Config, svr *gin.Engine, channelUploadRateLimiter ChannelUploadRateLimiter) *HttpServer {
+func maxBodyByte(config *config.Config) int64 {
+	maxBodyByte := config.Uploader.Http.Server.MaxBodyByte
+	for _, n := range config.Uploader.Http.Server.PerChannelMaxBodyByte {
+		if n > maxBodyByte {
+			maxBodyByte = n
+		}
+	}
+	return maxBodyByte
+}
+
+// parseChannelMaxBodyByte parses the per-channel body size overrides keyed by channel id
+func parseChannelMaxBodyByte(overrides map[string]int64) (map[uint64]int64, error) {
+	channelMaxBodyByte := make(map[uint64]int64, len(overrides))
+	for key, n := range overrides {
+		channelID, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid channel id %q in per-channel max body size: %w", key, err)
+		}
+		channelMaxBodyByte[channelID] = n
+	}
+	return channelMaxBodyByte, nil
+}
+
+func NewHttpServer(name string, logger common.HttpLog, config *config.Config, svr *gin.Engine, channelUploadRateLimiter ChannelUploadRateLimiter, presignRateLimiter PresignRateLimiter, channelStorageQuota ChannelStorageQuota, uploadDedupIndex UploadDedupIndex, uploadIdempotencyStore UploadIdempotencyStore, multipartUploadStore MultipartUploadStore, userUploadLimiter UserUploadLimiter, userUploadQuota UserUploadQuota, userSvc UserService, audioTranscoder *AudioTranscoder, uploadScanner UploadScanner, rc redis.UniversalClient) (*HttpServer, error) {
 	s3Endpoint := config.Uploader.S3.Endpoint
-	s3Bucket := config.Uploader.S3.Bucket
-	creds := credentials.NewStaticCredentialsProvider(config.Uploader.S3.AccessKey, config.Uploader.S3.SecretKey, "")
-	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
-		return aws.Endpoint{
-			PartitionID:       "aws",
-			URL:               s3Endpoint,
-			SigningRegion:     config.Uploader.S3.Region,
-			HostnameImmutable: true,
-		}, nil
-	})
-	awsConfig := aws.Config{
-		Credentials:                 creds,
-		EndpointResolverWithOptions: customResolver,
-		Region:                      config.Uploader.S3.Region,
-		RetryMaxAttempts:            3,
-	}
-	s3Client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
-	    o.UsePathStyle = true
-	})
+	s3Client := newS3Client(config)
+	sse, err := newServerSideEncryption(config)
+	if err != nil {
+		return nil, err
+	}
+	channelMaxBodyByte, err := parseChannelMaxBodyByte(config.Uploader.Http.Server.PerChannelMaxBodyByte)
+	if err != nil {
+		return nil, err
+	}
+	keyTemplate, err := newObjectKeyTemplate(config)
+	if err != nil {
+		return nil, err
+	}
+	presignClient, err := newPresignClient(config, s3Client)
+	if err != nil {
+		return nil, err
+	}
+	if config.Uploader.Multipart.Enabled {
+		// S3 rejects the completion of an upload with a smaller part before the last one
+		if config.Uploader.Multipart.MaxPartByte < minPartSize {
+			return nil, fmt.Errorf("uploader.multipart.maxPartByte %d must be at least %d", config.Uploader.Multipart.MaxPartByte, minPartSize)
+		}
+		if config.Uploader.Multipart.SweepIntervalSecond <= 0 {
+			logger.Warn("stale resumable uploads are not aborted: uploader.multipart.sweepIntervalSecond must be positive")
+		}
+	}
+	if channelStorageQuota.Enabled() && config.Uploader.Quota.ReconcileIntervalSecond <= 0 {
+		logger.Warn("unused presigned uploads are not given back to the channel quota: uploader.quota.reconcileIntervalSecond must be positive")
+	}
+	// a batch takes a presign per key at once, so a batch larger than the burst never passes
+	if batchMax, burst := config.Uploader.S3.PresignBatchMaxSize, config.Uploader.RateLimit.Presign.Burst; batchMax <= 0 || batchMax > burst {
+		return nil, fmt.Errorf("uploader.s3.presignBatchMaxSize %d must be positive and at most uploader.rateLimit.presign.burst %d", batchMax, burst)
+	}
 
-	return &HttpServer{
+	httpServer := &HttpServer{
 		name:                     name,
 		logger:                   logger,
 		svr:                      svr,
 		s3Endpoint:               s3Endpoint,
-		s3Bucket:                 s3Bucket,
+		buckets:                  common.NewBucketRouter(config.Uploader.S3.Bucket, config.Uploader.S3.BucketRouting),
 		maxMemory:                config.Uploader.Http.Server.MaxMemoryByte,
+		maxBodyByte:              config.Uploader.Http.Server.MaxBodyByte,
+		channelMaxBodyByte:       channelMaxBodyByte,
 		uploader:                 manager.NewUploader(s3Client),
-		presigner:                &Presigner{s3.NewPresignClient(s3Client), config.Uploader.S3.PresignLifetimeSecond},
+		instanceUploadLimiter:    NewInstanceUploadLimiter(config),
+		presignBatchMaxSize:      config.Uploader.S3.PresignBatchMaxSize,
+		presigner:                NewPresigner(presignClient, newPostPolicySigner(config), config.Uploader.S3.PresignLifetimeSecond, config.Uploader.S3.PresignClockSkewSecond, sse),
 		httpPort:                 config.Uploader.Http.Server.Port,
+		tlsConfig:                config.Uploader.Http.Server.TLS,
 		channelUploadRateLimiter: channelUploadRateLimiter,
+		presignRateLimiter:       presignRateLimiter,
+		channelStorageQuota:      channelStorageQuota,
+		uploadDedupIndex:         uploadDedupIndex,
+		uploadIdempotencyStore:   uploadIdempotencyStore,
+		multipartUploadStore:     multipartUploadStore,
+		maxPartSize:              config.Uploader.Multipart.MaxPartByte,
+		multipartSweepPeriod:     time.Duration(config.Uploader.Multipart.SweepIntervalSecond) * time.Second,
+		stopMultipartSweep:       make(chan struct{}),
+		storageReconcilePeriod:   time.Duration(config.Uploader.Quota.ReconcileIntervalSecond) * time.Second,
+		stopStorageReconcile:     make(chan struct{}),
+		userUploadLimiter:        userUploadLimiter,
+		userUploadQuota:          userUploadQuota,
+		userSvc:                  userSvc,
+		audioTranscoder:          audioTranscoder,
+		uploadScanner:            uploadScanner,
+		thumbnailer:              NewThumbnailer(config),
+		allowedContentTypes:      parseContentTypes(config.Uploader.S3.AllowedContentTypes),
 		serveSwag:                config.Uploader.Http.Server.Swag,
+		s3Client:                 s3Client,
+		sse:                      sse,
+		keyTemplate:              keyTemplate,
+		s3Backoff:                newS3Backoff(config.Uploader.S3.Throttle.RetryAfterBaseSecond, config.Uploader.S3.Throttle.RetryAfterMaxSecond),
+		s3RecheckEnabled:         config.Uploader.S3.ConnectivityCheck.Enabled,
+		s3RecheckPeriod:          time.Duration(config.Uploader.S3.ConnectivityCheck.RecheckIntervalSecond) * time.Second,
+		stopS3Recheck:            make(chan struct{}),
+		s3UploadTimeout:          time.Duration(config.Uploader.S3.UploadTimeoutSecond) * time.Second,
+		s3OperationTimeout:       time.Duration(config.Uploader.S3.OperationTimeoutSecond) * time.Second,
+		inFlight:                 common.NewInFlightRequests(),
+	}
+	svr.Use(httpServer.inFlight.Middleware())
+	httpServer.readiness = newReadinessChecker(rc, httpServer.checkS3, time.Duration(config.Uploader.Http.Server.ReadinessCacheSecond)*time.Second)
+	httpServer.s3Available.Store(true)
+	if config.Uploader.S3.ConnectivityCheck.Enabled {
+		if err := httpServer.checkS3(context.Background()); err != nil {
+			if config.Uploader.S3.ConnectivityCheck.FailFast {
+				return nil, fmt.Errorf("error connect to s3: %w", err)
+			}
+			logger.Warn("s3 unreachable, starting in degraded mode", slog.String("err", err.Error()))
+			httpServer.s3Available.Store(false)
+		}
+		if httpServer.s3RecheckPeriod <= 0 {
+			logger.Warn("s3 availability is not rechecked: uploader.s3.connectivityCheck.recheckIntervalSecond must be positive")
+		}
+	}
+	// a misconfigured proxy in front of the public endpoint breaks every presigned url,
+	// so it is checked even if the connectivity check is disabled
+	if config.Uploader.S3.PublicEndpoint != "" && httpServer.s3Available.Load() {
+		if err := httpServer.checkPublicPresign(context.Background()); err != nil {
+			if config.Uploader.S3.ConnectivityCheck.Enabled && config.Uploader.S3.ConnectivityCheck.FailFast {
+				return nil, fmt.Errorf("error verify presigned url through s3 public endpoint: %w", err)
+			}
+			logger.Warn("presigned urls may not verify through s3 public endpoint", slog.String("err", err.Error()))
+		}
+	}
+	return httpServer, nil
+}
+
+const s3CheckTimeout = 5 * time.Second
+
+func (r *HttpServer) checkS3(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s3CheckTimeout)
+	defer cancel()
+	for _, bucket := range r.buckets.Buckets() {
+		if _, err := r.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{
+			Bucket: aws.String(bucket),
+		}); err != nil {
+			return fmt.Errorf("error connect to bucket %s: %w", bucket, err)
+		}
+	}
+	return nil
+}
+
+// recheckS3 polls the bucket for the lifetime of the server, entering degraded mode when
+// it becomes unreachable and leaving it once it is reachable again
+func (r *HttpServer) recheckS3() {
+	ticker := time.NewTicker(r.s3RecheckPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.checkS3(context.Background()); err != nil {
+				if r.s3Available.Swap(false) {
+					r.logger.Warn("s3 unreachable, entering degraded mode", slog.String("err", err.Error()))
+				} else {
+					r.logger.Warn("s3 still unreachable", slog.String("err", err.Error()))
+				}
+				continue
+			}
+			if !r.s3Available.Swap(true) {
+				r.logger.Info("s3 reachable, leaving degraded mode")
+			}
+		case <-r.stopS3Recheck:
+			return
+		}
+	}
+}
+
+const multipartSweepBatch = 100
+
+// sweepExpiredMultipartUploads aborts resumable uploads without progress for the session ttl
+func (r *HttpServer) sweepExpiredMultipartUploads() {
+	ticker := time.NewTicker(r.multipartSweepPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !r.s3Available.Load() {
+				continue
+			}
+			sessions, err := r.multipartUploadStore.PopExpired(context.Background(), time.Now(), multipartSweepBatch)
+			if err != nil {
+				r.logger.Error("error popping expired multipart uploads: " + err.Error())
+				continue
+			}
+			for _, sess := range sessions {
+				r.abortMultipartUpload(sess)
+			}
+			if len(sessions) > 0 {
+				r.logger.Info("aborted expired multipart uploads", slog.Int("count", len(sessions)))
+			}
+		case <-r.stopMultipartSweep:
+			return
+		}
+	}
+}
+
+const storageReconcileBatch = 100
+
+// reconcileStorageHolds gives the reservations of presigned uploads that never reached S3
+// back to their channels
+func (r *HttpServer) reconcileStorageHolds() {
+	ticker := time.NewTicker(r.storageReconcilePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !r.s3Available.Load() {
+				continue
+			}
+			holds, err := r.channelStorageQuota.PopDueHolds(context.Background(), time.Now(), storageReconcileBatch)
+			if err != nil {
+				r.logger.Error("error popping due storage holds: " + err.Error())
+				continue
+			}
+			released := 0
+			for _, hold := range holds {
+				if r.reconcileStorageHold(hold) {
+					released++
+				}
+			}
+			if released > 0 {
+				r.logger.Info("released storage of unused presigned uploads", slog.Int("count", released))
+			}
+		case <-r.stopStorageReconcile:
+			return
+		}
+	}
+}
+
+// reconcileStorageHold releases the reservation of a presigned upload whose object does not
+// exist and reports whether it did. A hold that cannot be checked is retried later
+func (r *HttpServer) reconcileStorageHold(hold StorageHold) bool {
+	ctx, cancel := withS3Timeout(context.Background(), r.s3OperationTimeout)
+	defer cancel()
+	_, err := r.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(r.buckets.Bucket(hold.ObjectKey)),
+		Key:    aws.String(hold.ObjectKey),
+	})
+	if err == nil {
+		return false
+	}
+	var notFound *types.NotFound
+	if !errors.As(err, &notFound) {
+		r.logger.Error("error checking presigned upload: " + err.Error())
+		if err := r.channelStorageQuota.Hold(context.Background(), hold, time.Now().Add(r.storageReconcilePeriod)); err != nil {
+			r.logger.Error("error rescheduling storage hold: " + err.Error())
+		}
+		return false
+	}
+	r.releaseStorage(hold.ChannelID, hold.Size)
+	return true
+}
+
+func (r *HttpServer) RequireS3() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !r.s3Available.Load() {
+			response(c, http.StatusServiceUnavailable, ErrS3Unavailable)
+			c.Abort()
+			return
+		}
+		c.Next()
 	}
 }
 
@@ -116,9 +408,12 @@ func (r *HttpServer) ChannelUploadRateLimit() gin.HandlerFunc {
 			c.AbortWithStatus(http.StatusUnauthorized)
 			return
 		}
-		allow, err := r.channelUploadRateLimiter.Allow(c.Request.Context(), strconv.FormatUint(channelID, 10))
+		ctx, span := startSpan(c.Request.Context(), "ratelimit.ChannelUpload")
+		allow, err := r.channelUploadRateLimiter.Allow(ctx, strconv.FormatUint(channelID, 10))
+		span.SetAttributes(allowedAttr.Bool(allow))
+		endSpan(span, err)
 		if err != nil {
-			r.logger.Error(err.Error())
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
 			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
@@ -130,6 +425,195 @@ func (r *HttpServer) ChannelUploadRateLimit() gin.HandlerFunc {
 	}
 }
 
+// uploadFilesPath is the route of file uploads, the only route per-channel body size
+// overrides apply to
+const uploadFilesPath = "/api/uploader/upload/files"
+
+// BodySizeLimit caps the request body at the global max body size on every route but the
+// file upload, whose body is capped by ChannelBodySizeLimit instead
+func (r *HttpServer) BodySizeLimit() gin.HandlerFunc {
+	limit := common.LimitBodySize(r.maxBodyByte)
+	return func(c *gin.Context) {
+		if c.FullPath() == uploadFilesPath {
+			c.Next()
+			return
+		}
+		limit(c)
+	}
+}
+
+// ChannelBodySizeLimit caps the request body at the max body size of the channel, which
+// falls back to the global max body size if the channel has no override
+func (r *HttpServer) ChannelBodySizeLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+		if !ok {
+			response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+			c.Abort()
+			return
+		}
+		limit := r.channelBodyLimit(channelID)
+		if c.Request.ContentLength > limit {
+			response(c, http.StatusRequestEntityTooLarge, ErrBodyTooLarge)
+			c.Abort()
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// channelBodyLimit returns the max body size of the channel
+func (r *HttpServer) channelBodyLimit(channelID uint64) int64 {
+	if limit, ok := r.channelMaxBodyByte[channelID]; ok {
+		return limit
+	}
+	return r.maxBodyByte
+}
+
+func (r *HttpServer) PresignRateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !r.allowPresigns(c, 1) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// allowPresigns takes n presigns from the rate limit of the user, or of the channel if the
+// request has no session cookie, aborting the request and returning false if over the limit
+func (r *HttpServer) allowPresigns(c *gin.Context, n int) bool {
+	var key string
+	if userID, ok := c.Request.Context().Value(common.UserKey).(uint64); ok {
+		key = common.Join("presign:", strconv.FormatUint(userID, 10))
+	} else if channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64); ok {
+		key = common.Join("presign:chan:", strconv.FormatUint(channelID, 10))
+	} else {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		c.Abort()
+		return false
+	}
+	ctx, span := startSpan(c.Request.Context(), "ratelimit.Presign", costAttr.Int(n))
+	allow, err := r.presignRateLimiter.AllowN(ctx, key, time.Now(), n)
+	span.SetAttributes(allowedAttr.Bool(allow))
+	endSpan(span, err)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		c.Abort()
+		return false
+	}
+	if !allow {
+		response(c, http.StatusTooManyRequests, ErrTooManyPresigns)
+		c.Abort()
+		return false
+	}
+	return true
+}
+
+func (r *HttpServer) CookieAuth() gin.HandlerFunc {
+	return r.cookieAuth(true)
+}
+
+// OptionalCookieAuth resolves the user of the session cookie if the request sends one, so
+// that clients authenticating with the channel access token only keep working
+func (r *HttpServer) OptionalCookieAuth() gin.HandlerFunc {
+	return r.cookieAuth(false)
+}
+
+func (r *HttpServer) cookieAuth(required bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		sid, err := common.GetCookie(c, common.SessionIdCookieName)
+		if err != nil && !required {
+			c.Next()
+			return
+		}
+		if err != nil {
+			response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+			c.Abort()
+			return
+		}
+		userID, err := r.userSvc.GetUserIDBySession(c.Request.Context(), sid)
+		if err != nil {
+			response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+			c.Abort()
+			return
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), common.UserKey, userID))
+		c.Next()
+	}
+}
+
+// UserUploadConcurrencyLimit holds a per-user upload slot for the lifetime of the request.
+// The slot is released once the handler returns, whether the upload succeeded, failed,
+// panicked or was cancelled by the client
+func (r *HttpServer) UserUploadConcurrencyLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := c.Request.Context().Value(common.UserKey).(uint64)
+		if !ok {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		acquired, err := r.userUploadLimiter.Acquire(c.Request.Context(), userID)
+		if err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if !acquired {
+			response(c, http.StatusTooManyRequests, ErrTooManyInFlight)
+			c.Abort()
+			return
+		}
+		defer func() {
+			if err := r.userUploadLimiter.Release(context.Background(), userID); err != nil {
+				r.logger.ErrorContext(c.Request.Context(), err.Error())
+			}
+		}()
+		c.Next()
+	}
+}
+
+// UserUploadQuotaLimit rejects uploads whose Content-Length alone exceeds what is left of
+// the upload window of the user, before the body is read. The exact file sizes are
+// charged by the handler
+func (r *HttpServer) UserUploadQuotaLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+		if !ok {
+			response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+			c.Abort()
+			return
+		}
+		userID, ok := c.Request.Context().Value(common.UserKey).(uint64)
+		if !ok {
+			response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+			c.Abort()
+			return
+		}
+		if c.Request.ContentLength <= 0 {
+			c.Next()
+			return
+		}
+		ctx, span := startSpan(c.Request.Context(), "ratelimit.UserUploadQuota", sizeAttr.Int64(c.Request.ContentLength))
+		allow, err := r.userUploadQuota.Allow(ctx, channelID, userID, c.Request.ContentLength)
+		span.SetAttributes(allowedAttr.Bool(allow))
+		endSpan(span, err)
+		if err != nil {
+			r.logger.ErrorContext(c.Request.Context(), err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			c.Abort()
+			return
+		}
+		if !allow {
+			response(c, http.StatusRequestEntityTooLarge, ErrUserQuotaExceeded)
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
 // @title           Uploader Service Swagger API
 // @version         2.0
 // @description     Uploader service API
@@ -140,18 +624,66 @@ func (r *HttpServer) ChannelUploadRateLimit() gin.HandlerFunc {
 // @BasePath  /api
 func (r *HttpServer) RegisterRoutes() {
 	uploaderGroup := r.svr.Group("/api/uploader")
+	if len(r.channelMaxBodyByte) > 0 {
+		uploaderGroup.Use(r.BodySizeLimit())
+	}
 	{
+		uploaderGroup.GET("/healthz", r.Healthz)
+		uploaderGroup.GET("/readyz", r.Readyz)
 		uploadGroup := uploaderGroup.Group("/upload")
 		uploadGroup.Use(common.JWTForwardAuth())
+		uploadGroup.Use(r.RequireS3())
 		uploadGroup.Use(r.ChannelUploadRateLimit())
 		{
-			uploadGroup.POST("/files", r.UploadFiles)
-			uploadGroup.GET("/presigned", r.GetPresignedUpload)
+			var fileHandlers []gin.HandlerFunc
+			if len(r.channelMaxBodyByte) > 0 {
+				fileHandlers = append(fileHandlers, r.ChannelBodySizeLimit())
+			}
+			// idempotency keys are scoped to the user, and object keys may contain the user
+			if r.userUploadLimiter.Enabled() || r.userUploadQuota.Enabled() || r.uploadIdempotencyStore.Enabled() || r.keyTemplate.UsesUser() {
+				fileHandlers = append(fileHandlers, r.CookieAuth())
+			}
+			if r.userUploadQuota.Enabled() {
+				fileHandlers = append(fileHandlers, r.UserUploadQuotaLimit())
+			}
+			if r.userUploadLimiter.Enabled() {
+				fileHandlers = append(fileHandlers, r.UserUploadConcurrencyLimit())
+			}
+			uploadGroup.POST("/files", append(fileHandlers, r.UploadFiles)...)
+			// presigned object keys may contain the user
+			presignAuth := r.OptionalCookieAuth()
+			if r.keyTemplate.UsesUser() {
+				presignAuth = r.CookieAuth()
+			}
+			uploadGroup.GET("/presigned", presignAuth, r.PresignRateLimit(), r.GetPresignedUpload)
+			uploadGroup.GET("/presigned/post", presignAuth, r.PresignRateLimit(), r.GetPresignedPost)
+			if r.multipartUploadStore.Enabled() {
+				multipartGroup := uploadGroup.Group("/multipart")
+				multipartGroup.Use(r.CookieAuth())
+				{
+					multipartGroup.POST("/init", r.InitMultipartUpload)
+					if r.userUploadLimiter.Enabled() {
+						multipartGroup.PUT("/part", r.UserUploadConcurrencyLimit(), r.UploadPart)
+					} else {
+						multipartGroup.PUT("/part", r.UploadPart)
+					}
+					multipartGroup.POST("/complete", r.CompleteMultipartUpload)
+					multipartGroup.GET("", r.GetMultipartUpload)
+					multipartGroup.DELETE("", r.AbortMultipartUpload)
+				}
+			}
+		}
+		filesGroup := uploaderGroup.Group("/files")
+		filesGroup.Use(common.JWTForwardAuth())
+		filesGroup.Use(r.RequireS3())
+		{
+			filesGroup.DELETE("", r.DeleteFile)
 		}
 		downloadGroup := uploaderGroup.Group("/download")
 		downloadGroup.Use(common.JWTForwardAuth())
 		{
-			downloadGroup.GET("/presigned", r.GetPresignedDownload)
+			downloadGroup.GET("/presigned", r.OptionalCookieAuth(), r.PresignRateLimit(), r.GetPresignedDownload)
+			downloadGroup.POST("/presigned/batch", r.OptionalCookieAuth(), r.GetPresignedDownloadBatch)
 		}
 	}
 	if r.serveSwag {
@@ -166,21 +698,37 @@ func (r *HttpServer) Run() {
 			Addr:    addr,
 			Handler: common.NewOtelHttpHandler(r.svr, r.name+"_http"),
 		}
-		r.logger.Info("http server listening", slog.String("addr", addr))
-		err := r.httpServer.ListenAndServe()
+		r.logger.Info("http server listening", slog.String("addr", addr), slog.Bool("tls", r.tlsConfig.Enabled))
+		err := common.ListenAndServe(r.httpServer, r.tlsConfig)
 		if err != nil && err != http.ErrServerClosed {
 			r.logger.Error(err.Error())
 			os.Exit(1)
 		}
 	}()
+	if r.s3RecheckEnabled && r.s3RecheckPeriod > 0 {
+		r.workers.Go(r.recheckS3)
+	}
+	if r.multipartUploadStore.Enabled() && r.multipartSweepPeriod > 0 {
+		r.workers.Go(r.sweepExpiredMultipartUploads)
+	}
+	if r.channelStorageQuota.Enabled() && r.storageReconcilePeriod > 0 {
+		r.workers.Go(r.reconcileStorageHolds)
+	}
 }
 func (r *HttpServer) GracefulStop(ctx context.Context) error {
-	return r.httpServer.Shutdown(ctx)
+	close(r.stopS3Recheck)
+	close(r.stopMultipartSweep)
+	close(r.stopStorageReconcile)
+	err := common.Shutdown(ctx, r.httpServer, r.inFlight, r.logger.Logger)
+	return errors.Join(err, r.workers.Wait(ctx))
 }
 
 func response(c *gin.Context, httpCode int, err error) {
-	message := err.Error()
-	c.JSON(httpCode, common.ErrResponse{
-		Message: message,
-	})
+	c.JSON(httpCode, common.NewRequestErrResponse(c.Request.Context(), err, httpCode, errorCodes))
+}
+
+func responseWithDetails(c *gin.Context, httpCode int, err error, details map[string]interface{}) {
+	resp := common.NewRequestErrResponse(c.Request.Context(), err, httpCode, errorCodes)
+	resp.Details = details
+	c.JSON(httpCode, resp)
 }
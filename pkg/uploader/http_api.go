@@ -1,11 +1,17 @@
 package uploader
 
 import (
+	"bytes"
 	"context"
 	b64 "encoding/base64"
+	"encoding/json"
+	"errors"
 	"io"
+	"mime"
 	"net/http"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
@@ -14,17 +20,66 @@ import (
 	"github.com/minghsu0107/go-random-chat/pkg/common"
 )
 
+// @Summary Liveness probe
+// @Description Report that the uploader process is alive; dependencies are not checked
+// @Tags uploader
+// @Produce json
+// @Success 200 {object} common.SuccessMessage
+// @Router /uploader/healthz [get]
+func (r *HttpServer) Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, common.OkMsg)
+}
+
+// @Summary Readiness probe
+// @Description Check that Redis and the S3 bucket are reachable. Results are cached briefly, so frequent probes do not hit the dependencies every time
+// @Tags uploader
+// @Produce json
+// @Success 200 {object} ReadinessPresenter
+// @Failure 503 {object} ReadinessPresenter
+// @Router /uploader/readyz [get]
+func (r *HttpServer) Readyz(c *gin.Context) {
+	failed := r.readiness.Check(c.Request.Context())
+	if len(failed) > 0 {
+		c.JSON(http.StatusServiceUnavailable, &ReadinessPresenter{
+			Status: "unavailable",
+			Failed: failed,
+		})
+		return
+	}
+	c.JSON(http.StatusOK, &ReadinessPresenter{
+		Status: "ok",
+		Failed: failed,
+	})
+}
+
+// statusClientClosedRequest answers requests the client cancelled; nobody reads it, but it
+// keeps them apart from bad requests in logs and metrics
+const statusClientClosedRequest = 499
+
 // @Summary Upload files (deprecated)
-// @Description Upload files to S3 bucket (deprecated; use presigned urls instead)
+// @Description Upload files to S3 bucket (deprecated; use presigned urls instead). The content type of each file is sniffed from its content, checked against the allowlist and stored as the object content type, even if the declared type differs. Audio in formats that are not web-friendly is transcoded to opus/webm when enabled. When scanning is enabled, files flagged by the scanner are rejected with the reason. When dedup is enabled, files already stored in the channel are not uploaded again and are reported with the existing object key. Files that do not match their declared SHA-256 are rejected with 422 and not stored; the SHA-256 of stored files is returned on download in the x-amz-meta-sha256 header, except for transcoded audio
 // @Tags uploader
 // @Accept mpfd
 // @param files formData []file true "files to upload" collectionFormat(multi)
 // @Produce json
 // @param Authorization header string true "channel authorization"
+// @Param Cookie header string false "session id cookie; required when the per-user concurrency limit, upload quota, idempotency keys or a key template with {user} are enabled"
+// @Param X-Content-SHA256 header string false "comma-separated hex SHA-256 checksums of the files, in the order of the files"
+// @Param Idempotency-Key header string false "key of the upload; a retry with the same key returns the files stored by the first attempt"
+// @Success 200 {object} UploadedFilesPresenter "files stored by an earlier upload with the same idempotency key"
 // @Success 201 {object} UploadedFilesPresenter
 // @Failure 400 {object} common.ErrResponse
 // @Failure 401 {object} common.ErrResponse
+// @Failure 409 {object} common.ErrResponse
+// @Failure 413 {object} common.ErrResponse
+// @Failure 415 {object} common.ErrResponse
+// @Failure 422 {object} common.ErrResponse
+// @Failure 429 {object} common.ErrResponse
 // @Failure 500 {object} common.ErrResponse
+// @Failure 503 {object} common.ErrResponse
+// @Failure 504 {object} common.ErrResponse
+// @Header 201,413 {string} X-Channel-Storage-Usage "bytes charged to the channel, including this upload if it was accepted"
+// @Header 503 {string} Retry-After "seconds to wait before retrying while storage is throttling or the instance is at its upload cap"
 // @Router /uploader/upload/files [post]
 func (r *HttpServer) UploadFiles(c *gin.Context) {
 	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
@@ -32,54 +87,471 @@ func (r *HttpServer) UploadFiles(c *gin.Context) {
 		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
 		return
 	}
+	// the user is only known if a feature that needs it put the upload behind the session cookie
+	uploaderID, _ := c.Request.Context().Value(common.UserKey).(uint64)
+	idempotencyKey, ok := r.claimIdempotencyKey(c, channelID)
+	if !ok {
+		return
+	}
+	if idempotencyKey != "" {
+		// the claim is kept by a stored response and released otherwise
+		defer func() {
+			if idempotencyKey == "" {
+				return
+			}
+			userID := c.Request.Context().Value(common.UserKey).(uint64)
+			if err := r.uploadIdempotencyStore.Release(context.Background(), userID, channelID, idempotencyKey); err != nil {
+				r.logger.ErrorContext(c.Request.Context(), "error releasing idempotency key: "+err.Error())
+			}
+		}()
+	}
+	// parsing buffers the form in memory and on disk, so the slot of the instance upload cap
+	// is taken before the body is read and held until the files are stored
+	if err := r.instanceUploadLimiter.Acquire(c.Request.Context()); err != nil {
+		r.responseS3Error(c, "", "Upload", err)
+		return
+	}
+	defer r.instanceUploadLimiter.Release()
 	if err := c.Request.ParseMultipartForm(r.maxMemory); err != nil {
-		r.logger.Error("error parsing multipart form into memory: " + err.Error())
+		r.logger.ErrorContext(c.Request.Context(), "error parsing multipart form into memory: "+err.Error())
 		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
 	form, err := c.MultipartForm()
 	if err != nil {
-		r.logger.Error("parse multipart form error: " + err.Error())
+		r.logger.ErrorContext(c.Request.Context(), "parse multipart form error: "+err.Error())
 		response(c, http.StatusBadRequest, ErrReceiveFile)
 		return
 	}
 	fileHeaders := form.File["files"]
+	checksums, err := parseContentSHA256(c.GetHeader(contentSHA256Header), len(fileHeaders))
+	if err != nil {
+		response(c, http.StatusBadRequest, err)
+		return
+	}
+
+	contentTypes := make([]string, len(fileHeaders))
+	for i, fileHeader := range fileHeaders {
+		contentType, err := sniffContentType(fileHeader)
+		if err != nil {
+			r.logger.ErrorContext(c.Request.Context(), "error sniffing multipart file content type: "+err.Error())
+			response(c, http.StatusBadRequest, ErrOpenFile)
+			return
+		}
+		if !isContentTypeAllowed(contentType, r.allowedContentTypes) {
+			response(c, http.StatusUnsupportedMediaType, ErrUnsupportedType)
+			return
+		}
+		contentTypes[i] = contentType
+	}
+
+	// object keys of files already stored in the channel, by file index
+	existingKeys := make([]string, len(fileHeaders))
+	// index of an earlier file of the batch with the same content, or -1
+	duplicateOf := make([]int, len(fileHeaders))
+	var digests []string
+	if r.uploadDedupIndex.Enabled() {
+		if digests, err = digestFiles(fileHeaders); err != nil {
+			r.logger.ErrorContext(c.Request.Context(), "error hashing multipart file: "+err.Error())
+			response(c, http.StatusBadRequest, ErrOpenFile)
+			return
+		}
+		// the digests are the checksums of the received files, so they are verified up front
+		for i := range checksums {
+			if checksums[i] != digests[i] {
+				checksumMismatchesTotal.Inc()
+				response(c, http.StatusUnprocessableEntity, ErrChecksumMismatch)
+				return
+			}
+		}
+		checksums = nil
+		if existingKeys, err = r.uploadDedupIndex.Lookup(c.Request.Context(), channelID, digests); err != nil {
+			r.logger.ErrorContext(c.Request.Context(), "error looking up file digests: "+err.Error())
+			response(c, http.StatusInternalServerError, common.ErrServer)
+			return
+		}
+	}
+	firstIndex := make(map[string]int)
+	var totalSize int64
+	for i, fileHeader := range fileHeaders {
+		duplicateOf[i] = -1
+		if existingKeys[i] != "" {
+			continue
+		}
+		if digests != nil {
+			if j, ok := firstIndex[digests[i]]; ok {
+				duplicateOf[i] = j
+				continue
+			}
+			firstIndex[digests[i]] = i
+		}
+		totalSize += fileHeader.Size
+	}
+	if !r.reserveStorage(c, channelID, totalSize) {
+		return
+	}
+	userReservation, ok := r.reserveUserUpload(c, channelID, totalSize)
+	if !ok {
+		r.releaseStorage(channelID, totalSize)
+		return
+	}
 
 	var uploadedFiles []UploadedFilePresenter
+	// bytes reserved for files that are not stored yet
+	pendingSize := totalSize
+	// uploaded bytes charged to the user for files that are not stored yet; unlike the
+	// channel quota, this does not follow the size change of transcoding
+	userPendingSize := totalSize
+	abort := func() {
+		r.releaseStorage(channelID, pendingSize)
+		if err := r.userUploadQuota.Release(context.Background(), userReservation, userPendingSize); err != nil {
+			r.logger.ErrorContext(c.Request.Context(), "error releasing user upload quota: "+err.Error())
+		}
+	}
+
+	storedKeys := make(map[string]string)
+	// a hung S3 connection must not hold the request, retries included
+	s3Ctx, cancel := withS3Timeout(c.Request.Context(), r.s3UploadTimeout)
+	defer cancel()
+	// the transcoded audio of the file being stored, removed once the file is stored
+	var audio *TranscodedAudio
+	defer func() {
+		if audio != nil {
+			audio.Close()
+		}
+	}()
 
-	for _, fileHeader := range fileHeaders {
+	for i, fileHeader := range fileHeaders {
+		if existingKeys[i] != "" || duplicateOf[i] >= 0 {
+			objectKey := existingKeys[i]
+			if objectKey == "" {
+				objectKey = uploadedFiles[duplicateOf[i]].ObjectKey
+			}
+			uploadedFiles = append(uploadedFiles, UploadedFilePresenter{
+				Name:         fileHeader.Filename,
+				Url:          joinStrs(r.s3Endpoint, "/", r.buckets.Bucket(objectKey), "/", objectKey),
+				ObjectKey:    objectKey,
+				Deduplicated: true,
+			})
+			continue
+		}
 		f, err := fileHeader.Open()
 		if err != nil {
-			r.logger.Error("error opening multipart file header: " + err.Error())
+			r.logger.ErrorContext(c.Request.Context(), "error opening multipart file header: "+err.Error())
+			abort()
 			response(c, http.StatusBadRequest, ErrOpenFile)
 			return
 		}
 
+		var body io.ReadSeeker = f
+		size := fileHeader.Size
 		extension := filepath.Ext(fileHeader.Filename)
-		newFileName := newObjectKey(channelID, extension)
-		if err := r.putFileToS3(c.Request.Context(), r.s3Bucket, newFileName, f); err != nil {
-			r.logger.Error("error putting file to S3: " + err.Error())
-			response(c, http.StatusInternalServerError, ErrUploadFile)
+		contentType := contentTypes[i]
+		format := ""
+		// checksum is verified while the file is read; storedChecksum is kept as metadata
+		var checksum, storedChecksum string
+		if checksums != nil {
+			checksum, storedChecksum = checksums[i], checksums[i]
+		} else if digests != nil {
+			storedChecksum = digests[i]
+		}
+		// the declared type of the part is up to the client, so the sniffed one decides
+		if r.audioTranscoder.ShouldTranscode(contentType, extension) {
+			var src io.Reader = f
+			var verifier *checksumReader
+			if checksum != "" {
+				verifier = newChecksumReader(f, checksum)
+				src = verifier
+			}
+			audio, err = r.audioTranscoder.Transcode(c.Request.Context(), src)
+			// the transcoder may stop reading before the end of the file
+			if err == nil && verifier != nil {
+				if err = verifier.Verify(); err != nil {
+					audio.Close()
+					audio = nil
+				}
+			}
+			f.Close()
+			if err != nil {
+				abort()
+				if verifier != nil && verifier.Mismatched() {
+					checksumMismatchesTotal.Inc()
+					response(c, http.StatusUnprocessableEntity, ErrChecksumMismatch)
+					return
+				}
+				if errors.Is(err, ErrAudioTooLong) {
+					response(c, http.StatusBadRequest, err)
+					return
+				}
+				// a client that went away did not send a bad file
+				if errors.Is(err, context.Canceled) {
+					c.AbortWithStatus(statusClientClosedRequest)
+					return
+				}
+				r.logger.ErrorContext(c.Request.Context(), "error transcoding audio: "+err.Error())
+				response(c, http.StatusBadRequest, ErrTranscodeAudio)
+				return
+			}
+			// charge the quota for the stored size rather than the uploaded one
+			if audio.Size > size && !r.reserveStorage(c, channelID, audio.Size-size) {
+				abort()
+				return
+			} else if audio.Size < size {
+				r.releaseStorage(channelID, size-audio.Size)
+			}
+			pendingSize += audio.Size - size
+			body, size, extension, format, contentType = audio, audio.Size, audio.Extension, audio.Format, audio.ContentType
+			// the stored audio no longer has the checksum of the uploaded file
+			checksum, storedChecksum = "", ""
+		}
+
+		if err := scanFile(c.Request.Context(), r.uploadScanner, body); err != nil {
+			abort()
+			if errors.Is(err, ErrFileFlagged) {
+				response(c, http.StatusUnprocessableEntity, err)
+				return
+			}
+			r.logger.ErrorContext(c.Request.Context(), "error scanning file: "+err.Error())
+			response(c, http.StatusInternalServerError, ErrScanFile)
+			return
+		}
+
+		var thumb *Thumbnail
+		// why an image is stored without a thumbnail
+		thumbSkipped := ""
+		if r.thumbnailer.ShouldGenerate(contentType) {
+			if thumb, err = r.thumbnailer.Generate(c.Request.Context(), body, contentType); err != nil {
+				r.logger.ErrorContext(c.Request.Context(), "error generating thumbnail: "+err.Error())
+				thumbnailFailuresTotal.WithLabelValues("generate").Inc()
+				thumb = nil
+				thumbSkipped = thumbnailSkippedError
+				if errors.Is(err, errImageTooLarge) {
+					thumbSkipped = thumbnailSkippedTooLarge
+				}
+			}
+			if thumb != nil && r.thumbnailer.ShouldTranscode() {
+				if thumb, err = r.thumbnailer.Transcode(c.Request.Context(), thumb); err != nil {
+					r.logger.WarnContext(c.Request.Context(), "keeping thumbnail in its original format: "+err.Error())
+				}
+			}
+			if _, err := body.Seek(0, io.SeekStart); err != nil {
+				r.logger.ErrorContext(c.Request.Context(), "error rewinding multipart file: "+err.Error())
+				abort()
+				response(c, http.StatusInternalServerError, ErrUploadFile)
+				return
+			}
+		}
+
+		bucket := r.buckets.Route(contentType)
+		newFileName := r.buckets.ObjectKey(channelID, bucket, r.keyTemplate.Name(channelID, uploaderID, extension, time.Now()))
+		var upload io.Reader = body
+		var verifier *checksumReader
+		if checksum != "" {
+			verifier = newChecksumReader(body, checksum)
+			upload = verifier
+		}
+		if err := r.putFileToS3(s3Ctx, bucket, newFileName, contentType, storedChecksum, upload); err != nil {
+			abort()
+			if verifier != nil && verifier.Mismatched() {
+				checksumMismatchesTotal.Inc()
+				response(c, http.StatusUnprocessableEntity, ErrChecksumMismatch)
+				return
+			}
+			r.logger.ErrorContext(c.Request.Context(), "error putting file to S3: "+err.Error())
+			r.responseS3Error(c, bucket, "Upload", err)
 			return
 		}
+		pendingSize -= size
+		userPendingSize -= fileHeader.Size
+		if audio != nil {
+			audio.Close()
+			audio = nil
+		}
+		if digests != nil {
+			storedKeys[digests[i]] = newFileName
+		}
+		// the original is stored already, so a failed thumbnail does not fail the upload
+		if thumb != nil {
+			if thumbSkipped = r.storeThumbnail(c, s3Ctx, channelID, bucket, thumbnailKey(newFileName), thumb); thumbSkipped != "" {
+				thumb = nil
+			}
+		}
 		uploadedFiles = append(uploadedFiles, UploadedFilePresenter{
-			Name: fileHeader.Filename,
-			Url:  joinStrs(r.s3Endpoint, "/", r.s3Bucket, "/", newFileName),
+			Name:             fileHeader.Filename,
+			Url:              joinStrs(r.s3Endpoint, "/", bucket, "/", newFileName),
+			ObjectKey:        newFileName,
+			Format:           format,
+			Thumbnail:        thumb != nil,
+			ThumbnailSkipped: thumbSkipped,
 		})
 	}
 
-	c.JSON(http.StatusCreated, &UploadedFilesPresenter{
+	if err := r.uploadDedupIndex.Record(c.Request.Context(), channelID, storedKeys); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error recording file digests: "+err.Error())
+	}
+
+	resp, err := json.Marshal(&UploadedFilesPresenter{
 		UploadedFiles: uploadedFiles,
 	})
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error encoding uploaded files: "+err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if idempotencyKey != "" {
+		userID := c.Request.Context().Value(common.UserKey).(uint64)
+		if err := r.uploadIdempotencyStore.Complete(c.Request.Context(), userID, channelID, idempotencyKey, resp); err != nil {
+			r.logger.ErrorContext(c.Request.Context(), "error storing idempotent upload: "+err.Error())
+		} else {
+			idempotencyKey = ""
+		}
+	}
+	c.Data(http.StatusCreated, "application/json; charset=utf-8", resp)
 }
 
-func (r *HttpServer) putFileToS3(ctx context.Context, bucket, fileName string, f io.Reader) error {
-	_, err := r.uploader.Upload(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(fileName),
-		ACL:    types.ObjectCannedACLPublicRead,
-		Body:   f,
-	})
+// claimIdempotencyKey claims the Idempotency-Key of the request, if any. A request whose
+// key was used by a completed upload is answered with the stored response and false
+func (r *HttpServer) claimIdempotencyKey(c *gin.Context, channelID uint64) (string, bool) {
+	key := c.GetHeader(idempotencyKeyHeader)
+	if key == "" || !r.uploadIdempotencyStore.Enabled() {
+		return "", true
+	}
+	if !validIdempotencyKey(key) {
+		response(c, http.StatusBadRequest, ErrInvalidIdempotencyKey)
+		return "", false
+	}
+	userID, ok := c.Request.Context().Value(common.UserKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return "", false
+	}
+	stored, err := r.uploadIdempotencyStore.Claim(c.Request.Context(), userID, channelID, key)
+	if errors.Is(err, ErrIdempotencyKeyInUse) {
+		response(c, http.StatusConflict, err)
+		return "", false
+	}
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error claiming idempotency key: "+err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return "", false
+	}
+	if stored != nil {
+		c.Data(http.StatusOK, "application/json; charset=utf-8", stored)
+		return "", false
+	}
+	return key, true
+}
+
+// reserveStorage charges n bytes to the channel quota, responding with 413 if the upload
+// does not fit. The usage of the channel is reported in a header either way
+func (r *HttpServer) reserveStorage(c *gin.Context, channelID uint64, n int64) bool {
+	ok, usage, err := r.channelStorageQuota.Reserve(c.Request.Context(), channelID, n)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error reserving channel storage: "+err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return false
+	}
+	if r.channelStorageQuota.Enabled() {
+		c.Header(channelStorageUsageHeader, strconv.FormatInt(usage, 10))
+	}
+	if !ok {
+		responseWithDetails(c, http.StatusRequestEntityTooLarge, ErrQuotaExceeded, map[string]interface{}{
+			"usage": usage,
+		})
+		return false
+	}
+	return true
+}
+
+// reserveUserUpload charges n bytes to the upload window of the requesting user,
+// responding with 413 if the upload does not fit
+func (r *HttpServer) reserveUserUpload(c *gin.Context, channelID uint64, n int64) (*UserUploadReservation, bool) {
+	if !r.userUploadQuota.Enabled() {
+		return nil, true
+	}
+	userID, ok := c.Request.Context().Value(common.UserKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return nil, false
+	}
+	ok, reservation, err := r.userUploadQuota.Reserve(c.Request.Context(), channelID, userID, n)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error reserving user upload quota: "+err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return nil, false
+	}
+	if !ok {
+		response(c, http.StatusRequestEntityTooLarge, ErrUserQuotaExceeded)
+		return nil, false
+	}
+	return reservation, true
+}
+
+// storageHoldGrace lets an upload that started right before its presigned url expired
+// finish before its reservation is reconciled
+const storageHoldGrace = 15 * time.Minute
+
+// holdStorage schedules the reservation of a presigned upload to be given back if nothing
+// is uploaded before the url expires
+func (r *HttpServer) holdStorage(c *gin.Context, hold StorageHold) {
+	if err := r.channelStorageQuota.Hold(c.Request.Context(), hold, time.Now().Add(r.presigner.Expires()+storageHoldGrace)); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error holding channel storage: "+err.Error())
+	}
+}
+
+// storeThumbnail charges a thumbnail to the channel quota and uploads it, returning why
+// the thumbnail was skipped if it does not fit in the quota or could not be stored
+func (r *HttpServer) storeThumbnail(c *gin.Context, s3Ctx context.Context, channelID uint64, bucket, key string, thumb *Thumbnail) string {
+	size := int64(len(thumb.Body))
+	ok, _, err := r.channelStorageQuota.Reserve(c.Request.Context(), channelID, size)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error reserving channel storage for thumbnail: "+err.Error())
+		thumbnailFailuresTotal.WithLabelValues("quota").Inc()
+		return thumbnailSkippedError
+	}
+	if !ok {
+		thumbnailFailuresTotal.WithLabelValues("quota").Inc()
+		return thumbnailSkippedQuota
+	}
+	if err := r.putFileToS3(s3Ctx, bucket, key, thumb.ContentType, "", bytes.NewReader(thumb.Body)); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error putting thumbnail to S3: "+err.Error())
+		thumbnailFailuresTotal.WithLabelValues("store").Inc()
+		r.releaseStorage(channelID, size)
+		return thumbnailSkippedError
+	}
+	return ""
+}
+
+func (r *HttpServer) releaseStorage(channelID uint64, n int64) {
+	if _, err := r.channelStorageQuota.Release(context.Background(), channelID, n); err != nil {
+		r.logger.Error("error releasing channel storage: " + err.Error())
+	}
+}
+
+// putFileToS3 uploads a file, storing checksum as its SHA-256 metadata unless empty. The
+// caller holds a slot of the instance upload cap
+func (r *HttpServer) putFileToS3(ctx context.Context, bucket, fileName, contentType, checksum string, f io.Reader) error {
+	ctx, span := startSpan(ctx, "s3.Upload", bucketAttr.String(bucket), objectKeyAttr.String(fileName), contentTypeAttr.String(contentType))
+	body, size := measureBody(f)
+	start := time.Now()
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(fileName),
+		ACL:         types.ObjectCannedACLPublicRead,
+		ContentType: aws.String(contentType),
+		Body:        body,
+	}
+	if checksum != "" {
+		input.Metadata = map[string]string{checksumMetadataKey: checksum}
+	}
+	r.sse.applyPut(input)
+	_, err := r.uploader.Upload(ctx, input)
+	observeS3Upload(bucket, start, size(), err)
+	if err == nil {
+		r.s3Backoff.Succeeded()
+	}
+	span.SetAttributes(sizeAttr.Int64(size()))
+	endSpan(span, err)
 	if err != nil {
 		return err
 	}
@@ -91,11 +563,17 @@ func (r *HttpServer) putFileToS3(ctx context.Context, bucket, fileName string, f
 // @Tags uploader
 // @Produce json
 // @Param ext query string true "file extension"
+// @Param size query int true "file size in bytes, at most the max body size of the channel; the upload must have exactly this size"
 // @param Authorization header string true "channel authorization"
+// @Param Cookie header string false "session id cookie; presigns are rate limited per user if sent and per channel otherwise. Required when the key template contains {user}"
 // @Success 200 {object} PresignedUpload
 // @Failure 400 {object} common.ErrResponse
 // @Failure 401 {object} common.ErrResponse
+// @Failure 413 {object} common.ErrResponse
+// @Failure 429 {object} common.ErrResponse
 // @Failure 500 {object} common.ErrResponse
+// @Failure 503 {object} common.ErrResponse
+// @Header 200,413 {string} X-Channel-Storage-Usage "bytes charged to the channel, including this upload if it was accepted"
 // @Router /uploader/upload/presigned [get]
 func (r *HttpServer) GetPresignedUpload(c *gin.Context) {
 	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
@@ -108,17 +586,109 @@ func (r *HttpServer) GetPresignedUpload(c *gin.Context) {
 		response(c, http.StatusBadRequest, common.ErrInvalidParam)
 		return
 	}
-	objectKey := newObjectKey(channelID, common.Join(".", req.Extension))
-	res, err := r.presigner.PutObject(c.Request.Context(), r.s3Bucket, objectKey)
+	if req.Size <= 0 {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	// the url is signed with the declared size, so that direct uploads cannot bypass the
+	// body size limit, and the reservation matches what gets stored
+	if req.Size > r.channelBodyLimit(channelID) {
+		response(c, http.StatusRequestEntityTooLarge, ErrBodyTooLarge)
+		return
+	}
+	if !r.reserveStorage(c, channelID, req.Size) {
+		return
+	}
+	extension := common.Join(".", req.Extension)
+	bucket := r.buckets.Route(mime.TypeByExtension(extension))
+	userID, _ := c.Request.Context().Value(common.UserKey).(uint64)
+	objectKey := r.buckets.ObjectKey(channelID, bucket, r.keyTemplate.Name(channelID, userID, extension, time.Now()))
+	ctx, cancel := withS3Timeout(c.Request.Context(), r.s3OperationTimeout)
+	defer cancel()
+	res, err := r.presigner.PutObject(ctx, bucket, objectKey, req.Size)
 	if err != nil {
-		r.logger.Error("get presigned upload url failed: " + err.Error())
+		r.logger.ErrorContext(c.Request.Context(), "get presigned upload url failed: "+err.Error())
+		r.releaseStorage(channelID, req.Size)
 		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
+	r.holdStorage(c, StorageHold{ChannelID: channelID, Size: req.Size, ObjectKey: objectKey})
 
 	c.JSON(http.StatusOK, &PresignedUpload{
 		ObjectKey: objectKey,
 		Url:       res.URL,
+		Headers:   amzSignedHeaders(res.SignedHeader),
+	})
+}
+
+// @Summary Get presigned upload form
+// @Description Get a presigned POST policy for uploading a file to S3 from a browser form. Post the fields followed by the file as multipart/form-data to the url; S3 only accepts the returned object key, the content type of the extension and a file of exactly the given size
+// @Tags uploader
+// @Produce json
+// @Param ext query string true "file extension"
+// @Param size query int true "file size in bytes, at most the max body size of the channel; the upload must have exactly this size"
+// @param Authorization header string true "channel authorization"
+// @Param Cookie header string false "session id cookie; presigns are rate limited per user if sent and per channel otherwise. Required when the key template contains {user}"
+// @Success 200 {object} PresignedPostUpload
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 413 {object} common.ErrResponse
+// @Failure 415 {object} common.ErrResponse
+// @Failure 429 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Failure 503 {object} common.ErrResponse
+// @Header 200,413 {string} X-Channel-Storage-Usage "bytes charged to the channel, including this upload if it was accepted"
+// @Router /uploader/upload/presigned/post [get]
+func (r *HttpServer) GetPresignedPost(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	var req GetPresignedUploadRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if req.Size <= 0 {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if req.Size > r.channelBodyLimit(channelID) {
+		response(c, http.StatusRequestEntityTooLarge, ErrBodyTooLarge)
+		return
+	}
+	// the type cannot be sniffed from a direct upload, so the policy pins the type of the extension
+	extension := common.Join(".", req.Extension)
+	contentType := mime.TypeByExtension(extension)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if !isContentTypeAllowed(contentType, r.allowedContentTypes) {
+		response(c, http.StatusUnsupportedMediaType, ErrUnsupportedType)
+		return
+	}
+	if !r.reserveStorage(c, channelID, req.Size) {
+		return
+	}
+	bucket := r.buckets.Route(contentType)
+	userID, _ := c.Request.Context().Value(common.UserKey).(uint64)
+	objectKey := r.buckets.ObjectKey(channelID, bucket, r.keyTemplate.Name(channelID, userID, extension, time.Now()))
+	ctx, cancel := withS3Timeout(c.Request.Context(), r.s3OperationTimeout)
+	defer cancel()
+	post, err := r.presigner.PostObject(ctx, bucket, objectKey, contentType, req.Size)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "get presigned upload form failed: "+err.Error())
+		r.releaseStorage(channelID, req.Size)
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	r.holdStorage(c, StorageHold{ChannelID: channelID, Size: req.Size, ObjectKey: objectKey})
+
+	c.JSON(http.StatusOK, &PresignedPostUpload{
+		ObjectKey: objectKey,
+		Url:       post.URL,
+		Fields:    post.Fields,
 	})
 }
 
@@ -127,10 +697,14 @@ func (r *HttpServer) GetPresignedUpload(c *gin.Context) {
 // @Tags uploader
 // @Produce json
 // @Param okb64 query string true "base64-encoded object key"
+// @Param filename query string false "filename the browser saves the download as; path separators and control characters are removed"
+// @Param variant query string false "set to thumb for the thumbnail of an uploaded image"
 // @param Authorization header string true "channel authorization"
+// @Param Cookie header string false "session id cookie; presigns are rate limited per user if sent and per channel otherwise"
 // @Success 200 {object} PresignedDownload
 // @Failure 400 {object} common.ErrResponse
 // @Failure 401 {object} common.ErrResponse
+// @Failure 429 {object} common.ErrResponse
 // @Failure 500 {object} common.ErrResponse
 // @Router /uploader/download/presigned [get]
 func (r *HttpServer) GetPresignedDownload(c *gin.Context) {
@@ -144,6 +718,129 @@ func (r *HttpServer) GetPresignedDownload(c *gin.Context) {
 		response(c, http.StatusBadRequest, common.ErrInvalidParam)
 		return
 	}
+	objectKey, code, err := downloadObjectKey(channelID, req.ObjectKeyBase64, req.Variant)
+	if err != nil {
+		response(c, code, err)
+		return
+	}
+
+	ctx, cancel := withS3Timeout(c.Request.Context(), r.s3OperationTimeout)
+	defer cancel()
+	res, err := r.presigner.GetObject(ctx, r.buckets.Bucket(objectKey), objectKey, sanitizeFilename(req.Filename))
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "get presigned download url failed: "+err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+
+	c.JSON(http.StatusOK, &PresignedDownload{res.URL})
+}
+
+// @Summary Get presigned download urls in batch
+// @Description Get presigned urls for downloading several files from S3, in the order of the requested keys. Keys that are invalid or belong to another channel get a per-item error instead of failing the batch. Every key counts against the presign rate limit
+// @Tags uploader
+// @Accept json
+// @Produce json
+// @Param items body []PresignedDownloadBatchItem true "base64-encoded object keys with optional filename and variant"
+// @param Authorization header string true "channel authorization"
+// @Param Cookie header string false "session id cookie; presigns are rate limited per user if sent and per channel otherwise"
+// @Success 200 {array} PresignedDownloadBatchResult
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 413 {object} common.ErrResponse
+// @Failure 429 {object} common.ErrResponse
+// @Router /uploader/download/presigned/batch [post]
+func (r *HttpServer) GetPresignedDownloadBatch(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	var items []PresignedDownloadBatchItem
+	if err := c.ShouldBindJSON(&items); err != nil || len(items) == 0 {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if len(items) > r.presignBatchMaxSize {
+		response(c, http.StatusRequestEntityTooLarge, ErrBatchTooLarge)
+		return
+	}
+	if !r.allowPresigns(c, len(items)) {
+		return
+	}
+
+	ctx, cancel := withS3Timeout(c.Request.Context(), r.s3OperationTimeout)
+	defer cancel()
+	results := make([]PresignedDownloadBatchResult, len(items))
+	for i, item := range items {
+		objectKey, code, err := downloadObjectKey(channelID, item.ObjectKeyBase64, item.Variant)
+		if err != nil {
+			errResponse := common.NewErrResponse(err, code, errorCodes)
+			results[i].Error = &errResponse
+			continue
+		}
+		res, err := r.presigner.GetObject(ctx, r.buckets.Bucket(objectKey), objectKey, sanitizeFilename(item.Filename))
+		if err != nil {
+			r.logger.ErrorContext(c.Request.Context(), "get presigned download url failed: "+err.Error())
+			errResponse := common.NewErrResponse(common.ErrServer, http.StatusInternalServerError, errorCodes)
+			results[i].Error = &errResponse
+			continue
+		}
+		results[i].Url = res.URL
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// downloadObjectKey decodes a requested object key and checks that it belongs to the channel.
+// On failure it returns the http status and error to respond with
+func downloadObjectKey(channelID uint64, objectKeyBase64, variant string) (string, int, error) {
+	objectKeyByte, err := b64.URLEncoding.DecodeString(objectKeyBase64)
+	if err != nil || len(objectKeyByte) == 0 {
+		return "", http.StatusBadRequest, common.ErrInvalidParam
+	}
+	objectKey := byteSlice2String(objectKeyByte)
+	targetChannelID, err := getChannelIDFromObjectKey(objectKey)
+	if err != nil {
+		return "", http.StatusBadRequest, common.ErrInvalidParam
+	}
+	if channelID != targetChannelID {
+		return "", http.StatusUnauthorized, common.ErrUnauthorized
+	}
+	switch variant {
+	case "":
+	case thumbnailVariant:
+		objectKey = thumbnailKey(objectKey)
+	default:
+		return "", http.StatusBadRequest, common.ErrInvalidParam
+	}
+	return objectKey, http.StatusOK, nil
+}
+
+// @Summary Delete file
+// @Description Delete an uploaded file of the channel and return its size to the channel storage quota
+// @Tags uploader
+// @Produce json
+// @Param okb64 query string true "base64-encoded object key"
+// @param Authorization header string true "channel authorization"
+// @Success 200 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Failure 503 {object} common.ErrResponse
+// @Failure 504 {object} common.ErrResponse
+// @Router /uploader/files [delete]
+func (r *HttpServer) DeleteFile(c *gin.Context) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return
+	}
+	var req DeleteFileRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
 	objectKeyByte, err := b64.URLEncoding.DecodeString(req.ObjectKeyBase64)
 	if err != nil {
 		response(c, http.StatusBadRequest, common.ErrInvalidParam)
@@ -160,12 +857,447 @@ func (r *HttpServer) GetPresignedDownload(c *gin.Context) {
 		return
 	}
 
-	res, err := r.presigner.GetObject(c.Request.Context(), r.s3Bucket, objectKey)
+	bucket := r.buckets.Bucket(objectKey)
+	ctx, cancel := withS3Timeout(c.Request.Context(), r.s3OperationTimeout)
+	head, err := r.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+	})
+	cancel()
 	if err != nil {
-		r.logger.Error("get presigned download url failed: " + err.Error())
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			response(c, http.StatusNotFound, ErrFileNotFound)
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			response(c, http.StatusGatewayTimeout, ErrS3Timeout)
+			return
+		}
+		r.logger.ErrorContext(c.Request.Context(), "error getting file metadata from S3: "+err.Error())
 		response(c, http.StatusInternalServerError, common.ErrServer)
 		return
 	}
+	if _, err := r.s3Client.DeleteObject(c.Request.Context(), &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+	}); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error deleting file from S3: "+err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	r.releaseStorage(channelID, head.ContentLength)
+	// a presigned upload deleted before its reservation is reconciled must not be released twice
+	if err := r.channelStorageQuota.DropHold(c.Request.Context(), StorageHold{ChannelID: channelID, Size: head.ContentLength, ObjectKey: objectKey}); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error dropping storage hold: "+err.Error())
+	}
+	// images may have a thumbnail stored next to them, which is charged to the quota too
+	r.deleteThumbnail(c, channelID, bucket, thumbnailKey(objectKey))
+	if err := r.uploadDedupIndex.Forget(c.Request.Context(), channelID, objectKey); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error forgetting file digest: "+err.Error())
+	}
+	c.JSON(http.StatusOK, common.OkMsg)
+}
 
-	c.JSON(http.StatusOK, &PresignedDownload{res.URL})
+func (r *HttpServer) deleteThumbnail(c *gin.Context, channelID uint64, bucket, key string) {
+	ctx, cancel := withS3Timeout(c.Request.Context(), r.s3OperationTimeout)
+	defer cancel()
+	head, err := r.s3Client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NotFound
+		if !errors.As(err, &notFound) {
+			r.logger.ErrorContext(c.Request.Context(), "error getting thumbnail metadata from S3: "+err.Error())
+		}
+		return
+	}
+	if _, err := r.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error deleting thumbnail from S3: "+err.Error())
+		return
+	}
+	r.releaseStorage(channelID, head.ContentLength)
+}
+
+// @Summary Start resumable upload
+// @Description Start a resumable upload backed by an S3 multipart upload; parts are then uploaded one by one and may be retried individually. The file size is required and at most the max body size of the channel
+// @Tags uploader
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param Cookie header string true "session id cookie"
+// @Param request body InitMultipartUploadRequest true "file extension and size"
+// @Success 201 {object} MultipartUpload
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 413 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Failure 503 {object} common.ErrResponse
+// @Header 201,413 {string} X-Channel-Storage-Usage "bytes charged to the channel, including this upload if it was accepted"
+// @Header 503 {string} Retry-After "seconds to wait before retrying while storage is throttling"
+// @Router /uploader/upload/multipart/init [post]
+func (r *HttpServer) InitMultipartUpload(c *gin.Context) {
+	channelID, userID, ok := r.channelUser(c)
+	if !ok {
+		return
+	}
+	var req InitMultipartUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	if req.Size <= 0 {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	// parts are bounded by the declared size, so the file cannot outgrow the body size limit
+	if req.Size > r.channelBodyLimit(channelID) {
+		response(c, http.StatusRequestEntityTooLarge, ErrBodyTooLarge)
+		return
+	}
+	if !r.reserveStorage(c, channelID, req.Size) {
+		return
+	}
+	extension := sanitizeExtension(req.Extension)
+	bucket := r.buckets.Route(mime.TypeByExtension(extension))
+	objectKey := r.buckets.ObjectKey(channelID, bucket, r.keyTemplate.Name(channelID, userID, extension, time.Now()))
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objectKey),
+		ACL:    types.ObjectCannedACLPublicRead,
+	}
+	r.sse.applyMultipart(input)
+	out, err := r.s3Client.CreateMultipartUpload(c.Request.Context(), input)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error creating multipart upload: "+err.Error())
+		r.releaseStorage(channelID, req.Size)
+		r.responseS3Error(c, bucket, "CreateMultipartUpload", err)
+		return
+	}
+	sess := &MultipartSession{
+		ChannelID: channelID,
+		UserID:    userID,
+		UploadID:  *out.UploadId,
+		ObjectKey: objectKey,
+		Size:      req.Size,
+	}
+	if err := r.multipartUploadStore.Create(c.Request.Context(), sess); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error saving multipart upload: "+err.Error())
+		r.abortMultipartUpload(sess)
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusCreated, &MultipartUpload{
+		UploadID:  sess.UploadID,
+		ObjectKey: objectKey,
+	})
+}
+
+// @Summary Upload part
+// @Description Upload one part of a resumable upload. The Content-Range header gives the byte range of the part within the file. Every part but the one ending the file must be at least 5 MiB. Re-uploading a part number replaces the part
+// @Tags uploader
+// @Accept octet-stream
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param Cookie header string true "session id cookie"
+// @Param Content-Range header string true "byte range of the part, e.g. bytes 0-5242879/10485760"
+// @Param upload_id query string true "upload id"
+// @Param part_number query int true "part number from 1 to 10000"
+// @Success 200 {object} UploadedPartPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 413 {object} common.ErrResponse
+// @Failure 429 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Failure 503 {object} common.ErrResponse
+// @Header 503 {string} Retry-After "seconds to wait before retrying while storage is throttling or the instance is at its upload cap"
+// @Router /uploader/upload/multipart/part [put]
+func (r *HttpServer) UploadPart(c *gin.Context) {
+	var req UploadPartRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	sess, ok := r.getMultipartSession(c, req.UploadID)
+	if !ok {
+		return
+	}
+	start, end, err := parseContentRange(c.GetHeader("Content-Range"))
+	if err != nil || (sess.Size > 0 && end >= sess.Size) {
+		response(c, http.StatusBadRequest, ErrInvalidContentRange)
+		return
+	}
+	if end-start+1 > r.maxPartSize {
+		response(c, http.StatusRequestEntityTooLarge, ErrPartTooLarge)
+		return
+	}
+	// S3 only checks the part sizes on completion, when the upload can no longer be fixed
+	if sess.Size > 0 && end+1 < sess.Size && end-start+1 < minPartSize {
+		response(c, http.StatusBadRequest, ErrPartTooSmall)
+		return
+	}
+	// the part is buffered so that the request can be signed and retried by the sdk, so
+	// its slot is taken before reading it
+	bucket := r.buckets.Bucket(sess.ObjectKey)
+	if err := r.instanceUploadLimiter.Acquire(c.Request.Context()); err != nil {
+		r.responseS3Error(c, bucket, "UploadPart", err)
+		return
+	}
+	defer r.instanceUploadLimiter.Release()
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, r.maxPartSize+1))
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error reading part: "+err.Error())
+		response(c, http.StatusBadRequest, ErrReceiveFile)
+		return
+	}
+	if int64(len(body)) != end-start+1 {
+		response(c, http.StatusBadRequest, ErrInvalidContentRange)
+		return
+	}
+	ctx, span := startSpan(c.Request.Context(), "s3.UploadPart", bucketAttr.String(bucket), objectKeyAttr.String(sess.ObjectKey),
+		partNumberAttr.Int(int(req.PartNumber)), sizeAttr.Int(len(body)))
+	out, err := r.s3Client.UploadPart(ctx, &s3.UploadPartInput{
+		Bucket:        aws.String(bucket),
+		Key:           aws.String(sess.ObjectKey),
+		UploadId:      aws.String(sess.UploadID),
+		PartNumber:    req.PartNumber,
+		ContentLength: int64(len(body)),
+		Body:          bytes.NewReader(body),
+	})
+	endSpan(span, err)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error uploading part: "+err.Error())
+		r.responseS3Error(c, bucket, "UploadPart", err)
+		return
+	}
+	r.s3Backoff.Succeeded()
+	part := &UploadedPart{
+		PartNumber: req.PartNumber,
+		ETag:       *out.ETag,
+		Start:      start,
+		End:        end,
+	}
+	if err := r.multipartUploadStore.AddPart(c.Request.Context(), sess, part); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error saving uploaded part: "+err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	c.JSON(http.StatusOK, toUploadedPartPresenter(part))
+}
+
+// @Summary Get resumable upload
+// @Description Get the parts of a resumable upload that are already stored, so that a reconnecting client only uploads the missing ones
+// @Tags uploader
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param Cookie header string true "session id cookie"
+// @Param upload_id query string true "upload id"
+// @Success 200 {object} MultipartUploadPartsPresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Router /uploader/upload/multipart [get]
+func (r *HttpServer) GetMultipartUpload(c *gin.Context) {
+	var req MultipartUploadRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	sess, ok := r.getMultipartSession(c, req.UploadID)
+	if !ok {
+		return
+	}
+	parts, err := r.multipartUploadStore.ListParts(c.Request.Context(), sess.UploadID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error listing uploaded parts: "+err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	partPresenters := make([]UploadedPartPresenter, 0, len(parts))
+	for i := range parts {
+		partPresenters = append(partPresenters, *toUploadedPartPresenter(&parts[i]))
+	}
+	c.JSON(http.StatusOK, &MultipartUploadPartsPresenter{
+		UploadID:  sess.UploadID,
+		ObjectKey: sess.ObjectKey,
+		Size:      sess.Size,
+		Parts:     partPresenters,
+	})
+}
+
+// @Summary Complete resumable upload
+// @Description Assemble the uploaded parts into the final object. Parts must cover the file without gaps, starting at byte 0
+// @Tags uploader
+// @Accept json
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param Cookie header string true "session id cookie"
+// @Param request body CompleteMultipartUploadRequest true "upload id"
+// @Success 201 {object} UploadedFilePresenter
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Failure 503 {object} common.ErrResponse
+// @Header 503 {string} Retry-After "seconds to wait before retrying while storage is throttling"
+// @Router /uploader/upload/multipart/complete [post]
+func (r *HttpServer) CompleteMultipartUpload(c *gin.Context) {
+	var req CompleteMultipartUploadRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	sess, ok := r.getMultipartSession(c, req.UploadID)
+	if !ok {
+		return
+	}
+	parts, err := r.multipartUploadStore.ListParts(c.Request.Context(), sess.UploadID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error listing uploaded parts: "+err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return
+	}
+	if !partsCoverFile(parts, sess.Size) {
+		response(c, http.StatusBadRequest, ErrIncompleteUpload)
+		return
+	}
+	if !r.claimMultipartSession(c, sess) {
+		return
+	}
+	completedParts := make([]types.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completedParts = append(completedParts, types.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: part.PartNumber,
+		})
+	}
+	bucket := r.buckets.Bucket(sess.ObjectKey)
+	if _, err := r.s3Client.CompleteMultipartUpload(c.Request.Context(), &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(bucket),
+		Key:      aws.String(sess.ObjectKey),
+		UploadId: aws.String(sess.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: completedParts,
+		},
+	}); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error completing multipart upload: "+err.Error())
+		// keep the upload so that the client can retry
+		if err := r.multipartUploadStore.Unclaim(context.Background(), sess); err != nil {
+			r.logger.ErrorContext(c.Request.Context(), "error rescheduling multipart upload: "+err.Error())
+		}
+		r.responseS3Error(c, bucket, "CompleteMultipartUpload", err)
+		return
+	}
+	if err := r.multipartUploadStore.Remove(context.Background(), sess); err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error removing multipart upload: "+err.Error())
+	}
+	c.JSON(http.StatusCreated, &UploadedFilePresenter{
+		Url:       joinStrs(r.s3Endpoint, "/", bucket, "/", sess.ObjectKey),
+		ObjectKey: sess.ObjectKey,
+	})
+}
+
+// @Summary Abort resumable upload
+// @Description Abort a resumable upload, deleting its uploaded parts and returning its size to the channel storage quota
+// @Tags uploader
+// @Produce json
+// @param Authorization header string true "channel authorization"
+// @Param Cookie header string true "session id cookie"
+// @Param upload_id query string true "upload id"
+// @Success 200 {object} common.SuccessMessage
+// @Failure 400 {object} common.ErrResponse
+// @Failure 401 {object} common.ErrResponse
+// @Failure 404 {object} common.ErrResponse
+// @Failure 500 {object} common.ErrResponse
+// @Failure 503 {object} common.ErrResponse
+// @Router /uploader/upload/multipart [delete]
+func (r *HttpServer) AbortMultipartUpload(c *gin.Context) {
+	var req MultipartUploadRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		response(c, http.StatusBadRequest, common.ErrInvalidParam)
+		return
+	}
+	sess, ok := r.getMultipartSession(c, req.UploadID)
+	if !ok {
+		return
+	}
+	if !r.claimMultipartSession(c, sess) {
+		return
+	}
+	r.abortMultipartUpload(sess)
+	c.JSON(http.StatusOK, common.OkMsg)
+}
+
+// channelUser returns the channel of the access token and the user of the session cookie
+func (r *HttpServer) channelUser(c *gin.Context) (uint64, uint64, bool) {
+	channelID, ok := c.Request.Context().Value(common.ChannelKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return 0, 0, false
+	}
+	userID, ok := c.Request.Context().Value(common.UserKey).(uint64)
+	if !ok {
+		response(c, http.StatusUnauthorized, common.ErrUnauthorized)
+		return 0, 0, false
+	}
+	return channelID, userID, true
+}
+
+// getMultipartSession looks up an upload of the requesting user in the requesting channel
+func (r *HttpServer) getMultipartSession(c *gin.Context, uploadID string) (*MultipartSession, bool) {
+	channelID, userID, ok := r.channelUser(c)
+	if !ok {
+		return nil, false
+	}
+	sess, err := r.multipartUploadStore.Get(c.Request.Context(), channelID, userID, uploadID)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error getting multipart upload: "+err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return nil, false
+	}
+	if sess == nil {
+		response(c, http.StatusNotFound, ErrUploadNotFound)
+		return nil, false
+	}
+	return sess, true
+}
+
+// claimMultipartSession responds with 404 if the upload was already completed, aborted or expired
+func (r *HttpServer) claimMultipartSession(c *gin.Context, sess *MultipartSession) bool {
+	claimed, err := r.multipartUploadStore.Claim(c.Request.Context(), sess)
+	if err != nil {
+		r.logger.ErrorContext(c.Request.Context(), "error claiming multipart upload: "+err.Error())
+		response(c, http.StatusInternalServerError, common.ErrServer)
+		return false
+	}
+	if !claimed {
+		response(c, http.StatusNotFound, ErrUploadNotFound)
+		return false
+	}
+	return true
+}
+
+// abortMultipartUpload deletes the parts of a claimed upload from S3 and releases its reservation
+func (r *HttpServer) abortMultipartUpload(sess *MultipartSession) {
+	ctx := context.Background()
+	if _, err := r.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(r.buckets.Bucket(sess.ObjectKey)),
+		Key:      aws.String(sess.ObjectKey),
+		UploadId: aws.String(sess.UploadID),
+	}); err != nil {
+		var noSuchUpload *types.NoSuchUpload
+		if !errors.As(err, &noSuchUpload) {
+			r.logger.Error("error aborting multipart upload: " + err.Error())
+		}
+	}
+	if err := r.multipartUploadStore.Remove(ctx, sess); err != nil {
+		r.logger.Error("error removing multipart upload: " + err.Error())
+	}
+	r.releaseStorage(sess.ChannelID, sess.Size)
 }
@@ -0,0 +1,105 @@
+package uploader
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	maxIdempotencyKeyLen      = 255
+	uploadIdempotencyPrefix   = "rc:uploadidempotency"
+	idempotencyPendingPayload = "pending"
+)
+
+// UploadIdempotencyStore remembers the response of uploads made with an Idempotency-Key
+// header, so that a retried upload gets the files stored by the first attempt instead of
+// storing them again. Keys are scoped to the user and the channel
+type UploadIdempotencyStore struct {
+	rc         redis.UniversalClient
+	keyPrefix  string
+	enabled    bool
+	expiration time.Duration
+	// pendingExpiration bounds how long the claim of an unfinished upload blocks retries
+	pendingExpiration time.Duration
+}
+
+// claimIdempotencyKeyScript returns the stored response of the key, or marks the key as
+// pending and returns nil if it is not used yet
+var claimIdempotencyKeyScript = redis.NewScript(`
+local key = KEYS[1]
+local val = redis.call("GET", key)
+if val then
+  return val
+end
+redis.call("SET", key, ARGV[1], "PX", ARGV[2])
+return false
+`)
+
+func NewUploadIdempotencyStore(rc redis.UniversalClient, config *config.Config) UploadIdempotencyStore {
+	expiration := time.Duration(config.Redis.ExpirationHour) * time.Hour
+	pendingExpiration := time.Duration(config.Uploader.Idempotency.PendingTimeoutSecond) * time.Second
+	if pendingExpiration <= 0 || pendingExpiration > expiration {
+		pendingExpiration = expiration
+	}
+	return UploadIdempotencyStore{
+		rc:                rc,
+		keyPrefix:         config.Redis.KeyPrefix,
+		enabled:           config.Uploader.Idempotency.Enabled,
+		expiration:        expiration,
+		pendingExpiration: pendingExpiration,
+	}
+}
+
+// Enabled reports whether idempotency keys are honored
+func (s UploadIdempotencyStore) Enabled() bool {
+	return s.enabled
+}
+
+// Claim reserves the key for an upload. It returns the stored response if an upload with
+// the key completed before, or ErrIdempotencyKeyInUse if one is still in progress
+func (s UploadIdempotencyStore) Claim(ctx context.Context, userID, channelID uint64, key string) ([]byte, error) {
+	val, err := claimIdempotencyKeyScript.Run(ctx, s.rc, []string{s.key(userID, channelID, key)}, idempotencyPendingPayload, s.pendingExpiration.Milliseconds()).Text()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if val == idempotencyPendingPayload {
+		return nil, ErrIdempotencyKeyInUse
+	}
+	return []byte(val), nil
+}
+
+// Complete stores the response of the upload claimed with the key
+func (s UploadIdempotencyStore) Complete(ctx context.Context, userID, channelID uint64, key string, resp []byte) error {
+	return s.rc.Set(ctx, s.key(userID, channelID, key), resp, s.expiration).Err()
+}
+
+// Release gives up the claim of a failed upload so that it can be retried with the same key
+func (s UploadIdempotencyStore) Release(ctx context.Context, userID, channelID uint64, key string) error {
+	return s.rc.Del(ctx, s.key(userID, channelID, key)).Err()
+}
+
+func (s UploadIdempotencyStore) key(userID, channelID uint64, key string) string {
+	return common.PrefixRedisKey(s.keyPrefix, common.Join(uploadIdempotencyPrefix, ":", strconv.FormatUint(userID, 10), ":", strconv.FormatUint(channelID, 10), ":", key))
+}
+
+// validIdempotencyKey reports whether the key is non-empty printable ASCII within the max length
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package uploader
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+const (
+	keyPlaceholderChannel = "{channel}"
+	keyPlaceholderUser    = "{user}"
+	keyPlaceholderDate    = "{date}"
+	keyPlaceholderUUID    = "{uuid}"
+	keyPlaceholderExt     = "{ext}"
+)
+
+// objectKeyTemplate renders the name of uploaded objects, which follows the channel id (and
+// the routed bucket) in their key. The channel prefix is not part of the template since
+// ownership checks and channel purges rely on it
+type objectKeyTemplate struct {
+	segments []string
+	usesUser bool
+}
+
+func newObjectKeyTemplate(config *config.Config) (objectKeyTemplate, error) {
+	tmpl := config.Uploader.S3.KeyTemplate
+	var t objectKeyTemplate
+	hasUUID := false
+	for rest := tmpl; rest != ""; {
+		start := strings.IndexAny(rest, "{}")
+		if start < 0 {
+			t.segments = append(t.segments, rest)
+			break
+		}
+		if start > 0 {
+			t.segments = append(t.segments, rest[:start])
+			rest = rest[start:]
+		}
+		end := strings.IndexByte(rest, '}')
+		if rest[0] != '{' || end < 0 {
+			return objectKeyTemplate{}, fmt.Errorf("s3 key template %q has unbalanced braces", tmpl)
+		}
+		placeholder := rest[:end+1]
+		switch placeholder {
+		case keyPlaceholderChannel, keyPlaceholderDate, keyPlaceholderExt:
+		case keyPlaceholderUser:
+			t.usesUser = true
+		case keyPlaceholderUUID:
+			hasUUID = true
+		default:
+			return objectKeyTemplate{}, fmt.Errorf("s3 key template %q has unknown placeholder %s", tmpl, placeholder)
+		}
+		t.segments = append(t.segments, placeholder)
+		rest = rest[end+1:]
+	}
+	// keys must be unique, or uploads would overwrite each other
+	if !hasUUID {
+		return objectKeyTemplate{}, fmt.Errorf("s3 key template %q must contain %s", tmpl, keyPlaceholderUUID)
+	}
+	for _, segment := range t.segments {
+		if !strings.HasPrefix(segment, "{") && !isURLSafeKey(segment) {
+			return objectKeyTemplate{}, fmt.Errorf("s3 key template %q may only contain letters, digits and -._~/ outside placeholders", tmpl)
+		}
+	}
+	for _, part := range strings.Split(tmpl, "/") {
+		if part == "" || part == "." || part == ".." {
+			return objectKeyTemplate{}, fmt.Errorf("s3 key template %q has an empty, . or .. path segment", tmpl)
+		}
+	}
+	return t, nil
+}
+
+// UsesUser reports whether keys contain the id of the uploading user
+func (t objectKeyTemplate) UsesUser() bool {
+	return t.usesUser
+}
+
+// Name renders an object name for a file with the extension, including its dot, uploaded by
+// the user at now. Characters of the extension that are not URL-safe are dropped
+func (t objectKeyTemplate) Name(channelID, userID uint64, extension string, now time.Time) string {
+	var sb strings.Builder
+	for _, segment := range t.segments {
+		switch segment {
+		case keyPlaceholderChannel:
+			sb.WriteString(strconv.FormatUint(channelID, 10))
+		case keyPlaceholderUser:
+			sb.WriteString(strconv.FormatUint(userID, 10))
+		case keyPlaceholderDate:
+			sb.WriteString(now.UTC().Format("2006-01-02"))
+		case keyPlaceholderUUID:
+			sb.WriteString(uuid.New().String())
+		case keyPlaceholderExt:
+			sb.WriteString(sanitizeExtension(extension))
+		default:
+			sb.WriteString(segment)
+		}
+	}
+	return sb.String()
+}
+
+// sanitizeExtension keeps the letters and digits of a file extension, or returns an empty
+// extension if none are left
+func sanitizeExtension(extension string) string {
+	ext := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return -1
+	}, extension)
+	if ext == "" {
+		return ""
+	}
+	return joinStrs(".", ext)
+}
+
+// isURLSafeKey reports whether s only contains unreserved URL characters and slashes
+func isURLSafeKey(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' || c == '/' {
+			continue
+		}
+		return false
+	}
+	return true
+}
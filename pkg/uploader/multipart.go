@@ -0,0 +1,233 @@
+package uploader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	multipartUploadsPrefix = "rc:multipartuploads"
+	multipartPartsPrefix   = "rc:multipartparts"
+	// sorted set of in-progress uploads scored by the unix time they expire at
+	multipartExpiryKey = "rc:multipartexpiry"
+)
+
+// MultipartSession is an in-progress resumable upload of a user to a channel
+type MultipartSession struct {
+	ChannelID uint64 `json:"-"`
+	UserID    uint64 `json:"-"`
+	UploadID  string `json:"-"`
+	ObjectKey string `json:"object_key"`
+	// Size is the declared file size reserved from the channel quota
+	Size int64 `json:"size"`
+}
+
+// UploadedPart is a part of a multipart upload stored in S3
+type UploadedPart struct {
+	PartNumber int32  `json:"part_number"`
+	ETag       string `json:"etag"`
+	Start      int64  `json:"start"`
+	End        int64  `json:"end"`
+}
+
+// MultipartUploadStore persists in-progress multipart uploads and their completed parts so
+// that a reconnecting client can resume where it left off
+type MultipartUploadStore struct {
+	rc         redis.UniversalClient
+	keyPrefix  string
+	enabled    bool
+	sessionTTL time.Duration
+}
+
+var popExpiredUploadsScript = redis.NewScript(`
+local key = KEYS[1]
+local now = ARGV[1]
+local limit = tonumber(ARGV[2])
+local members = redis.call("ZRANGEBYSCORE", key, "-inf", now, "LIMIT", 0, limit)
+if #members > 0 then
+  redis.call("ZREM", key, unpack(members))
+end
+return members
+`)
+
+func NewMultipartUploadStore(rc redis.UniversalClient, config *config.Config) MultipartUploadStore {
+	return MultipartUploadStore{
+		rc:         rc,
+		keyPrefix:  config.Redis.KeyPrefix,
+		enabled:    config.Uploader.Multipart.Enabled,
+		sessionTTL: time.Duration(config.Uploader.Multipart.SessionTTLSecond) * time.Second,
+	}
+}
+
+// Enabled reports whether resumable uploads are served
+func (s MultipartUploadStore) Enabled() bool {
+	return s.enabled
+}
+
+func (s MultipartUploadStore) Create(ctx context.Context, sess *MultipartSession) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	key := multipartUploadsKey(s.keyPrefix, sess.ChannelID, sess.UserID)
+	_, err = s.rc.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, sess.UploadID, data)
+		pipe.Expire(ctx, key, s.dataTTL())
+		pipe.ZAdd(ctx, s.expiryKey(), redis.Z{
+			Score:  float64(time.Now().Add(s.sessionTTL).Unix()),
+			Member: multipartExpiryMember(sess.ChannelID, sess.UserID, sess.UploadID),
+		})
+		return nil
+	})
+	return err
+}
+
+// Get returns the upload of the user in the channel, or nil if there is none
+func (s MultipartUploadStore) Get(ctx context.Context, channelID, userID uint64, uploadID string) (*MultipartSession, error) {
+	data, err := s.rc.HGet(ctx, multipartUploadsKey(s.keyPrefix, channelID, userID), uploadID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sess MultipartSession
+	if err := json.Unmarshal(data, &sess); err != nil {
+		return nil, err
+	}
+	sess.ChannelID, sess.UserID, sess.UploadID = channelID, userID, uploadID
+	return &sess, nil
+}
+
+// AddPart records a completed part and extends the session, so that only uploads
+// without progress for the whole ttl expire
+func (s MultipartUploadStore) AddPart(ctx context.Context, sess *MultipartSession, part *UploadedPart) error {
+	data, err := json.Marshal(part)
+	if err != nil {
+		return err
+	}
+	partsKey := multipartPartsKey(s.keyPrefix, sess.UploadID)
+	_, err = s.rc.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, partsKey, strconv.Itoa(int(part.PartNumber)), data)
+		pipe.Expire(ctx, partsKey, s.dataTTL())
+		pipe.Expire(ctx, multipartUploadsKey(s.keyPrefix, sess.ChannelID, sess.UserID), s.dataTTL())
+		pipe.ZAddXX(ctx, s.expiryKey(), redis.Z{
+			Score:  float64(time.Now().Add(s.sessionTTL).Unix()),
+			Member: multipartExpiryMember(sess.ChannelID, sess.UserID, sess.UploadID),
+		})
+		return nil
+	})
+	return err
+}
+
+// ListParts returns the completed parts of an upload ordered by part number
+func (s MultipartUploadStore) ListParts(ctx context.Context, uploadID string) ([]UploadedPart, error) {
+	vals, err := s.rc.HGetAll(ctx, multipartPartsKey(s.keyPrefix, uploadID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]UploadedPart, 0, len(vals))
+	for _, val := range vals {
+		var part UploadedPart
+		if err := json.Unmarshal([]byte(val), &part); err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+// Claim takes the upload off the expiry schedule. Only one caller claims an upload, so
+// completing, aborting and expiring it never race with each other
+func (s MultipartUploadStore) Claim(ctx context.Context, sess *MultipartSession) (bool, error) {
+	n, err := s.rc.ZRem(ctx, s.expiryKey(), multipartExpiryMember(sess.ChannelID, sess.UserID, sess.UploadID)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// Unclaim puts a claimed upload back on the expiry schedule, e.g. after completing it failed
+func (s MultipartUploadStore) Unclaim(ctx context.Context, sess *MultipartSession) error {
+	return s.rc.ZAdd(ctx, s.expiryKey(), redis.Z{
+		Score:  float64(time.Now().Add(s.sessionTTL).Unix()),
+		Member: multipartExpiryMember(sess.ChannelID, sess.UserID, sess.UploadID),
+	}).Err()
+}
+
+// Remove deletes a claimed upload and its parts
+func (s MultipartUploadStore) Remove(ctx context.Context, sess *MultipartSession) error {
+	_, err := s.rc.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, multipartUploadsKey(s.keyPrefix, sess.ChannelID, sess.UserID), sess.UploadID)
+		pipe.Del(ctx, multipartPartsKey(s.keyPrefix, sess.UploadID))
+		return nil
+	})
+	return err
+}
+
+// PopExpired claims up to limit uploads that expired before now. The pop is atomic, so
+// each expired upload is handled by exactly one uploader instance
+func (s MultipartUploadStore) PopExpired(ctx context.Context, now time.Time, limit int64) ([]*MultipartSession, error) {
+	members, err := popExpiredUploadsScript.Run(ctx, s.rc, []string{s.expiryKey()}, now.Unix(), limit).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	var sessions []*MultipartSession
+	for _, member := range members {
+		fields := strings.SplitN(member, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		channelID, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		userID, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		sess, err := s.Get(ctx, channelID, userID, fields[2])
+		if err != nil {
+			return nil, err
+		}
+		if sess == nil {
+			continue
+		}
+		sessions = append(sessions, sess)
+	}
+	return sessions, nil
+}
+
+// dataTTL outlives the expiry schedule so that expired uploads can still be looked up
+// and aborted by the sweeper
+func (s MultipartUploadStore) dataTTL() time.Duration {
+	return 2 * s.sessionTTL
+}
+
+func (s MultipartUploadStore) expiryKey() string {
+	return common.PrefixRedisKey(s.keyPrefix, multipartExpiryKey)
+}
+
+func multipartUploadsKey(prefix string, channelID, userID uint64) string {
+	return common.PrefixRedisKey(prefix, common.Join(multipartUploadsPrefix, ":", strconv.FormatUint(channelID, 10), ":", strconv.FormatUint(userID, 10)))
+}
+
+func multipartPartsKey(prefix, uploadID string) string {
+	return common.PrefixRedisKey(prefix, common.Join(multipartPartsPrefix, ":", uploadID))
+}
+
+func multipartExpiryMember(channelID, userID uint64, uploadID string) string {
+	return common.Join(strconv.FormatUint(channelID, 10), ":", strconv.FormatUint(userID, 10), ":", uploadID)
+}
@@ -0,0 +1,119 @@
+package uploader
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+const (
+	postPolicyAlgorithm  = "AWS4-HMAC-SHA256"
+	postPolicyDateFormat = "20060102T150405Z"
+)
+
+// postPolicySigner signs S3 POST policies with SigV4. The SDK only presigns requests, while
+// a POST policy is signed as a whole and sent by the browser as form fields
+type postPolicySigner struct {
+	credentials aws.CredentialsProvider
+	// endpoint is the origin that browsers post forms to, which is not part of the signature
+	endpoint string
+	region   string
+}
+
+func newPostPolicySigner(config *config.Config) postPolicySigner {
+	endpoint := config.Uploader.S3.PublicEndpoint
+	if endpoint == "" {
+		endpoint = config.Uploader.S3.Endpoint
+	}
+	return postPolicySigner{
+		credentials: credentials.NewStaticCredentialsProvider(config.Uploader.S3.AccessKey, config.Uploader.S3.SecretKey, ""),
+		endpoint:    strings.TrimSuffix(endpoint, "/"),
+		region:      config.Uploader.S3.Region,
+	}
+}
+
+// PresignedPost is a form that uploads a file to S3 when posted to URL as multipart/form-data,
+// with the fields before the file
+type PresignedPost struct {
+	URL    string
+	Fields map[string]string
+}
+
+// PostObject makes a presigned POST policy that can be used to upload an object to a bucket
+// from a browser form. The policy only accepts the object key, the content type and exactly
+// size bytes, and expires like presigned requests. Configured server-side encryption is
+// signed as fields the form has to carry.
+func (presigner *Presigner) PostObject(ctx context.Context, bucketName, objectKey, contentType string, size int64) (post *PresignedPost, err error) {
+	_, span := startSpan(ctx, "s3.PresignPostObject", bucketAttr.String(bucketName), objectKeyAttr.String(objectKey), contentTypeAttr.String(contentType), sizeAttr.Int64(size))
+	defer func() { endSpan(span, err) }()
+	creds, err := presigner.post.credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	signingTime := time.Now().UTC().Add(-presigner.clockSkew)
+	date := signingTime.Format("20060102")
+	fields := map[string]string{
+		"key":              objectKey,
+		"Content-Type":     contentType,
+		"x-amz-algorithm":  postPolicyAlgorithm,
+		"x-amz-credential": strings.Join([]string{creds.AccessKeyID, date, presigner.post.region, "s3", "aws4_request"}, "/"),
+		"x-amz-date":       signingTime.Format(postPolicyDateFormat),
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+	for name, value := range presigner.sse.formFields() {
+		fields[name] = value
+	}
+
+	conditions := []interface{}{
+		map[string]string{"bucket": bucketName},
+		[]interface{}{"content-length-range", size, size},
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		conditions = append(conditions, map[string]string{name: fields[name]})
+	}
+	policy, err := json.Marshal(map[string]interface{}{
+		"expiration": signingTime.Add(presigner.expires).Format("2006-01-02T15:04:05.000Z"),
+		"conditions": conditions,
+	})
+	if err != nil {
+		return nil, err
+	}
+	encodedPolicy := base64.StdEncoding.EncodeToString(policy)
+	fields["policy"] = encodedPolicy
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(postPolicySigningKey(creds.SecretAccessKey, date, presigner.post.region), encodedPolicy))
+	return &PresignedPost{
+		URL:    joinStrs(presigner.post.endpoint, "/", bucketName),
+		Fields: fields,
+	}, nil
+}
+
+// postPolicySigningKey derives the SigV4 signing key of the date and region
+func postPolicySigningKey(secretKey, date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
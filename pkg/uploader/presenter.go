@@ -1,8 +1,28 @@
 package uploader
 
+import "github.com/minghsu0107/go-random-chat/pkg/common"
+
 type UploadedFilePresenter struct {
-	Name string `json:"name"`
-	Url  string `json:"url"`
+	Name      string `json:"name"`
+	Url       string `json:"url"`
+	ObjectKey string `json:"object_key"`
+	// Format is set when the file was transcoded before being stored
+	Format string `json:"format,omitempty"`
+	// Thumbnail is set when a thumbnail of the image was stored alongside it
+	Thumbnail bool `json:"thumbnail,omitempty"`
+	// ThumbnailSkipped is set when the image is stored without a thumbnail: too_large if
+	// it has more pixels than thumbnails are generated for, quota if the thumbnail does
+	// not fit in the channel storage quota, and error if it could not be generated or stored
+	ThumbnailSkipped string `json:"thumbnail_skipped,omitempty"`
+	// Deduplicated is set when the file matched an object already stored in the channel,
+	// in which case ObjectKey and Url point to the existing object
+	Deduplicated bool `json:"deduplicated"`
+}
+
+type ReadinessPresenter struct {
+	Status string `json:"status"`
+	// Failed lists the dependencies that could not be reached
+	Failed []string `json:"failed"`
 }
 
 type UploadedFilesPresenter struct {
@@ -11,17 +31,95 @@ type UploadedFilesPresenter struct {
 
 type GetPresignedUploadRequest struct {
 	Extension string `form:"ext" binding:"required"`
+	Size      int64  `form:"size"`
+}
+
+type DeleteFileRequest struct {
+	ObjectKeyBase64 string `form:"okb64" binding:"required"`
 }
 
 type GetPresignedDownloadRequest struct {
 	ObjectKeyBase64 string `form:"okb64" binding:"required"`
+	// Filename is suggested to the browser for saving the download
+	Filename string `form:"filename"`
+	// Variant selects a derived object; "thumb" returns the thumbnail of an image
+	Variant string `form:"variant"`
+}
+
+type InitMultipartUploadRequest struct {
+	Extension string `json:"ext" binding:"required"`
+	// Size is the size of the whole file, which bounds the parts
+	Size int64 `json:"size" binding:"required"`
+}
+
+type UploadPartRequest struct {
+	UploadID   string `form:"upload_id" binding:"required"`
+	PartNumber int32  `form:"part_number" binding:"required,min=1,max=10000"`
+}
+
+type MultipartUploadRequest struct {
+	UploadID string `form:"upload_id" binding:"required"`
+}
+
+type CompleteMultipartUploadRequest struct {
+	UploadID string `json:"upload_id" binding:"required"`
+}
+
+type MultipartUpload struct {
+	UploadID  string `json:"upload_id"`
+	ObjectKey string `json:"object_key"`
+}
+
+type UploadedPartPresenter struct {
+	PartNumber int32  `json:"part_number"`
+	ETag       string `json:"etag"`
+	Start      int64  `json:"start"`
+	End        int64  `json:"end"`
+}
+
+type MultipartUploadPartsPresenter struct {
+	UploadID  string                  `json:"upload_id"`
+	ObjectKey string                  `json:"object_key"`
+	Size      int64                   `json:"size"`
+	Parts     []UploadedPartPresenter `json:"parts"`
+}
+
+func toUploadedPartPresenter(part *UploadedPart) *UploadedPartPresenter {
+	return &UploadedPartPresenter{
+		PartNumber: part.PartNumber,
+		ETag:       part.ETag,
+		Start:      part.Start,
+		End:        part.End,
+	}
 }
 
 type PresignedUpload struct {
 	ObjectKey string `json:"object_key"`
 	Url       string `json:"url"`
+	// Headers are signed into the url and must be sent with the upload
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// PresignedPostUpload is a form that browsers post the file to, as the last field after
+// all of Fields
+type PresignedPostUpload struct {
+	ObjectKey string            `json:"object_key"`
+	Url       string            `json:"url"`
+	Fields    map[string]string `json:"fields"`
 }
 
 type PresignedDownload struct {
 	Url string `json:"url"`
 }
+
+type PresignedDownloadBatchItem struct {
+	ObjectKeyBase64 string `json:"okb64"`
+	Filename        string `json:"filename"`
+	Variant         string `json:"variant"`
+}
+
+// PresignedDownloadBatchResult holds either the url of a key or the reason it was refused
+type PresignedDownloadBatchResult struct {
+	Url   string              `json:"url,omitempty"`
+	Error *common.ErrResponse `json:"error,omitempty"`
+}
@@ -3,6 +3,7 @@ package uploader
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -10,20 +11,82 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
+// maxPresignLifetime is the longest validity S3 accepts for a SigV4 presigned URL
+const maxPresignLifetime = 7 * 24 * time.Hour
+
+// Presigner creates presigned S3 requests.
+//
+// A non-zero clock skew backdates the signing time by the skew and extends the expiration
+// by twice the skew, so a URL is accepted from (now - skew) to (now + lifetime + skew).
+// This absorbs clock drift between this server, S3 and clients, at the cost of every URL
+// staying valid for up to 2*skew longer than the configured lifetime. The resulting
+// expiration is clamped to the 7-day limit of S3.
 type Presigner struct {
-	presignClient  *s3.PresignClient
-	lifetimeSecond int64
+	presignClient *s3.PresignClient
+	post          postPolicySigner
+	expires       time.Duration
+	clockSkew     time.Duration
+	sse           serverSideEncryption
+}
+
+func NewPresigner(presignClient *s3.PresignClient, post postPolicySigner, lifetimeSecond, clockSkewSecond int64, sse serverSideEncryption) *Presigner {
+	clockSkew := time.Duration(clockSkewSecond) * time.Second
+	if clockSkew < 0 {
+		clockSkew = 0
+	}
+	expires := time.Duration(lifetimeSecond)*time.Second + 2*clockSkew
+	if expires > maxPresignLifetime {
+		expires = maxPresignLifetime
+	}
+	return &Presigner{
+		presignClient: presignClient,
+		post:          post,
+		expires:       expires,
+		clockSkew:     clockSkew,
+		sse:           sse,
+	}
+}
+
+// skewedSigner signs requests as if they were signed clockSkew earlier
+type skewedSigner struct {
+	s3.HTTPPresignerV4
+	clockSkew time.Duration
+}
+
+func (s skewedSigner) PresignHTTP(
+	ctx context.Context, credentials aws.Credentials, r *http.Request,
+	payloadHash string, service string, region string, signingTime time.Time,
+	optFns ...func(*v4.SignerOptions),
+) (string, http.Header, error) {
+	return s.HTTPPresignerV4.PresignHTTP(ctx, credentials, r, payloadHash, service, region, signingTime.Add(-s.clockSkew), optFns...)
+}
+
+// Expires returns how long presigned requests stay valid
+func (presigner *Presigner) Expires() time.Duration {
+	return presigner.expires
+}
+
+func (presigner *Presigner) applyOptions(opts *s3.PresignOptions) {
+	opts.Expires = presigner.expires
+	if presigner.clockSkew > 0 {
+		opts.Presigner = skewedSigner{opts.Presigner, presigner.clockSkew}
+	}
 }
 
 // GetObject makes a presigned request that can be used to get an object from a bucket.
-// The presigned request is valid for the specified number of seconds.
-func (presigner *Presigner) GetObject(ctx context.Context, bucketName string, objectKey string) (*v4.PresignedHTTPRequest, error) {
-	request, err := presigner.presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+// The presigned request is valid for the specified number of seconds. A non-empty filename
+// makes S3 serve the object as an attachment with that name.
+func (presigner *Presigner) GetObject(ctx context.Context, bucketName string, objectKey string, filename string) (request *v4.PresignedHTTPRequest, err error) {
+	ctx, span := startSpan(ctx, "s3.PresignGetObject", bucketAttr.String(bucketName), objectKeyAttr.String(objectKey))
+	defer func() { endSpan(span, err) }()
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucketName),
 		Key:    aws.String(objectKey),
-	}, func(opts *s3.PresignOptions) {
-		opts.Expires = time.Duration(presigner.lifetimeSecond * int64(time.Second))
-	})
+	}
+	if filename != "" {
+		input.ResponseContentDisposition = aws.String(attachmentDisposition(filename))
+	}
+	request, err = presigner.presignClient.PresignGetObject(ctx, input, presigner.applyOptions)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get a presigned request to get %v:%v, reason: %v", bucketName, objectKey, err)
 	}
@@ -31,14 +94,19 @@ func (presigner *Presigner) GetObject(ctx context.Context, bucketName string, ob
 }
 
 // PutObject makes a presigned request that can be used to put an object in a bucket.
-// The presigned request is valid for the specified number of seconds.
-func (presigner *Presigner) PutObject(ctx context.Context, bucketName string, objectKey string) (*v4.PresignedHTTPRequest, error) {
-	request, err := presigner.presignClient.PresignPutObject(ctx, &s3.PutObjectInput{
-		Bucket: aws.String(bucketName),
-		Key:    aws.String(objectKey),
-	}, func(opts *s3.PresignOptions) {
-		opts.Expires = time.Duration(presigner.lifetimeSecond * int64(time.Second))
-	})
+// The presigned request is valid for the specified number of seconds. The size is signed
+// as the content length, so S3 rejects uploads of any other size. Configured server-side
+// encryption is signed as headers the upload has to carry.
+func (presigner *Presigner) PutObject(ctx context.Context, bucketName string, objectKey string, size int64) (request *v4.PresignedHTTPRequest, err error) {
+	ctx, span := startSpan(ctx, "s3.PresignPutObject", bucketAttr.String(bucketName), objectKeyAttr.String(objectKey), sizeAttr.Int64(size))
+	defer func() { endSpan(span, err) }()
+	input := &s3.PutObjectInput{
+		Bucket:        aws.String(bucketName),
+		Key:           aws.String(objectKey),
+		ContentLength: size,
+	}
+	presigner.sse.applyPut(input)
+	request, err = presigner.presignClient.PresignPutObject(ctx, input, presigner.applyOptions)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't get a presigned request to put %v:%v, reason: %v", bucketName, objectKey, err)
 	}
@@ -0,0 +1,79 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+// newPresignClient creates the client that signs presigned URLs. With a public endpoint,
+// URLs are signed for the public host instead of having the host of URLs signed for the
+// internal endpoint replaced, since the host is part of the SigV4 signature. They verify as
+// long as the reverse proxy forwards the Host header unchanged, as MinIO requires
+func newPresignClient(config *config.Config, s3Client *s3.Client) (*s3.PresignClient, error) {
+	publicEndpoint := config.Uploader.S3.PublicEndpoint
+	if publicEndpoint == "" {
+		return s3.NewPresignClient(s3Client), nil
+	}
+	if err := validatePublicEndpoint(publicEndpoint); err != nil {
+		return nil, err
+	}
+	region := config.Uploader.S3.Region
+	return s3.NewPresignClient(s3Client, s3.WithPresignClientFromClientOptions(func(o *s3.Options) {
+		o.EndpointResolver = s3.EndpointResolverFromURL(publicEndpoint, func(e *aws.Endpoint) {
+			e.PartitionID = "aws"
+			e.SigningRegion = region
+			e.HostnameImmutable = true
+		})
+	})), nil
+}
+
+// validatePublicEndpoint checks that the public endpoint is an http(s) origin. A path prefix
+// is rejected because the path is signed too, and a proxy stripping it breaks the signature
+func validatePublicEndpoint(publicEndpoint string) error {
+	u, err := url.Parse(publicEndpoint)
+	if err != nil {
+		return fmt.Errorf("invalid s3 public endpoint %q: %w", publicEndpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("s3 public endpoint %q must be an absolute http or https url", publicEndpoint)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return fmt.Errorf("s3 public endpoint %q must not have a path, query, fragment or credentials", publicEndpoint)
+	}
+	return nil
+}
+
+// checkPublicPresign verifies that a URL presigned for the public endpoint is accepted.
+// It gets a random key, so S3 answers 404 if the signature verifies and 403 otherwise
+func (r *HttpServer) checkPublicPresign(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s3CheckTimeout)
+	defer cancel()
+	bucket := r.buckets.Buckets()[0]
+	res, err := r.presigner.GetObject(ctx, bucket, uuid.New().String(), "")
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, res.Method, res.URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = res.SignedHeader.Clone()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error reach s3 public endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNotFound && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("presigned url through s3 public endpoint rejected with status %d", resp.StatusCode)
+	}
+	return nil
+}
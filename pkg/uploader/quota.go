@@ -0,0 +1,286 @@
+package uploader
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/redis/go-redis/v9"
+)
+
+const channelStorageUsageHeader = "X-Channel-Storage-Usage"
+
+// channelStorageUsagePrefix is shared with the chat service, which drops the counter on channel deletion
+const channelStorageUsagePrefix = "rc:channelstorage"
+
+// storageHoldsKey schedules the reservations of presigned uploads to be reconciled
+const storageHoldsKey = "rc:storageholds"
+
+// ChannelStorageQuota tracks the total bytes uploaded to each channel
+type ChannelStorageQuota struct {
+	rc        redis.UniversalClient
+	keyPrefix string
+	maxBytes  int64
+}
+
+var reserveStorageScript = redis.NewScript(`
+local key = KEYS[1]
+local n = tonumber(ARGV[1])
+local max_bytes = tonumber(ARGV[2])
+local usage = tonumber(redis.call("GET", key) or "0")
+if usage + n > max_bytes then
+  return { 0, usage }
+end
+return { 1, redis.call("INCRBY", key, n) }
+`)
+
+var releaseStorageScript = redis.NewScript(`
+local key = KEYS[1]
+local n = tonumber(ARGV[1])
+local usage = tonumber(redis.call("GET", key) or "0")
+if usage <= n then
+  redis.call("DEL", key)
+  return 0
+end
+return redis.call("DECRBY", key, n)
+`)
+
+func NewChannelStorageQuota(rc redis.UniversalClient, config *config.Config) ChannelStorageQuota {
+	return ChannelStorageQuota{
+		rc:        rc,
+		keyPrefix: config.Redis.KeyPrefix,
+		maxBytes:  config.Uploader.Quota.MaxBytesPerChannel,
+	}
+}
+
+// Enabled reports whether a per-channel cap is configured
+func (q ChannelStorageQuota) Enabled() bool {
+	return q.maxBytes > 0
+}
+
+// Reserve adds n bytes to the channel usage unless that would exceed the cap.
+// It returns whether the bytes were reserved and the resulting usage
+func (q ChannelStorageQuota) Reserve(ctx context.Context, channelID uint64, n int64) (bool, int64, error) {
+	if !q.Enabled() {
+		return true, 0, nil
+	}
+	rs, err := reserveStorageScript.Run(ctx, q.rc, []string{channelStorageUsageKey(q.keyPrefix, channelID)}, n, q.maxBytes).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return rs[0] == 1, rs[1], nil
+}
+
+// Release subtracts n bytes from the channel usage, never going below zero
+func (q ChannelStorageQuota) Release(ctx context.Context, channelID uint64, n int64) (int64, error) {
+	if !q.Enabled() || n <= 0 {
+		return 0, nil
+	}
+	return releaseStorageScript.Run(ctx, q.rc, []string{channelStorageUsageKey(q.keyPrefix, channelID)}, n).Int64()
+}
+
+// StorageHold is the storage reserved for a presigned upload, which is uploaded to S3
+// directly, so the uploader cannot tell whether the upload ever happens
+type StorageHold struct {
+	ChannelID uint64
+	Size      int64
+	ObjectKey string
+}
+
+func (h StorageHold) member() string {
+	return common.Join(strconv.FormatUint(h.ChannelID, 10), ":", strconv.FormatInt(h.Size, 10), ":", h.ObjectKey)
+}
+
+// Hold schedules the reservation of a presigned upload to be reconciled at the given time
+func (q ChannelStorageQuota) Hold(ctx context.Context, hold StorageHold, at time.Time) error {
+	if !q.Enabled() {
+		return nil
+	}
+	return q.rc.ZAdd(ctx, q.holdsKey(), redis.Z{Score: float64(at.Unix()), Member: hold.member()}).Err()
+}
+
+// DropHold cancels the reconciliation of a reservation, e.g. once its object is deleted
+// and the bytes are released
+func (q ChannelStorageQuota) DropHold(ctx context.Context, hold StorageHold) error {
+	if !q.Enabled() {
+		return nil
+	}
+	return q.rc.ZRem(ctx, q.holdsKey(), hold.member()).Err()
+}
+
+// PopDueHolds claims up to limit reservations due for reconciliation before now. The pop is
+// atomic, so each reservation is reconciled by exactly one uploader instance
+func (q ChannelStorageQuota) PopDueHolds(ctx context.Context, now time.Time, limit int64) ([]StorageHold, error) {
+	members, err := popExpiredUploadsScript.Run(ctx, q.rc, []string{q.holdsKey()}, now.Unix(), limit).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	var holds []StorageHold
+	for _, member := range members {
+		fields := strings.SplitN(member, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		channelID, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		holds = append(holds, StorageHold{ChannelID: channelID, Size: size, ObjectKey: fields[2]})
+	}
+	return holds, nil
+}
+
+func (q ChannelStorageQuota) holdsKey() string {
+	return common.PrefixRedisKey(q.keyPrefix, storageHoldsKey)
+}
+
+func channelStorageUsageKey(prefix string, channelID uint64) string {
+	return common.PrefixRedisKey(prefix, common.Join(channelStorageUsagePrefix, ":", strconv.FormatUint(channelID, 10)))
+}
+
+const userUploadQuotaPrefix = "rc:useruploadquota"
+
+// UserUploadQuota caps the bytes a user uploads to a channel within a sliding window.
+// Every reservation is kept with its time so that bytes leave the window exactly when
+// they are older than the window
+type UserUploadQuota struct {
+	rc         redis.UniversalClient
+	keyPrefix  string
+	maxBytes   int64
+	window     time.Duration
+	expiration time.Duration
+}
+
+// UserUploadReservation is the bytes charged to a user by a single upload request
+type UserUploadReservation struct {
+	channelID uint64
+	userID    uint64
+	id        string
+}
+
+var reserveUserUploadScript = redis.NewScript(`
+local times_key = KEYS[1]
+local bytes_key = KEYS[2]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local n = tonumber(ARGV[3])
+local max_bytes = tonumber(ARGV[4])
+local id = ARGV[5]
+local ttl = tonumber(ARGV[6])
+local expired = redis.call("ZRANGEBYSCORE", times_key, "-inf", now - window)
+if #expired > 0 then
+  redis.call("ZREM", times_key, unpack(expired))
+  redis.call("HDEL", bytes_key, unpack(expired))
+end
+local usage = 0
+for _, v in ipairs(redis.call("HVALS", bytes_key)) do
+  usage = usage + tonumber(v)
+end
+if usage + n > max_bytes then
+  return { 0, usage }
+end
+if id ~= "" and n > 0 then
+  redis.call("ZADD", times_key, now, id)
+  redis.call("HSET", bytes_key, id, n)
+  redis.call("EXPIRE", times_key, ttl)
+  redis.call("EXPIRE", bytes_key, ttl)
+end
+return { 1, usage + n }
+`)
+
+var releaseUserUploadScript = redis.NewScript(`
+local times_key = KEYS[1]
+local bytes_key = KEYS[2]
+local id = ARGV[1]
+local n = tonumber(ARGV[2])
+if redis.call("HEXISTS", bytes_key, id) == 0 then
+  return 0
+end
+local left = redis.call("HINCRBY", bytes_key, id, -n)
+if left <= 0 then
+  redis.call("HDEL", bytes_key, id)
+  redis.call("ZREM", times_key, id)
+  return 0
+end
+return left
+`)
+
+func NewUserUploadQuota(rc redis.UniversalClient, config *config.Config) UserUploadQuota {
+	window := time.Duration(config.Uploader.RateLimit.UserUploadQuota.WindowSecond) * time.Second
+	expiration := time.Duration(config.Redis.ExpirationHour) * time.Hour
+	// entries must outlive the window to be counted
+	if expiration < window {
+		expiration = window
+	}
+	return UserUploadQuota{
+		rc:         rc,
+		keyPrefix:  config.Redis.KeyPrefix,
+		maxBytes:   config.Uploader.RateLimit.UserUploadQuota.MaxBytesPerWindow,
+		window:     window,
+		expiration: expiration,
+	}
+}
+
+// Enabled reports whether a per-user cap is configured
+func (q UserUploadQuota) Enabled() bool {
+	return q.maxBytes > 0
+}
+
+// Allow reports whether n more bytes fit in the window of the user without reserving them
+func (q UserUploadQuota) Allow(ctx context.Context, channelID, userID uint64, n int64) (bool, error) {
+	if !q.Enabled() {
+		return true, nil
+	}
+	ok, _, err := q.run(ctx, channelID, userID, n, "")
+	return ok, err
+}
+
+// Reserve charges n bytes to the window of the user unless that would exceed the cap.
+// The returned reservation is nil if nothing was charged
+func (q UserUploadQuota) Reserve(ctx context.Context, channelID, userID uint64, n int64) (bool, *UserUploadReservation, error) {
+	if !q.Enabled() || n <= 0 {
+		return true, nil, nil
+	}
+	id := uuid.New().String()
+	ok, _, err := q.run(ctx, channelID, userID, n, id)
+	if err != nil || !ok {
+		return false, nil, err
+	}
+	return true, &UserUploadReservation{
+		channelID: channelID,
+		userID:    userID,
+		id:        id,
+	}, nil
+}
+
+// Release returns n bytes of a reservation, e.g. for files that failed to upload
+func (q UserUploadQuota) Release(ctx context.Context, reservation *UserUploadReservation, n int64) error {
+	if reservation == nil || n <= 0 {
+		return nil
+	}
+	return releaseUserUploadScript.Run(ctx, q.rc, userUploadQuotaKeys(q.keyPrefix, reservation.channelID, reservation.userID), reservation.id, n).Err()
+}
+
+func (q UserUploadQuota) run(ctx context.Context, channelID, userID uint64, n int64, id string) (bool, int64, error) {
+	rs, err := reserveUserUploadScript.Run(ctx, q.rc, userUploadQuotaKeys(q.keyPrefix, channelID, userID),
+		time.Now().UnixMilli(), q.window.Milliseconds(), n, q.maxBytes, id, int64(q.expiration.Seconds())).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return rs[0] == 1, rs[1], nil
+}
+
+func userUploadQuotaKeys(prefix string, channelID, userID uint64) []string {
+	// force keys to be hashed to the same slot
+	key := common.Join("{", common.PrefixRedisKey(prefix, common.Join(userUploadQuotaPrefix, ":", strconv.FormatUint(channelID, 10), ":", strconv.FormatUint(userID, 10))), "}")
+	return []string{common.Join(key, ":ts"), common.Join(key, ":bytes")}
+}
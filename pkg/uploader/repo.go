@@ -0,0 +1,40 @@
+package uploader
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/minghsu0107/go-random-chat/pkg/transport"
+	userpb "github.com/minghsu0107/go-random-chat/proto/user"
+)
+
+type UserRepo interface {
+	GetUserIDBySession(ctx context.Context, sid string) (uint64, error)
+}
+
+type UserRepoImpl struct {
+	getUserIDBySession endpoint.Endpoint
+}
+
+func NewUserRepoImpl(userConn *UserClientConn) *UserRepoImpl {
+	return &UserRepoImpl{
+		getUserIDBySession: transport.NewGrpcEndpoint(
+			userConn.Conn,
+			"user",
+			"user.UserService",
+			"GetUserIdBySession",
+			&userpb.GetUserIdBySessionResponse{},
+		),
+	}
+}
+
+func (repo *UserRepoImpl) GetUserIDBySession(ctx context.Context, sid string) (uint64, error) {
+	res, err := repo.getUserIDBySession(ctx, &userpb.GetUserIdBySessionRequest{
+		Sid: sid,
+	})
+	if err != nil {
+		return 0, err
+	}
+	pbUserID := res.(*userpb.GetUserIdBySessionResponse)
+	return pbUserID.UserId, nil
+}
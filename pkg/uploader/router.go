@@ -2,22 +2,30 @@ package uploader
 
 import (
 	"context"
+	"time"
 
 	"github.com/minghsu0107/go-random-chat/pkg/common"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
 )
 
 type Router struct {
-	httpServer common.HttpServer
+	httpServer      common.HttpServer
+	shutdownTimeout time.Duration
 }
 
-func NewRouter(httpServer common.HttpServer) *Router {
-	return &Router{httpServer}
+func NewRouter(config *config.Config, httpServer common.HttpServer) *Router {
+	return &Router{httpServer, time.Duration(config.Uploader.Http.Server.ShutdownTimeoutSecond) * time.Second}
 }
 
 func (r *Router) Run() {
 	r.httpServer.RegisterRoutes()
 	r.httpServer.Run()
 }
+
+// ShutdownTimeout implements common.ShutdownTimeouter
+func (r *Router) ShutdownTimeout() time.Duration {
+	return r.shutdownTimeout
+}
 func (r *Router) GracefulStop(ctx context.Context) error {
 	return r.httpServer.GracefulStop(ctx)
 }
@@ -0,0 +1,64 @@
+package uploader
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+// newS3Client creates the S3 client of the uploader with the retry, timeout and connection
+// pool settings of the config. Zero settings keep the defaults of the SDK
+func newS3Client(config *config.Config) *s3.Client {
+	s3Config := config.Uploader.S3
+	creds := credentials.NewStaticCredentialsProvider(s3Config.AccessKey, s3Config.SecretKey, "")
+	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		return aws.Endpoint{
+			PartitionID:       "aws",
+			URL:               s3Config.Endpoint,
+			SigningRegion:     s3Config.Region,
+			HostnameImmutable: true,
+		}, nil
+	})
+	httpClient := awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+		if s3Config.Client.MaxIdleConns > 0 {
+			t.MaxIdleConns = s3Config.Client.MaxIdleConns
+		}
+		if s3Config.Client.MaxIdleConnsPerHost > 0 {
+			t.MaxIdleConnsPerHost = s3Config.Client.MaxIdleConnsPerHost
+		}
+		if s3Config.Client.MaxConnsPerHost > 0 {
+			t.MaxConnsPerHost = s3Config.Client.MaxConnsPerHost
+		}
+		if s3Config.Client.IdleConnTimeoutSecond > 0 {
+			t.IdleConnTimeout = time.Duration(s3Config.Client.IdleConnTimeoutSecond) * time.Second
+		}
+	})
+	if s3Config.Client.RequestTimeoutSecond > 0 {
+		httpClient = httpClient.WithTimeout(time.Duration(s3Config.Client.RequestTimeoutSecond) * time.Second)
+	}
+	awsConfig := aws.Config{
+		Credentials:                 creds,
+		EndpointResolverWithOptions: customResolver,
+		Region:                      s3Config.Region,
+		RetryMaxAttempts:            s3Config.Client.RetryMaxAttempts,
+		HTTPClient:                  httpClient,
+	}
+	return s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.UsePathStyle = true
+	})
+}
+
+// withS3Timeout bounds an S3 operation, including its retries, by the timeout. A zero
+// timeout leaves the operation bounded by ctx only
+func withS3Timeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,114 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	s3UploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "uploader",
+		Name:      "s3_upload_duration_seconds",
+		Help:      "Duration of uploads of objects to S3, by bucket and result.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"bucket", "result"})
+	s3UploadSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "uploader",
+		Name:      "s3_upload_size_bytes",
+		Help:      "Size of objects uploaded to S3, by bucket and result.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 11),
+	}, []string{"bucket", "result"})
+	s3UploadErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "uploader",
+		Name:      "s3_upload_errors_total",
+		Help:      "Total number of failed uploads of objects to S3, by bucket and error category.",
+	}, []string{"bucket", "category"})
+)
+
+// s3 error codes that count as auth or quota failures; the quota codes include the ones
+// returned by MinIO
+var (
+	s3AuthErrorCodes = map[string]bool{
+		"AccessDenied":          true,
+		"InvalidAccessKeyId":    true,
+		"SignatureDoesNotMatch": true,
+		"ExpiredToken":          true,
+		"InvalidToken":          true,
+	}
+	s3QuotaErrorCodes = map[string]bool{
+		"QuotaExceeded":                  true,
+		"EntityTooLarge":                 true,
+		"XMinioStorageFull":              true,
+		"XMinioAdminBucketQuotaExceeded": true,
+	}
+)
+
+// observeS3Upload records the duration and size of an upload and, if it failed, its error category
+func observeS3Upload(bucket string, start time.Time, size int64, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+		s3UploadErrorsTotal.WithLabelValues(bucket, s3ErrorCategory(err)).Inc()
+	}
+	s3UploadDuration.WithLabelValues(bucket, result).Observe(time.Since(start).Seconds())
+	s3UploadSize.WithLabelValues(bucket, result).Observe(float64(size))
+}
+
+// s3ErrorCategory classifies an upload error as auth, quota, throttled, network, canceled or other
+func s3ErrorCategory(err error) string {
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) {
+		switch code := apiErr.ErrorCode(); {
+		case s3AuthErrorCodes[code]:
+			return "auth"
+		case s3QuotaErrorCodes[code]:
+			return "quota"
+		case s3ThrottleErrorCodes[code]:
+			return "throttled"
+		}
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return "network"
+	}
+	return "other"
+}
+
+// measureBody returns the body to upload and a func reporting its size once uploaded.
+// Seekable bodies are measured upfront and passed through unchanged, so that the uploader
+// can still read them without buffering; other bodies are counted as they are read
+func measureBody(f io.Reader) (io.Reader, func() int64) {
+	if s, ok := f.(io.Seeker); ok {
+		cur, err := s.Seek(0, io.SeekCurrent)
+		if err == nil {
+			end, err := s.Seek(0, io.SeekEnd)
+			if _, seekErr := s.Seek(cur, io.SeekStart); err == nil && seekErr == nil {
+				return f, func() int64 { return end - cur }
+			}
+		}
+	}
+	body := &countingReader{r: f}
+	return body, func() int64 { return body.n }
+}
+
+// countingReader counts the bytes read from the wrapped reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
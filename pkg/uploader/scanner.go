@@ -0,0 +1,146 @@
+package uploader
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var scannedFilesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "uploader",
+	Name:      "scanned_files_total",
+	Help:      "Total number of uploaded files scanned before being stored, by result.",
+}, []string{"result"})
+
+// UploadScanner inspects uploaded content before it is stored. Scan reports whether the
+// content is clean; flagged content yields false with an error wrapping ErrFileFlagged
+// that carries the reason, while other errors mean the scan itself failed
+type UploadScanner interface {
+	Scan(ctx context.Context, r io.Reader) (bool, error)
+}
+
+func NewUploadScanner(config *config.Config) (UploadScanner, error) {
+	if !config.Uploader.Scan.Enabled {
+		return NoopScanner{}, nil
+	}
+	if config.Uploader.Scan.ClamAV.ChunkByte <= 0 {
+		return nil, fmt.Errorf("uploader.scan.clamav.chunkByte %d must be positive", config.Uploader.Scan.ClamAV.ChunkByte)
+	}
+	return &ClamAVScanner{
+		addr:      config.Uploader.Scan.ClamAV.Address,
+		timeout:   time.Duration(config.Uploader.Scan.ClamAV.TimeoutSecond) * time.Second,
+		chunkSize: config.Uploader.Scan.ClamAV.ChunkByte,
+	}, nil
+}
+
+// NoopScanner accepts all content without reading it
+type NoopScanner struct{}
+
+func (NoopScanner) Scan(ctx context.Context, r io.Reader) (bool, error) {
+	return true, nil
+}
+
+// ClamAVScanner scans content with clamd over TCP using the INSTREAM command. Content is
+// streamed in chunks through a buffer of chunkSize bytes, so a file is never held in memory
+// as a whole
+type ClamAVScanner struct {
+	addr      string
+	timeout   time.Duration
+	chunkSize int
+}
+
+func (s *ClamAVScanner) Scan(ctx context.Context, r io.Reader) (bool, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(s.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return false, err
+	}
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return false, err
+	}
+	chunk := make([]byte, s.chunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return false, err
+			}
+			if _, err := conn.Write(chunk[:n]); err != nil {
+				return false, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	// a zero-length chunk ends the stream
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return false, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadBytes(0)
+	if err != nil {
+		return false, err
+	}
+	return parseClamAVReply(string(bytes.TrimRight(reply, "\x00")))
+}
+
+// parseClamAVReply parses replies of the form "stream: OK", "stream: <signature> FOUND"
+// and "<message> ERROR"
+func parseClamAVReply(reply string) (bool, error) {
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return true, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return false, fmt.Errorf("%w: %s", ErrFileFlagged, strings.TrimSuffix(result, " FOUND"))
+	default:
+		return false, fmt.Errorf("clamd scan error: %s", result)
+	}
+}
+
+// scanFile runs the scanner over the body and rewinds it so that it can be stored afterwards.
+// Flagged content yields an error wrapping ErrFileFlagged
+func scanFile(ctx context.Context, scanner UploadScanner, body io.ReadSeeker) error {
+	clean, err := scanner.Scan(ctx, body)
+	if !clean && err == nil {
+		err = ErrFileFlagged
+	}
+	switch {
+	case clean && err == nil:
+		scannedFilesTotal.WithLabelValues("clean").Inc()
+	case errors.Is(err, ErrFileFlagged):
+		scannedFilesTotal.WithLabelValues("flagged").Inc()
+		return err
+	default:
+		scannedFilesTotal.WithLabelValues("error").Inc()
+		return err
+	}
+	_, err = body.Seek(0, io.SeekStart)
+	return err
+}
@@ -0,0 +1,26 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+)
+
+type UserService interface {
+	GetUserIDBySession(ctx context.Context, sid string) (uint64, error)
+}
+
+type UserServiceImpl struct {
+	userRepo UserRepo
+}
+
+func NewUserServiceImpl(userRepo UserRepo) *UserServiceImpl {
+	return &UserServiceImpl{userRepo}
+}
+
+func (svc *UserServiceImpl) GetUserIDBySession(ctx context.Context, sid string) (uint64, error) {
+	userID, err := svc.userRepo.GetUserIDBySession(ctx, sid)
+	if err != nil {
+		return 0, fmt.Errorf("error get user id by sid %s: %w", sid, err)
+	}
+	return userID, nil
+}
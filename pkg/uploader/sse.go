@@ -0,0 +1,84 @@
+package uploader
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+// serverSideEncryption is the S3 server-side encryption requested for every stored object.
+// The zero value requests none and leaves the bucket default in effect
+type serverSideEncryption struct {
+	algorithm types.ServerSideEncryption
+	kmsKeyID  string
+}
+
+func newServerSideEncryption(config *config.Config) (serverSideEncryption, error) {
+	sse := config.Uploader.S3.SSE
+	switch algorithm := types.ServerSideEncryption(sse.Algorithm); algorithm {
+	case "":
+		return serverSideEncryption{}, nil
+	case types.ServerSideEncryptionAes256:
+		return serverSideEncryption{algorithm: algorithm}, nil
+	case types.ServerSideEncryptionAwsKms:
+		if sse.KMSKeyID == "" {
+			return serverSideEncryption{}, fmt.Errorf("s3 sse algorithm %s requires a kms key id", algorithm)
+		}
+		return serverSideEncryption{algorithm: algorithm, kmsKeyID: sse.KMSKeyID}, nil
+	default:
+		return serverSideEncryption{}, fmt.Errorf("unsupported s3 sse algorithm %q", sse.Algorithm)
+	}
+}
+
+func (sse serverSideEncryption) applyPut(input *s3.PutObjectInput) {
+	if sse.algorithm == "" {
+		return
+	}
+	input.ServerSideEncryption = sse.algorithm
+	if sse.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(sse.kmsKeyID)
+	}
+}
+
+func (sse serverSideEncryption) applyMultipart(input *s3.CreateMultipartUploadInput) {
+	if sse.algorithm == "" {
+		return
+	}
+	input.ServerSideEncryption = sse.algorithm
+	if sse.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(sse.kmsKeyID)
+	}
+}
+
+// formFields returns the fields requesting the encryption in a POST policy form
+func (sse serverSideEncryption) formFields() map[string]string {
+	if sse.algorithm == "" {
+		return nil
+	}
+	fields := map[string]string{"x-amz-server-side-encryption": string(sse.algorithm)}
+	if sse.kmsKeyID != "" {
+		fields["x-amz-server-side-encryption-aws-kms-key-id"] = sse.kmsKeyID
+	}
+	return fields
+}
+
+// amzSignedHeaders returns the x-amz-* headers a presigned request is signed with,
+// which the client has to send along for the signature to match
+func amzSignedHeaders(signed http.Header) map[string]string {
+	var headers map[string]string
+	for name, vals := range signed {
+		if len(vals) == 0 || !strings.HasPrefix(strings.ToLower(name), "x-amz-") {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[name] = strings.Join(vals, ",")
+	}
+	return headers
+}
@@ -0,0 +1,107 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/smithy-go"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var s3ThrottledTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "uploader",
+	Name:      "s3_throttled_total",
+	Help:      "Total number of S3 requests rejected by throttling after retries, by bucket and operation.",
+}, []string{"bucket", "operation"})
+
+// s3 error codes of throttled requests, including the generic ones of the sdk
+var s3ThrottleErrorCodes = map[string]bool{
+	"SlowDown":                   true,
+	"Throttling":                 true,
+	"ThrottlingException":        true,
+	"ThrottledException":         true,
+	"RequestThrottled":           true,
+	"RequestLimitExceeded":       true,
+	"TooManyRequests":            true,
+	"ServiceUnavailable":         true,
+	"XMinioServerNotInitialized": true,
+}
+
+// isS3Throttled reports whether err is S3 asking the client to slow down
+func isS3Throttled(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && s3ThrottleErrorCodes[apiErr.ErrorCode()]
+}
+
+// s3Backoff computes the Retry-After returned while S3 is throttling. Every throttled
+// request in a row doubles the delay up to the max, and a successful request resets it.
+// Up to half of the delay is added as jitter so that clients do not retry in lockstep
+type s3Backoff struct {
+	base   time.Duration
+	max    time.Duration
+	streak atomic.Int32
+}
+
+func newS3Backoff(baseSecond, maxSecond int64) *s3Backoff {
+	base := time.Duration(baseSecond) * time.Second
+	if base <= 0 {
+		base = time.Second
+	}
+	max := time.Duration(maxSecond) * time.Second
+	if max < base {
+		max = base
+	}
+	return &s3Backoff{
+		base: base,
+		max:  max,
+	}
+}
+
+// Throttled records a throttled request and returns how long the client should wait
+func (b *s3Backoff) Throttled() time.Duration {
+	streak := b.streak.Add(1)
+	delay := b.max
+	if shift := streak - 1; shift < 32 {
+		if d := b.base << shift; d > 0 && d < b.max {
+			delay = d
+		}
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Succeeded resets the delay once S3 accepts requests again
+func (b *s3Backoff) Succeeded() {
+	if b.streak.Load() != 0 {
+		b.streak.Store(0)
+	}
+}
+
+// responseS3Error responds to a failed S3 write. Throttling and a full instance are answered
+// with 503 and a Retry-After header, a write past its timeout with 504; other errors fail
+// with ErrUploadFile
+func (r *HttpServer) responseS3Error(c *gin.Context, bucket, operation string, err error) {
+	if errors.Is(err, ErrInstanceBusy) {
+		c.Header("Retry-After", "1")
+		response(c, http.StatusServiceUnavailable, ErrInstanceBusy)
+		return
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		response(c, http.StatusGatewayTimeout, ErrS3Timeout)
+		return
+	}
+	if !isS3Throttled(err) {
+		response(c, http.StatusInternalServerError, ErrUploadFile)
+		return
+	}
+	s3ThrottledTotal.WithLabelValues(bucket, operation).Inc()
+	retryAfter := r.s3Backoff.Throttled()
+	c.Header("Retry-After", strconv.FormatInt(int64((retryAfter+time.Second-1)/time.Second), 10))
+	response(c, http.StatusServiceUnavailable, ErrS3Throttled)
+}
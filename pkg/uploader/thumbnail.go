@@ -0,0 +1,368 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// thumbnailSuffix is appended to the object key of an image to derive the key of its thumbnail
+const thumbnailSuffix = "_thumb"
+
+// thumbnailVariant selects the thumbnail of an image in download requests
+const thumbnailVariant = "thumb"
+
+var thumbnailFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "uploader",
+	Name:      "thumbnail_failures_total",
+	Help:      "Total number of uploaded images whose thumbnail could not be generated or stored, by stage.",
+}, []string{"stage"})
+
+var (
+	thumbnailTranscodeFallbacksTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "uploader",
+		Name:      "thumbnail_transcode_fallbacks_total",
+		Help:      "Total number of thumbnails kept in their original format instead of the configured output format, by format and reason.",
+	}, []string{"format", "reason"})
+	thumbnailTranscodeBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "uploader",
+		Name:      "thumbnail_transcode_bytes_total",
+		Help:      "Total size of thumbnails before and after transcoding to the output format, by format and version.",
+	}, []string{"format", "version"})
+	thumbnailTranscodeRatio = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "uploader",
+		Name:      "thumbnail_transcode_size_ratio",
+		Help:      "Size of transcoded thumbnails relative to their original encoding, by format.",
+		Buckets:   prometheus.LinearBuckets(0.1, 0.1, 15),
+	}, []string{"format"})
+)
+
+// reasons reported for images stored without a thumbnail
+const (
+	thumbnailSkippedTooLarge = "too_large"
+	thumbnailSkippedQuota    = "quota"
+	thumbnailSkippedError    = "error"
+)
+
+var (
+	errImageTooLarge = errors.New("image exceeds max source pixels")
+	errInvalidWebP   = errors.New("invalid webp header")
+)
+
+// thumbnailEncoding describes how ffmpeg encodes a thumbnail output format
+type thumbnailEncoding struct {
+	encoder     string
+	args        []string
+	extension   string
+	contentType string
+}
+
+var thumbnailEncodings = map[string]thumbnailEncoding{
+	"webp": {"libwebp", []string{"-quality", "80", "-f", "webp"}, ".webp", "image/webp"},
+	"avif": {"libaom-av1", []string{"-still-picture", "1", "-crf", "32", "-f", "avif"}, ".avif", "image/avif"},
+}
+
+const encoderProbeTimeout = 5 * time.Second
+
+// encoderProbe checks once whether ffmpeg is installed with the encoder of the output format
+type encoderProbe struct {
+	once      sync.Once
+	available bool
+}
+
+// Thumbnail is an encoded thumbnail ready to be stored
+type Thumbnail struct {
+	Body        []byte
+	ContentType string
+}
+
+// Thumbnailer scales uploaded JPEG, PNG and WebP images down to fit within the configured
+// bounds. PNG thumbnails stay PNG so that transparency is kept, as do WebP ones, which are
+// decoded by ffmpeg; everything else is encoded as JPEG. Thumbnails can then be re-encoded
+// to webp or avif with ffmpeg
+type Thumbnailer struct {
+	enabled         bool
+	maxWidth        int
+	maxHeight       int
+	maxSourcePixels int
+	quality         int
+	outputFormat    string
+	ffmpegPath      string
+	probe           *encoderProbe
+}
+
+func NewThumbnailer(config *config.Config) Thumbnailer {
+	outputFormat := strings.ToLower(config.Uploader.Thumbnail.OutputFormat)
+	if _, ok := thumbnailEncodings[outputFormat]; outputFormat != "" && !ok {
+		slog.Warn("unsupported thumbnail output format; keeping jpeg/png", slog.String("format", outputFormat))
+		outputFormat = ""
+	}
+	return Thumbnailer{
+		enabled:         config.Uploader.Thumbnail.Enabled,
+		maxWidth:        config.Uploader.Thumbnail.MaxWidth,
+		maxHeight:       config.Uploader.Thumbnail.MaxHeight,
+		maxSourcePixels: config.Uploader.Thumbnail.MaxSourcePixels,
+		quality:         config.Uploader.Thumbnail.JpegQuality,
+		outputFormat:    outputFormat,
+		ffmpegPath:      config.Uploader.Thumbnail.FfmpegPath,
+		probe:           &encoderProbe{},
+	}
+}
+
+// ShouldGenerate reports whether a thumbnail is generated for content of the given type
+func (t Thumbnailer) ShouldGenerate(contentType string) bool {
+	if !t.enabled {
+		return false
+	}
+	switch contentType {
+	case "image/jpeg", "image/png", "image/webp":
+		return true
+	}
+	return false
+}
+
+// Generate decodes the image in src and encodes a thumbnail of it. The image header is
+// checked first so that oversized images are rejected before their pixels are decoded
+func (t Thumbnailer) Generate(ctx context.Context, src io.ReadSeeker, contentType string) (*Thumbnail, error) {
+	if contentType == "image/webp" {
+		return t.generateWebP(ctx, src)
+	}
+	cfg, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > t.maxSourcePixels {
+		return nil, errImageTooLarge
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, format, err := image.Decode(src)
+	if err != nil {
+		return nil, err
+	}
+	w, h := fitWithin(cfg.Width, cfg.Height, t.maxWidth, t.maxHeight)
+	thumb := resizeImage(img, w, h)
+
+	var buf bytes.Buffer
+	if format == "png" {
+		err = png.Encode(&buf, thumb)
+		return &Thumbnail{buf.Bytes(), "image/png"}, err
+	}
+	err = jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: t.quality})
+	return &Thumbnail{buf.Bytes(), "image/jpeg"}, err
+}
+
+// generateWebP scales a WebP image with ffmpeg, since the standard library cannot decode it.
+// The thumbnail is encoded as PNG so that transparency is kept
+func (t Thumbnailer) generateWebP(ctx context.Context, src io.ReadSeeker) (*Thumbnail, error) {
+	width, height, err := webpSize(src)
+	if err != nil {
+		return nil, err
+	}
+	if width*height > t.maxSourcePixels {
+		return nil, errImageTooLarge
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	w, h := fitWithin(width, height, t.maxWidth, t.maxHeight)
+	body, err := t.runFfmpeg(ctx, src, ".png", func(in, out string) []string {
+		return scaleArgs(in, out, w, h)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Thumbnail{body, "image/png"}, nil
+}
+
+// ShouldTranscode reports whether thumbnails are re-encoded to an output format
+func (t Thumbnailer) ShouldTranscode() bool {
+	return t.outputFormat != ""
+}
+
+// Transcode re-encodes a thumbnail to the configured output format with ffmpeg. The
+// original thumbnail is returned if the encoder is unavailable, if encoding fails, or if
+// the result is not smaller; a non-nil error explains why
+func (t Thumbnailer) Transcode(ctx context.Context, thumb *Thumbnail) (*Thumbnail, error) {
+	encoding := thumbnailEncodings[t.outputFormat]
+	if !t.encoderAvailable(encoding.encoder) {
+		thumbnailTranscodeFallbacksTotal.WithLabelValues(t.outputFormat, "unavailable").Inc()
+		return thumb, fmt.Errorf("ffmpeg encoder %s is unavailable", encoding.encoder)
+	}
+	body, err := t.runFfmpeg(ctx, bytes.NewReader(thumb.Body), encoding.extension, func(in, out string) []string {
+		return encodeArgs(encoding, in, out)
+	})
+	if err != nil {
+		thumbnailTranscodeFallbacksTotal.WithLabelValues(t.outputFormat, "error").Inc()
+		return thumb, err
+	}
+	thumbnailTranscodeBytesTotal.WithLabelValues(t.outputFormat, "original").Add(float64(len(thumb.Body)))
+	thumbnailTranscodeBytesTotal.WithLabelValues(t.outputFormat, "transcoded").Add(float64(len(body)))
+	thumbnailTranscodeRatio.WithLabelValues(t.outputFormat).Observe(float64(len(body)) / float64(len(thumb.Body)))
+	if len(body) >= len(thumb.Body) {
+		thumbnailTranscodeFallbacksTotal.WithLabelValues(t.outputFormat, "larger").Inc()
+		return thumb, nil
+	}
+	return &Thumbnail{body, encoding.contentType}, nil
+}
+
+// encoderAvailable checks on first use that ffmpeg is installed and built with the encoder.
+// The probe does not use the context of the request that triggers it, since its result is kept
+func (t Thumbnailer) encoderAvailable(encoder string) bool {
+	t.probe.once.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), encoderProbeTimeout)
+		defer cancel()
+		output, err := exec.CommandContext(ctx, t.ffmpegPath, "-hide_banner", "-encoders").Output()
+		if err != nil {
+			slog.Warn("ffmpeg is unavailable for thumbnail transcoding: " + err.Error())
+			return
+		}
+		for _, line := range strings.Split(string(output), "\n") {
+			if fields := strings.Fields(line); len(fields) >= 2 && fields[1] == encoder {
+				t.probe.available = true
+				return
+			}
+		}
+		slog.Warn("ffmpeg is built without the thumbnail encoder", slog.String("encoder", encoder))
+	})
+	return t.probe.available
+}
+
+// runFfmpeg writes src to a temporary file and runs ffmpeg with the arguments built by
+// args, returning the output file, whose extension selects the muxer
+func (t Thumbnailer) runFfmpeg(ctx context.Context, src io.Reader, extension string, args func(in, out string) []string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "thumbnail-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "in")
+	f, err := os.OpenFile(in, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	out := filepath.Join(dir, "out"+extension)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.ffmpegPath, args(in, out)...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.ReadFile(out)
+}
+
+// encodeArgs builds the ffmpeg arguments that encode the image in to out
+func encodeArgs(encoding thumbnailEncoding, in, out string) []string {
+	args := []string{"-nostdin", "-loglevel", "error", "-i", in, "-c:v", encoding.encoder}
+	args = append(args, encoding.args...)
+	return append(args, out)
+}
+
+// scaleArgs builds the ffmpeg arguments that scale the first frame of the image in to
+// w x h and write it to out
+func scaleArgs(in, out string, w, h int) []string {
+	return []string{"-nostdin", "-loglevel", "error", "-i", in, "-vf", fmt.Sprintf("scale=%d:%d", w, h), "-frames:v", "1", out}
+}
+
+// webpSize reads the canvas size of a WebP image from its header, which may be a lossy
+// (VP8), lossless (VP8L) or extended (VP8X) bitstream
+func webpSize(r io.Reader) (int, int, error) {
+	var header [30]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, 0, errInvalidWebP
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+		return 0, 0, errInvalidWebP
+	}
+	switch string(header[12:16]) {
+	case "VP8 ":
+		if header[23] != 0x9d || header[24] != 0x01 || header[25] != 0x2a {
+			return 0, 0, errInvalidWebP
+		}
+		w := int(binary.LittleEndian.Uint16(header[26:28]) & 0x3fff)
+		h := int(binary.LittleEndian.Uint16(header[28:30]) & 0x3fff)
+		return w, h, nil
+	case "VP8L":
+		if header[20] != 0x2f {
+			return 0, 0, errInvalidWebP
+		}
+		bits := binary.LittleEndian.Uint32(header[21:25])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, nil
+	case "VP8X":
+		w := int(header[24]) | int(header[25])<<8 | int(header[26])<<16
+		h := int(header[27]) | int(header[28])<<8 | int(header[29])<<16
+		return w + 1, h + 1, nil
+	}
+	return 0, 0, errInvalidWebP
+}
+
+// fitWithin returns the largest size of the same aspect ratio as w x h that fits within
+// maxW x maxH; images already within bounds keep their size
+func fitWithin(w, h, maxW, maxH int) (int, int) {
+	if w <= maxW && h <= maxH {
+		return w, h
+	}
+	if w*maxH > h*maxW {
+		return maxW, max(1, h*maxW/w)
+	}
+	return max(1, w*maxH/h), maxH
+}
+
+// resizeImage scales src to w x h by averaging the source pixels covered by each
+// destination pixel, which avoids the aliasing of nearest-neighbour sampling when shrinking
+func resizeImage(src image.Image, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	for y := 0; y < h; y++ {
+		y0, y1 := y*sh/h, max((y+1)*sh/h, y*sh/h+1)
+		for x := 0; x < w; x++ {
+			x0, x1 := x*sw/w, max((x+1)*sw/w, x*sw/w+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+func thumbnailKey(objectKey string) string {
+	return objectKey + thumbnailSuffix
+}
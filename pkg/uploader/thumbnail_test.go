@@ -0,0 +1,173 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestEncodeArgs(t *testing.T) {
+	tests := []struct {
+		format string
+		want   []string
+	}{
+		{"webp", []string{"-nostdin", "-loglevel", "error", "-i", "in", "-c:v", "libwebp", "-quality", "80", "-f", "webp", "out.webp"}},
+		{"avif", []string{"-nostdin", "-loglevel", "error", "-i", "in", "-c:v", "libaom-av1", "-still-picture", "1", "-crf", "32", "-f", "avif", "out.avif"}},
+	}
+	for _, tt := range tests {
+		encoding := thumbnailEncodings[tt.format]
+		got := encodeArgs(encoding, "in", "out"+encoding.extension)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.format, got, tt.want)
+		}
+	}
+	// building the arguments must not modify the shared encoding
+	if args := thumbnailEncodings["webp"].args; len(args) != 4 {
+		t.Errorf("webp encoding args changed to %q", args)
+	}
+}
+
+// fakeFfmpeg writes a script that lists the libwebp encoder, records the arguments of an
+// encode in the returned file and writes output to the last argument
+func fakeFfmpeg(t *testing.T, output string) (string, string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg is a shell script")
+	}
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := `#!/bin/sh
+if [ "$2" = "-encoders" ]; then
+  echo " V....D libwebp              libwebp WebP image"
+  exit 0
+fi
+printf '%s\n' "$@" > "` + argsFile + `"
+for last; do :; done
+printf '` + output + `' > "$last"
+`
+	path := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(path, []byte(script), 0o700); err != nil {
+		t.Fatalf("write fake ffmpeg: %v", err)
+	}
+	return path, argsFile
+}
+
+func TestThumbnailerTranscode(t *testing.T) {
+	ffmpegPath, argsFile := fakeFfmpeg(t, "webp")
+	thumbnailer := Thumbnailer{outputFormat: "webp", ffmpegPath: ffmpegPath, probe: &encoderProbe{}}
+	original := &Thumbnail{Body: []byte("jpeg thumbnail"), ContentType: "image/jpeg"}
+
+	thumb, err := thumbnailer.Transcode(context.Background(), original)
+	if err != nil {
+		t.Fatalf("transcode: %v", err)
+	}
+	if string(thumb.Body) != "webp" || thumb.ContentType != "image/webp" {
+		t.Errorf("got %q of type %s, want the webp output", thumb.Body, thumb.ContentType)
+	}
+	data, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read ffmpeg args: %v", err)
+	}
+	args := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(args) != 12 {
+		t.Fatalf("ffmpeg ran with %q, want 12 args", args)
+	}
+	if args[3] != "-i" || filepath.Base(args[4]) != "in" {
+		t.Errorf("ffmpeg input is %q, want the thumbnail file", args[3:5])
+	}
+	if got, want := args[5:11], []string{"-c:v", "libwebp", "-quality", "80", "-f", "webp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ffmpeg encoding args are %q, want %q", got, want)
+	}
+	if filepath.Base(args[11]) != "out.webp" {
+		t.Errorf("ffmpeg output is %q, want out.webp", args[11])
+	}
+}
+
+func TestThumbnailerTranscodeKeepsSmallerOriginal(t *testing.T) {
+	ffmpegPath, _ := fakeFfmpeg(t, "a webp larger than the original")
+	thumbnailer := Thumbnailer{outputFormat: "webp", ffmpegPath: ffmpegPath, probe: &encoderProbe{}}
+	original := &Thumbnail{Body: []byte("jpeg"), ContentType: "image/jpeg"}
+
+	thumb, err := thumbnailer.Transcode(context.Background(), original)
+	if err != nil {
+		t.Fatalf("transcode: %v", err)
+	}
+	if thumb != original {
+		t.Errorf("got %q of type %s, want the original thumbnail", thumb.Body, thumb.ContentType)
+	}
+}
+
+func TestThumbnailerTranscodeWithoutEncoder(t *testing.T) {
+	thumbnailer := Thumbnailer{outputFormat: "avif", ffmpegPath: filepath.Join(t.TempDir(), "missing"), probe: &encoderProbe{}}
+	original := &Thumbnail{Body: []byte("jpeg"), ContentType: "image/jpeg"}
+
+	thumb, err := thumbnailer.Transcode(context.Background(), original)
+	if err == nil {
+		t.Error("transcode without ffmpeg: got no error")
+	}
+	if thumb != original {
+		t.Errorf("got %q of type %s, want the original thumbnail", thumb.Body, thumb.ContentType)
+	}
+}
+
+func TestWebpSize(t *testing.T) {
+	riff := func(chunk string, data ...byte) []byte {
+		b := append([]byte("RIFF\x00\x00\x00\x00WEBP"+chunk+"\x00\x00\x00\x00"), data...)
+		return append(b, make([]byte, 30)...)
+	}
+	tests := []struct {
+		name   string
+		header []byte
+		w, h   int
+	}{
+		// 3-byte frame tag, start code, then 14-bit width and height
+		{"lossy", riff("VP8 ", 0, 0, 0, 0x9d, 0x01, 0x2a, 0x40, 0x01, 0xf0, 0x00), 320, 240},
+		// signature, then 14-bit width-1 and height-1 packed little-endian
+		{"lossless", riff("VP8L", 0x2f, 0x3f, 0xc1, 0x3b, 0x00), 320, 240},
+		// flags, then 24-bit canvas width-1 and height-1
+		{"extended", riff("VP8X", 0, 0, 0, 0, 0x3f, 0x01, 0x00, 0xef, 0x00, 0x00), 320, 240},
+	}
+	for _, tt := range tests {
+		w, h, err := webpSize(bytes.NewReader(tt.header))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if w != tt.w || h != tt.h {
+			t.Errorf("%s: got %dx%d, want %dx%d", tt.name, w, h, tt.w, tt.h)
+		}
+	}
+	if _, _, err := webpSize(strings.NewReader("\x89PNG\r\n\x1a\n")); err == nil {
+		t.Error("expected an error for a non-webp header")
+	}
+}
+
+func TestThumbnailerGenerateWebP(t *testing.T) {
+	ffmpeg, argsFile := fakeFfmpeg(t, "png")
+	thumbnailer := Thumbnailer{maxWidth: 160, maxHeight: 160, maxSourcePixels: 1 << 20, ffmpegPath: ffmpeg}
+	src := append([]byte("RIFF\x00\x00\x00\x00WEBPVP8X\x00\x00\x00\x00\x00\x00\x00\x00\x3f\x01\x00\xef\x00\x00"), make([]byte, 8)...)
+	thumb, err := thumbnailer.Generate(context.Background(), bytes.NewReader(src), "image/webp")
+	if err != nil {
+		t.Fatalf("generate: %v", err)
+	}
+	if thumb.ContentType != "image/png" || string(thumb.Body) != "png" {
+		t.Errorf("got %q of type %s", thumb.Body, thumb.ContentType)
+	}
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatalf("read args: %v", err)
+	}
+	if !strings.Contains(string(args), "scale=160:120\n") {
+		t.Errorf("expected a 160x120 scale, got args %q", args)
+	}
+
+	thumbnailer.maxSourcePixels = 320*240 - 1
+	if _, err := thumbnailer.Generate(context.Background(), bytes.NewReader(src), "image/webp"); err != errImageTooLarge {
+		t.Errorf("got %v, want errImageTooLarge", err)
+	}
+}
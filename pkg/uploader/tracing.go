@@ -0,0 +1,38 @@
+package uploader
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the upload pipeline as children of the request span started
+// by the otel http handler. It is resolved through the global provider, so spans are only
+// exported once tracing is registered
+var tracer = otel.Tracer("github.com/minghsu0107/go-random-chat/pkg/uploader")
+
+var (
+	bucketAttr      = attribute.Key("s3.bucket")
+	objectKeyAttr   = attribute.Key("s3.key")
+	sizeAttr        = attribute.Key("s3.size_bytes")
+	contentTypeAttr = attribute.Key("s3.content_type")
+	partNumberAttr  = attribute.Key("s3.part_number")
+	allowedAttr     = attribute.Key("ratelimit.allowed")
+	costAttr        = attribute.Key("ratelimit.cost")
+)
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, as the status of the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
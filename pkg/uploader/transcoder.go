@@ -0,0 +1,172 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minghsu0107/go-random-chat/pkg/config"
+)
+
+const (
+	transcodedAudioExtension = ".webm"
+	transcodedAudioFormat    = "webm/opus"
+	transcodedAudioType      = "audio/webm"
+)
+
+// AudioTranscoder converts uploaded audio to opus in a webm container by shelling out to ffmpeg
+type AudioTranscoder struct {
+	enabled           bool
+	ffmpegPath        string
+	ffprobePath       string
+	maxDuration       time.Duration
+	allowedExtensions map[string]struct{}
+	sem               chan struct{}
+}
+
+// TranscodedAudio is a transcoded file on local disk; Close removes it
+type TranscodedAudio struct {
+	*os.File
+	Size        int64
+	Extension   string
+	Format      string
+	ContentType string
+	dir         string
+}
+
+func (a *TranscodedAudio) Close() error {
+	a.File.Close()
+	return os.RemoveAll(a.dir)
+}
+
+func NewAudioTranscoder(config *config.Config) *AudioTranscoder {
+	allowedExtensions := make(map[string]struct{})
+	for _, ext := range strings.Split(config.Uploader.Transcode.Audio.AllowedExtensions, ",") {
+		if ext = strings.ToLower(strings.TrimSpace(ext)); ext != "" {
+			allowedExtensions[ext] = struct{}{}
+		}
+	}
+	maxConcurrent := config.Uploader.Transcode.Audio.MaxConcurrent
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &AudioTranscoder{
+		enabled:           config.Uploader.Transcode.Audio.Enabled,
+		ffmpegPath:        config.Uploader.Transcode.Audio.FfmpegPath,
+		ffprobePath:       config.Uploader.Transcode.Audio.FfprobePath,
+		maxDuration:       time.Duration(config.Uploader.Transcode.Audio.MaxDurationSecond) * time.Second,
+		allowedExtensions: allowedExtensions,
+		sem:               make(chan struct{}, maxConcurrent),
+	}
+}
+
+// ShouldTranscode reports whether an uploaded file is audio that is not already in an allowed format
+func (t *AudioTranscoder) ShouldTranscode(contentType, extension string) bool {
+	if !t.enabled || !strings.HasPrefix(contentType, "audio/") {
+		return false
+	}
+	_, allowed := t.allowedExtensions[strings.ToLower(extension)]
+	return !allowed
+}
+
+// Transcode converts src to opus/webm. At most the configured number of transcodes run at
+// once; callers wait for a free slot until ctx is done
+func (t *AudioTranscoder) Transcode(ctx context.Context, src io.Reader) (*TranscodedAudio, error) {
+	select {
+	case t.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-t.sem }()
+
+	dir, err := os.MkdirTemp("", "transcode-")
+	if err != nil {
+		return nil, err
+	}
+	audio, err := t.transcode(ctx, dir, src)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return audio, nil
+}
+
+func (t *AudioTranscoder) transcode(ctx context.Context, dir string, src io.Reader) (*TranscodedAudio, error) {
+	in := filepath.Join(dir, "in")
+	f, err := os.Create(in)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, src)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := t.probeDuration(ctx, in)
+	if err != nil {
+		return nil, err
+	}
+	if duration > t.maxDuration {
+		return nil, ErrAudioTooLong
+	}
+
+	out := filepath.Join(dir, "out"+transcodedAudioExtension)
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.ffmpegPath,
+		"-nostdin", "-loglevel", "error",
+		"-i", in,
+		"-t", strconv.FormatFloat(t.maxDuration.Seconds(), 'f', -1, 64),
+		"-vn", "-c:a", "libopus", "-b:a", "64k",
+		"-f", "webm", out,
+	)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	result, err := os.Open(out)
+	if err != nil {
+		return nil, err
+	}
+	info, err := result.Stat()
+	if err != nil {
+		result.Close()
+		return nil, err
+	}
+	return &TranscodedAudio{
+		File:        result,
+		Size:        info.Size(),
+		Extension:   transcodedAudioExtension,
+		Format:      transcodedAudioFormat,
+		ContentType: transcodedAudioType,
+		dir:         dir,
+	}, nil
+}
+
+func (t *AudioTranscoder) probeDuration(ctx context.Context, path string) (time.Duration, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, t.ffprobePath,
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(string(output)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("ffprobe: invalid duration %q", strings.TrimSpace(string(output)))
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -2,17 +2,16 @@ package uploader
 
 import (
 	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 	"unsafe"
-
-	"github.com/google/uuid"
 )
 
-func newObjectKey(channelID uint64, extension string) string {
-	return joinStrs(strconv.FormatUint(channelID, 10), "/", uuid.New().String(), extension)
-}
-
 func getChannelIDFromObjectKey(objectKey string) (uint64, error) {
 	channelIDStr := strings.Split(objectKey, "/")[0]
 	channelID, err := strconv.ParseUint(channelIDStr, 10, 64)
@@ -22,6 +21,151 @@ func getChannelIDFromObjectKey(objectKey string) (uint64, error) {
 	return channelID, nil
 }
 
+// sniffContentType detects the content type of an uploaded file from its first 512 bytes,
+// regardless of the content type the client declared
+func sniffContentType(fileHeader *multipart.FileHeader) (string, error) {
+	f, err := fileHeader.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// parseContentTypes splits a comma-separated content type allowlist
+func parseContentTypes(s string) []string {
+	var contentTypes []string
+	for _, contentType := range strings.Split(s, ",") {
+		if contentType = strings.ToLower(strings.TrimSpace(contentType)); contentType != "" {
+			contentTypes = append(contentTypes, contentType)
+		}
+	}
+	return contentTypes
+}
+
+// isContentTypeAllowed reports whether the media type of contentType, ignoring parameters
+// such as charset, matches the allowlist. Entries may have a wildcard subtype like image/*,
+// and an empty allowlist allows every type
+func isContentTypeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	for _, pattern := range allowed {
+		if pattern == "*/*" || pattern == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeFilename drops path separators, control characters and quotes from a client
+// supplied filename, so that it can be used as is in a Content-Disposition header
+func sanitizeFilename(filename string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == '"' || unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, filename))
+}
+
+// attachmentDisposition returns a Content-Disposition for downloading a file under the
+// sanitized filename. Non-ASCII characters are replaced in the plain filename parameter
+// and kept in the RFC 5987 encoded one, which browsers prefer
+func attachmentDisposition(filename string) string {
+	ascii := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII {
+			return '_'
+		}
+		return r
+	}, filename)
+	disposition := joinStrs(`attachment; filename="`, ascii, `"`)
+	if ascii != filename {
+		disposition = joinStrs(disposition, "; filename*=UTF-8''", encodeExtValue(filename))
+	}
+	return disposition
+}
+
+// encodeExtValue percent-encodes every byte of s but the attr-chars of RFC 5987. Path
+// escaping is not enough, since it leaves characters such as ; and , that end the parameter
+func encodeExtValue(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isAttrChar(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0f])
+	}
+	return b.String()
+}
+
+func isAttrChar(c byte) bool {
+	if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' {
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", c) >= 0
+}
+
+// parseContentRange parses a Content-Range header of the form "bytes <start>-<end>/<size>",
+// where size may be "*"
+func parseContentRange(contentRange string) (int64, int64, error) {
+	rangeStr, ok := strings.CutPrefix(contentRange, "bytes ")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid content range: %v", contentRange)
+	}
+	rangeStr, _, _ = strings.Cut(rangeStr, "/")
+	startStr, endStr, ok := strings.Cut(rangeStr, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid content range: %v", contentRange)
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := strconv.ParseInt(endStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start < 0 || end < start {
+		return 0, 0, fmt.Errorf("invalid content range: %v", contentRange)
+	}
+	return start, end, nil
+}
+
+// minPartSize is the smallest part S3 accepts for any part of a multipart upload but the last
+const minPartSize = 5 << 20
+
+// partsCoverFile reports whether parts ordered by part number cover the file from byte 0
+// without gaps or overlaps. A size of 0 means the size was not declared
+func partsCoverFile(parts []UploadedPart, size int64) bool {
+	if len(parts) == 0 {
+		return false
+	}
+	var next int64
+	for _, part := range parts {
+		if part.Start != next {
+			return false
+		}
+		next = part.End + 1
+	}
+	return size == 0 || next == size
+}
+
 func joinStrs(strs ...string) string {
 	var sb strings.Builder
 	for _, str := range strs {
@@ -0,0 +1,20 @@
+package uploader
+
+import "testing"
+
+func TestAttachmentDisposition(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"report.pdf", `attachment; filename="report.pdf"`},
+		{"résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`},
+		// separators that would end the parameter or the header value are encoded
+		{"日記; a,b 'c' (1).txt", `attachment; filename="__; a,b 'c' (1).txt"; filename*=UTF-8''%E6%97%A5%E8%A8%98%3B%20a%2Cb%20%27c%27%20%281%29.txt`},
+	}
+	for _, tt := range tests {
+		if got := attachmentDisposition(tt.filename); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.filename, got, tt.want)
+		}
+	}
+}
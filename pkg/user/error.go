@@ -1,8 +1,17 @@
 package user
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/minghsu0107/go-random-chat/pkg/common"
+)
 
 var (
 	ErrUserNotFound    = errors.New("error user not found")
 	ErrSessionNotFound = errors.New("error session not found")
 )
+
+var errorCodes = map[error]common.ErrorCode{
+	ErrUserNotFound:    common.CodeUserNotFound,
+	ErrSessionNotFound: common.CodeSessionNotFound,
+}
@@ -26,6 +26,7 @@ type HttpServer struct {
 	logger            common.HttpLog
 	svr               *gin.Engine
 	httpPort          string
+	tlsConfig         config.TLSConfig
 	httpServer        *http.Server
 	userSvc           UserService
 	serveSwag         bool
@@ -37,7 +38,7 @@ type HttpServer struct {
 func NewGinServer(name string, logger common.HttpLog, config *config.Config) *gin.Engine {
 	svr := gin.New()
 	svr.Use(gin.Recovery())
-	svr.Use(common.CorsMiddleware())
+	svr.Use(common.CorsMiddleware(config.User.Http.Server.Cors))
 	svr.Use(common.LoggingMiddleware(logger))
 
 	mdlw := prommiddleware.New(prommiddleware.Config{
@@ -55,6 +56,7 @@ func NewHttpServer(name string, logger common.HttpLog, config *config.Config, sv
 		logger:    logger,
 		svr:       svr,
 		httpPort:  config.User.Http.Server.Port,
+		tlsConfig: config.User.Http.Server.TLS,
 		userSvc:   userSvc,
 		serveSwag: config.User.Http.Server.Swag,
 		googleOauthConfig: &oauth2.Config{
@@ -119,8 +121,8 @@ func (r *HttpServer) Run() {
 			Addr:    addr,
 			Handler: common.NewOtelHttpHandler(r.svr, r.name+"_http"),
 		}
-		r.logger.Info("http server listening", slog.String("addr", addr))
-		err := r.httpServer.ListenAndServe()
+		r.logger.Info("http server listening", slog.String("addr", addr), slog.Bool("tls", r.tlsConfig.Enabled))
+		err := common.ListenAndServe(r.httpServer, r.tlsConfig)
 		if err != nil && err != http.ErrServerClosed {
 			r.logger.Error(err.Error())
 			os.Exit(1)
@@ -133,8 +135,5 @@ func (r *HttpServer) GracefulStop(ctx context.Context) error {
 }
 
 func response(c *gin.Context, httpCode int, err error) {
-	message := err.Error()
-	c.JSON(httpCode, common.ErrResponse{
-		Message: message,
-	})
+	c.JSON(httpCode, common.NewRequestErrResponse(c.Request.Context(), err, httpCode, errorCodes))
 }
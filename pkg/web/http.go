@@ -19,6 +19,7 @@ type HttpServer struct {
 	logger     common.HttpLog
 	svr        *gin.Engine
 	httpPort   string
+	tlsConfig  config.TLSConfig
 	httpServer *http.Server
 }
 
@@ -38,10 +39,11 @@ func NewGinServer(name string, logger common.HttpLog) *gin.Engine {
 
 func NewHttpServer(name string, logger common.HttpLog, config *config.Config, svr *gin.Engine) *HttpServer {
 	return &HttpServer{
-		name:     name,
-		logger:   logger,
-		svr:      svr,
-		httpPort: config.Web.Http.Server.Port,
+		name:      name,
+		logger:    logger,
+		svr:       svr,
+		httpPort:  config.Web.Http.Server.Port,
+		tlsConfig: config.Web.Http.Server.TLS,
 	}
 }
 
@@ -63,8 +65,8 @@ func (r *HttpServer) Run() {
 			Addr:    addr,
 			Handler: common.NewOtelHttpHandler(r.svr, r.name+"_http"),
 		}
-		r.logger.Info("http server listening", slog.String("addr", addr))
-		err := r.httpServer.ListenAndServe()
+		r.logger.Info("http server listening", slog.String("addr", addr), slog.Bool("tls", r.tlsConfig.Enabled))
+		err := common.ListenAndServe(r.httpServer, r.tlsConfig)
 		if err != nil && err != http.ErrServerClosed {
 			r.logger.Error(err.Error())
 			os.Exit(1)
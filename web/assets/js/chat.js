@@ -173,7 +173,7 @@ function uploadFiles(files) {
 
 function uploadFiles(files) {
     for (const file of files) {
-        fetch(`/api/uploader/upload/presigned?ext=${getFileExtention(file.name)}`, {
+        fetch(`/api/uploader/upload/presigned?ext=${getFileExtention(file.name)}&size=${file.size}`, {
             method: 'GET',
             headers: new Headers({
                 'Authorization': 'Bearer ' + ACCESS_TOKEN
@@ -188,6 +188,7 @@ function uploadFiles(files) {
             .then(result => {
                 fetch(result.url, {
                     method: 'PUT',
+                    headers: new Headers(result.headers || {}),
                     body: file
                 })
                     .then(() => {
@@ -272,7 +273,7 @@ text.onkeydown = function (e) {
 }
 
 function connectWebSocket(chatUrl) {
-    ws = new WebSocket(chatUrl)
+    ws = new WebSocket(chatUrl, "randomchat.v1")
     ws.addEventListener('open', async function (e) {
         try {
             insertDummy()
@@ -494,6 +495,12 @@ async function processMessage(m) {
                         actionMsg = ID2NAME[m.user_id] + " leaved, channel closed"
                     }
                     break
+                case "channeljoined":
+                    actionMsg = ID2NAME[m.user_id] + " joined the channel"
+                    break
+                case "channelleft":
+                    actionMsg = ID2NAME[m.user_id] + " left the channel"
+                    break
                 case "istyping":
                     if (m.user_id !== USER_ID) {
                         msg = await getTypingMessage(m.user_id, LEFT, peerTypingID)